@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sort"
+
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/proto"
+)
+
+// apiVersionInfo describes the generated API surface as returned by the
+// generated GeneratedAPIVersion function.
+type apiVersionInfo struct {
+	// FalafelVersion is the version of falafel the API was generated
+	// with.
+	FalafelVersion string `json:"falafel_version"`
+
+	// ProtoDigest is the hex encoded SHA-256 digest of the descriptors of
+	// the proto files the API was generated from.
+	ProtoDigest string `json:"proto_digest"`
+
+	// Features is the sorted list of the enabled feature flags, being
+	// the options set to 1.
+	Features []string `json:"features"`
+}
+
+// genAPIVersion creates the GeneratedAPIVersion function reporting the falafel
+// version, the digest of the source protos and the enabled feature flags.
+func genAPIVersion(gen *protogen.Plugin, param map[string]string) {
+	// The descriptors are hashed in the order of their paths, so the
+	// digest doesn't depend on the order protoc is invoked with.
+	var (
+		paths []string
+		file  *protogen.File
+	)
+	for _, f := range gen.Files {
+		if !f.Generate {
+			continue
+		}
+
+		if file == nil {
+			file = f
+		}
+		paths = append(paths, f.Desc.Path())
+	}
+	if file == nil {
+		return
+	}
+	sort.Strings(paths)
+
+	h := sha256.New()
+	marshal := proto.MarshalOptions{Deterministic: true}
+	for _, p := range paths {
+		for _, fd := range gen.Request.ProtoFile {
+			if fd.GetName() != p {
+				continue
+			}
+
+			b, err := marshal.Marshal(fd)
+			if err != nil {
+				log.Fatalf("unable to marshal %s: %v", p, err)
+			}
+			h.Write(b)
+		}
+	}
+
+	info := apiVersionInfo{
+		FalafelVersion: version,
+		ProtoDigest:    hex.EncodeToString(h.Sum(nil)),
+		Features:       []string{},
+	}
+	for key, value := range param {
+		if value == "1" {
+			info.Features = append(info.Features, key)
+		}
+	}
+	sort.Strings(info.Features)
+
+	b, err := json.Marshal(info)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mode := "mobile"
+	if param["js_stubs"] == "1" {
+		mode = "js"
+	}
+	buildTag := modeBuildTags(param, mode)
+
+	filename := "./version_generated.go"
+	g := gen.NewGeneratedFile(filename, file.GoImportPath)
+	p := apiVersionParams{
+		ToolName: versionString,
+		Package:  param["package_name"],
+		BuildTag: buildTag,
+		Version:  string(b),
+	}
+	executeTemplate(g, apiVersionTemplate, p)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// asyncAPIVersion is the version of the AsyncAPI specification the generated
+// documents follow.
+const asyncAPIVersion = "2.6.0"
+
+// genAsyncAPI creates an AsyncAPI document describing the streaming methods of
+// the service as exposed by the JSON stubs. Each method is a channel named
+// like its key in the JSON callback registry, the client publishes the
+// request to it and subscribes to the responses. No document is created if
+// the service has no streaming methods.
+func genAsyncAPI(gen *protogen.Plugin, file *protogen.File,
+	service *protogen.Service, pkg string, param map[string]string) {
+
+	schemas := make(map[string]interface{})
+	messages := make(map[string]interface{})
+	channels := make(map[string]interface{})
+
+	// addMessage adds the message and the schemas of all messages it
+	// references to the components, and returns a reference to it.
+	addMessage := func(msg *protogen.Message) map[string]string {
+		name := string(msg.Desc.FullName())
+		if _, ok := messages[name]; !ok {
+			addSchema(schemas, msg.Desc)
+			messages[name] = map[string]interface{}{
+				"name":    name,
+				"payload": schemaRef(msg.Desc),
+			}
+		}
+
+		return map[string]string{
+			"$ref": "#/components/messages/" + name,
+		}
+	}
+
+	for _, method := range includedMethods(service, param) {
+		// Client-streaming methods are not exposed by the JSON stubs.
+		if method.Desc.IsStreamingClient() ||
+			!method.Desc.IsStreamingServer() {
+
+			continue
+		}
+
+		channel := map[string]interface{}{
+			"publish": map[string]interface{}{
+				"operationId": "send" + method.GoName + "Request",
+				"message":     addMessage(method.Input),
+			},
+			"subscribe": map[string]interface{}{
+				"operationId": "receive" + method.GoName + "Response",
+				"message":     addMessage(method.Output),
+			},
+		}
+		comment := strings.TrimSpace(string(method.Comments.Leading))
+		if comment != "" {
+			channel["description"] = comment
+		}
+
+		name := pkg + "." + service.GoName + "." + method.GoName
+		channels[name] = channel
+	}
+
+	if len(channels) == 0 {
+		return
+	}
+
+	doc := map[string]interface{}{
+		"asyncapi": asyncAPIVersion,
+		"info": map[string]interface{}{
+			"title":       pkg + "." + service.GoName,
+			"version":     version,
+			"description": "Generated by " + versionString + ".",
+		},
+		"defaultContentType": "application/json",
+		"channels":           channels,
+		"components": map[string]interface{}{
+			"messages": messages,
+			"schemas":  schemas,
+		},
+	}
+
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	filename := outDir(param, service, "./") +
+		strings.ToLower(service.GoName) + ".asyncapi.json"
+	g := gen.NewGeneratedFile(filename, file.GoImportPath)
+	if _, err := g.Write(append(b, '\n')); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// schemaRef returns a reference to the schema of the given message.
+func schemaRef(msg protoreflect.MessageDescriptor) map[string]string {
+	return map[string]string{
+		"$ref": "#/components/schemas/" + string(msg.FullName()),
+	}
+}
+
+// addSchema adds the JSON schema of the given message, and all messages it
+// references, to the schemas. The schema follows the JSON encoding of the
+// stubs, which use the proto field names.
+func addSchema(schemas map[string]interface{},
+	msg protoreflect.MessageDescriptor) {
+
+	name := string(msg.FullName())
+	if _, ok := schemas[name]; ok {
+		return
+	}
+
+	properties := make(map[string]interface{})
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	schemas[name] = schema
+
+	fields := msg.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+
+		var fieldSchema interface{}
+		switch {
+		case field.IsMap():
+			fieldSchema = map[string]interface{}{
+				"type": "object",
+				"additionalProperties": valueSchema(
+					schemas, field.MapValue(),
+				),
+			}
+
+		case field.IsList():
+			fieldSchema = map[string]interface{}{
+				"type":  "array",
+				"items": valueSchema(schemas, field),
+			}
+
+		default:
+			fieldSchema = valueSchema(schemas, field)
+		}
+
+		properties[string(field.Name())] = fieldSchema
+	}
+}
+
+// valueSchema returns the JSON schema of a single value of the given field.
+func valueSchema(schemas map[string]interface{},
+	field protoreflect.FieldDescriptor) interface{} {
+
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		return map[string]string{"type": "boolean"}
+
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind,
+		protoreflect.Sfixed32Kind, protoreflect.Uint32Kind,
+		protoreflect.Fixed32Kind:
+
+		return map[string]string{"type": "integer"}
+
+	// 64-bit integers are encoded as strings in JSON.
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind,
+		protoreflect.Sfixed64Kind, protoreflect.Uint64Kind,
+		protoreflect.Fixed64Kind:
+
+		return map[string]string{"type": "string", "format": "int64"}
+
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return map[string]string{"type": "number"}
+
+	case protoreflect.StringKind:
+		return map[string]string{"type": "string"}
+
+	case protoreflect.BytesKind:
+		return map[string]string{"type": "string", "format": "byte"}
+
+	case protoreflect.EnumKind:
+		var names []string
+		values := field.Enum().Values()
+		for i := 0; i < values.Len(); i++ {
+			names = append(names, string(values.Get(i).Name()))
+		}
+
+		return map[string]interface{}{"type": "string", "enum": names}
+
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		addSchema(schemas, field.Message())
+		return schemaRef(field.Message())
+	}
+
+	return map[string]interface{}{}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// detectRequiredFields returns the proto names of the required fields of the
+// request message. Fields are required if they are marked with the
+// (falafel.required) option, are listed in params as Message.field, where the
+// message is given by its name or full name, or are proto2 required fields.
+func detectRequiredFields(msg *protogen.Message, params []string) []string {
+	var required []string
+	for _, field := range msg.Fields {
+		name := string(field.Desc.Name())
+
+		isRequired := fieldBoolOption(field, requiredOption) ||
+			field.Desc.Cardinality() == protoreflect.Required
+		for _, p := range params {
+			if p == string(msg.Desc.Name())+"."+name ||
+				p == string(msg.Desc.FullName())+"."+name {
+
+				isRequired = true
+			}
+		}
+		if !isRequired {
+			continue
+		}
+
+		required = append(required, name)
+	}
+
+	return required
+}
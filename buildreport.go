@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"go/build/constraint"
+	"log"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+)
+
+// maxReportTags is the maximum number of build tags whose combinations are
+// all reported if no combinations are given with build_report_tags.
+const maxReportTags = 10
+
+// buildReport is the content of the build report listing which services are
+// compiled in for each combination of build tags.
+type buildReport struct {
+	// Services are the services of the proto files of this run, together
+	// with the build constraints of their files.
+	Services []serviceConstraint `json:"services"`
+
+	// Combinations are the reported combinations of build tags.
+	Combinations []tagCombination `json:"combinations"`
+}
+
+// serviceConstraint describes the build constraint of a service's files.
+type serviceConstraint struct {
+	// Service is the full name of the service.
+	Service string `json:"service"`
+
+	// File is the proto file defining the service.
+	File string `json:"file"`
+
+	// Constraint is the build constraint of the service's files, or
+	// empty if they are always built.
+	Constraint string `json:"constraint,omitempty"`
+
+	// Fallback is true if fallback stubs are built instead of the
+	// service's files if the constraint isn't satisfied.
+	Fallback bool `json:"fallback,omitempty"`
+
+	// expr is the parsed constraint, or nil if there is none.
+	expr constraint.Expr
+
+	// methods are the methods the APIs are generated for.
+	methods []string
+}
+
+// tagCombination lists what is built for a combination of build tags.
+type tagCombination struct {
+	// Tags are the build tags that are set, all others are unset.
+	Tags []string `json:"tags"`
+
+	// Services are the services compiled in.
+	Services []builtService `json:"services"`
+
+	// Fallback are the full names of the services that are replaced by
+	// their fallback stubs, whose methods always fail.
+	Fallback []string `json:"fallback,omitempty"`
+
+	// Missing are the full names of the services that are left out.
+	Missing []string `json:"missing,omitempty"`
+}
+
+// builtService is a service compiled in for a combination of build tags.
+type builtService struct {
+	// Service is the full name of the service.
+	Service string `json:"service"`
+
+	// Methods are the methods the APIs are generated for.
+	Methods []string `json:"methods"`
+}
+
+// genBuildReport creates falafel_build_report.json, reporting which services
+// and methods are compiled in for each combination of the build tags the
+// files of the services are constrained by. The combinations can be given with
+// build_report_tags, as space separated lists of tags joined by +, e.g.
+// build_report_tags=[signrpc+walletrpc autopilotrpc]. Otherwise all
+// combinations are reported.
+func genBuildReport(gen *protogen.Plugin, param map[string]string) {
+	mode := "mobile"
+	if param["js_stubs"] == "1" {
+		mode = "js"
+	}
+
+	var (
+		report buildReport
+		tags   = make(map[string]bool)
+		first  *protogen.File
+	)
+	for _, f := range gen.Files {
+		if !f.Generate {
+			continue
+		}
+		if first == nil {
+			first = f
+		}
+
+		fileParam := fileParams(param, f)
+		for _, service := range f.Services {
+			param := serviceOverrides(fileParam, service)
+
+			s := serviceConstraint{
+				Service: string(service.Desc.FullName()),
+				File:    f.Proto.GetName(),
+				expr: parseBuildTags(pruneBuildTags(
+					service, param, modeBuildTags(param, mode),
+				)),
+			}
+			if s.expr != nil {
+				s.Constraint = s.expr.String()
+				s.Fallback = mode == "mobile" &&
+					param["fallback_stubs"] == "1"
+
+				addTags(tags, s.expr)
+			}
+			for _, method := range includedMethods(service, param) {
+				s.methods = append(s.methods, method.GoName)
+			}
+
+			report.Services = append(report.Services, s)
+		}
+	}
+	if first == nil {
+		return
+	}
+
+	for _, set := range tagCombinations(param, tags) {
+		c := tagCombination{
+			Tags:     []string{},
+			Services: []builtService{},
+		}
+		for tag := range set {
+			c.Tags = append(c.Tags, tag)
+		}
+		sort.Strings(c.Tags)
+
+		for _, s := range report.Services {
+			switch {
+			case s.expr == nil || s.expr.Eval(func(tag string) bool {
+				return set[tag]
+			}):
+				c.Services = append(c.Services, builtService{
+					Service: s.Service,
+					Methods: append([]string{}, s.methods...),
+				})
+
+			case s.Fallback:
+				c.Fallback = append(c.Fallback, s.Service)
+
+			default:
+				c.Missing = append(c.Missing, s.Service)
+			}
+		}
+
+		report.Combinations = append(report.Combinations, c)
+	}
+
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	filename := "./falafel_build_report.json"
+	g := gen.NewGeneratedFile(filename, first.GoImportPath)
+	if _, err := g.Write(append(b, '\n')); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// addTags adds the build tags the constraint refers to to the set.
+func addTags(tags map[string]bool, expr constraint.Expr) {
+	switch e := expr.(type) {
+	case *constraint.TagExpr:
+		tags[e.Tag] = true
+
+	case *constraint.NotExpr:
+		addTags(tags, e.X)
+
+	case *constraint.AndExpr:
+		addTags(tags, e.X)
+		addTags(tags, e.Y)
+
+	case *constraint.OrExpr:
+		addTags(tags, e.X)
+		addTags(tags, e.Y)
+	}
+}
+
+// tagCombinations returns the sets of build tags to report, either those given
+// with build_report_tags, or all combinations of the given tags.
+func tagCombinations(param map[string]string,
+	tags map[string]bool) []map[string]bool {
+
+	var sets []map[string]bool
+	if combinations, ok := param["build_report_tags"]; ok {
+		for _, combination := range strings.Fields(combinations) {
+			set := make(map[string]bool)
+			for _, tag := range strings.Split(combination, "+") {
+				if tag != "" {
+					set[tag] = true
+				}
+			}
+			sets = append(sets, set)
+		}
+
+		return sets
+	}
+
+	sorted := make([]string, 0, len(tags))
+	for tag := range tags {
+		sorted = append(sorted, tag)
+	}
+	sort.Strings(sorted)
+
+	if len(sorted) > maxReportTags {
+		log.Fatalf("the services are constrained by %d build tags, "+
+			"list the combinations to report with "+
+			"build_report_tags", len(sorted))
+	}
+
+	// Each combination is given by the bits of its index, starting
+	// with the one without any tags.
+	for i := 0; i < 1<<len(sorted); i++ {
+		set := make(map[string]bool)
+		for j, tag := range sorted {
+			if i&(1<<j) != 0 {
+				set[tag] = true
+			}
+		}
+		sets = append(sets, set)
+	}
+
+	return sets
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"google.golang.org/protobuf/compiler/protogen"
+)
+
+// surfaceChange is a change of the signatures of the generated APIs made in a
+// falafel version. If the compat_version the downstream project was built
+// against is older, deprecated shims matching the previous surface are
+// generated next to the APIs.
+type surfaceChange struct {
+	// Version is the falafel version introducing the change.
+	Version string
+
+	// Shims creates the shims of a method, given its rpcParams. Nothing
+	// should be created for methods not affected by the change.
+	Shims *template.Template
+}
+
+// surfaceChanges are the changes of the generated API surface, ordered by the
+// version introducing them. The signatures haven't changed since the shims
+// were introduced in version 0.9.2, so there are none yet.
+var surfaceChanges []surfaceChange
+
+// parseVersion parses a version in the major.minor.patch format.
+func parseVersion(v string) ([3]int, bool) {
+	var parsed [3]int
+
+	parts := strings.Split(v, ".")
+	if len(parts) != len(parsed) {
+		return parsed, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return parsed, false
+		}
+		parsed[i] = n
+	}
+
+	return parsed, true
+}
+
+// olderVersion returns true if version a is older than version b.
+func olderVersion(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+
+	return false
+}
+
+// compatChanges returns the surface changes made since the version selected
+// with compat_version, whose shims must be generated. No shims are needed if
+// compat_version isn't set.
+func compatChanges(param map[string]string) []surfaceChange {
+	compatVersion := param["compat_version"]
+	if compatVersion == "" {
+		return nil
+	}
+
+	compat, ok := parseVersion(compatVersion)
+	if !ok {
+		log.Fatalf("invalid compat_version %s", compatVersion)
+	}
+	current, _ := parseVersion(version)
+	if olderVersion(current, compat) {
+		log.Fatalf("compat_version %s is newer than %s", compatVersion,
+			versionString)
+	}
+
+	var changes []surfaceChange
+	for _, change := range surfaceChanges {
+		v, _ := parseVersion(change.Version)
+		if olderVersion(compat, v) {
+			changes = append(changes, change)
+		}
+	}
+
+	return changes
+}
+
+// genCompatShims adds the deprecated shims of the methods for all given
+// surface changes to the generated file.
+func genCompatShims(g *protogen.GeneratedFile, changes []surfaceChange,
+	methods []rpcParams) {
+
+	for _, change := range changes {
+		for _, m := range methods {
+			executeTemplate(g, change.Shims, m)
+		}
+	}
+}
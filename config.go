@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// applyConfig adds the parameters of the config file selected with
+// config=<path> to the parameters. The file is written in YAML or JSON, and
+// maps the names of the options to their values, e.g.:
+//
+//	package_name: lndmobile
+//	mem_rpc: true
+//	listeners:
+//	  lightning: lightningLis
+//	serialized_methods: [UnlockWallet, InitWallet]
+//	services:
+//	  WalletUnlocker:
+//	    api_prefix: true
+//
+// Maps are turned into space separated key=value pairs and lists into space
+// separated values, as expected by the options taking several values. The
+// options under services and files override those of the service, and of the
+// proto file given by its path or base name. Parameters that are set
+// explicitly take precedence over those of the config file.
+func applyConfig(param map[string]string) map[string]string {
+
+	configPath, ok := param["config"]
+	if !ok {
+		return param
+	}
+
+	b, err := os.ReadFile(configPath)
+	if err != nil {
+		log.Fatalf("unable to read config: %v", err)
+	}
+
+	var config map[string]interface{}
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		log.Fatalf("invalid config %s: %v", configPath, err)
+	}
+
+	options := make(map[string]string)
+	for key, value := range config {
+		switch key {
+		case "services":
+			for service, opts := range configSection(key, value) {
+				addOverrides(options, "service", service, opts)
+			}
+
+		case "files":
+			for file, opts := range configSection(key, value) {
+				addOverrides(options, "file", file, opts)
+			}
+
+		default:
+			options[key] = configValue(key, value)
+		}
+	}
+
+	for key, value := range options {
+		if _, ok := param[key]; !ok {
+			param[key] = value
+		}
+	}
+
+	return param
+}
+
+// configSection returns the entries of a section of the config file mapping
+// names to their options.
+func configSection(key string, value interface{}) map[string]interface{} {
+	section, ok := value.(map[string]interface{})
+	if !ok {
+		log.Fatalf("config: %s must map names to their options", key)
+	}
+
+	return section
+}
+
+// addOverrides adds the options of the config file overriding those of the
+// given service or proto file to the parameters, in the format read by
+// serviceOverrides and fileParams respectively.
+func addOverrides(options map[string]string, kind, name string,
+	opts interface{}) {
+
+	prefix := kind + "." + name + "."
+	for option, value := range configSection(name, opts) {
+		options[prefix+option] = configValue(option, value)
+	}
+}
+
+// configValue returns the value of an option read from the config file in the
+// format of the plugin parameters.
+func configValue(option string, value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+
+	case string, int, float64:
+		return fmt.Sprint(v)
+
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			values = append(values, configScalar(option, e))
+		}
+		return strings.Join(values, " ")
+
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		pairs := make([]string, 0, len(keys))
+		for _, key := range keys {
+			pairs = append(
+				pairs, key+"="+configScalar(option, v[key]),
+			)
+		}
+		return strings.Join(pairs, " ")
+
+	default:
+		log.Fatalf("config: invalid value of %s", option)
+		return ""
+	}
+}
+
+// configScalar returns the value of an element of a list or map read from the
+// config file, which must not be a list or map itself.
+func configScalar(option string, value interface{}) string {
+	switch value.(type) {
+	case []interface{}, map[string]interface{}:
+		log.Fatalf("config: invalid nested value of %s", option)
+	}
+
+	return configValue(option, value)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"go/build/constraint"
+	"log"
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+)
+
+// dartKeywords are the reserved words of Dart, which can't be used as method
+// names and are therefore suffixed with an underscore.
+var dartKeywords = map[string]bool{
+	"assert": true, "break": true, "case": true, "catch": true,
+	"class": true, "const": true, "continue": true, "default": true,
+	"do": true, "else": true, "enum": true, "extends": true,
+	"false": true, "final": true, "finally": true, "for": true,
+	"if": true, "in": true, "is": true, "new": true, "null": true,
+	"rethrow": true, "return": true, "super": true, "switch": true,
+	"this": true, "throw": true, "true": true, "try": true, "var": true,
+	"void": true, "while": true, "with": true,
+}
+
+// cgoBuildTags returns the build constraint of the files of the C ABI shim,
+// which are only built with cgo in addition to the given build tags.
+func cgoBuildTags(buildTags string) string {
+	var expr constraint.Expr = &constraint.TagExpr{Tag: "cgo"}
+	if tags := parseBuildTags(buildTags); tags != nil {
+		expr = &constraint.AndExpr{X: tags, Y: expr}
+	}
+
+	return "//go:build " + expr.String()
+}
+
+// genFFIRuntime creates falafel_ffi.h, declaring the callback of the C ABI
+// shim, falafel_ffi_generated.go, tracking the calls made through it, and
+// falafel_ffi.dart, starting the calls from Dart and dispatching their
+// results. They are shared by the bindings of all services, so they are only
+// created once per run.
+func genFFIRuntime(gen *protogen.Plugin, param map[string]string) {
+	for _, f := range gen.Files {
+		if !f.Generate {
+			continue
+		}
+
+		pkg := param["package_name"]
+		p := ffiParams{
+			ToolName: versionString,
+			Package:  pkg,
+			BuildTag: cgoBuildTags(modeBuildTags(param, "mobile")),
+			Prefix:   pkg,
+		}
+
+		g := gen.NewGeneratedFile("./falafel_ffi.h", f.GoImportPath)
+		executeTemplate(g, ffiHeaderTemplate, p)
+
+		g = gen.NewGeneratedFile(
+			"./falafel_ffi_generated.go", f.GoImportPath,
+		)
+		executeTemplate(g, ffiRuntimeTemplate, p)
+
+		g = gen.NewGeneratedFile("./falafel_ffi.dart", f.GoImportPath)
+		executeTemplate(g, dartRuntimeTemplate, p)
+
+		return
+	}
+}
+
+// genFFIBindings creates <service>_ffi_generated.go in dir, exporting a C
+// function per method of the service that starts a call through its
+// XxxWithContext API, and <service>_ffi.dart, calling them through Dart FFI.
+// Unary and client-streaming methods return futures, and server-streaming and
+// bidirectional methods streams of the responses. Requests and responses are
+// the payloads of the mobile APIs.
+func genFFIBindings(gen *protogen.Plugin, file *protogen.File,
+	service *protogen.Service, dir string, methods []rpcParams,
+	param map[string]string, buildTags string) {
+
+	pkg := param["package_name"]
+	n := strings.ToLower(service.GoName)
+
+	g := gen.NewGeneratedFile(dir+n+"_ffi_generated.go", file.GoImportPath)
+	p := ffiParams{
+		ToolName: versionString,
+		FileName: file.Proto.GetName(),
+		Package:  pkg,
+		BuildTag: cgoBuildTags(buildTags),
+		Prefix:   pkg,
+		Methods:  methods,
+	}
+	executeTemplate(g, ffiTemplate, p)
+
+	comments := make(map[string]string)
+	for _, method := range service.Methods {
+		comments[method.GoName] = strings.TrimSpace(
+			string(method.Comments.Leading),
+		)
+	}
+
+	var b strings.Builder
+	for _, m := range methods {
+		name := lowerCamel(m.MethodName)
+		if dartKeywords[name] {
+			name += "_"
+		}
+		field := "_call" + m.MethodName
+		symbol := pkg + "_" + m.ApiPrefix + m.MethodName
+
+		native, dart := "FalafelRequestCallNative", "FalafelRequestCall"
+		if m.ClientStream {
+			native, dart = "FalafelStreamCallNative",
+				"FalafelStreamCall"
+		}
+		fmt.Fprintf(&b, "\n  late final %s = _ffi.library.lookupFunction<"+
+			"%s,\n      %s>('%s');\n", field, native, dart, symbol)
+
+		b.WriteString("\n")
+		if comment := comments[m.MethodName]; comment != "" {
+			for _, line := range strings.Split(comment, "\n") {
+				line = strings.TrimRight("  /// "+line, " ")
+				b.WriteString(line + "\n")
+			}
+		}
+
+		switch {
+		case !m.ClientStream && !m.ServerStream:
+			fmt.Fprintf(&b, "  Future<Uint8List> %s(Uint8List request, "+
+				"{Future<void>? cancel}) =>\n"+
+				"      _ffi.unary(%s, request, cancel: cancel);\n",
+				name, field)
+
+		case !m.ClientStream && m.ServerStream:
+			fmt.Fprintf(&b, "  Stream<Uint8List> %s(Uint8List request) =>\n"+
+				"      _ffi.serverStream(%s, request);\n",
+				name, field)
+
+		case m.ClientStream && m.ServerStream:
+			fmt.Fprintf(&b, "  Stream<Uint8List> %s(Stream<Uint8List> "+
+				"requests) =>\n"+
+				"      _ffi.bidiStream(%s, requests);\n",
+				name, field)
+
+		default:
+			fmt.Fprintf(&b, "  Future<Uint8List> %s(Stream<Uint8List> "+
+				"requests,\n"+
+				"          {Future<void>? cancel}) =>\n"+
+				"      _ffi.clientStream(%s, requests, "+
+				"cancel: cancel);\n", name, field)
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "// Code generated by %s. DO NOT EDIT.\n", versionString)
+	fmt.Fprintf(&out, "// source: %s\n\n", file.Proto.GetName())
+	out.WriteString("import 'dart:ffi';\n" +
+		"import 'dart:typed_data';\n\n" +
+		"import 'falafel_ffi.dart';\n")
+
+	fmt.Fprintf(&out, "\n/// %[1]sFfi exposes the APIs of the %[1]s service "+
+		"through the C ABI\n"+
+		"/// of the library. Requests and responses are the payloads of "+
+		"the mobile\n"+
+		"/// APIs.\n"+
+		"class %[1]sFfi {\n"+
+		"  %[1]sFfi(this._ffi);\n\n"+
+		"  final FalafelFfi _ffi;\n%[2]s}\n",
+		service.GoName, b.String())
+
+	g = gen.NewGeneratedFile(dir+n+"_ffi.dart", file.GoImportPath)
+	if _, err := g.Write([]byte(out.String())); err != nil {
+		log.Fatal(err)
+	}
+}
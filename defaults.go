@@ -0,0 +1,191 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// requestDefault is a default value injected into a request field that is
+// unset when the request is dispatched.
+type requestDefault struct {
+	// Field is the Go name of the request field.
+	Field string
+
+	// Zero is the Go literal of the field's zero value, which marks the
+	// field as unset.
+	Zero string
+
+	// Value is the Go literal of the default value.
+	Value string
+}
+
+// Unset returns the Go condition checking whether the field of the request
+// with the given variable name is unset.
+func (d requestDefault) Unset(req string) string {
+	if d.Zero == "false" {
+		return "!" + req + "." + d.Field
+	}
+
+	return req + "." + d.Field + " == " + d.Zero
+}
+
+// detectRequestDefaults returns the defaults of the fields of the request
+// message. They are either set with the (falafel.request_default) field option
+// or given in the following format, where the message is referenced by its
+// name or full name:
+// request_defaults=[Message1.field1=value1 Message2.field2=value2]
+func detectRequestDefaults(msg *protogen.Message, params []string,
+	imports *goImports) []requestDefault {
+
+	var defaults []requestDefault
+	for _, field := range msg.Fields {
+		value, ok := fieldStringOption(field, requestDefaultOption)
+		for _, p := range params {
+			key, v, found := strings.Cut(p, "=")
+			if !found {
+				log.Fatalf("invalid request default %s", p)
+			}
+
+			name := string(field.Desc.Name())
+			if key == string(msg.Desc.Name())+"."+name ||
+				key == string(msg.Desc.FullName())+"."+name {
+
+				value, ok = v, true
+			}
+		}
+		if !ok {
+			continue
+		}
+
+		defaults = append(defaults, newRequestDefault(field, value, imports))
+	}
+
+	return defaults
+}
+
+// checkRequestDefaults makes sure that the entries of request_defaults name a
+// field of a message known to the plugin, as an entry that doesn't match any
+// field would otherwise be ignored without notice.
+func checkRequestDefaults(gen *protogen.Plugin, params []string) {
+	var (
+		messages = make(map[string]bool)
+		fields   = make(map[string]bool)
+		walk     func([]*protogen.Message)
+	)
+	walk = func(msgs []*protogen.Message) {
+		for _, msg := range msgs {
+			names := []string{
+				string(msg.Desc.Name()), string(msg.Desc.FullName()),
+			}
+			for _, name := range names {
+				messages[name] = true
+				for _, field := range msg.Fields {
+					fields[name+"."+string(field.Desc.Name())] = true
+				}
+			}
+			walk(msg.Messages)
+		}
+	}
+	for _, f := range gen.Files {
+		walk(f.Messages)
+	}
+
+	for _, p := range params {
+		key, _, found := strings.Cut(p, "=")
+		index := strings.LastIndex(key, ".")
+		if !found || index < 0 {
+			log.Fatalf("invalid request default %s", p)
+		}
+
+		switch {
+		case !messages[key[:index]]:
+			log.Fatalf("request default %s: unknown message %s", p,
+				key[:index])
+
+		case !fields[key]:
+			log.Fatalf("request default %s: unknown field %s", p,
+				key[index+1:])
+		}
+	}
+}
+
+// newRequestDefault parses the default value of the field. Only singular
+// scalar fields without explicit presence are supported, as they are unset
+// when holding their zero value.
+func newRequestDefault(field *protogen.Field, value string,
+	imports *goImports) requestDefault {
+
+	desc := field.Desc
+	if desc.IsList() || desc.IsMap() || desc.HasPresence() {
+		log.Fatalf("request default of %s: only singular scalar "+
+			"fields are supported", desc.FullName())
+	}
+
+	d := requestDefault{
+		Field: field.GoName,
+		Zero:  "0",
+	}
+
+	var err error
+	switch desc.Kind() {
+	case protoreflect.BoolKind:
+		var v bool
+		v, err = strconv.ParseBool(value)
+		d.Zero, d.Value = "false", strconv.FormatBool(v)
+
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind,
+		protoreflect.Sfixed32Kind:
+
+		_, err = strconv.ParseInt(value, 10, 32)
+		d.Value = value
+
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind,
+		protoreflect.Sfixed64Kind:
+
+		_, err = strconv.ParseInt(value, 10, 64)
+		d.Value = value
+
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		_, err = strconv.ParseUint(value, 10, 32)
+		d.Value = value
+
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		_, err = strconv.ParseUint(value, 10, 64)
+		d.Value = value
+
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		var v float64
+		v, err = strconv.ParseFloat(value, 64)
+		d.Value = strconv.FormatFloat(v, 'g', -1, 64)
+
+	case protoreflect.StringKind:
+		d.Zero, d.Value = `""`, strconv.Quote(value)
+
+	case protoreflect.EnumKind:
+		v := field.Enum.Desc.Values().ByName(protoreflect.Name(value))
+		if v == nil {
+			log.Fatalf("request default of %s: unknown enum value %s",
+				desc.FullName(), value)
+		}
+
+		for _, enumValue := range field.Enum.Values {
+			if enumValue.Desc == v {
+				d.Value = imports.typeName(enumValue.GoIdent)
+			}
+		}
+
+	default:
+		log.Fatalf("request default of %s: %v fields are not "+
+			"supported", desc.FullName(), desc.Kind())
+	}
+	if err != nil {
+		log.Fatalf("invalid request default of %s: %v",
+			desc.FullName(), err)
+	}
+
+	return d
+}
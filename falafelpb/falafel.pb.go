@@ -0,0 +1,177 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.33.0
+// 	protoc        (unknown)
+// source: falafelpb/falafel.proto
+
+package falafelpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	descriptorpb "google.golang.org/protobuf/types/descriptorpb"
+	reflect "reflect"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+var file_falafelpb_falafel_proto_extTypes = []protoimpl.ExtensionInfo{
+	{
+		ExtendedType:  (*descriptorpb.MethodOptions)(nil),
+		ExtensionType: ([]string)(nil),
+		Field:         50001,
+		Name:          "falafel.permissions",
+		Tag:           "bytes,50001,rep,name=permissions",
+		Filename:      "falafelpb/falafel.proto",
+	},
+	{
+		ExtendedType:  (*descriptorpb.MethodOptions)(nil),
+		ExtensionType: (*bool)(nil),
+		Field:         50002,
+		Name:          "falafel.serialized",
+		Tag:           "varint,50002,opt,name=serialized",
+		Filename:      "falafelpb/falafel.proto",
+	},
+	{
+		ExtendedType:  (*descriptorpb.MethodOptions)(nil),
+		ExtensionType: (*bool)(nil),
+		Field:         50003,
+		Name:          "falafel.progress",
+		Tag:           "varint,50003,opt,name=progress",
+		Filename:      "falafelpb/falafel.proto",
+	},
+	{
+		ExtendedType:  (*descriptorpb.FieldOptions)(nil),
+		ExtensionType: (*string)(nil),
+		Field:         50001,
+		Name:          "falafel.request_default",
+		Tag:           "bytes,50001,opt,name=request_default",
+		Filename:      "falafelpb/falafel.proto",
+	},
+	{
+		ExtendedType:  (*descriptorpb.FieldOptions)(nil),
+		ExtensionType: (*bool)(nil),
+		Field:         50002,
+		Name:          "falafel.required",
+		Tag:           "varint,50002,opt,name=required",
+		Filename:      "falafelpb/falafel.proto",
+	},
+}
+
+// Extension fields to descriptorpb.MethodOptions.
+var (
+	// permissions lists the macaroon permissions required to call the
+	// method, each in the form entity:action. They are used when generating
+	// the permission map with permissions=1.
+	//
+	// repeated string permissions = 50001;
+	E_Permissions = &file_falafelpb_falafel_proto_extTypes[0]
+	// serialized marks the method as not safe to be called concurrently.
+	// Concurrent callers fail with an "already in progress" error instead.
+	//
+	// optional bool serialized = 50002;
+	E_Serialized = &file_falafelpb_falafel_proto_extTypes[1]
+	// progress marks the unary method as long-running. A WithProgress
+	// variant of its API is generated, delivering the progress reported by
+	// the source registered for the method with RegisterProgressSource.
+	//
+	// optional bool progress = 50003;
+	E_Progress = &file_falafelpb_falafel_proto_extTypes[2]
+)
+
+// Extension fields to descriptorpb.FieldOptions.
+var (
+	// request_default is the default value injected into the field of a
+	// request when it is unset, before the request is dispatched by the
+	// generated APIs. Only singular scalar fields without explicit presence
+	// are supported, enum values are given by name.
+	//
+	// optional string request_default = 50001;
+	E_RequestDefault = &file_falafelpb_falafel_proto_extTypes[3]
+	// required marks the field of a request as required. The JSON request
+	// builders generated with json_request_builders=1 fail if it is unset.
+	//
+	// optional bool required = 50002;
+	E_Required = &file_falafelpb_falafel_proto_extTypes[4]
+)
+
+var File_falafelpb_falafel_proto protoreflect.FileDescriptor
+
+var file_falafelpb_falafel_proto_rawDesc = []byte{
+	0x0a, 0x17, 0x66, 0x61, 0x6c, 0x61, 0x66, 0x65, 0x6c, 0x70, 0x62, 0x2f, 0x66, 0x61, 0x6c, 0x61,
+	0x66, 0x65, 0x6c, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x07, 0x66, 0x61, 0x6c, 0x61, 0x66,
+	0x65, 0x6c, 0x1a, 0x20, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+	0x62, 0x75, 0x66, 0x2f, 0x64, 0x65, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74, 0x6f, 0x72, 0x2e, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x3a, 0x42, 0x0a, 0x0b, 0x70, 0x65, 0x72, 0x6d, 0x69, 0x73, 0x73, 0x69,
+	0x6f, 0x6e, 0x73, 0x12, 0x1e, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x4d, 0x65, 0x74, 0x68, 0x6f, 0x64, 0x4f, 0x70, 0x74, 0x69,
+	0x6f, 0x6e, 0x73, 0x18, 0xd1, 0x86, 0x03, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0b, 0x70, 0x65, 0x72,
+	0x6d, 0x69, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x73, 0x3a, 0x40, 0x0a, 0x0a, 0x73, 0x65, 0x72, 0x69,
+	0x61, 0x6c, 0x69, 0x7a, 0x65, 0x64, 0x12, 0x1e, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x4d, 0x65, 0x74, 0x68, 0x6f, 0x64, 0x4f,
+	0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0xd2, 0x86, 0x03, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0a,
+	0x73, 0x65, 0x72, 0x69, 0x61, 0x6c, 0x69, 0x7a, 0x65, 0x64, 0x3a, 0x3c, 0x0a, 0x08, 0x70, 0x72,
+	0x6f, 0x67, 0x72, 0x65, 0x73, 0x73, 0x12, 0x1e, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x4d, 0x65, 0x74, 0x68, 0x6f, 0x64, 0x4f,
+	0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0xd3, 0x86, 0x03, 0x20, 0x01, 0x28, 0x08, 0x52, 0x08,
+	0x70, 0x72, 0x6f, 0x67, 0x72, 0x65, 0x73, 0x73, 0x3a, 0x48, 0x0a, 0x0f, 0x72, 0x65, 0x71, 0x75,
+	0x65, 0x73, 0x74, 0x5f, 0x64, 0x65, 0x66, 0x61, 0x75, 0x6c, 0x74, 0x12, 0x1d, 0x2e, 0x67, 0x6f,
+	0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x46, 0x69,
+	0x65, 0x6c, 0x64, 0x4f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0xd1, 0x86, 0x03, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x0e, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x44, 0x65, 0x66, 0x61, 0x75,
+	0x6c, 0x74, 0x3a, 0x3b, 0x0a, 0x08, 0x72, 0x65, 0x71, 0x75, 0x69, 0x72, 0x65, 0x64, 0x12, 0x1d,
+	0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66,
+	0x2e, 0x46, 0x69, 0x65, 0x6c, 0x64, 0x4f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0xd2, 0x86,
+	0x03, 0x20, 0x01, 0x28, 0x08, 0x52, 0x08, 0x72, 0x65, 0x71, 0x75, 0x69, 0x72, 0x65, 0x64, 0x42,
+	0x2c, 0x5a, 0x2a, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x6c, 0x69,
+	0x67, 0x68, 0x74, 0x6e, 0x69, 0x6e, 0x67, 0x6c, 0x61, 0x62, 0x73, 0x2f, 0x66, 0x61, 0x6c, 0x61,
+	0x66, 0x65, 0x6c, 0x2f, 0x66, 0x61, 0x6c, 0x61, 0x66, 0x65, 0x6c, 0x70, 0x62, 0x62, 0x06, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var file_falafelpb_falafel_proto_goTypes = []interface{}{
+	(*descriptorpb.MethodOptions)(nil), // 0: google.protobuf.MethodOptions
+	(*descriptorpb.FieldOptions)(nil),  // 1: google.protobuf.FieldOptions
+}
+var file_falafelpb_falafel_proto_depIdxs = []int32{
+	0, // 0: falafel.permissions:extendee -> google.protobuf.MethodOptions
+	0, // 1: falafel.serialized:extendee -> google.protobuf.MethodOptions
+	0, // 2: falafel.progress:extendee -> google.protobuf.MethodOptions
+	1, // 3: falafel.request_default:extendee -> google.protobuf.FieldOptions
+	1, // 4: falafel.required:extendee -> google.protobuf.FieldOptions
+	5, // [5:5] is the sub-list for method output_type
+	5, // [5:5] is the sub-list for method input_type
+	5, // [5:5] is the sub-list for extension type_name
+	0, // [0:5] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_falafelpb_falafel_proto_init() }
+func file_falafelpb_falafel_proto_init() {
+	if File_falafelpb_falafel_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_falafelpb_falafel_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   0,
+			NumExtensions: 5,
+			NumServices:   0,
+		},
+		GoTypes:           file_falafelpb_falafel_proto_goTypes,
+		DependencyIndexes: file_falafelpb_falafel_proto_depIdxs,
+		ExtensionInfos:    file_falafelpb_falafel_proto_extTypes,
+	}.Build()
+	File_falafelpb_falafel_proto = out.File
+	file_falafelpb_falafel_proto_rawDesc = nil
+	file_falafelpb_falafel_proto_goTypes = nil
+	file_falafelpb_falafel_proto_depIdxs = nil
+}
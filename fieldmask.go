@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// streamFieldMask returns the paths of the response fields that are kept when
+// delivering the responses of the streaming method as JSON, or nil if all
+// fields are kept. The masks are given in the following format, where the
+// method is optionally qualified with its service and listed once per path:
+// stream_field_masks=[Method1=path1 Method1=path2 Service.Method2=path3]
+func streamFieldMask(method *protogen.Method, params []string) []string {
+	var mask []string
+	for _, p := range params {
+		key, value, found := strings.Cut(p, "=")
+		if !found || value == "" {
+			log.Fatalf("invalid stream field mask %s", p)
+		}
+
+		if !listsMethod([]string{key}, method) {
+			continue
+		}
+
+		if method.Desc.IsStreamingClient() ||
+			!method.Desc.IsStreamingServer() {
+
+			log.Fatalf("stream field mask of %s: only server-streaming "+
+				"methods are supported", method.Desc.FullName())
+		}
+
+		mask = append(mask, value)
+	}
+
+	for _, path := range mask {
+		checkFieldPath(method.Output.Desc, path)
+	}
+
+	return mask
+}
+
+// checkFieldPath makes sure the dotted path of proto field names refers to a
+// field of the message. Only the last element of the path may be a scalar or
+// map field, repeated messages are traversed element-wise.
+func checkFieldPath(msg protoreflect.MessageDescriptor, path string) {
+	desc := msg
+	names := strings.Split(path, ".")
+	for i, name := range names {
+		field := desc.Fields().ByName(protoreflect.Name(name))
+		if field == nil {
+			log.Fatalf("stream field mask: field %s of path %s not "+
+				"found in %s", name, path, desc.FullName())
+		}
+
+		if i == len(names)-1 {
+			break
+		}
+
+		if field.IsMap() || field.Message() == nil {
+			log.Fatalf("stream field mask: field %s of path %s is "+
+				"not a message", field.FullName(), path)
+		}
+		desc = field.Message()
+	}
+}
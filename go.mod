@@ -1,6 +1,9 @@
 module github.com/lightninglabs/falafel
 
-require google.golang.org/protobuf v1.33.0
+require (
+	google.golang.org/protobuf v1.33.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require github.com/google/go-cmp v0.6.0 // indirect
 
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+)
+
+// grpcWebParams holds the parameters of the shared plumbing translating
+// gRPC-Web requests into calls over the in-memory listeners.
+type grpcWebParams struct {
+	ToolName string
+	Package  string
+	BuildTag string
+}
+
+// grpcWebHandlerParams holds the parameters of the gRPC-Web handler of a
+// service.
+type grpcWebHandlerParams struct {
+	ToolName    string
+	FileName    string
+	Package     string
+	BuildTags   string
+	ServiceName string
+
+	// Methods are the methods of the service served by the handler.
+	// Client-streaming methods are left out, as gRPC-Web doesn't support
+	// them.
+	Methods []rpcParams
+
+	// ServiceGating and Lifecycle indicate whether the handler must check
+	// that the service is enabled and start the embedded node before
+	// forwarding a request, like the mobile APIs do.
+	ServiceGating bool
+	Lifecycle     bool
+}
+
+// genGRPCWeb creates grpcweb_generated.go, holding the handler plumbing shared
+// by the gRPC-Web handlers of all services of the package.
+func genGRPCWeb(gen *protogen.Plugin, file *protogen.File, pkg,
+	buildTag string) {
+
+	filename := "./grpcweb_generated.go"
+	g := gen.NewGeneratedFile(filename, file.GoImportPath)
+	p := grpcWebParams{
+		ToolName: versionString,
+		Package:  pkg,
+		BuildTag: buildTag,
+	}
+	executeTemplate(g, grpcWebTemplate, p)
+}
+
+// genGRPCWebHandler creates a file in dir, next to the service file, holding
+// the constructor of the service's gRPC-Web handler.
+func genGRPCWebHandler(gen *protogen.Plugin, file *protogen.File,
+	service *protogen.Service, dir, pkg, buildTags string,
+	methods []rpcParams, param map[string]string) {
+
+	n := strings.ToLower(service.GoName)
+	filename := dir + n + "_grpcweb_generated.go"
+	g := gen.NewGeneratedFile(filename, file.GoImportPath)
+
+	params := grpcWebHandlerParams{
+		ToolName:      versionString,
+		FileName:      filename,
+		Package:       pkg,
+		BuildTags:     buildTags,
+		ServiceName:   service.GoName,
+		ServiceGating: param["service_gating"] == "1",
+		Lifecycle:     param["lifecycle"] == "1",
+	}
+	for _, m := range methods {
+		if !m.ClientStream {
+			params.Methods = append(params.Methods, m)
+		}
+	}
+
+	executeTemplate(g, grpcWebHandlerTemplate, params)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+)
+
+// reservedNames are the package names already imported by the templates,
+// which must never be used as alias for another package.
+var reservedNames = map[string]struct{}{
+	"bufconn":   {},
+	"context":   {},
+	"gateway":   {},
+	"grpc":      {},
+	"gzip":      {},
+	"http":      {},
+	"insecure":  {},
+	"io":        {},
+	"net":       {},
+	"proto":     {},
+	"protojson": {},
+	"runtime":   {},
+	"sync":      {},
+	"testing":   {},
+	"time":      {},
+}
+
+// goPackageNames maps the import paths of the Go packages of all proto files
+// known to the plugin to the names they declare, which may differ from the
+// last element of the path, e.g. for go_package = "example.com/semi;semipb".
+var goPackageNames = make(map[string]string)
+
+// registerGoPackageNames records the names of the Go packages of all proto
+// files known to the plugin, including those of imported files.
+func registerGoPackageNames(gen *protogen.Plugin) {
+	for _, f := range gen.Files {
+		goPackageNames[string(f.GoImportPath)] = string(f.GoPackageName)
+	}
+}
+
+// versionSuffix matches the major version suffix of a go module path.
+var versionSuffix = regexp.MustCompile(`^v[0-9]+$`)
+
+// goImport is a single import of a generated file.
+type goImport struct {
+	// Path is the import path of the package.
+	Path string
+
+	// Alias is the name the package is imported as. It is empty if the
+	// package can be referenced by its own name.
+	Alias string
+}
+
+// Std returns true if the import is a package of the standard library.
+func (i goImport) Std() bool {
+	return !strings.Contains(strings.Split(i.Path, "/")[0], ".")
+}
+
+// goImports keeps track of the packages a generated file needs to import, and
+// the name each of them is referenced by. Packages sharing the same name are
+// given unique aliases, so the generated code always compiles.
+type goImports struct {
+	// pkg is the package name of the generated file itself. Types from
+	// this package are referenced without a qualifier.
+	pkg string
+
+	// pkgPath is the import path of the generated file itself, if known.
+	// If set, it takes precedence over pkg when determining whether a type
+	// is local to the generated file.
+	pkgPath protogen.GoImportPath
+
+	// explicit is the set of aliases requested by the user, keyed by
+	// import path.
+	explicit map[string]string
+
+	// rewrites maps import path prefixes to the prefixes they are
+	// replaced with, e.g. to import a fork or a new major version of a
+	// module.
+	rewrites map[string]string
+
+	// names maps each import path to the name it is referenced by.
+	names map[string]string
+
+	// declared maps each import path to the name its package declares.
+	declared map[string]string
+
+	// used is the set of names already taken by an import.
+	used map[string]string
+}
+
+// newGoImports creates a new import set for a file generated in package pkg,
+// using the given explicit aliases where set. Import paths starting with one of
+// the prefixes of rewrites are rewritten before they are added.
+func newGoImports(pkg string, explicit,
+	rewrites map[string]string) *goImports {
+
+	return &goImports{
+		pkg:      pkg,
+		explicit: explicit,
+		rewrites: rewrites,
+		names:    make(map[string]string),
+		declared: make(map[string]string),
+		used:     make(map[string]string),
+	}
+}
+
+// rewriteImport returns the import path with the longest matching prefix of
+// rewrites replaced. A prefix only matches whole path elements, so
+// github.com/a/b matches github.com/a/b/c but not github.com/a/bc.
+func rewriteImport(importPath string, rewrites map[string]string) string {
+	longest := ""
+	for prefix := range rewrites {
+		if importPath != prefix &&
+			!strings.HasPrefix(importPath, prefix+"/") {
+
+			continue
+		}
+
+		if len(prefix) > len(longest) {
+			longest = prefix
+		}
+	}
+	if longest == "" {
+		return importPath
+	}
+
+	return rewrites[longest] + importPath[len(longest):]
+}
+
+// pkgName returns the name of the package with the given import path. It is
+// the name declared by the Go package of a proto file if known, and otherwise
+// assumed to be the last element of the path, ignoring any major version
+// suffix.
+func pkgName(importPath string) string {
+	if name, ok := goPackageNames[importPath]; ok {
+		return name
+	}
+
+	path := strings.Split(importPath, "/")
+	name := path[len(path)-1]
+	if versionSuffix.MatchString(name) && len(path) > 1 {
+		name = path[len(path)-2]
+	}
+
+	return name
+}
+
+// add adds the given import path to the set, and returns the name the package
+// must be referenced by in the generated code.
+func (i *goImports) add(importPath string) string {
+	// A rewritten package is assumed to declare the same name as the
+	// original one.
+	declared := pkgName(importPath)
+	importPath = rewriteImport(importPath, i.rewrites)
+	if name, ok := i.names[importPath]; ok {
+		return name
+	}
+
+	name, ok := i.explicit[importPath]
+	if !ok {
+		name = sanitizeName(declared)
+
+		// If the name collides with an import already in use, we
+		// append a numeric suffix until it is unique.
+		base := name
+		for n := 1; i.taken(name); n++ {
+			name = fmt.Sprintf("%s%d", base, n)
+		}
+	}
+
+	i.names[importPath] = name
+	i.declared[importPath] = declared
+	i.used[name] = importPath
+
+	return name
+}
+
+// taken returns true if the given name cannot be used for a new import.
+func (i *goImports) taken(name string) bool {
+	if _, ok := reservedNames[name]; ok {
+		return true
+	}
+	if _, ok := i.used[name]; ok {
+		return true
+	}
+
+	// An explicit alias reserves its name even before the package is
+	// added.
+	for _, alias := range i.explicit {
+		if alias == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// typeName returns the name of the given Go type as it must be referenced
+// from within the generated package. If the type comes from an outside
+// package, the package is added to the set and its name is prepended to the
+// type.
+func (i *goImports) typeName(ident protogen.GoIdent) string {
+	switch {
+	case i.pkgPath != "" && ident.GoImportPath == i.pkgPath:
+		return ident.GoName
+
+	case i.pkgPath == "" && pkgName(string(ident.GoImportPath)) == i.pkg:
+		return ident.GoName
+	}
+
+	name := i.add(string(ident.GoImportPath))
+	return fmt.Sprintf("%s.%s", name, ident.GoName)
+}
+
+// imports returns all imports of the set, sorted by import path.
+func (i *goImports) imports() []goImport {
+	imports := make([]goImport, 0, len(i.names))
+	for path, name := range i.names {
+		imp := goImport{Path: path}
+		if name != i.declared[path] {
+			imp.Alias = name
+		}
+		imports = append(imports, imp)
+	}
+
+	sort.Slice(imports, func(a, b int) bool {
+		return imports[a].Path < imports[b].Path
+	})
+
+	return imports
+}
+
+// sanitizeName turns the given string into a valid Go identifier.
+func sanitizeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z',
+			r >= '0' && r <= '9', r == '_':
+
+			return r
+		}
+		return '_'
+	}, name)
+
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+
+	return name
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/proto"
+)
+
+// incrementalParams are the parameters that only control which services are
+// regenerated, and are therefore not part of the digests.
+var incrementalParams = []string{
+	"changed",
+	"previous_digests",
+	"digest_manifest",
+}
+
+// changeFilter decides which services are regenerated in an incremental run.
+// The files of the other services are not created, so protoc leaves the ones
+// of previous runs untouched.
+type changeFilter struct {
+	gen *protogen.Plugin
+
+	// changed is the set of services and proto files, by their path or
+	// base name, that are listed as changed.
+	changed map[string]bool
+
+	// previous maps the path of each proto file to its digest in a
+	// previous run.
+	previous map[string]string
+
+	// incremental indicates whether only changed services are
+	// regenerated.
+	incremental bool
+}
+
+// newChangeFilter creates the filter of the changed services. They are listed
+// in the following format, either by name or by their proto file:
+// changed=[Service1 file1.proto path/to/file2.proto]
+// In addition, the digests of the proto files in a previous run can be read
+// from a digest manifest created with digest_manifest=1:
+// previous_digests=<path>
+func newChangeFilter(gen *protogen.Plugin,
+	param map[string]string) *changeFilter {
+
+	c := &changeFilter{
+		gen:     gen,
+		changed: make(map[string]bool),
+	}
+
+	if changed, ok := param["changed"]; ok {
+		for _, name := range strings.Fields(changed) {
+			c.changed[name] = true
+		}
+		c.incremental = true
+	}
+
+	if p := param["previous_digests"]; p != "" {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			log.Fatalf("unable to read digest manifest: %v", err)
+		}
+
+		if err := json.Unmarshal(b, &c.previous); err != nil {
+			log.Fatalf("invalid digest manifest %s: %v", p, err)
+		}
+		c.incremental = true
+	}
+
+	return c
+}
+
+// serviceChanged returns whether the files of the service must be generated.
+// A service is considered changed if it or its proto file is listed as
+// changed, or the digest of its proto file differs from the previous run.
+func (c *changeFilter) serviceChanged(file *protogen.File,
+	service *protogen.Service, param map[string]string) bool {
+
+	if !c.incremental {
+		return true
+	}
+
+	filePath := file.Desc.Path()
+	if c.changed[service.GoName] || c.changed[filePath] ||
+		c.changed[path.Base(filePath)] {
+
+		return true
+	}
+
+	if c.previous == nil {
+		return false
+	}
+
+	return c.previous[filePath] != fileDigest(c.gen, file, param)
+}
+
+// fileDigest returns the hex encoded SHA-256 digest of everything the files
+// generated from the proto file depend on: the falafel version, the parameters
+// and the descriptors of the file and all files it imports.
+func fileDigest(gen *protogen.Plugin, file *protogen.File,
+	param map[string]string) string {
+
+	h := sha256.New()
+	h.Write([]byte(version + "\n"))
+
+	// The parameters are hashed in a fixed order, leaving out those
+	// only controlling the incremental run.
+	keys := make([]string, 0, len(param))
+	for key := range param {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if isIncrementalParam(key) {
+			continue
+		}
+		h.Write([]byte(key + "=" + param[key] + "\n"))
+	}
+
+	// Collect the paths of the file and all files it transitively
+	// imports.
+	paths := map[string]bool{file.Desc.Path(): true}
+	queue := []string{file.Desc.Path()}
+	for len(queue) > 0 {
+		fd, ok := gen.FilesByPath[queue[0]]
+		queue = queue[1:]
+		if !ok {
+			continue
+		}
+
+		imports := fd.Desc.Imports()
+		for i := 0; i < imports.Len(); i++ {
+			p := imports.Get(i).Path()
+			if !paths[p] {
+				paths[p] = true
+				queue = append(queue, p)
+			}
+		}
+	}
+
+	sorted := make([]string, 0, len(paths))
+	for p := range paths {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+
+	marshal := proto.MarshalOptions{Deterministic: true}
+	for _, p := range sorted {
+		for _, fd := range gen.Request.ProtoFile {
+			if fd.GetName() != p {
+				continue
+			}
+
+			b, err := marshal.Marshal(fd)
+			if err != nil {
+				log.Fatalf("unable to marshal %s: %v", p, err)
+			}
+			h.Write(b)
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// isIncrementalParam returns whether the parameter only controls which
+// services are regenerated.
+func isIncrementalParam(key string) bool {
+	for _, p := range incrementalParams {
+		if key == p {
+			return true
+		}
+	}
+
+	return false
+}
+
+// genDigestManifest creates the manifest mapping the path of each proto file
+// of this run to its digest, to be passed in as previous_digests to the next
+// run.
+func genDigestManifest(gen *protogen.Plugin, param map[string]string) {
+	var file *protogen.File
+	digests := make(map[string]string)
+	for _, f := range gen.Files {
+		if !f.Generate {
+			continue
+		}
+
+		if file == nil {
+			file = f
+		}
+		digests[f.Desc.Path()] = fileDigest(gen, f, fileParams(param, f))
+	}
+	if file == nil {
+		return
+	}
+
+	b, err := json.MarshalIndent(digests, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	filename := "./falafel_digests.json"
+	g := gen.NewGeneratedFile(filename, file.GoImportPath)
+	if _, err := g.Write(append(b, '\n')); err != nil {
+		log.Fatal(err)
+	}
+}
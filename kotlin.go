@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+)
+
+// kotlinKeywords are the hard keywords of Kotlin, which must be escaped with
+// backticks to be used as names.
+var kotlinKeywords = map[string]bool{
+	"as": true, "break": true, "class": true, "continue": true, "do": true,
+	"else": true, "false": true, "for": true, "fun": true, "if": true,
+	"in": true, "interface": true, "is": true, "null": true,
+	"object": true, "package": true, "return": true, "super": true,
+	"this": true, "throw": true, "true": true, "try": true,
+	"typealias": true, "typeof": true, "val": true, "var": true,
+	"when": true, "while": true,
+}
+
+// kotlinBindings returns the Kotlin package of the coroutine helpers, the Java
+// package of the gomobile bindings and the class holding their static methods.
+// The bindings of package lndmobile are generated into the Java package
+// lndmobile, prefixed with the -javapkg given to gomobile bind if any, as
+// static methods of the class Lndmobile.
+func kotlinBindings(param map[string]string) (string, string, string) {
+	pkg := param["package_name"]
+	bindingsPkg := pkg
+	if javaPkg := param["java_package"]; javaPkg != "" {
+		bindingsPkg = javaPkg + "." + pkg
+	}
+
+	kotlinPkg := param["kotlin_package"]
+	if kotlinPkg == "" {
+		kotlinPkg = bindingsPkg
+	}
+
+	return kotlinPkg, bindingsPkg, upperCase(pkg)
+}
+
+// genKotlinRuntime creates FalafelCoroutines.kt, holding the helpers adapting
+// the callbacks of the gomobile bindings to suspend functions and flows. It is
+// shared by the coroutine wrappers of all services, so it is only created once
+// per run.
+func genKotlinRuntime(gen *protogen.Plugin, param map[string]string) {
+	for _, f := range gen.Files {
+		if !f.Generate {
+			continue
+		}
+
+		kotlinPkg, bindingsPkg, bindingsClass := kotlinBindings(param)
+
+		filename := "./FalafelCoroutines.kt"
+		g := gen.NewGeneratedFile(filename, f.GoImportPath)
+		p := kotlinParams{
+			ToolName:        versionString,
+			Package:         kotlinPkg,
+			BindingsPackage: bindingsPkg,
+			BindingsClass:   bindingsClass,
+		}
+		executeTemplate(g, kotlinRuntimeTemplate, p)
+
+		return
+	}
+}
+
+// genKotlinHelpers creates <Service>Coroutines.kt in dir, exposing the APIs of
+// the service as suspend functions for unary and client-streaming calls, and
+// as flows for server-streaming and bidirectional calls. Requests and
+// responses are serialized protos. The calls are made through the
+// XxxWithContext APIs, such that they are cancelled together with their
+// coroutines.
+func genKotlinHelpers(gen *protogen.Plugin, file *protogen.File,
+	service *protogen.Service, dir string, methods []rpcParams,
+	param map[string]string) {
+
+	kotlinPkg, bindingsPkg, bindingsClass := kotlinBindings(param)
+
+	comments := make(map[string]string)
+	for _, method := range service.Methods {
+		comments[method.GoName] = strings.TrimSpace(
+			string(method.Comments.Leading),
+		)
+	}
+
+	var (
+		b       strings.Builder
+		streams bool
+	)
+	for i, m := range methods {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+
+		// The comment must not end the doc comment early.
+		comment := strings.ReplaceAll(
+			comments[m.MethodName], "*/", "*\\/",
+		)
+		if comment != "" {
+			b.WriteString("    /**\n")
+			for _, line := range strings.Split(comment, "\n") {
+				line = strings.TrimRight(" * "+line, " ")
+				b.WriteString("    " + line + "\n")
+			}
+			b.WriteString("     */\n")
+		}
+
+		name := lowerCamel(m.MethodName)
+		if kotlinKeywords[name] {
+			name = "`" + name + "`"
+		}
+		call := bindingsClass + "." +
+			lowerCamel(m.ApiPrefix+m.MethodName+"WithContext")
+
+		switch {
+		case !m.ClientStream && !m.ServerStream:
+			fmt.Fprintf(&b, "    suspend fun %s(request: ByteArray): "+
+				"ByteArray =\n"+
+				"        unaryCall { token, callback ->\n"+
+				"            %s(token, request, callback)\n"+
+				"        }\n", name, call)
+
+		case !m.ClientStream && m.ServerStream:
+			streams = true
+			fmt.Fprintf(&b, "    fun %s(request: ByteArray): "+
+				"Flow<ByteArray> =\n"+
+				"        serverStream { token, rStream ->\n"+
+				"            %s(token, request, rStream)\n"+
+				"        }\n", name, call)
+
+		case m.ClientStream && m.ServerStream:
+			streams = true
+			fmt.Fprintf(&b, "    fun %s(requests: Flow<ByteArray>): "+
+				"Flow<ByteArray> =\n"+
+				"        bidiStream(requests) { token, rStream ->\n"+
+				"            %s(token, rStream)\n"+
+				"        }\n", name, call)
+
+		default:
+			streams = true
+			fmt.Fprintf(&b, "    suspend fun %s(requests: "+
+				"Flow<ByteArray>): ByteArray =\n"+
+				"        clientStream(requests) { token, callback ->\n"+
+				"            %s(token, callback)\n"+
+				"        }\n", name, call)
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "// Code generated by %s. DO NOT EDIT.\n", versionString)
+	fmt.Fprintf(&out, "// source: %s\n\n", file.Proto.GetName())
+	fmt.Fprintf(&out, "package %s\n\n", kotlinPkg)
+	fmt.Fprintf(&out, "import %s.%s\n", bindingsPkg, bindingsClass)
+	if streams {
+		out.WriteString("import kotlinx.coroutines.flow.Flow\n")
+	}
+
+	fmt.Fprintf(&out, "\n/**\n"+
+		" * %[1]sCoroutines exposes the APIs of the %[1]s service as\n"+
+		" * suspend functions and flows of serialized protos. Calls are\n"+
+		" * cancelled together with their coroutines, and streams once their\n"+
+		" * collection is cancelled.\n"+
+		" */\n"+
+		"object %[1]sCoroutines {\n%[2]s}\n",
+		service.GoName, b.String())
+
+	filename := dir + service.GoName + "Coroutines.kt"
+	g := gen.NewGeneratedFile(filename, file.GoImportPath)
+	if _, err := g.Write([]byte(out.String())); err != nil {
+		log.Fatal(err)
+	}
+}
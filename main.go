@@ -2,13 +2,18 @@ package main
 
 import (
 	"fmt"
+	"go/build/constraint"
 	"log"
 	"os"
 	"os/exec"
+	"path"
+	"sort"
 	"strings"
 	"text/template"
+	"unicode"
 
 	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/types/pluginpb"
 )
 
@@ -17,6 +22,26 @@ const version = "0.9.2"
 
 var versionString = fmt.Sprintf("%s %s", toolName, version)
 
+// runtimeUnsupported is the list of options that alter the generated plumbing
+// and can therefore not be used together with the shared runtime package.
+var runtimeUnsupported = []string{
+	"serialization_hooks",
+	"fault_injection",
+	"throttling",
+	"pprof_labels",
+	"call_draining",
+	"stream_buffer",
+	"request_errors",
+	"callback_dispatcher",
+	"usage_stats",
+	"stream_stats",
+	"stream_heartbeats",
+	"gen_callbacks",
+	"stream_delivery",
+	"json_encoding",
+	"grpc_compat",
+}
+
 func main() {
 	maybeVersion := ""
 	if len(os.Args) > 1 {
@@ -27,41 +52,267 @@ func main() {
 		return
 	}
 
-	protogen.Options{}.Run(func(gen *protogen.Plugin) error {
+	generate := func(gen *protogen.Plugin) error {
 		// Set support for optional fields in proto3
 		gen.SupportedFeatures = uint64(
 			pluginpb.CodeGeneratorResponse_FEATURE_PROTO3_OPTIONAL,
 		)
 
-		// Parse the parameters handed to the plugin.
-		param := parseParams(gen.Request.GetParameter())
-
-		// Iterate over each file passed to the plugin.
+		// Parse the parameters handed to the plugin, and add those
+		// of the config file and the selected profile.
+		param := applyProfile(applyConfig(
+			parseParams(gen.Request.GetParameter()),
+		))
+
+		// Replace the built-in templates with those supplied by the
+		// user, if any.
+		applyTemplatesDir(param)
+
+		// Select whether a failing template fails the run or only
+		// leaves out the file it renders.
+		applyTemplateErrors(param)
+
+		// Record the names of the Go packages of all proto files, so
+		// their imports are referenced by the name they declare.
+		registerGoPackageNames(gen)
+
+		// Only the services that changed since a previous run are
+		// regenerated if requested.
+		changes := newChangeFilter(gen, param)
+
+		// Iterate over each file passed to the plugin, keeping track
+		// of the exported mobile APIs and the request defaults.
+		var (
+			symbols  []apiSymbol
+			defaults []string
+		)
 		for _, f := range gen.Files {
 			if !f.Generate {
 				continue
 			}
 
+			// Apply any parameter overrides for this proto file.
+			param := fileParams(param, f)
+			defaults = append(
+				defaults, strings.Fields(param["request_defaults"])...,
+			)
+
 			// Extract the RPC call godoc from the proto file.
 			godoc := extractComments(f)
 
 			// Generate stubs either for mobile or for JS.
 			if param["js_stubs"] == "1" {
-				genJSStubs(gen, f, param)
+				genJSStubs(gen, f, param, changes)
 			} else {
-				genMobileStubs(gen, f, param, godoc)
+				symbols = append(
+					symbols,
+					genMobileStubs(
+						gen, f, param, godoc, changes,
+					)...,
+				)
+
+				// Create the callback interfaces of the mobile
+				// APIs if requested, so they don't have to be
+				// written by hand.
+				if param["gen_callbacks"] == "1" {
+					genCallbacks(gen, f, param)
+				}
 			}
 
-			// Finally, with the service definitions successfully
-			// created, create the in-memory grpc definitions if
+			// Create the macaroon permission map skeletons if
 			// requested.
-			if param["mem_rpc"] == "1" {
-				genMemRPC(gen, f, param)
+			if param["permissions"] == "1" {
+				genPermissions(gen, f, param, changes)
 			}
 		}
 
+		// Make sure all request defaults name a known field, now that
+		// those of all files are known.
+		checkRequestDefaults(gen, defaults)
+
+		// Finally, with the service definitions successfully created,
+		// create the in-memory grpc definitions if requested. They're
+		// shared by all proto files of the package, so they are only
+		// created once.
+		genMemRPCFiles(gen, param)
+
+		// The JavaScript helper decoding compressed responses only
+		// needs to be created once per run.
+		if param["js_stubs"] == "1" && param["gzip_json"] == "1" {
+			genJSInflateHelper(gen)
+		}
+
+		// The Kotlin helpers shared by the coroutine wrappers of all
+		// services only need to be created once per run.
+		if param["js_stubs"] != "1" && param["kotlin_helpers"] == "1" {
+			genKotlinRuntime(gen, param)
+		}
+
+		// The part of the C ABI shim and the Dart FFI bindings shared
+		// by all services only needs to be created once per run.
+		if param["js_stubs"] != "1" && param["dart_ffi"] == "1" {
+			genFFIRuntime(gen, param)
+		}
+
+		// The part of the React Native method table shared by all
+		// services only needs to be created once per run.
+		if param["js_stubs"] != "1" && param["react_native"] == "1" {
+			genReactNativeRuntime(gen, param)
+		}
+
+		// Make sure the mobile APIs don't collide with those of other
+		// runs bound into the same framework, and list them for the
+		// other runs if requested.
+		if param["symbol_manifests"] != "" {
+			checkSymbols(param["symbol_manifests"], symbols)
+		}
+		if param["symbol_manifest"] == "1" {
+			genSymbolManifest(gen, param, symbols)
+		}
+
+		// Report the services and messages that aren't referenced
+		// by the generated APIs if requested.
+		if param["size_report"] == "1" {
+			genSizeReport(gen, param)
+		}
+
+		// Report which services are compiled in for each
+		// combination of build tags if requested.
+		if param["build_report"] == "1" {
+			genBuildReport(gen, param)
+		}
+
+		// The API version describes all files of the run, so it is
+		// only created once.
+		if param["api_version"] == "1" {
+			genAPIVersion(gen, param)
+		}
+
+		// List the digests of the proto files for the next
+		// incremental run if requested.
+		if param["digest_manifest"] == "1" {
+			genDigestManifest(gen, param)
+		}
+
+		// The JSON field codecs and list helpers are shared by all
+		// stubs of a package, so they are only created once per
+		// package.
+		if param["js_stubs"] == "1" {
+			genJSONCodecs(gen, param)
+		}
+
+		// The Swift names are read from the generated APIs, so they
+		// are mapped last.
+		if param["swift_naming"] == "1" {
+			genSwiftNames(gen, param, changes)
+		}
+
 		return nil
-	})
+	}
+
+	// Without protoc, the descriptors are read from a descriptor set or
+	// fetched using server reflection.
+	if isStandalone(os.Args[1:]) {
+		if err := runStandalone(os.Args[1:], generate); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	runPlugin(generate)
+}
+
+// genJSInflateHelper creates the JavaScript helper that decodes the gzip
+// compressed responses delivered by the JSON stubs.
+func genJSInflateHelper(gen *protogen.Plugin) {
+	for _, f := range gen.Files {
+		if !f.Generate {
+			continue
+		}
+
+		filename := "./falafel_inflate.js"
+		g := gen.NewGeneratedFile(filename, f.GoImportPath)
+		executeTemplate(g, jsInflateTemplate, versionString)
+
+		return
+	}
+}
+
+// genJSONCodecs creates the registry of the JSON field codecs and the helpers
+// normalizing lists and maps and converting times in each package the JSON
+// stubs are generated into, if requested.
+func genJSONCodecs(gen *protogen.Plugin, param map[string]string) {
+	created := make(map[string]struct{})
+	for _, f := range gen.Files {
+		if !f.Generate {
+			continue
+		}
+
+		param := fileParams(param, f)
+		if param["json_codecs"] != "1" && param["json_empty_lists"] == "" &&
+			param["json_times"] == "" {
+
+			continue
+		}
+
+		servicePackages := split(param["service_packages"], " ")
+		for _, service := range f.Services {
+			dir, pkg := "./", param["package_name"]
+			n := strings.ToLower(service.GoName)
+			if outPkg := servicePackages[n]; outPkg != "" {
+				dir, pkg = "./"+outPkg+"/", outPkg
+			}
+			dir = outDir(serviceOverrides(param, service), service, dir)
+
+			if _, ok := created[dir]; ok {
+				continue
+			}
+			created[dir] = struct{}{}
+
+			filename := dir + "json_codecs.pb.json.go"
+			g := gen.NewGeneratedFile(filename, f.GoImportPath)
+			p := jsonCodecsParams{
+				ToolName:   versionString,
+				Package:    pkg,
+				BuildTag:   modeBuildTags(param, "js"),
+				Codecs:     param["json_codecs"] == "1",
+				EmptyLists: param["json_empty_lists"],
+				Times:      param["json_times"],
+			}
+			executeTemplate(g, jsonCodecsTemplate, p)
+		}
+	}
+}
+
+// defaultBuildTags are the build constraints of the files generated in each
+// output mode if default_build_tags is set, such that the outputs of all modes
+// can be generated into the same package.
+var defaultBuildTags = map[string]string{
+	"mobile":  "//go:build !js",
+	"js":      "//go:build js",
+	"mem_rpc": "//go:build !js",
+}
+
+// modeBuildTags returns the build constraints of the files generated in the
+// given output mode, which is either mobile, js or mem_rpc. They are set with
+// the mode's <mode>_build_tags option, falling back to build_tags for the
+// mobile and JS stubs, and to the mode's default if default_build_tags is set.
+func modeBuildTags(param map[string]string, mode string) string {
+	if tags, ok := param[mode+"_build_tags"]; ok {
+		return tags
+	}
+
+	// For compatibility, the in-memory plumbing isn't restricted by the
+	// build tags of the stubs.
+	if mode != "mem_rpc" && param["build_tags"] != "" {
+		return param["build_tags"]
+	}
+
+	if param["default_build_tags"] == "1" {
+		return defaultBuildTags[mode]
+	}
+
+	return ""
 }
 
 // parseParams parses any parameters handed to the plugin.
@@ -82,6 +333,67 @@ func parseParams(parameter string) map[string]string {
 	return param
 }
 
+// fileParams returns the parameters for the given proto file, with any
+// overrides for the file applied. Overrides come in the following format,
+// where the file is either the path of the proto file or its base name:
+// file.<file>.<option>=<value>
+func fileParams(param map[string]string,
+	file *protogen.File) map[string]string {
+
+	filePath := file.Desc.Path()
+	fileParam := make(map[string]string, len(param))
+	overrides := make(map[string]string)
+	for key, value := range param {
+		if !strings.HasPrefix(key, "file.") {
+			fileParam[key] = value
+			continue
+		}
+
+		// The option name follows the last dot, as the file name
+		// contains dots itself.
+		index := strings.LastIndex(key, ".")
+		if index < len("file.") {
+			log.Fatalf("invalid file override %s", key)
+		}
+		name, option := key[len("file."):index], key[index+1:]
+		if name == filePath || name == path.Base(filePath) {
+			overrides[option] = value
+		}
+	}
+
+	for option, value := range overrides {
+		fileParam[option] = value
+	}
+
+	return fileParam
+}
+
+// serviceOverrides returns the parameters for the given service, with any
+// overrides for the service applied. Overrides come in the following format:
+// service.<service>.<option>=<value>
+// Only the options read while generating the files of the service can be
+// overridden, not those of the plumbing shared by all services.
+func serviceOverrides(param map[string]string,
+	service *protogen.Service) map[string]string {
+
+	prefix := "service." + service.GoName + "."
+	serviceParam := make(map[string]string, len(param))
+	overrides := make(map[string]string)
+	for key, value := range param {
+		serviceParam[key] = value
+
+		if strings.HasPrefix(key, prefix) {
+			overrides[key[len(prefix):]] = value
+		}
+	}
+
+	for option, value := range overrides {
+		serviceParam[option] = value
+	}
+
+	return serviceParam
+}
+
 // extractComments extracts the RPC call godoc from the proto file.
 func extractComments(file *protogen.File) map[string]string {
 	locations := file.Desc.SourceLocations()
@@ -128,8 +440,11 @@ func extractComments(file *protogen.File) map[string]string {
 	return godoc
 }
 
+// genMobileStubs creates the mobile APIs of all services of the file, and
+// returns the exported API functions generated.
 func genMobileStubs(gen *protogen.Plugin, file *protogen.File,
-	param map[string]string, godoc map[string]string) {
+	param map[string]string, godoc map[string]string,
+	changes *changeFilter) []apiSymbol {
 
 	// We need package_name and target_package in order to continue.
 	pkg := param["package_name"]
@@ -147,25 +462,221 @@ func genMobileStubs(gen *protogen.Plugin, file *protogen.File,
 	// default listener if provided.
 	defaultLis := param["defaultlistener"]
 
-	targetPkg := param["target_package"]
-	if targetPkg == "" {
-		log.Fatal("target package not set")
+	// All mobile APIs share the generated plumbing, so they must be
+	// generated into the same package.
+	if param["service_packages"] != "" {
+		log.Fatal("service_packages is only supported with js_stubs")
+	}
+	if param["lifecycle"] == "1" && param["mem_rpc"] != "1" {
+		log.Fatal("lifecycle is only supported with mem_rpc")
+	}
+	if param["global_metadata"] == "1" && param["mem_rpc"] != "1" {
+		log.Fatal("global_metadata is only supported with mem_rpc")
+	}
+	if param["metadata_provider"] == "1" && param["mem_rpc"] != "1" {
+		log.Fatal("metadata_provider is only supported with mem_rpc")
+	}
+	if param["conn_pool"] == "1" && param["mem_rpc"] != "1" {
+		log.Fatal("conn_pool is only supported with mem_rpc")
+	}
+	if param["connection_observer"] == "1" && param["mem_rpc"] != "1" {
+		log.Fatal("connection_observer is only supported with mem_rpc")
+	}
+	if param["message_preview"] == "1" && param["mem_rpc"] != "1" {
+		log.Fatal("message_preview is only supported with mem_rpc")
+	}
+	if param["type_registry"] == "1" && param["mem_rpc"] != "1" {
+		log.Fatal("type_registry is only supported with mem_rpc")
+	}
+	if param["dial_options"] == "1" && param["mem_rpc"] != "1" {
+		log.Fatal("dial_options is only supported with mem_rpc")
+	}
+	if param["kotlin_helpers"] == "1" && param["with_context"] != "1" {
+		log.Fatal("kotlin_helpers is only supported with with_context")
+	}
+	if param["kotlin_helpers"] == "1" && param["unexported_api"] == "1" {
+		log.Fatal("kotlin_helpers is not supported with unexported_api")
+	}
+	if param["dart_ffi"] == "1" && param["with_context"] != "1" {
+		log.Fatal("dart_ffi is only supported with with_context")
+	}
+	if param["dart_ffi"] == "1" && param["unexported_api"] == "1" {
+		log.Fatal("dart_ffi is not supported with unexported_api")
+	}
+	if param["react_native"] == "1" && param["with_context"] != "1" {
+		log.Fatal("react_native is only supported with with_context")
+	}
+	if param["react_native"] == "1" && param["unexported_api"] == "1" {
+		log.Fatal("react_native is not supported with unexported_api")
+	}
+	if param["server_interceptors"] == "1" && param["mem_rpc"] != "1" {
+		log.Fatal("server_interceptors is only supported with mem_rpc")
+	}
+	if param["openmetrics"] == "1" && param["usage_stats"] != "1" {
+		log.Fatal("openmetrics is only supported with usage_stats")
+	}
+	if param["unexported_api"] == "1" && param["mem_rpc"] != "1" {
+		log.Fatal("unexported_api is only supported with mem_rpc")
+	}
+	if param["gen_tests"] == "1" && param["mem_rpc"] != "1" {
+		log.Fatal("gen_tests is only supported with mem_rpc")
+	}
+	if param["gen_tests"] == "1" && param["state_gating"] != "" {
+		log.Fatal("gen_tests is not supported with state_gating")
+	}
+	if param["grpc_web"] == "1" && param["mem_rpc"] != "1" {
+		log.Fatal("grpc_web is only supported with mem_rpc")
+	}
+	if param["rest_gateway"] == "1" && param["mem_rpc"] != "1" {
+		log.Fatal("rest_gateway is only supported with mem_rpc")
+	}
+
+	// The payloads are encoded by the shared plumbing, so the encoding
+	// applies to all services.
+	jsonEncoding := param["json_encoding"] == "1"
+	if jsonEncoding && param["mem_rpc"] != "1" {
+		log.Fatal("json_encoding is only supported with mem_rpc")
 	}
+	if jsonEncoding && param["request_errors"] == "1" {
+		log.Fatal("request_errors is not supported with json_encoding")
+	}
+	if jsonEncoding && param["message_preview"] == "1" {
+		log.Fatal("message_preview is not supported with json_encoding")
+	}
+	switch param["json_unknown_fields"] {
+	case "", "reject", "discard":
 
-	targetName := ""
-	if i := strings.LastIndex(targetPkg, "/"); i > 0 {
-		targetName = targetPkg[i+1:]
+	default:
+		log.Fatalf("invalid json_unknown_fields %s",
+			param["json_unknown_fields"])
 	}
 
-	buildTags := param["build_tags"]
+	// Calls made before the wallet is unlocked either block or fail,
+	// except those of the services that are served before.
+	var stateGating *stateGatingParams
+	switch param["state_gating"] {
+	case "":
+
+	case "block", "error":
+		if param["mem_rpc"] != "1" {
+			log.Fatal("state_gating is only supported with mem_rpc")
+		}
+
+		stateGating = detectStateGating(
+			gen, newGoImports(pkg, nil, nil),
+		)
+		if stateGating == nil {
+			log.Fatal("state_gating requires a SubscribeState " +
+				"method")
+		}
 
-	apiPrefix := false
-	if param["api_prefix"] == "1" {
-		apiPrefix = true
+	default:
+		log.Fatalf("invalid state_gating %s", param["state_gating"])
 	}
 
 	// For each service, we'll create a file with the generated API.
+	var symbols []apiSymbol
+	fileParam := param
+	protoFile := newProtoFile(file)
 	for _, service := range file.Services {
+		// Apply any parameter overrides for this service.
+		param := serviceOverrides(fileParam, service)
+
+		targetPkg := param["target_package"]
+		if targetPkg == "" {
+			log.Fatal("target package not set")
+		}
+
+		buildTags := pruneBuildTags(
+			service, param, modeBuildTags(param, "mobile"),
+		)
+
+		apiPrefix := false
+		if param["api_prefix"] == "1" {
+			apiPrefix = true
+		}
+
+		// The API functions can be generated unexported, to be called
+		// through the facade only.
+		unexported := param["unexported_api"] == "1"
+
+		// Any explicit import aliases come in the following format:
+		// import_aliases=[path1=alias1 path2=alias2]
+		importAliases := split(param["import_aliases"], " ")
+
+		// Any import path rewrites come in the following format:
+		// import_rewrites=[prefix1=replacement1 prefix2=replacement2]
+		importRewrites := split(param["import_rewrites"], " ")
+
+		typedResponses := param["typed_responses"] == "1"
+		if unexported && typedResponses {
+			log.Fatal("typed_responses is not supported with " +
+				"unexported_api")
+		}
+
+		typedAPI := param["typed_api"] == "1"
+		if unexported && typedAPI {
+			log.Fatal("typed_api is not supported with unexported_api")
+		}
+		if typedAPI && param["fallback_stubs"] == "1" {
+			log.Fatal("typed_api is not supported with fallback_stubs")
+		}
+
+		// The upload helpers and the API tests serialize the messages
+		// themselves.
+		if jsonEncoding && param["upload_helpers"] == "1" {
+			log.Fatal("upload_helpers is not supported with " +
+				"json_encoding")
+		}
+		if jsonEncoding && param["gen_tests"] == "1" {
+			log.Fatal("gen_tests is not supported with json_encoding")
+		}
+
+		paginationHelpers := param["pagination_helpers"] == "1"
+		longPoll := param["long_poll"] == "1"
+		notifications := param["notifications"] == "1"
+		paymentTracking := param["payment_tracking"] == "1"
+		uploadHelpers := param["upload_helpers"] == "1"
+		streamTransforms := param["stream_transforms"] == "1"
+		streamBackpressure := param["stream_backpressure"] == "1"
+		streamHandles := param["stream_handles"] == "1"
+		tasks := param["tasks"] == "1"
+		withContext := param["with_context"] == "1"
+		timeoutParam := param["call_timeout_param"] == "1"
+		serviceInterfaces := param["service_interfaces"] == "1"
+
+		// The streams delivering their first response separately come
+		// in the following format:
+		// initial_response=[Service1.Method1 Method2]
+		initialResponse := strings.Fields(param["initial_response"])
+
+		// The methods that must not be called concurrently come in the
+		// following format, in addition to those marked with the
+		// (falafel.serialized) option:
+		// serialized_methods=[Service1.Method1 Method2]
+		serializedMethods := strings.Fields(param["serialized_methods"])
+
+		// The long-running unary methods reporting their progress come
+		// in the following format, in addition to those marked with the
+		// (falafel.progress) option:
+		// progress_methods=[Service1.Method1 Method2]
+		progressMethods := strings.Fields(param["progress_methods"])
+
+		// The methods whose payloads are compressed come in the
+		// following format:
+		// compressed_methods=[Service1.Method1 Method2]
+		compressedMethods := strings.Fields(param["compressed_methods"])
+
+		// The defaults of request fields come in the following format,
+		// in addition to those set with the (falafel.request_default)
+		// option:
+		// request_defaults=[Message1.field1=value1 Message2.field2=value2]
+		requestDefaults := strings.Fields(param["request_defaults"])
+
+		// The APIs whose signatures changed since compat_version keep
+		// their previous signatures as deprecated shims.
+		compat := compatChanges(param)
+
 		name := service.GoName
 		n := strings.ToLower(name)
 
@@ -178,199 +689,880 @@ func genMobileStubs(gen *protogen.Plugin, file *protogen.File,
 			listener = defaultLis
 		}
 
-		filename := "./" + n + "_api_generated.go"
-		g := gen.NewGeneratedFile(filename, file.GoImportPath)
+		// Keep track of all packages the generated file must import,
+		// starting with the target package.
+		imports := newGoImports(pkg, importAliases, importRewrites)
+		targetName := imports.add(targetPkg)
+
+		// Gather the parameters for each method defined by the
+		// service first, such that all imports are known before the
+		// header is created.
+		var methods []rpcParams
+		usesProto := typedResponses && !jsonEncoding
+		for _, method := range orderMethods(
+			includedMethods(service, param), param,
+		) {
+			methodName := method.GoName
 
-		// Create the file header.
-		params := headerParams{
-			ToolName:  versionString,
-			FileName:  filename,
-			Package:   pkg,
-			TargetPkg: targetPkg,
-			BuildTags: buildTags,
-		}
-		if err := headerTemplate.Execute(g, params); err != nil {
-			log.Fatal(err)
-		}
+			rpcParams := rpcParams{
+				ServiceName:  service.GoName,
+				TargetName:   targetName,
+				MethodName:   methodName,
+				FullMethod:   fullMethodName(method),
+				RequestType:  imports.typeName(method.Input.GoIdent),
+				ResponseType: imports.typeName(method.Output.GoIdent),
+				Comment:      godoc[methodName],
+				ClientStream: method.Desc.IsStreamingClient(),
+				ServerStream: method.Desc.IsStreamingServer(),
+
+				RequestMessage: string(
+					method.Input.Desc.FullName(),
+				),
+				ResponseMessage: string(
+					method.Output.Desc.FullName(),
+				),
+				JSONEncoding: jsonEncoding,
+			}
+			if apiPrefix {
+				rpcParams.ApiPrefix = service.GoName
+			}
+			if unexported {
+				rpcParams.ApiPrefix = lowerCase(service.GoName)
+				rpcParams.Facade = true
+			}
+			if paginationHelpers {
+				rpcParams.Pagination = detectPagination(method)
+			}
+			if longPoll && rpcParams.ServerStream &&
+				!rpcParams.ClientStream {
 
-		// Create service specific methods.
-		serviceParams := serviceParams{
-			ServiceName: name,
-			TargetName:  targetName,
-			Listener:    listener,
-		}
-		err := serviceTemplate.Execute(g, serviceParams)
-		if err != nil {
-			log.Fatal(err)
-		}
+				rpcParams.LongPoll = true
+			}
+			if notifications && rpcParams.ServerStream &&
+				!rpcParams.ClientStream {
 
-		// Go through each method defined by the service and call the
-		// appropriate template depending on the RPC type.
-		for _, method := range service.Methods {
-			methodName := method.GoName
+				rpcParams.Notification = true
+			}
+			if streamTransforms && rpcParams.ServerStream &&
+				!rpcParams.ClientStream {
 
-			// Get the input type's package.
-			typeImportPath := string(
-				method.Input.GoIdent.GoImportPath,
-			)
-			path := strings.Split(typeImportPath, "/")
-			if len(path) == 0 {
-				log.Fatal("expected an import path for the " +
-					"input type but got none")
-				return
+				rpcParams.StreamTransform = true
 			}
+			if streamHandles && rpcParams.ServerStream {
+				rpcParams.StreamHandle = true
+			}
+			if streamBackpressure && rpcParams.ServerStream &&
+				!rpcParams.ClientStream {
 
-			// Get the package name of the input type.
-			inputPkg := path[len(path)-1]
+				rpcParams.Backpressure = true
+			}
+			if tasks && !rpcParams.ClientStream &&
+				!rpcParams.ServerStream {
 
-			inputType := method.Input.GoIdent.GoName
+				rpcParams.Task = true
+			}
+			if !rpcParams.ClientStream && !rpcParams.ServerStream &&
+				(listsMethod(progressMethods, method) ||
+					methodBoolOption(method, progressOption)) {
 
-			// If the input comes from an outside package, we need
-			// to prepend the outside package's name to the type.
-			if inputPkg != pkg {
-				inputType = fmt.Sprintf(
-					"%s.%s", inputPkg, inputType,
-				)
+				rpcParams.Progress = true
 			}
+			rpcParams.WithContext = withContext
+			if timeoutParam && !rpcParams.ClientStream &&
+				!rpcParams.ServerStream {
 
-			rpcParams := rpcParams{
-				ServiceName: service.GoName,
-				MethodName:  methodName,
-				RequestType: inputType,
-				Comment:     godoc[methodName],
+				rpcParams.TimeoutParam = true
 			}
-			if apiPrefix {
-				rpcParams.ApiPrefix = service.GoName
+			if rpcParams.ServerStream &&
+				listsMethod(initialResponse, method) {
+
+				rpcParams.InitialResponse = true
 			}
+			if listsMethod(serializedMethods, method) ||
+				methodBoolOption(method, serializedOption) {
 
-			clientStream := method.Desc.IsStreamingClient()
-			serverStream := method.Desc.IsStreamingServer()
+				rpcParams.Serialized = true
+			}
+			rpcParams.Compressor = compressor(
+				method, compressedMethods, imports,
+			)
+			if !rpcParams.ClientStream {
+				rpcParams.Defaults = detectRequestDefaults(
+					method.Input, requestDefaults, imports,
+				)
+			}
+			if paymentTracking {
+				rpcParams.PaymentTracking = detectPaymentTracking(
+					service, method, imports,
+				)
+			}
+			if uploadHelpers {
+				rpcParams.Upload = detectUpload(method, imports)
+			}
+			rpcParams.Typed = typedAPI
 
-			switch {
-			case !clientStream && !serverStream:
-				err := syncTemplate.Execute(g, rpcParams)
-				if err != nil {
-					log.Fatal(err)
-				}
+			methods = append(methods, rpcParams)
 
-			case !clientStream && serverStream:
-				err := readStreamTemplate.Execute(g, rpcParams)
-				if err != nil {
-					log.Fatal(err)
-				}
+			// Only exported functions can collide with those of
+			// other packages.
+			if !unexported {
+				symbols = append(symbols, newAPISymbols(
+					file, rpcParams, typedResponses,
+				)...)
+			}
 
-			case clientStream && serverStream:
-				err := biStreamTemplate.Execute(g, rpcParams)
-				if err != nil {
-					log.Fatal(err)
-				}
+			// The proto package is only referenced by unary
+			// methods, the serialized typed responses and the
+			// upload helpers.
+			if !rpcParams.ClientStream && !rpcParams.ServerStream ||
+				rpcParams.Upload != nil {
 
-			default:
-				log.Fatal("unexpected method type")
+				usesProto = true
 			}
 		}
-	}
-}
-
-func genJSStubs(gen *protogen.Plugin, file *protogen.File,
-	param map[string]string) {
-
-	// We need package_name and target_package in order to continue.
-	pkg := param["package_name"]
-	if pkg == "" {
-		log.Fatal("package name not set")
-	}
-
-	buildTag := param["build_tags"]
-	manualImport := param["manual_import"]
 
-	// For each service, we'll create a file with the generated API.
-	for _, service := range file.Services {
-		name := service.GoName
-		n := strings.ToLower(name)
+		// The symbols of unchanged services are still listed, but
+		// their files are left untouched.
+		if !changes.serviceChanged(file, service, fileParam) {
+			continue
+		}
 
-		filename := "./" + n + ".pb.json.go"
+		filename := outDir(param, service, "./") + n +
+			"_api_generated.go"
 		g := gen.NewGeneratedFile(filename, file.GoImportPath)
 
 		// Create the file header.
-		params := jsHeaderParams{
-			ToolName:          versionString,
-			FileName:          file.Proto.GetName(),
-			ServiceName:       name,
-			Package:           pkg,
-			AdditionalImports: make(map[string]struct{}),
-			BuildTag:          buildTag,
+		params := headerParams{
+			ToolName:  versionString,
+			FileName:  filename,
+			Package:   pkg,
+			Imports:   imports.imports(),
+			BuildTags: buildTags,
+			Proto:     usesProto,
+			File:      protoFile,
 		}
+		executeTemplate(g, headerTemplate, params)
 
-		if manualImport != "" {
-			params.AdditionalImports[manualImport] = struct{}{}
+		// Create service specific methods.
+		serviceParams := serviceParams{
+			ServiceName:   name,
+			TargetName:    targetName,
+			Listener:      listener,
+			ServiceGating: param["service_gating"] == "1",
+			Lifecycle:     param["lifecycle"] == "1",
+			StateGating:   stateGating.stateGated(service),
+
+			GlobalMetadata: param["global_metadata"] == "1",
+			ConnPool:       param["conn_pool"] == "1",
+
+			MetadataProvider: param["metadata_provider"] == "1",
+			DialOptions:      param["dial_options"] == "1",
+
+			File: protoFile,
 		}
+		executeTemplate(g, serviceTemplate, serviceParams)
 
 		// Go through each method defined by the service and call the
-		// appropriate template.
-		for _, method := range service.Methods {
-			methodName := method.GoName
+		// appropriate template depending on the RPC type.
+		for _, rpcParams := range methods {
+			clientStream := rpcParams.ClientStream
+			serverStream := rpcParams.ServerStream
 
-			// Get the input type's package.
-			typeImportPath := string(
-				method.Input.GoIdent.GoImportPath,
-			)
-			path := strings.Split(typeImportPath, "/")
-			if len(path) == 0 {
-				log.Fatal("expected an import path for the " +
-					"input type but got none")
-				return
-			}
+			switch {
+			case !clientStream && !serverStream:
+				executeTemplate(g, syncTemplate, rpcParams)
+
+				if rpcParams.Task {
+					executeTemplate(
+						g, taskTemplate, rpcParams,
+					)
+				}
+
+				if rpcParams.Progress {
+					executeTemplate(
+						g, progressTemplate, rpcParams,
+					)
+				}
 
-			// Get the package name of the input type.
-			inputPkg := path[len(path)-1]
+			case !clientStream && serverStream:
+				executeTemplate(
+					g, readStreamTemplate, rpcParams,
+				)
 
-			inputType := method.Input.GoIdent.GoName
+				if rpcParams.Backpressure {
+					executeTemplate(
+						g, demandTemplate, rpcParams,
+					)
+				}
 
-			// If the input comes from an outside package, we need
-			// to prepend the outside package's name to the type.
-			if inputPkg != pkg {
-				params.AdditionalImports[typeImportPath] = struct{}{}
+			case clientStream && serverStream:
+				executeTemplate(g, biStreamTemplate, rpcParams)
 
-				inputType = fmt.Sprintf(
-					"%s.%s", inputPkg, inputType,
+			case clientStream && !serverStream:
+				executeTemplate(
+					g, clientStreamTemplate, rpcParams,
 				)
 			}
 
-			p := jsRpcParams{
-				MethodName:  methodName,
-				ServiceName: service.GoName,
-				RequestType: inputType,
+			// Add the variant returning a handle that stops the
+			// stream if requested.
+			if rpcParams.StreamHandle {
+				executeTemplate(g, handleTemplate, rpcParams)
 			}
 
-			clientStream := method.Desc.IsStreamingClient()
-			serverStream := method.Desc.IsStreamingServer()
+			// Add the variant taking a token that cancels the call
+			// if requested.
+			if rpcParams.WithContext {
+				executeTemplate(g, contextTemplate, rpcParams)
+			}
 
-			if serverStream {
-				p.ResponseStreaming = true
+			// If requested, add a helper that unmarshals the
+			// serialized responses into the concrete type.
+			if typedResponses {
+				executeTemplate(
+					g, responseHelperTemplate, rpcParams,
+				)
 			}
 
-			if clientStream {
+			// For list-style RPCs, add a helper that pages through
+			// all results if requested.
+			if rpcParams.Pagination != nil {
+				executeTemplate(
+					g, paginationTemplate, rpcParams,
+				)
+			}
+
+			// Add the long-poll adapter for server-streaming RPCs
+			// if requested.
+			if rpcParams.LongPoll {
+				executeTemplate(g, longPollTemplate, rpcParams)
+			}
+
+			// Add the helper delivering the first response of the
+			// stream separately if requested.
+			if rpcParams.InitialResponse {
+				executeTemplate(
+					g, initialResponseTemplate, rpcParams,
+				)
+			}
+
+			// Add the reconnect-safe wrapper for payment streams if
+			// requested.
+			if rpcParams.PaymentTracking != nil {
+				executeTemplate(
+					g, paymentStreamTemplate, rpcParams,
+				)
+			}
+
+			// Add the helper sending a payload in chunks to
+			// client-streaming uploads if requested.
+			if rpcParams.Upload != nil {
+				executeTemplate(g, uploadTemplate, rpcParams)
+			}
+
+			// Add the variant taking and returning the messages
+			// instead of their serialization if requested.
+			if rpcParams.Typed {
+				executeTemplate(g, typedTemplate, rpcParams)
+			}
+		}
+
+		// Register the subscriptions of the service as notification
+		// sources, the API functions with the facade and the types of
+		// the messages with the type registry if requested.
+		genNotificationSources(g, methods)
+		genFacadeMethods(g, methods)
+		if param["type_registry"] == "1" && len(methods) > 0 {
+			executeTemplate(g, methodTypesTemplate, methods)
+		}
+		genCompatShims(g, compat, methods)
+
+		// Add the interface of the service's API functions if
+		// requested, so Go code can swap in another implementation.
+		if serviceInterfaces {
+			genServiceInterface(g, name, methods)
+		}
+
+		// Create the Kotlin coroutine wrappers of the service's APIs
+		// if requested, so Android apps don't have to adapt the
+		// callbacks by hand.
+		if param["kotlin_helpers"] == "1" {
+			genKotlinHelpers(
+				gen, file, service, outDir(param, service, "./"),
+				methods, param,
+			)
+		}
+
+		// Create the C ABI shim and the Dart FFI bindings of the
+		// service's APIs if requested, so Flutter apps can call them
+		// without the gomobile bindings.
+		if param["dart_ffi"] == "1" {
+			genFFIBindings(
+				gen, file, service, outDir(param, service, "./"),
+				methods, param, buildTags,
+			)
+		}
+
+		// Create the TurboModule spec of the service and register its
+		// methods with the React Native method table if requested, so
+		// React Native apps get typed signatures of the APIs.
+		if param["react_native"] == "1" {
+			genReactNativeSpec(
+				gen, file, service, outDir(param, service, "./"),
+				methods, param, buildTags,
+			)
+		}
+
+		// If requested, create a fallback file that is used when the
+		// build tags exclude the service, keeping the exported API
+		// intact.
+		if param["fallback_stubs"] == "1" {
+			genFallbackStubs(
+				gen, file, service, outDir(param, service, "./"),
+				pkg, buildTags, methods, importAliases,
+				importRewrites, typedResponses, compat,
+				serviceInterfaces,
+			)
+		}
+
+		// Create the test of the service's APIs if requested, so
+		// template regressions are caught by downstream projects.
+		if param["gen_tests"] == "1" && len(methods) > 0 {
+			genAPITests(
+				gen, file, service, outDir(param, service, "./"),
+				pkg, targetPkg, buildTags, listener, methods,
+				importAliases, importRewrites,
+			)
+		}
+
+		// Create the gRPC-Web handler of the service if requested, so
+		// browser clients can call it without the JS stubs.
+		if param["grpc_web"] == "1" {
+			genGRPCWebHandler(
+				gen, file, service, outDir(param, service, "./"),
+				pkg, buildTags, methods, param,
+			)
+		}
+
+		// Create the REST handler of the service if requested, serving
+		// the methods annotated with google.api.http rules.
+		if param["rest_gateway"] == "1" {
+			genRESTHandler(
+				gen, file, service, outDir(param, service, "./"),
+				pkg, targetPkg, buildTags, methods,
+				importAliases, importRewrites, param,
+			)
+		}
+	}
+
+	return symbols
+}
+
+// genAPITests creates a test file in dir, next to the service file, which
+// serves a mock implementation of the service on its in-memory listener and
+// calls each of the service's APIs once.
+func genAPITests(gen *protogen.Plugin, file *protogen.File,
+	service *protogen.Service, dir, pkg, targetPkg, buildTags,
+	listener string, methods []rpcParams,
+	importAliases, importRewrites map[string]string) {
+
+	n := strings.ToLower(service.GoName)
+	filename := dir + n + "_api_generated_test.go"
+	g := gen.NewGeneratedFile(filename, file.GoImportPath)
+
+	// The test references the request and response types, so they are
+	// added to the test's own imports.
+	imports := newGoImports(pkg, importAliases, importRewrites)
+	targetName := imports.add(targetPkg)
+
+	params := apiTestsParams{
+		ToolName:    versionString,
+		FileName:    filename,
+		Package:     pkg,
+		BuildTags:   buildTags,
+		ServiceName: service.GoName,
+		TargetName:  targetName,
+		Listener:    listener,
+	}
+	for _, m := range methods {
+		method := findMethod(service, m.MethodName)
+		m.TargetName = targetName
+		m.RequestType = imports.typeName(method.Input.GoIdent)
+		m.ResponseType = imports.typeName(method.Output.GoIdent)
+
+		if !m.ClientStream && !m.ServerStream {
+			params.Unary = true
+		}
+		if m.ClientStream && !m.ServerStream {
+			params.ClientStreams = true
+		}
+		params.Methods = append(params.Methods, m)
+	}
+	params.Imports = imports.imports()
+
+	executeTemplate(g, apiTestsTemplate, params)
+}
+
+// genFallbackStubs creates a file with the same exported API as the generated
+// service file, that is only built if the build tags of the service file are
+// not satisfied. It is created in dir, next to the service file. All its
+// methods return an Unimplemented error.
+func genFallbackStubs(gen *protogen.Plugin, file *protogen.File,
+	service *protogen.Service, dir, pkg, buildTags string,
+	methods []rpcParams,
+	importAliases, importRewrites map[string]string, typedResponses bool,
+	compat []surfaceChange, serviceInterface bool) {
+
+	// The build constraint of the fallback file is the negation of the
+	// service file's constraint.
+	expr := parseBuildTags(buildTags)
+	if expr == nil {
+		log.Fatal("fallback stubs require build_tags to be set")
+	}
+
+	// Only the response types are referenced by the fallback file, which
+	// are only needed for the typed response helpers.
+	imports := newGoImports(pkg, importAliases, importRewrites)
+	fallbackMethods := make([]rpcParams, 0, len(methods))
+	for _, m := range methods {
+		if typedResponses {
+			method := findMethod(service, m.MethodName)
+			m.ResponseType = imports.typeName(method.Output.GoIdent)
+		}
+		fallbackMethods = append(fallbackMethods, m)
+	}
+
+	n := strings.ToLower(service.GoName)
+	filename := dir + n + "_api_fallback_generated.go"
+	g := gen.NewGeneratedFile(filename, file.GoImportPath)
+
+	params := fallbackParams{
+		ToolName:        versionString,
+		FileName:        filename,
+		Package:         pkg,
+		Imports:         imports.imports(),
+		BuildConstraint: negateConstraint(expr).String(),
+		ServiceName:     service.GoName,
+		Tags:            expr.String(),
+		TypedResponses:  typedResponses,
+		Methods:         fallbackMethods,
+	}
+	executeTemplate(g, fallbackTemplate, params)
+
+	genNotificationSources(g, fallbackMethods)
+	genFacadeMethods(g, fallbackMethods)
+	genCompatShims(g, compat, fallbackMethods)
+	if serviceInterface {
+		genServiceInterface(g, service.GoName, fallbackMethods)
+	}
+}
+
+// genServiceInterface adds the interface of the API functions of the service,
+// together with its default implementation calling them.
+func genServiceInterface(g *protogen.GeneratedFile, serviceName string,
+	methods []rpcParams) {
+
+	params := serviceInterfaceParams{
+		ServiceName: serviceName,
+		Methods:     methods,
+	}
+	executeTemplate(g, serviceInterfaceTemplate, params)
+}
+
+// genFacadeMethods registers all methods whose API functions are unexported
+// with the facade. Nothing is created if there are none.
+func genFacadeMethods(g *protogen.GeneratedFile, methods []rpcParams) {
+	var facade []rpcParams
+	for _, m := range methods {
+		if m.Facade {
+			facade = append(facade, m)
+		}
+	}
+	if len(facade) == 0 {
+		return
+	}
+
+	executeTemplate(g, facadeMethodsTemplate, facade)
+}
+
+// genNotificationSources registers all methods that are notification sources
+// with the notification demultiplexer. Nothing is created if there are none.
+func genNotificationSources(g *protogen.GeneratedFile, methods []rpcParams) {
+	var sources []rpcParams
+	for _, m := range methods {
+		if m.Notification {
+			sources = append(sources, m)
+		}
+	}
+	if len(sources) == 0 {
+		return
+	}
+
+	executeTemplate(g, notificationSourcesTemplate, sources)
+}
+
+// parseBuildTags parses the build constraint lines of buildTags, combining
+// several lines with a logical and. Nil is returned if there are none.
+func parseBuildTags(buildTags string) constraint.Expr {
+	var expr constraint.Expr
+	for _, line := range strings.Split(buildTags, "\n") {
+		line = strings.TrimSpace(line)
+		if !constraint.IsGoBuild(line) && !constraint.IsPlusBuild(line) {
+			continue
+		}
+
+		e, err := constraint.Parse(line)
+		if err != nil {
+			log.Fatalf("invalid build tags %q: %v", line, err)
+		}
+
+		if expr == nil {
+			expr = e
+		} else {
+			expr = &constraint.AndExpr{X: expr, Y: e}
+		}
+	}
+
+	return expr
+}
+
+// negateConstraint returns the negation of the given build constraint, avoiding
+// double negations which are rejected by the go tool.
+func negateConstraint(expr constraint.Expr) constraint.Expr {
+	if not, ok := expr.(*constraint.NotExpr); ok {
+		return not.X
+	}
+
+	return &constraint.NotExpr{X: expr}
+}
+
+// findMethod returns the method with the given Go name of the service.
+func findMethod(service *protogen.Service, name string) *protogen.Method {
+	for _, method := range service.Methods {
+		if method.GoName == name {
+			return method
+		}
+	}
+
+	log.Fatalf("method %s not found in service %s", name, service.GoName)
+	return nil
+}
+
+func genJSStubs(gen *protogen.Plugin, file *protogen.File,
+	param map[string]string, changes *changeFilter) {
+
+	// We need package_name and target_package in order to continue.
+	pkg := param["package_name"]
+	if pkg == "" {
+		log.Fatal("package name not set")
+	}
+
+	// Services can be generated into their own package. The mapping
+	// comes in the following format:
+	// service_packages=[service1=pkg1 service2=pkg2]
+	servicePackages := split(param["service_packages"], " ")
+
+	// For each service, we'll create a file with the generated API.
+	fileParam := param
+	for _, service := range file.Services {
+		if !changes.serviceChanged(file, service, fileParam) {
+			continue
+		}
+
+		// Apply any parameter overrides for this service.
+		param := serviceOverrides(fileParam, service)
+
+		buildTag := pruneBuildTags(
+			service, param, modeBuildTags(param, "js"),
+		)
+		manualImport := param["manual_import"]
+		importAliases := split(param["import_aliases"], " ")
+		importRewrites := split(param["import_rewrites"], " ")
+
+		name := service.GoName
+		n := strings.ToLower(name)
+
+		// By default, the stubs are generated into the proto's own
+		// package, so types from it don't need to be imported. If the
+		// service has its own package, the stubs are put into a
+		// directory of that name and import the proto's package.
+		var (
+			dir        = "./"
+			imports    = newGoImports(pkg, importAliases, importRewrites)
+			outPkg     = servicePackages[n]
+			targetName string
+		)
+		if outPkg == "" {
+			imports.pkgPath = file.GoImportPath
+		} else {
+			dir = "./" + outPkg + "/"
+			imports = newGoImports(
+				outPkg, importAliases, importRewrites,
+			)
+			targetName = imports.add(string(file.GoImportPath))
+		}
+		if manualImport != "" {
+			imports.add(manualImport)
+		}
+		filename := outDir(param, service, dir) + n + ".pb.json.go"
+		g := gen.NewGeneratedFile(filename, file.GoImportPath)
+
+		// Create the file header.
+		params := jsHeaderParams{
+			ToolName:         versionString,
+			FileName:         file.Proto.GetName(),
+			ServiceName:      name,
+			Package:          pkg,
+			OutputPackage:    outPkg,
+			BuildTag:         buildTag,
+			TypedResponses:   param["typed_responses"] == "1",
+			GzipJSON:         param["gzip_json"] == "1",
+			CamelCaseAliases: param["js_camel_case"] == "1",
+			ErrorContext:     param["error_context"] == "1",
+			Timeouts:         param["js_timeouts"] == "1",
+			DiscardUnknown:   param["json_unknown_fields"] == "discard",
+		}
+		// The defaults of request fields come in the following
+		// format, in addition to those set with the
+		// (falafel.request_default) option:
+		// request_defaults=[Message1.field1=value1 Message2.field2=value2]
+		requestDefaults := strings.Fields(param["request_defaults"])
+
+		// The field masks of streaming methods come in the following
+		// format, listing each path of a method separately:
+		// stream_field_masks=[Method1=path1 Method1=path2 Service.Method2=path3]
+		fieldMasks := strings.Fields(param["stream_field_masks"])
+
+		// The methods whose payloads are compressed come in the
+		// following format:
+		// compressed_methods=[Service1.Method1 Method2]
+		compressedMethods := strings.Fields(param["compressed_methods"])
+
+		// The required fields of requests come in the following
+		// format, in addition to those marked with the
+		// (falafel.required) option:
+		// required_fields=[Message1.field1 Message2.field2]
+		requestBuilders := param["json_request_builders"] == "1"
+		requiredFields := strings.Fields(param["required_fields"])
+
+		// Unknown fields of the JSON requests are either rejected, as
+		// by default, or discarded.
+		switch param["json_unknown_fields"] {
+		case "", "reject", "discard":
+
+		default:
+			log.Fatalf("invalid json_unknown_fields %s",
+				param["json_unknown_fields"])
+		}
+
+		framing := param["json_stream_framing"]
+		switch framing {
+		case "", "ndjson", "length_prefixed":
+
+		default:
+			log.Fatalf("invalid json_stream_framing %s",
+				param["json_stream_framing"])
+		}
+
+		// Empty lists and maps of responses are either emitted or
+		// omitted. Setting either also drops the null elements of lists
+		// and maps of requests.
+		emptyLists := param["json_empty_lists"]
+		switch emptyLists {
+		case "", "emit", "omit":
+
+		default:
+			log.Fatalf("invalid json_empty_lists %s", emptyLists)
+		}
+
+		// Times of responses are given either as RFC 3339 strings or
+		// as unix seconds.
+		times := param["json_times"]
+		switch times {
+		case "", "rfc3339", "epoch":
+
+		default:
+			log.Fatalf("invalid json_times %s", times)
+		}
+
+		// The requests and responses are converted by the shared JSON
+		// helpers if they apply codecs, normalize lists or convert
+		// times.
+		jsonCodecs := param["json_codecs"] == "1" || emptyLists != "" ||
+			times != ""
+
+		// Go through each method defined by the service and call the
+		// appropriate template.
+		for _, method := range orderMethods(
+			includedMethods(service, param), param,
+		) {
+			methodName := method.GoName
+
+			// If the input comes from an outside package, it is added
+			// to the imports and prefixed with the package's name.
+			inputType := imports.typeName(method.Input.GoIdent)
+
+			p := jsRpcParams{
+				MethodName:  methodName,
+				FullMethod:  fullMethodName(method),
+				ServiceName: service.GoName,
+				TargetName:  targetName,
+				RequestType: inputType,
+				GzipJSON:    params.GzipJSON,
+				JSONCodecs:  jsonCodecs,
+
+				StreamFraming: framing,
+				Defaults: detectRequestDefaults(
+					method.Input, requestDefaults, imports,
+				),
+				FieldMask: streamFieldMask(method, fieldMasks),
+				Compressor: compressor(
+					method, compressedMethods, imports,
+				),
+			}
+
+			// The required fields are only checked by the request
+			// builders.
+			if requestBuilders {
+				p.RequiredFields = detectRequiredFields(
+					method.Input, requiredFields,
+				)
+			}
+
+			// The response type is only referenced by the typed
+			// response helpers, so we only import it if needed.
+			if params.TypedResponses {
+				p.ResponseType = imports.typeName(
+					method.Output.GoIdent,
+				)
+			}
+
+			clientStream := method.Desc.IsStreamingClient()
+			serverStream := method.Desc.IsStreamingServer()
+
+			if serverStream {
+				p.ResponseStreaming = true
+			}
+
+			// Methods sending a stream of requests are registered
+			// separately, if requested.
+			if clientStream {
+				if param["js_client_streams"] == "1" {
+					params.SendStreamMethods = append(
+						params.SendStreamMethods, p,
+					)
+					if !serverStream {
+						params.ClientStreams = true
+					}
+				}
 				continue
 			}
 
 			params.Methods = append(params.Methods, p)
+
+			// The framing helpers are only needed by services with
+			// streams.
+			if serverStream {
+				params.StreamFraming = framing
+			}
+			if len(p.FieldMask) > 0 {
+				params.FieldMasks = true
+			}
 		}
+		params.Imports = imports.imports()
 
-		if err := jsTemplate.Execute(g, params); err != nil {
-			log.Fatal(err)
+		// The requests of all registered methods can be built with
+		// the request builders, if requested.
+		if requestBuilders {
+			params.BuilderMethods = append(
+				params.BuilderMethods, params.Methods...,
+			)
+			params.BuilderMethods = append(
+				params.BuilderMethods, params.SendStreamMethods...,
+			)
+		}
+		for _, m := range params.BuilderMethods {
+			if len(m.RequiredFields) > 0 {
+				params.RequiredFields = true
+			}
 		}
 
+		executeTemplate(g, jsTemplate, params)
+
 		// Run goimports on the generated file.
 		cmd := exec.Command("goimports", "-w", filename)
 		if err := cmd.Run(); err != nil {
 			log.Fatal("failed to run goimports: %w", err)
 		}
+
+		// Describe the streaming methods in an AsyncAPI document if
+		// requested.
+		if param["asyncapi"] == "1" {
+			genAsyncAPI(gen, file, service, pkg, param)
+		}
+
+		// Declare the JSON requests and responses for TypeScript
+		// consumers if requested.
+		if param["ts_definitions"] == "1" {
+			genTSDefinitions(gen, file, service, pkg, param)
+		}
+	}
+}
+
+// genMemRPCFiles creates the in-memory grpc definitions for the proto files
+// with mem_rpc=1. As all of them are created in the package_name package, the
+// definitions are only created once, declaring the listeners of all files.
+func genMemRPCFiles(gen *protogen.Plugin, param map[string]string) {
+	var (
+		first    *protogen.File
+		memParam map[string]string
+		added    = make(map[string]struct{})
+	)
+	for _, f := range gen.Files {
+		if !f.Generate {
+			continue
+		}
+
+		param := fileParams(param, f)
+		if param["mem_rpc"] != "1" {
+			continue
+		}
+
+		// The definitions of different packages would be created in
+		// the same files, so only one package is supported per run.
+		if first == nil {
+			first, memParam = f, param
+		} else if param["package_name"] != memParam["package_name"] {
+			log.Fatalf("mem_rpc is set for packages %s and %s, but "+
+				"only one package is supported per run",
+				memParam["package_name"], param["package_name"])
+		}
+
+		// Further split the listener params by service name. They
+		// come in the following format:
+		// listeners=[service1=lis1 service2=lis2]
+		for _, listener := range split(param["listeners"], " ") {
+			added[listener] = struct{}{}
+		}
+	}
+	if first == nil {
+		return
+	}
+
+	// Each listener is only declared once, even if it serves multiple
+	// services or is listed by multiple files. The listeners are sorted,
+	// so the output doesn't depend on the order of the files.
+	listeners := make([]string, 0, len(added))
+	for listener := range added {
+		listeners = append(listeners, listener)
 	}
+	sort.Strings(listeners)
+
+	genMemRPC(gen, first, memParam, listeners)
 }
 
 func genMemRPC(gen *protogen.Plugin, file *protogen.File,
-	param map[string]string) {
+	param map[string]string, listeners []string) {
 
 	// We need package_name and target_package in order to continue.
 	pkg := param["package_name"]
@@ -378,50 +1570,482 @@ func genMemRPC(gen *protogen.Plugin, file *protogen.File,
 		log.Fatal("package name not set")
 	}
 
-	// Further split the listener params by service name. They come in the
-	// following format:
-	// listeners=[service1=lis1 service2=lis2]
-	lis := param["listeners"]
-	listeners := split(lis, " ")
+	memTags := modeBuildTags(param, "mem_rpc")
 
-	var (
-		usedListeners []string
-		added         = make(map[string]struct{})
-	)
-	for _, listener := range listeners {
-		// Skip listeners already added to the slice, to avoid
-		// the definitions being created multiple times.
-		if _, ok := added[listener]; ok {
-			continue
-		}
-		usedListeners = append(usedListeners, listener)
-		added[listener] = struct{}{}
+	switch delivery := param["stream_delivery"]; delivery {
+	case "", "ordered", "concurrent":
+
+	default:
+		log.Fatalf("invalid stream_delivery %s", delivery)
+	}
+
+	// The plumbing can be written against older or the latest grpc-go
+	// APIs, for the projects pinning them.
+	grpcCompat := param["grpc_compat"]
+	switch grpcCompat {
+	case "", "legacy", "latest":
+
+	default:
+		log.Fatalf("invalid grpc_compat %s", grpcCompat)
 	}
 
 	// Create memrpc_generated.go file
 	filename := "./memrpc_generated.go"
 	g := gen.NewGeneratedFile(filename, file.GoImportPath)
 	p := memRpcParams{
-		ToolName: versionString,
-		Package:  pkg,
+		ToolName:           versionString,
+		Package:            pkg,
+		BuildTag:           memTags,
+		SerializationHooks: param["serialization_hooks"] == "1",
+		FaultInjection:     param["fault_injection"] == "1",
+		Throttling:         param["throttling"] == "1",
+		Pagination:         hasServiceOption(gen, param, "pagination_helpers"),
+		PaymentTracking:    hasServiceOption(gen, param, "payment_tracking"),
+		InitialResponse:    hasServiceOption(gen, param, "initial_response"),
+		PprofLabels:        param["pprof_labels"] == "1",
+		CallDraining:       param["call_draining"] == "1",
+		StreamBuffer:       param["stream_buffer"] == "1",
+		ErrorContext:       param["error_context"] == "1",
+		StreamTransforms:   hasServiceOption(gen, param, "stream_transforms"),
+		StreamBackpressure: hasServiceOption(gen, param, "stream_backpressure"),
+		RequestErrors:      param["request_errors"] == "1",
+		CallbackDispatcher: param["callback_dispatcher"] == "1",
+		StreamDelivery:     param["stream_delivery"],
+		UsageStats:         param["usage_stats"] == "1",
+		OpenMetrics:        param["openmetrics"] == "1",
+		StreamStats:        param["stream_stats"] == "1",
+		ClientStreams:      hasClientStreams(gen),
+		Tasks:              hasServiceOption(gen, param, "tasks"),
+		StreamHeartbeats:   param["stream_heartbeats"] == "1",
+		GenCallbacks:       param["gen_callbacks"] == "1",
+		JSONEncoding:       param["json_encoding"] == "1",
+		DiscardUnknown:     param["json_unknown_fields"] == "discard",
+		GRPCCompat:         grpcCompat,
 	}
-	if err := memRpcTemplate.Execute(g, p); err != nil {
-		log.Fatal(err)
+
+	// If requested, the plumbing is imported from the shared runtime
+	// package instead of being generated inline. The runtime doesn't
+	// support all options that alter the plumbing, so we bail out if any
+	// of them is set.
+	memTemplate := memRpcTemplate
+	if param["use_runtime"] == "1" {
+		for _, opt := range runtimeUnsupported {
+			if param[opt] != "" && param[opt] != "0" {
+				log.Fatalf("option %s is not supported together "+
+					"with use_runtime", opt)
+			}
+		}
+		memTemplate = memRpcRuntimeTemplate
+	}
+	executeTemplate(g, memTemplate, p)
+
+	// The listeners are buffer listeners by default, but can be replaced
+	// by pipe listeners or abstract unix sockets, e.g. if the buffer
+	// listeners don't play well with the threading of the platform.
+	transport := param["mem_transport"]
+	switch transport {
+	case "":
+		transport = "bufconn"
+
+	case "bufconn", "pipe", "unix":
+
+	default:
+		log.Fatalf("invalid mem_transport %s", transport)
 	}
 
 	// Create listeners_generated.go file
 	lisFilename := "./listeners_generated.go"
 	lisG := gen.NewGeneratedFile(lisFilename, file.GoImportPath)
 	lisp := listenersParams{
-		ToolName:  versionString,
-		Package:   pkg,
-		Listeners: usedListeners,
+		ToolName:      versionString,
+		Package:       pkg,
+		BuildTag:      memTags,
+		Listeners:     listeners,
+		Transport:     transport,
+		ServiceGating: param["service_gating"] == "1",
+		CallDraining:  param["call_draining"] == "1",
+		UseRuntime:    param["use_runtime"] == "1",
+
+		SerializedMethods: hasMarkedMethods(
+			gen, param, "serialized_methods", serializedOption,
+		),
+		ProgressMethods: hasMarkedMethods(
+			gen, param, "progress_methods", progressOption,
+		),
+		WithContext:   hasServiceOption(gen, param, "with_context"),
+		CallTimeouts:  hasServiceOption(gen, param, "call_timeout_param"),
+		StreamHandles: hasServiceOption(gen, param, "stream_handles"),
+
+		GlobalMetadata: param["global_metadata"] == "1",
+		ConnPool:       param["conn_pool"] == "1",
+
+		MetadataProvider:   param["metadata_provider"] == "1",
+		DialOptions:        param["dial_options"] == "1",
+		ConnectionObserver: param["connection_observer"] == "1",
+		ServerInterceptors: param["server_interceptors"] == "1",
+		GRPCCompat:         grpcCompat,
 	}
-	if err := listenersTemplate.Execute(lisG, lisp); err != nil {
-		log.Fatal(err)
+	executeTemplate(lisG, listenersTemplate, lisp)
+
+	// Create longpoll_generated.go file holding the stream ID registry
+	// used by the long-poll adapters.
+	if hasServiceOption(gen, param, "long_poll") {
+		pollFilename := "./longpoll_generated.go"
+		pollG := gen.NewGeneratedFile(pollFilename, file.GoImportPath)
+		pollp := longPollRegistryParams{
+			ToolName: versionString,
+			Package:  pkg,
+			BuildTag: memTags,
+		}
+		executeTemplate(pollG, longPollRegistryTemplate, pollp)
+	}
+
+	// Create lifecycle_generated.go file holding the helper starting the
+	// embedded node on the first call.
+	if param["lifecycle"] == "1" {
+		readyService := param["lifecycle_ready"]
+		if readyService != "" && !generatesService(gen, readyService) {
+			log.Fatalf("lifecycle_ready service %s not found",
+				readyService)
+		}
+
+		lifeFilename := "./lifecycle_generated.go"
+		lifeG := gen.NewGeneratedFile(lifeFilename, file.GoImportPath)
+		lifep := lifecycleParams{
+			ToolName:     versionString,
+			Package:      pkg,
+			BuildTag:     memTags,
+			ReadyService: readyService,
+			StateGating:  param["state_gating"] != "",
+			GRPCCompat:   grpcCompat,
+		}
+		executeTemplate(lifeG, lifecycleTemplate, lifep)
+	}
+
+	// Create unlock_generated.go file holding the helper unlocking the
+	// wallet and waiting for the RPC server if requested.
+	if param["unlock_helper"] == "1" {
+		genUnlockHelper(
+			gen, file, pkg, memTags,
+			split(param["import_aliases"], " "),
+			split(param["import_rewrites"], " "),
+		)
+	}
+
+	// Create stategating_generated.go file holding the check gating
+	// calls on the RPC server being active if requested.
+	if param["state_gating"] != "" {
+		genStateGating(
+			gen, file, pkg, memTags, param["state_gating"], param,
+		)
+	}
+
+	// Create preview_generated.go file holding the helpers rendering
+	// previews of the messages for logging if requested.
+	if param["message_preview"] == "1" {
+		genPreview(gen, file, pkg, memTags)
+	}
+
+	// Create method_types_generated.go file holding the registry of the
+	// request and response types of the methods if requested.
+	if param["type_registry"] == "1" {
+		typesFilename := "./method_types_generated.go"
+		typesG := gen.NewGeneratedFile(typesFilename, file.GoImportPath)
+		typesp := typeRegistryParams{
+			ToolName: versionString,
+			Package:  pkg,
+			BuildTag: memTags,
+		}
+		executeTemplate(typesG, typeRegistryTemplate, typesp)
+	}
+
+	// Create storage_generated.go file holding the interface of the
+	// storage implemented by the host if requested.
+	if param["storage"] == "1" {
+		storageFilename := "./storage_generated.go"
+		storageG := gen.NewGeneratedFile(
+			storageFilename, file.GoImportPath,
+		)
+		storagep := storageParams{
+			ToolName: versionString,
+			Package:  pkg,
+			BuildTag: memTags,
+		}
+		executeTemplate(storageG, storageTemplate, storagep)
+	}
+
+	// Create grpcweb_generated.go file holding the plumbing of the
+	// gRPC-Web handlers.
+	if hasServiceOption(gen, param, "grpc_web") {
+		genGRPCWeb(gen, file, pkg, memTags)
+	}
+
+	// Create rest_generated.go file holding the router plumbing of the
+	// REST handlers.
+	if hasServiceOption(gen, param, "rest_gateway") {
+		genREST(gen, file, pkg, memTags, param)
+	}
+
+	// Create notifications_generated.go file holding the demultiplexer
+	// the subscriptions are registered with.
+	if hasServiceOption(gen, param, "unexported_api") {
+		facadeFilename := "./facade_generated.go"
+		facadeG := gen.NewGeneratedFile(facadeFilename, file.GoImportPath)
+		facadep := facadeParams{
+			ToolName: versionString,
+			Package:  pkg,
+			BuildTag: memTags,
+		}
+		executeTemplate(facadeG, facadeTemplate, facadep)
+	}
+
+	if hasServiceOption(gen, param, "notifications") {
+		notifFilename := "./notifications_generated.go"
+		notifG := gen.NewGeneratedFile(notifFilename, file.GoImportPath)
+		notifp := notificationsParams{
+			ToolName: versionString,
+			Package:  pkg,
+			BuildTag: memTags,
+		}
+		executeTemplate(notifG, notificationsTemplate, notifp)
 	}
 }
 
+// generatesService returns true if a service with the given name is generated
+// in this run.
+func generatesService(gen *protogen.Plugin, name string) bool {
+	for _, f := range gen.Files {
+		if !f.Generate {
+			continue
+		}
+
+		for _, service := range f.Services {
+			if service.GoName == name {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// hasMarkedMethods returns true if any method generated in this run is listed
+// in the given list option, e.g. serialized_methods, or is marked with the
+// boolean falafel method option with the given field number.
+func hasMarkedMethods(gen *protogen.Plugin, param map[string]string,
+	list string, option protowire.Number) bool {
+
+	for _, f := range gen.Files {
+		if !f.Generate {
+			continue
+		}
+
+		fileParam := fileParams(param, f)
+		for _, service := range f.Services {
+			listed := strings.Fields(serviceOverrides(
+				fileParam, service,
+			)[list])
+			for _, method := range service.Methods {
+				if listsMethod(listed, method) ||
+					methodBoolOption(method, option) {
+
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// hasServiceOption returns whether the option is set for any service generated
+// in this run, taking the overrides of the files and services into account.
+func hasServiceOption(gen *protogen.Plugin, param map[string]string,
+	option string) bool {
+
+	for _, f := range gen.Files {
+		if !f.Generate {
+			continue
+		}
+
+		fileParam := fileParams(param, f)
+		for _, service := range f.Services {
+			value := serviceOverrides(fileParam, service)[option]
+			if value != "" && value != "0" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// hasClientStreams returns whether any service generated in this run has
+// client-streaming methods that aren't bidirectional.
+func hasClientStreams(gen *protogen.Plugin) bool {
+	for _, f := range gen.Files {
+		if !f.Generate {
+			continue
+		}
+
+		for _, service := range f.Services {
+			for _, method := range service.Methods {
+				if method.Desc.IsStreamingClient() &&
+					!method.Desc.IsStreamingServer() {
+
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// genCallbacks creates the Callback, RecvStream and SendStream interfaces
+// implemented by the callers of the mobile APIs. They are tagged like the
+// mobile APIs, and are left out of the in-memory RPC plumbing.
+func genCallbacks(gen *protogen.Plugin, file *protogen.File,
+	param map[string]string) {
+
+	pkg := param["package_name"]
+	if pkg == "" {
+		log.Fatal("package name not set")
+	}
+
+	g := gen.NewGeneratedFile("./callbacks_generated.go", file.GoImportPath)
+	p := callbacksParams{
+		ToolName: versionString,
+		Package:  pkg,
+		BuildTag: modeBuildTags(param, "mobile"),
+	}
+	executeTemplate(g, callbacksTemplate, p)
+}
+
+func genPermissions(gen *protogen.Plugin, file *protogen.File,
+	param map[string]string, changes *changeFilter) {
+
+	pkg := param["package_name"]
+	if pkg == "" {
+		log.Fatal("package name not set")
+	}
+
+	// For each service, we'll create a file with the permission map.
+	for _, service := range file.Services {
+		if !changes.serviceChanged(file, service, param) {
+			continue
+		}
+
+		params := permissionsParams{
+			ToolName:    versionString,
+			FileName:    file.Proto.GetName(),
+			Package:     pkg,
+			ServiceName: service.GoName,
+		}
+
+		// The permissions of each method are taken from the falafel
+		// permissions option, if set.
+		for _, method := range orderMethods(service.Methods, param) {
+			m := methodPermissions{
+				FullMethod: fullMethodName(method),
+			}
+
+			perms := methodStringOptions(method, permissionsOption)
+			for _, perm := range perms {
+				entity, action, ok := strings.Cut(perm, ":")
+				if !ok {
+					log.Fatalf("invalid permission %q of "+
+						"method %s, expected "+
+						"entity:action", perm,
+						m.FullMethod)
+				}
+
+				m.Ops = append(m.Ops, permissionOp{
+					Entity: entity,
+					Action: action,
+				})
+			}
+
+			params.Methods = append(params.Methods, m)
+		}
+
+		n := strings.ToLower(service.GoName)
+		filename := outDir(param, service, "./") + n +
+			"_permissions_generated.go"
+		g := gen.NewGeneratedFile(filename, file.GoImportPath)
+		executeTemplate(g, permissionsTemplate, params)
+	}
+}
+
+// listsMethod returns true if the given method is contained in the list, either
+// by its name or qualified with its service as Service.Method.
+func listsMethod(list []string, method *protogen.Method) bool {
+	qualified := method.Parent.GoName + "." + method.GoName
+	for _, name := range list {
+		if name == method.GoName || name == qualified {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compressor returns the name the gzip compressor of gRPC is imported as if the
+// method is contained in the list of methods whose payloads are compressed,
+// adding it to the imports, or an empty string otherwise. Importing the
+// compressor registers it, so the server compresses its responses as well.
+func compressor(method *protogen.Method, compressed []string,
+	imports *goImports) string {
+
+	if !listsMethod(compressed, method) {
+		return ""
+	}
+
+	return imports.add("google.golang.org/grpc/encoding/gzip")
+}
+
+// orderMethods returns the methods in the order they should be generated in.
+// By default this is the order of the proto file, with method_order=alpha they
+// are sorted by name instead. With group_streaming=1, the streaming methods
+// are moved after all unary methods.
+func orderMethods(methods []*protogen.Method,
+	param map[string]string) []*protogen.Method {
+
+	ordered := make([]*protogen.Method, len(methods))
+	copy(ordered, methods)
+
+	switch param["method_order"] {
+	case "", "proto":
+
+	case "alpha":
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].GoName < ordered[j].GoName
+		})
+
+	default:
+		log.Fatalf("unknown method order %s", param["method_order"])
+	}
+
+	if param["group_streaming"] == "1" {
+		isStreaming := func(m *protogen.Method) bool {
+			return m.Desc.IsStreamingClient() ||
+				m.Desc.IsStreamingServer()
+		}
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return !isStreaming(ordered[i]) && isStreaming(ordered[j])
+		})
+	}
+
+	return ordered
+}
+
+// fullMethodName returns the full gRPC method name of the given method, in the
+// form /package.Service/Method.
+func fullMethodName(method *protogen.Method) string {
+	return fmt.Sprintf("/%s/%s", method.Parent.Desc.FullName(),
+		method.Desc.Name())
+}
+
 func split(parameter string, c string) map[string]string {
 	param := make(map[string]string)
 	if parameter == "" {
@@ -458,3 +2082,25 @@ func upperCase(s string) string {
 
 	return strings.ToUpper(s[:1]) + s[1:]
 }
+
+// lowerCamel returns the lowerCamel name of the exported Go name, as gomobile
+// names the methods of the Java bindings. A leading initialism is lowercased as
+// a whole, e.g. RPCServer becomes rpcServer and URL becomes url.
+func lowerCamel(name string) string {
+	runes := []rune(name)
+	upper := 0
+	for upper < len(runes) && unicode.IsUpper(runes[upper]) {
+		upper++
+	}
+
+	// The last upper-case letter of an initialism followed by a word
+	// starts that word.
+	if upper > 1 && upper < len(runes) {
+		upper--
+	}
+	for i := 0; i < upper; i++ {
+		runes[i] = unicode.ToLower(runes[i])
+	}
+
+	return string(runes)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"log"
+
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// The field numbers of the method options defined in falafelpb/falafel.proto.
+const (
+	permissionsOption protowire.Number = 50001
+	serializedOption  protowire.Number = 50002
+	progressOption    protowire.Number = 50003
+)
+
+// The field numbers of the field options defined in falafelpb/falafel.proto.
+const (
+	requestDefaultOption protowire.Number = 50001
+	requiredOption       protowire.Number = 50002
+)
+
+// methodStringOptions returns all string values of the falafel method option
+// with the given field number.
+func methodStringOptions(method *protogen.Method,
+	num protowire.Number) []string {
+
+	return stringOptions(method.Desc, num)
+}
+
+// methodBoolOption returns the value of the boolean falafel method option with
+// the given field number, or false if it isn't set.
+func methodBoolOption(method *protogen.Method, num protowire.Number) bool {
+	return boolOption(method.Desc, num)
+}
+
+// fieldBoolOption returns the value of the boolean falafel field option with
+// the given field number, or false if it isn't set.
+func fieldBoolOption(field *protogen.Field, num protowire.Number) bool {
+	return boolOption(field.Desc, num)
+}
+
+// boolOption returns the value of the boolean falafel option with the given
+// field number set on the descriptor, or false if it isn't set.
+func boolOption(desc protoreflect.Descriptor, num protowire.Number) bool {
+	var value bool
+	rangeOptions(desc, func(fieldNum protowire.Number,
+		wireType protowire.Type, b []byte) {
+
+		if fieldNum != num || wireType != protowire.VarintType {
+			return
+		}
+
+		v, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			log.Fatalf("invalid options of %s: %v",
+				desc.FullName(), protowire.ParseError(n))
+		}
+		value = v != 0
+	})
+
+	return value
+}
+
+// fieldStringOption returns the value of the string falafel field option with
+// the given field number, and whether it is set.
+func fieldStringOption(field *protogen.Field,
+	num protowire.Number) (string, bool) {
+
+	values := stringOptions(field.Desc, num)
+	if len(values) == 0 {
+		return "", false
+	}
+
+	// As for any non-repeated field, the last value wins.
+	return values[len(values)-1], true
+}
+
+// stringOptions returns all string values of the falafel option with the given
+// field number set on the descriptor.
+func stringOptions(desc protoreflect.Descriptor,
+	num protowire.Number) []string {
+
+	var values []string
+	rangeOptions(desc, func(fieldNum protowire.Number,
+		wireType protowire.Type, b []byte) {
+
+		if fieldNum != num || wireType != protowire.BytesType {
+			return
+		}
+
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			log.Fatalf("invalid options of %s: %v",
+				desc.FullName(), protowire.ParseError(n))
+		}
+		values = append(values, string(v))
+	})
+
+	return values
+}
+
+// rangeOptions calls f with the number, wire type and encoded value of every
+// unknown field of the descriptor's options. As the falafel options are
+// extensions that are not registered with the plugin, they are read from the
+// unknown fields.
+func rangeOptions(desc protoreflect.Descriptor,
+	f func(protowire.Number, protowire.Type, []byte)) {
+
+	opts := desc.Options()
+	if opts == nil {
+		return
+	}
+
+	rangeFields(desc, opts.ProtoReflect().GetUnknown(), f)
+}
+
+// rangeFields calls f with the number, wire type and encoded value of every
+// field of the encoded message b, which is part of the options of desc.
+func rangeFields(desc protoreflect.Descriptor, b []byte,
+	f func(protowire.Number, protowire.Type, []byte)) {
+
+	for len(b) > 0 {
+		fieldNum, wireType, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			log.Fatalf("invalid options of %s: %v",
+				desc.FullName(), protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		n = protowire.ConsumeFieldValue(fieldNum, wireType, b)
+		if n < 0 {
+			log.Fatalf("invalid options of %s: %v",
+				desc.FullName(), protowire.ParseError(n))
+		}
+		f(fieldNum, wireType, b[:n])
+		b = b[n:]
+	}
+}
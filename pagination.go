@@ -0,0 +1,99 @@
+package main
+
+import (
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// paginationParams holds the Go names of the fields used to page through the
+// results of a list-style RPC.
+type paginationParams struct {
+	// Offset is the request field holding the offset to start at.
+	Offset string
+
+	// NextOffset is the response field holding the offset of the last
+	// returned result, which is where the next page starts.
+	NextOffset string
+
+	// PrevOffset is the response field holding the offset of the first
+	// returned result, used instead of NextOffset when paging backwards.
+	// It is empty if the response has no such field.
+	PrevOffset string
+
+	// Reversed is the request field indicating that the results are
+	// paged backwards. It is empty if the request has no such field.
+	Reversed string
+
+	// Results is the repeated response field holding the results.
+	Results string
+}
+
+// detectPagination checks whether the given unary method is a list-style RPC
+// that can be paged through, as for example ListPayments or ListInvoices in
+// lnd. These have an index_offset field in their request and return the
+// offset of the last result in their response. Nil is returned if the method
+// doesn't follow this pattern.
+func detectPagination(method *protogen.Method) *paginationParams {
+	if method.Desc.IsStreamingClient() || method.Desc.IsStreamingServer() {
+		return nil
+	}
+
+	offset := findField(method.Input, "index_offset")
+	if offset == nil {
+		return nil
+	}
+
+	next := findField(method.Output, "last_index_offset", "last_offset_index")
+	if next == nil || next.Desc.Kind() != offset.Desc.Kind() {
+		return nil
+	}
+
+	// The results are the first repeated field of the response.
+	var results *protogen.Field
+	for _, field := range method.Output.Fields {
+		if field.Desc.IsList() {
+			results = field
+			break
+		}
+	}
+	if results == nil {
+		return nil
+	}
+
+	p := &paginationParams{
+		Offset:     offset.GoName,
+		NextOffset: next.GoName,
+		Results:    results.GoName,
+	}
+
+	// If the results can be paged backwards, we need to continue at the
+	// first offset instead.
+	reversed := findField(method.Input, "reversed")
+	prev := findField(
+		method.Output, "first_index_offset", "first_offset_index",
+	)
+	if reversed != nil && reversed.Desc.Kind() == protoreflect.BoolKind &&
+		prev != nil && prev.Desc.Kind() == offset.Desc.Kind() {
+
+		p.Reversed = reversed.GoName
+		p.PrevOffset = prev.GoName
+	}
+
+	return p
+}
+
+// findField returns the first non-repeated field of the message with one of
+// the given names, or nil if there is none.
+func findField(msg *protogen.Message, names ...string) *protogen.Field {
+	for _, name := range names {
+		for _, field := range msg.Fields {
+			if string(field.Desc.Name()) == name &&
+				!field.Desc.IsList() && !field.Desc.IsMap() {
+
+				return field
+			}
+		}
+	}
+
+	return nil
+}
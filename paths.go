@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/pluginpb"
+)
+
+// outDir returns the directory the files of the service are created in,
+// relative to the output directory and ending with a slash. It is given by
+// the service's entry in out_dir, falling back to defaultDir if it has none.
+// The entries come in the following format:
+// out_dir=[service1=./dir1 service2=./dir2]
+func outDir(param map[string]string, service *protogen.Service,
+	defaultDir string) string {
+
+	dirs := split(param["out_dir"], " ")
+	dir, ok := dirs[strings.ToLower(service.GoName)]
+	if !ok || dir == "" {
+		return defaultDir
+	}
+
+	return strings.TrimSuffix(dir, "/") + "/"
+}
+
+// runPlugin runs the plugin like protogen.Options.Run. Before the request is
+// handed to protogen, the proto files without a go_package option are mapped
+// to the import path of target_package, so they can be generated without
+// passing an M<file>=<import path> parameter for each of them.
+func runPlugin(f func(*protogen.Plugin) error) {
+	if err := run(f); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", filepath.Base(os.Args[0]), err)
+		os.Exit(1)
+	}
+}
+
+func run(f func(*protogen.Plugin) error) error {
+	if len(os.Args) > 1 {
+		return fmt.Errorf("unknown argument %q (this program should be "+
+			"run by protoc, not directly)", os.Args[1])
+	}
+
+	in, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	req := &pluginpb.CodeGeneratorRequest{}
+	if err := proto.Unmarshal(in, req); err != nil {
+		return err
+	}
+	addImportPaths(req)
+
+	gen, err := protogen.Options{}.New(req)
+	if err != nil {
+		return err
+	}
+
+	// Errors of the plugin are reported in the response, while those of
+	// the request and the I/O are reported to stderr.
+	if err := f(gen); err != nil {
+		gen.Error(err)
+	}
+
+	out, err := proto.Marshal(gen.Response())
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(out)
+
+	return err
+}
+
+// addImportPaths adds an M<file>=<import path> parameter mapping each proto
+// file without a go_package option to the import path of target_package,
+// unless the file is already mapped. Without target_package, or an explicit
+// mapping, protogen fails to determine the import path of such files.
+func addImportPaths(req *pluginpb.CodeGeneratorRequest) {
+	param := applyProfile(applyConfig(parseParams(req.GetParameter())))
+
+	targetPkg := param["target_package"]
+	if targetPkg == "" {
+		return
+	}
+
+	params := []string{req.GetParameter()}
+	for _, file := range req.GetProtoFile() {
+		if file.GetOptions().GetGoPackage() != "" {
+			continue
+		}
+		if _, ok := param["M"+file.GetName()]; ok {
+			continue
+		}
+
+		params = append(params, "M"+file.GetName()+"="+targetPkg)
+	}
+	if len(params) == 1 {
+		return
+	}
+
+	if params[0] == "" {
+		params = params[1:]
+	}
+	req.Parameter = proto.String(strings.Join(params, ","))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// paymentTrackingParams holds what is needed to re-track a payment after the
+// stream delivering its updates dropped.
+type paymentTrackingParams struct {
+	// TrackMethod is the name of the method tracking a payment by its
+	// hash.
+	TrackMethod string
+
+	// TrackRequestType is the request type of the track method.
+	TrackRequestType string
+
+	// TrackHash is the request field of the track method holding the
+	// payment hash.
+	TrackHash string
+
+	// ResponseHash is the field of the payment updates holding the
+	// payment hash.
+	ResponseHash string
+
+	// HexPkg is the name the encoding/hex package is imported as, if the
+	// payment hash of the updates is hex encoded. It is empty if the hash
+	// is delivered as bytes.
+	HexPkg string
+}
+
+// detectPaymentTracking checks whether the given method is a payment stream
+// that can be resumed by re-tracking the payment, as for example SendPaymentV2
+// and TrackPaymentV2 in lnd. This requires a TrackPayment method in the same
+// service taking the payment hash and delivering the same updates, which
+// carry the payment hash themselves. Nil is returned if the method doesn't
+// follow this pattern.
+func detectPaymentTracking(service *protogen.Service, method *protogen.Method,
+	imports *goImports) *paymentTrackingParams {
+
+	if method.Desc.IsStreamingClient() || !method.Desc.IsStreamingServer() {
+		return nil
+	}
+
+	respHash := findField(method.Output, "payment_hash")
+	if respHash == nil {
+		return nil
+	}
+
+	var hexHash bool
+	switch respHash.Desc.Kind() {
+	case protoreflect.StringKind:
+		hexHash = true
+
+	case protoreflect.BytesKind:
+
+	default:
+		return nil
+	}
+
+	for _, track := range service.Methods {
+		if !strings.HasPrefix(track.GoName, "TrackPayment") ||
+			track.Desc.IsStreamingClient() ||
+			!track.Desc.IsStreamingServer() ||
+			track.Output.Desc.FullName() != method.Output.Desc.FullName() {
+
+			continue
+		}
+
+		trackHash := findField(track.Input, "payment_hash")
+		if trackHash == nil ||
+			trackHash.Desc.Kind() != protoreflect.BytesKind {
+
+			continue
+		}
+
+		p := &paymentTrackingParams{
+			TrackMethod:      track.GoName,
+			TrackRequestType: imports.typeName(track.Input.GoIdent),
+			TrackHash:        trackHash.GoName,
+			ResponseHash:     respHash.GoName,
+		}
+		if hexHash {
+			p.HexPkg = imports.add("encoding/hex")
+		}
+
+		return p
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// previewParams holds the parameters of the helpers rendering previews of
+// messages for logging.
+type previewParams struct {
+	ToolName string
+	Package  string
+	BuildTag string
+
+	// Redacted are the full names of the fields whose values are left out
+	// of the previews.
+	Redacted []string
+}
+
+// sensitiveWords are the words of field names marking a field as holding a
+// secret, e.g. wallet_password or cipher_seed_mnemonic.
+var sensitiveWords = map[string]bool{
+	"password":   true,
+	"passphrase": true,
+	"pw":         true,
+	"seed":       true,
+	"mnemonic":   true,
+	"macaroon":   true,
+	"macaroons":  true,
+	"secret":     true,
+	"preimage":   true,
+	"xprv":       true,
+	"privkey":    true,
+}
+
+// sensitivePairs are the pairs of consecutive words of field names marking a
+// field as holding a secret, e.g. extended_master_key.
+var sensitivePairs = map[string]bool{
+	"private_key": true,
+	"priv_key":    true,
+	"master_key":  true,
+	"root_key":    true,
+}
+
+// sensitiveField returns whether the field holds a secret that must not be
+// logged, either because its debug_redact option is set or because its name
+// suggests so.
+func sensitiveField(field *protogen.Field) bool {
+	opts, ok := field.Desc.Options().(*descriptorpb.FieldOptions)
+	if ok && opts.GetDebugRedact() {
+		return true
+	}
+
+	words := strings.Split(strings.ToLower(string(field.Desc.Name())), "_")
+	for i, word := range words {
+		if sensitiveWords[word] {
+			return true
+		}
+		if i > 0 && sensitivePairs[words[i-1]+"_"+word] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// redactedFields returns the sorted full names of the sensitive fields of all
+// messages known to the plugin, including those of imported files, as they
+// may be nested in the requests and responses.
+func redactedFields(gen *protogen.Plugin) []string {
+	var (
+		redacted []string
+		walk     func([]*protogen.Message)
+	)
+	walk = func(msgs []*protogen.Message) {
+		for _, msg := range msgs {
+			for _, field := range msg.Fields {
+				if sensitiveField(field) {
+					redacted = append(
+						redacted, string(field.Desc.FullName()),
+					)
+				}
+			}
+			walk(msg.Messages)
+		}
+	}
+	for _, f := range gen.Files {
+		walk(f.Messages)
+	}
+	sort.Strings(redacted)
+
+	return redacted
+}
+
+// genPreview creates preview_generated.go, holding the helpers rendering
+// redacted, size-capped previews of the requests and responses.
+func genPreview(gen *protogen.Plugin, file *protogen.File, pkg,
+	buildTag string) {
+
+	filename := "./preview_generated.go"
+	g := gen.NewGeneratedFile(filename, file.GoImportPath)
+	p := previewParams{
+		ToolName: versionString,
+		Package:  pkg,
+		BuildTag: buildTag,
+		Redacted: redactedFields(gen),
+	}
+	executeTemplate(g, previewTemplate, p)
+}
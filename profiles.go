@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+)
+
+// profiles are the named presets of parameters needed by well-known consumers
+// of falafel, selected with profile=<name>.
+var profiles = map[string]map[string]string{
+	// lnd-mobile generates the gomobile APIs of lnd, served by the
+	// in-memory listeners of its RPC server.
+	"lnd-mobile": {
+		"package_name":   "lndmobile",
+		"target_package": "github.com/lightningnetwork/lnd/lnrpc",
+		"listeners": "lightning=lightningLis " +
+			"walletunlocker=lightningLis state=lightningLis",
+		"defaultlistener": "lightningLis",
+		"mem_rpc":         "1",
+		"api_prefix":      "1",
+	},
+
+	// lnd-wasm generates the JSON/WASM stubs of lnd's RPC packages. The
+	// package name must be set to the name of the RPC package.
+	"lnd-wasm": {
+		"js_stubs":   "1",
+		"build_tags": "//go:build js",
+	},
+
+	// loop generates the JSON/WASM stubs of loop's RPC package.
+	"loop": {
+		"package_name": "looprpc",
+		"js_stubs":     "1",
+		"build_tags":   "//go:build js",
+	},
+}
+
+// applyProfile adds the parameters of the profile selected with profile=<name>
+// to the parameters. Parameters that are set explicitly take precedence over
+// those of the profile.
+func applyProfile(param map[string]string) map[string]string {
+	name, ok := param["profile"]
+	if !ok {
+		return param
+	}
+
+	profile, ok := profiles[name]
+	if !ok {
+		names := make([]string, 0, len(profiles))
+		for name := range profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		log.Fatalf("unknown profile %s, available profiles: %s", name,
+			strings.Join(names, ", "))
+	}
+
+	for key, value := range profile {
+		if _, ok := param[key]; !ok {
+			param[key] = value
+		}
+	}
+
+	return param
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// packageFieldNumber is the field number of the package statement in
+// google.protobuf.FileDescriptorProto, locating its comments.
+const packageFieldNumber = 2
+
+// protoFile holds the file-level information of a proto file passed to the
+// header and service templates, such that overrides given with templates_dir
+// can include provenance and per-file configuration in the generated code.
+type protoFile struct {
+	// Path is the path of the proto file, e.g. lightning.proto.
+	Path string
+
+	// Package is the proto package of the file.
+	Package string
+
+	// GoPackage is the value of the file's go_package option, if set.
+	GoPackage string
+
+	// GoImportPath and GoPackageName are the Go package the messages of
+	// the file are generated into.
+	GoImportPath  string
+	GoPackageName string
+
+	// Comments are the leading comments of the package statement.
+	Comments string
+
+	// options maps the field numbers of the custom options set on the
+	// file to their values.
+	options map[int32][]string
+}
+
+// newProtoFile returns the file-level information of the proto file.
+func newProtoFile(file *protogen.File) protoFile {
+	f := protoFile{
+		Path:          file.Desc.Path(),
+		Package:       string(file.Desc.Package()),
+		GoImportPath:  string(file.GoImportPath),
+		GoPackageName: string(file.GoPackageName),
+		options:       make(map[int32][]string),
+	}
+	if opts, ok := file.Desc.Options().(*descriptorpb.FileOptions); ok {
+		f.GoPackage = opts.GetGoPackage()
+	}
+
+	loc := file.Desc.SourceLocations().ByPath(
+		protoreflect.SourcePath{packageFieldNumber},
+	)
+
+	// Each line of a comment keeps the space following the comment
+	// marker, which is stripped.
+	lines := strings.Split(strings.TrimSpace(loc.LeadingComments), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimPrefix(line, " ")
+	}
+	f.Comments = strings.Join(lines, "\n")
+
+	// Custom options are extensions not known to the plugin, so they are
+	// read from the unknown fields of the file options.
+	rangeOptions(file.Desc, func(num protowire.Number,
+		wireType protowire.Type, b []byte) {
+
+		var (
+			value string
+			n     int
+		)
+		switch wireType {
+		case protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			value = string(v)
+
+		case protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			value = strconv.FormatUint(v, 10)
+
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			value = strconv.FormatUint(uint64(v), 10)
+
+		case protowire.Fixed64Type:
+			var v uint64
+			v, n = protowire.ConsumeFixed64(b)
+			value = strconv.FormatUint(v, 10)
+
+		default:
+			return
+		}
+		if n < 0 {
+			log.Fatalf("invalid options of %s: %v", f.Path,
+				protowire.ParseError(n))
+		}
+
+		f.options[int32(num)] = append(f.options[int32(num)], value)
+	})
+
+	return f
+}
+
+// Option returns the value of the custom file option with the given field
+// number, or an empty string if it isn't set. Scalar values are formatted as
+// unsigned decimals, e.g. 1 for a true bool. As for any non-repeated field,
+// the last value wins.
+func (f protoFile) Option(num int) string {
+	values := f.options[int32(num)]
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[len(values)-1]
+}
+
+// OptionValues returns all values of the repeated custom file option with the
+// given field number.
+func (f protoFile) OptionValues(num int) []string {
+	return f.options[int32(num)]
+}
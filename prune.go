@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// unreferencedBuildTag is the build constraint the files of unreferenced
+// services are tagged with if prune_services=1 is set. As the tag is never set
+// by default, the files and the proto packages they import are left out of
+// the build.
+const unreferencedBuildTag = "//go:build falafel_unreferenced"
+
+// includedMethods returns the methods of the service the APIs are generated
+// for, i.e. all methods except those listed in exclude_methods.
+func includedMethods(service *protogen.Service,
+	param map[string]string) []*protogen.Method {
+
+	// The excluded methods come in the following format:
+	// exclude_methods=[Service1.Method1 Method2]
+	excluded := strings.Fields(param["exclude_methods"])
+
+	methods := make([]*protogen.Method, 0, len(service.Methods))
+	for _, method := range service.Methods {
+		if listsMethod(excluded, method) {
+			continue
+		}
+		methods = append(methods, method)
+	}
+
+	return methods
+}
+
+// isUnreferenced returns true if all methods of the service are excluded, so
+// none of its APIs are generated.
+func isUnreferenced(service *protogen.Service, param map[string]string) bool {
+	return len(service.Methods) > 0 &&
+		len(includedMethods(service, param)) == 0
+}
+
+// pruneBuildTags returns the build tags of the files of the service, which are
+// replaced by the unreferencedBuildTag if the service is unreferenced and
+// prune_services=1 is set.
+func pruneBuildTags(service *protogen.Service, param map[string]string,
+	buildTags string) string {
+
+	if param["prune_services"] == "1" && isUnreferenced(service, param) {
+		return unreferencedBuildTag
+	}
+
+	return buildTags
+}
+
+// sizeReport is the content of the size report listing the services and
+// messages referenced by the generated APIs.
+type sizeReport struct {
+	// Services are the services of the proto files of this run.
+	Services []serviceSize `json:"services"`
+
+	// Messages summarizes the messages defined in the proto files of this
+	// run.
+	Messages messageSizes `json:"messages"`
+}
+
+// serviceSize describes the generated APIs of a service.
+type serviceSize struct {
+	// Service is the full name of the service.
+	Service string `json:"service"`
+
+	// File is the proto file defining the service.
+	File string `json:"file"`
+
+	// Methods are the methods the APIs are generated for.
+	Methods []string `json:"methods"`
+
+	// Excluded are the methods left out with exclude_methods.
+	Excluded []string `json:"excluded,omitempty"`
+
+	// Unreferenced is true if all methods of the service are excluded.
+	Unreferenced bool `json:"unreferenced,omitempty"`
+
+	// Pruned is true if the files of the unreferenced service are left out
+	// of the build with prune_services=1.
+	Pruned bool `json:"pruned,omitempty"`
+}
+
+// messageSizes summarizes which messages are referenced by the generated APIs,
+// together with the size of their descriptors as an estimate of the marshaling
+// code and metadata they pull into the binary.
+type messageSizes struct {
+	// Referenced is the number of messages referenced by the requests and
+	// responses of the generated APIs.
+	Referenced int `json:"referenced"`
+
+	// ReferencedBytes is the descriptor size of the referenced messages.
+	ReferencedBytes int `json:"referenced_bytes"`
+
+	// Unreferenced are the full names of the messages not referenced by
+	// any generated API.
+	Unreferenced []string `json:"unreferenced"`
+
+	// UnreferencedBytes is the descriptor size of the unreferenced
+	// messages.
+	UnreferencedBytes int `json:"unreferenced_bytes"`
+}
+
+// genSizeReport creates falafel_size_report.json, reporting the services and
+// messages of this run that aren't referenced by the generated APIs.
+func genSizeReport(gen *protogen.Plugin, param map[string]string) {
+	var (
+		report     sizeReport
+		referenced = make(map[protoreflect.FullName]bool)
+		first      *protogen.File
+	)
+	for _, f := range gen.Files {
+		if !f.Generate {
+			continue
+		}
+		if first == nil {
+			first = f
+		}
+
+		fileParam := fileParams(param, f)
+		for _, service := range f.Services {
+			param := serviceOverrides(fileParam, service)
+
+			s := serviceSize{
+				Service:      string(service.Desc.FullName()),
+				File:         f.Proto.GetName(),
+				Methods:      []string{},
+				Unreferenced: isUnreferenced(service, param),
+			}
+			s.Pruned = s.Unreferenced &&
+				param["prune_services"] == "1"
+
+			included := includedMethods(service, param)
+			for _, method := range service.Methods {
+				name := method.GoName
+				if !containsMethod(included, method) {
+					s.Excluded = append(s.Excluded, name)
+					continue
+				}
+
+				s.Methods = append(s.Methods, name)
+				addReferenced(referenced, method.Input.Desc)
+				addReferenced(referenced, method.Output.Desc)
+			}
+
+			report.Services = append(report.Services, s)
+		}
+	}
+	if first == nil {
+		return
+	}
+
+	// Go through all messages defined in the proto files of this run,
+	// including nested ones, and sum up the size of their descriptors.
+	report.Messages.Unreferenced = []string{}
+	var walk func(msgs []*protogen.Message)
+	walk = func(msgs []*protogen.Message) {
+		for _, msg := range msgs {
+			walk(msg.Messages)
+
+			// Map entries are part of the message declaring
+			// the map field.
+			if msg.Desc.IsMapEntry() {
+				continue
+			}
+
+			size := descriptorSize(msg.Desc)
+			if referenced[msg.Desc.FullName()] {
+				report.Messages.Referenced++
+				report.Messages.ReferencedBytes += size
+				continue
+			}
+
+			report.Messages.Unreferenced = append(
+				report.Messages.Unreferenced,
+				string(msg.Desc.FullName()),
+			)
+			report.Messages.UnreferencedBytes += size
+		}
+	}
+	for _, f := range gen.Files {
+		if f.Generate {
+			walk(f.Messages)
+		}
+	}
+	sort.Strings(report.Messages.Unreferenced)
+
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	filename := "./falafel_size_report.json"
+	g := gen.NewGeneratedFile(filename, first.GoImportPath)
+	if _, err := g.Write(append(b, '\n')); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// containsMethod returns true if the method is contained in the list.
+func containsMethod(methods []*protogen.Method, method *protogen.Method) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addReferenced adds the message and all messages referenced by its fields to
+// the set of referenced messages.
+func addReferenced(referenced map[protoreflect.FullName]bool,
+	msg protoreflect.MessageDescriptor) {
+
+	if referenced[msg.FullName()] {
+		return
+	}
+	referenced[msg.FullName()] = true
+
+	fields := msg.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		if m := fields.Get(i).Message(); m != nil {
+			addReferenced(referenced, m)
+		}
+	}
+}
+
+// descriptorSize returns the size of the serialized descriptor of the message,
+// excluding the messages and enums nested in it.
+func descriptorSize(msg protoreflect.MessageDescriptor) int {
+	d := protodesc.ToDescriptorProto(msg)
+	d.NestedType = nil
+	d.EnumType = nil
+
+	return proto.Size(d)
+}
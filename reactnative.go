@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+)
+
+// reactNativeReserved are the names of the methods every TurboModule spec
+// declares in addition to those of the service, or that TurboModules reserve,
+// which are therefore suffixed with an underscore when used by the service.
+var reactNativeReserved = map[string]bool{
+	"send": true, "closeSend": true, "cancel": true,
+	"addListener": true, "removeListeners": true, "getConstants": true,
+}
+
+// reactNativeMethods returns the methods of a service as named in its
+// TurboModule spec.
+func reactNativeMethods(methods []rpcParams) []reactNativeMethod {
+	rnMethods := make([]reactNativeMethod, 0, len(methods))
+	for _, m := range methods {
+		name := lowerCamel(m.MethodName)
+		if reactNativeReserved[name] {
+			name += "_"
+		}
+
+		rnMethods = append(rnMethods, reactNativeMethod{
+			rpcParams: m,
+			Name:      name,
+		})
+	}
+
+	return rnMethods
+}
+
+// genReactNativeRuntime creates falafel_rn_generated.go, holding the part of
+// the React Native method table shared by all services, so it is only created
+// once per run.
+func genReactNativeRuntime(gen *protogen.Plugin, param map[string]string) {
+	for _, f := range gen.Files {
+		if !f.Generate {
+			continue
+		}
+
+		g := gen.NewGeneratedFile(
+			"./falafel_rn_generated.go", f.GoImportPath,
+		)
+		p := reactNativeParams{
+			ToolName:     versionString,
+			Package:      param["package_name"],
+			BuildTag:     modeBuildTags(param, "mobile"),
+			JSONEncoding: param["json_encoding"] == "1",
+		}
+		executeTemplate(g, reactNativeRuntimeTemplate, p)
+
+		return
+	}
+}
+
+// genReactNativeSpec creates <service>_rn_generated.go in dir, registering the
+// methods of the service with the React Native method table, and
+// Native<Service>.ts, the TurboModule spec the native module implements by
+// forwarding each method to ReactNativeCall. Methods returning a single
+// response return a promise, and the results of the streams are emitted as
+// events.
+func genReactNativeSpec(gen *protogen.Plugin, file *protogen.File,
+	service *protogen.Service, dir string, methods []rpcParams,
+	param map[string]string, buildTags string) {
+
+	rnMethods := reactNativeMethods(methods)
+
+	g := gen.NewGeneratedFile(
+		dir+strings.ToLower(service.GoName)+"_rn_generated.go",
+		file.GoImportPath,
+	)
+	p := reactNativeParams{
+		ToolName: versionString,
+		FileName: file.Proto.GetName(),
+		Package:  param["package_name"],
+		BuildTag: buildTags,
+		Module:   service.GoName,
+		Methods:  rnMethods,
+	}
+	executeTemplate(g, reactNativeTemplate, p)
+
+	comments := make(map[string]string)
+	for _, method := range service.Methods {
+		comments[method.GoName] = strings.TrimSpace(
+			string(method.Comments.Leading),
+		)
+	}
+
+	payload := "base64-encoded serialized protos"
+	if param["json_encoding"] == "1" {
+		payload = "JSON-encoded protos"
+	}
+
+	var (
+		b                   strings.Builder
+		events, sendStreams bool
+	)
+	for _, m := range rnMethods {
+		// The comment must not end the doc comment early.
+		comment := strings.ReplaceAll(
+			comments[m.MethodName], "*/", "*\\/",
+		)
+		if comment != "" {
+			b.WriteString("  /**\n")
+			for _, line := range strings.Split(comment, "\n") {
+				line = strings.TrimRight(" * "+line, " ")
+				b.WriteString("  " + line + "\n")
+			}
+			b.WriteString("   */\n")
+		}
+
+		switch {
+		case !m.ClientStream && !m.ServerStream:
+			fmt.Fprintf(&b, "  %s(id: string, request: string): "+
+				"Promise<string>;\n", m.Name)
+
+		case !m.ClientStream && m.ServerStream:
+			events = true
+			fmt.Fprintf(&b, "  %s(id: string, request: string): "+
+				"void;\n", m.Name)
+
+		case m.ClientStream && m.ServerStream:
+			events, sendStreams = true, true
+			fmt.Fprintf(&b, "  %s(id: string): void;\n", m.Name)
+
+		case m.ClientStream && !m.ServerStream:
+			sendStreams = true
+			fmt.Fprintf(&b, "  %s(id: string): Promise<string>;\n",
+				m.Name)
+		}
+		b.WriteString("\n")
+	}
+
+	if sendStreams {
+		b.WriteString("  /**\n" +
+			"   * Sends a request to the stream of the call with " +
+			"the given ID.\n" +
+			"   */\n" +
+			"  send(id: string, request: string): void;\n\n" +
+			"  /**\n" +
+			"   * Closes the request stream of the call with the " +
+			"given ID.\n" +
+			"   */\n" +
+			"  closeSend(id: string): void;\n\n")
+	}
+	b.WriteString("  /**\n" +
+		"   * Cancels the call with the given ID.\n" +
+		"   */\n" +
+		"  cancel(id: string): void;\n")
+	if events {
+		b.WriteString("\n" +
+			"  // The methods NativeEventEmitter requires.\n" +
+			"  addListener(eventName: string): void;\n" +
+			"  removeListeners(count: number): void;\n")
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "// Code generated by %s. DO NOT EDIT.\n", versionString)
+	fmt.Fprintf(&out, "// source: %s\n\n", file.Proto.GetName())
+	out.WriteString("import type { TurboModule } from 'react-native';\n" +
+		"import { TurboModuleRegistry } from 'react-native';\n")
+
+	fmt.Fprintf(&out, "\n/**\n"+
+		" * Spec of the %[1]s module, exposing the APIs of the %[1]s "+
+		"service.\n"+
+		" * Requests and responses are %[2]s. Every call is\n"+
+		" * identified by an ID chosen by the caller, which can be "+
+		"cancelled with\n"+
+		" * cancel. Methods delivering a single response return a "+
+		"promise, the\n"+
+		" * others emit the results of their streams as events "+
+		"carrying the ID.\n"+
+		" */\n"+
+		"export interface Spec extends TurboModule {\n%[3]s}\n\n"+
+		"export default TurboModuleRegistry.getEnforcing<Spec>"+
+		"('%[1]s');\n", service.GoName, payload, b.String())
+
+	g = gen.NewGeneratedFile(
+		dir+"Native"+service.GoName+".ts", file.GoImportPath,
+	)
+	if _, err := g.Write([]byte(out.String())); err != nil {
+		log.Fatal(err)
+	}
+}
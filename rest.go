@@ -0,0 +1,401 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// httpRuleOption is the field number of the google.api.http method option,
+// holding the HTTP rule mapping a method to a REST endpoint.
+const httpRuleOption protowire.Number = 72295728
+
+// The field numbers of the google.api.HttpRule message.
+const (
+	httpRuleGet                protowire.Number = 2
+	httpRulePut                protowire.Number = 3
+	httpRulePost               protowire.Number = 4
+	httpRuleDelete             protowire.Number = 5
+	httpRulePatch              protowire.Number = 6
+	httpRuleBody               protowire.Number = 7
+	httpRuleCustom             protowire.Number = 8
+	httpRuleAdditionalBindings protowire.Number = 11
+	httpRuleResponseBody       protowire.Number = 12
+)
+
+// restSegment is a segment of the path template of an HTTP rule.
+type restSegment struct {
+	// Literal is the path segment matched literally, unless Wildcard is
+	// set.
+	Literal string
+
+	// Wildcard is * to match any single segment, or ** to match all
+	// remaining segments.
+	Wildcard string
+
+	// Field is the dotted path of the request field the segment is bound
+	// to, if any.
+	Field string
+}
+
+// restRoute is a REST endpoint of a method, given by an HTTP rule.
+type restRoute struct {
+	// Method is the HTTP method of the endpoint.
+	Method string
+
+	// Path is the path template of the endpoint, e.g.
+	// /v1/invoice/{r_hash_str}, and Segments and Verb its parsed form.
+	Path     string
+	Segments []restSegment
+	Verb     string
+
+	// Body is the request field the request body is mapped to, * for the
+	// whole request, or empty if there is no body.
+	Body string
+
+	// ResponseBody is the response field returned as response body, or
+	// empty for the whole response.
+	ResponseBody string
+
+	// RPC holds the parameters of the method.
+	RPC rpcParams
+}
+
+// restParams holds the parameters of the shared plumbing of the REST
+// handlers.
+type restParams struct {
+	ToolName string
+	Package  string
+	BuildTag string
+
+	// RejectUnknown indicates whether requests with unknown fields or
+	// query parameters are rejected instead of ignoring them.
+	RejectUnknown bool
+}
+
+// restHandlerParams holds the parameters of the REST handler of a service.
+type restHandlerParams struct {
+	grpcWebHandlerParams
+
+	Imports []goImport
+
+	// Routes are the REST endpoints of the methods of the service.
+	Routes []restRoute
+}
+
+// httpRules returns the HTTP rules of the method's google.api.http option,
+// including the additional bindings, as routes.
+func httpRules(method *protogen.Method) []restRoute {
+	var routes []restRoute
+	for _, rule := range stringOptions(method.Desc, httpRuleOption) {
+		routes = append(routes, parseHTTPRule(method, []byte(rule))...)
+	}
+
+	return routes
+}
+
+// parseHTTPRule parses the encoded google.api.HttpRule message of the method
+// into its route, followed by those of its additional bindings.
+func parseHTTPRule(method *protogen.Method, b []byte) []restRoute {
+	var (
+		route    restRoute
+		bindings []restRoute
+	)
+	rangeFields(method.Desc, b, func(num protowire.Number,
+		wireType protowire.Type, v []byte) {
+
+		if wireType != protowire.BytesType {
+			return
+		}
+		value, n := protowire.ConsumeBytes(v)
+		if n < 0 {
+			log.Fatalf("invalid google.api.http option of %s: %v",
+				method.Desc.FullName(), protowire.ParseError(n))
+		}
+
+		switch num {
+		case httpRuleGet:
+			route.Method, route.Path = "GET", string(value)
+
+		case httpRulePut:
+			route.Method, route.Path = "PUT", string(value)
+
+		case httpRulePost:
+			route.Method, route.Path = "POST", string(value)
+
+		case httpRuleDelete:
+			route.Method, route.Path = "DELETE", string(value)
+
+		case httpRulePatch:
+			route.Method, route.Path = "PATCH", string(value)
+
+		// A custom pattern holds the method in its kind field and the
+		// path in its path field.
+		case httpRuleCustom:
+			rangeFields(method.Desc, value, func(num protowire.Number,
+				wireType protowire.Type, v []byte) {
+
+				s, n := protowire.ConsumeBytes(v)
+				if wireType != protowire.BytesType || n < 0 {
+					return
+				}
+
+				switch num {
+				case 1:
+					route.Method = string(s)
+				case 2:
+					route.Path = string(s)
+				}
+			})
+
+		case httpRuleBody:
+			route.Body = string(value)
+
+		case httpRuleResponseBody:
+			route.ResponseBody = string(value)
+
+		case httpRuleAdditionalBindings:
+			bindings = append(
+				bindings, parseHTTPRule(method, value)...,
+			)
+		}
+	})
+	if route.Method == "" || route.Path == "" {
+		log.Fatalf("google.api.http option of %s has no pattern",
+			method.Desc.FullName())
+	}
+
+	segments, verb, err := parsePathTemplate(route.Path)
+	if err != nil {
+		log.Fatalf("invalid path %s of %s: %v", route.Path,
+			method.Desc.FullName(), err)
+	}
+	route.Segments, route.Verb = segments, verb
+
+	// The fields referenced by the rule must exist, so the requests can
+	// be mapped at runtime.
+	for _, segment := range segments {
+		if segment.Field == "" {
+			continue
+		}
+		if err := checkRESTField(method.Input, segment.Field); err != nil {
+			log.Fatalf("invalid path %s of %s: %v", route.Path,
+				method.Desc.FullName(), err)
+		}
+	}
+	if route.Body != "" && route.Body != "*" &&
+		messageField(method.Input, route.Body) == nil {
+
+		log.Fatalf("body field %s of %s not found", route.Body,
+			method.Desc.FullName())
+	}
+	if route.ResponseBody != "" &&
+		messageField(method.Output, route.ResponseBody) == nil {
+
+		log.Fatalf("response body field %s of %s not found",
+			route.ResponseBody, method.Desc.FullName())
+	}
+
+	return append([]restRoute{route}, bindings...)
+}
+
+// parsePathTemplate parses the path template of an HTTP rule into its
+// segments and verb, following the syntax of google.api.HttpRule:
+// Template = "/" Segments [ Verb ]
+// Segments = Segment { "/" Segment }
+// Segment  = "*" | "**" | LITERAL | Variable
+// Variable = "{" FieldPath [ "=" Segments ] "}"
+// Verb     = ":" LITERAL
+func parsePathTemplate(path string) ([]restSegment, string, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, "", fmt.Errorf("path must start with /")
+	}
+
+	// The verb follows the last colon outside of any variable.
+	var verb string
+	if i := strings.LastIndex(path, ":"); i > strings.LastIndex(path, "}") &&
+		i > strings.LastIndex(path, "/") {
+
+		path, verb = path[:i], path[i+1:]
+	}
+
+	var segments []restSegment
+	rest := path[1:]
+	for rest != "" {
+		// Variables may span several segments, so they are parsed as
+		// a whole.
+		if strings.HasPrefix(rest, "{") {
+			end := strings.Index(rest, "}")
+			if end < 0 {
+				return nil, "", fmt.Errorf("unterminated variable")
+			}
+
+			field, pattern, found := strings.Cut(rest[1:end], "=")
+			if !found {
+				pattern = "*"
+			}
+			if field == "" || pattern == "" {
+				return nil, "", fmt.Errorf("invalid variable %s",
+					rest[:end+1])
+			}
+
+			for _, s := range strings.Split(pattern, "/") {
+				segments = append(
+					segments, newRESTSegment(s, field),
+				)
+			}
+
+			rest = rest[end+1:]
+		} else {
+			end := strings.Index(rest, "/")
+			if end < 0 {
+				end = len(rest)
+			}
+			segments = append(
+				segments, newRESTSegment(rest[:end], ""),
+			)
+			rest = rest[end:]
+		}
+
+		if rest == "" {
+			break
+		}
+		if !strings.HasPrefix(rest, "/") || rest == "/" {
+			return nil, "", fmt.Errorf("invalid segment separator")
+		}
+		rest = rest[1:]
+	}
+
+	for i, s := range segments {
+		if s.Wildcard == "" && s.Literal == "" {
+			return nil, "", fmt.Errorf("empty segment")
+		}
+		if s.Wildcard == "**" && i != len(segments)-1 {
+			return nil, "", fmt.Errorf("** must be the last segment")
+		}
+	}
+
+	return segments, verb, nil
+}
+
+// newRESTSegment returns the segment of the path template given by s, which is
+// bound to the field if it isn't empty.
+func newRESTSegment(s, field string) restSegment {
+	if s == "*" || s == "**" {
+		return restSegment{Wildcard: s, Field: field}
+	}
+
+	return restSegment{Literal: s, Field: field}
+}
+
+// messageField returns the field of the message with the given proto name,
+// including repeated fields, or nil if there is none.
+func messageField(msg *protogen.Message, name string) *protogen.Field {
+	for _, field := range msg.Fields {
+		if string(field.Desc.Name()) == name {
+			return field
+		}
+	}
+
+	return nil
+}
+
+// checkRESTField returns an error if the dotted field path doesn't name a
+// non-repeated field of the message that a path segment can be bound to.
+func checkRESTField(msg *protogen.Message, path string) error {
+	names := strings.Split(path, ".")
+	for i, name := range names {
+		field := messageField(msg, name)
+		if field == nil {
+			return fmt.Errorf("field %s of %s not found", name,
+				msg.Desc.FullName())
+		}
+		if field.Desc.IsList() || field.Desc.IsMap() {
+			return fmt.Errorf("field %s of %s is repeated", name,
+				msg.Desc.FullName())
+		}
+
+		if i == len(names)-1 {
+			break
+		}
+		if field.Message == nil {
+			return fmt.Errorf("field %s of %s is not a message",
+				name, msg.Desc.FullName())
+		}
+		msg = field.Message
+	}
+
+	return nil
+}
+
+// genREST creates rest_generated.go, holding the router plumbing shared by the
+// REST handlers of all services of the package.
+func genREST(gen *protogen.Plugin, file *protogen.File, pkg, buildTag string,
+	param map[string]string) {
+
+	filename := "./rest_generated.go"
+	g := gen.NewGeneratedFile(filename, file.GoImportPath)
+	p := restParams{
+		ToolName:      versionString,
+		Package:       pkg,
+		BuildTag:      buildTag,
+		RejectUnknown: param["json_unknown_fields"] == "reject",
+	}
+	executeTemplate(g, restTemplate, p)
+}
+
+// genRESTHandler creates a file in dir, next to the service file, holding the
+// constructor of the service's REST handler. No file is created if none of the
+// service's methods has an HTTP rule.
+func genRESTHandler(gen *protogen.Plugin, file *protogen.File,
+	service *protogen.Service, dir, pkg, targetPkg, buildTags string,
+	methods []rpcParams, importAliases, importRewrites map[string]string,
+	param map[string]string) {
+
+	n := strings.ToLower(service.GoName)
+	filename := dir + n + "_rest_generated.go"
+
+	// The handler references the request and response types, so they are
+	// added to the handler's own imports.
+	imports := newGoImports(pkg, importAliases, importRewrites)
+	targetName := imports.add(targetPkg)
+
+	params := restHandlerParams{
+		grpcWebHandlerParams: grpcWebHandlerParams{
+			ToolName:      versionString,
+			FileName:      filename,
+			Package:       pkg,
+			BuildTags:     buildTags,
+			ServiceName:   service.GoName,
+			ServiceGating: param["service_gating"] == "1",
+			Lifecycle:     param["lifecycle"] == "1",
+		},
+	}
+	for _, m := range methods {
+		// Like grpc-gateway, only unary and server-streaming methods
+		// are mapped.
+		if m.ClientStream {
+			continue
+		}
+
+		method := findMethod(service, m.MethodName)
+		m.TargetName = targetName
+		m.RequestType = imports.typeName(method.Input.GoIdent)
+		m.ResponseType = imports.typeName(method.Output.GoIdent)
+
+		for _, route := range httpRules(method) {
+			route.RPC = m
+			params.Routes = append(params.Routes, route)
+		}
+	}
+	if len(params.Routes) == 0 {
+		return
+	}
+	params.Imports = imports.imports()
+
+	g := gen.NewGeneratedFile(filename, file.GoImportPath)
+	executeTemplate(g, restHandlerTemplate, params)
+}
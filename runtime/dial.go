@@ -0,0 +1,52 @@
+package runtime
+
+import (
+	"context"
+	"net"
+
+	"google.golang.org/grpc"
+)
+
+// Dialer is an in-memory listener that client connections can be dialed on,
+// such as a bufconn.Listener.
+type Dialer interface {
+	// Dial creates a new in-memory connection to the listener.
+	Dial() (net.Conn, error)
+}
+
+// DialListener dials the given in-memory listener using the passed extra dial
+// options, and returns the grpc client connection together with a closure
+// that closes the underlying connection.
+func DialListener(lis Dialer, extraOpts ...grpc.DialOption) (*grpc.ClientConn,
+	func(), error) {
+
+	conn, err := lis.Dial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Set up a custom dialer using the listener conn.
+	dialer := func(context.Context, string) (net.Conn, error) {
+		return conn, nil
+	}
+
+	// Create a dial options array.
+	opts := []grpc.DialOption{
+		grpc.WithContextDialer(dialer),
+	}
+	opts = append(opts, extraOpts...)
+
+	// As address we use "localhost" to mimic a local connection.
+	address := "localhost"
+	clientConn, err := grpc.Dial(address, opts...)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	closeConn := func() {
+		conn.Close()
+	}
+
+	return clientConn, closeConn, nil
+}
@@ -0,0 +1,56 @@
+package runtime
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MethodError prefixes err with the service and method it originates from,
+// e.g. lnrpc.Lightning/SendCoins. The io.EOF marking the end of a stream is
+// passed on unchanged.
+func MethodError(method string, err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+
+	return fmt.Errorf("%s: %w", strings.TrimPrefix(method, "/"), err)
+}
+
+// ErrorContextCallback wraps a Callback or RecvStream, prefixing the errors
+// delivered to it with the method they originate from.
+type ErrorContextCallback struct {
+	Callback
+
+	// Method is the full gRPC method name of the RPC call.
+	Method string
+}
+
+// OnError is called if any error is encountered during the execution of the
+// RPC call.
+func (c *ErrorContextCallback) OnError(err error) {
+	c.Callback.OnError(MethodError(c.Method, err))
+}
+
+// ErrorContextSendStream wraps a SendStream, prefixing the errors it returns
+// with the method they originate from.
+type ErrorContextSendStream struct {
+	SendStream
+
+	// Method is the full gRPC method name of the RPC call.
+	Method string
+}
+
+// Send sends the serialized protobuf request to the server.
+//
+// Part of the SendStream interface.
+func (s *ErrorContextSendStream) Send(req []byte) error {
+	return MethodError(s.Method, s.SendStream.Send(req))
+}
+
+// Stop closes the bidirectional connection.
+//
+// Part of the SendStream interface.
+func (s *ErrorContextSendStream) Stop() error {
+	return MethodError(s.Method, s.SendStream.Stop())
+}
@@ -0,0 +1,16 @@
+module github.com/lightninglabs/falafel/runtime
+
+require (
+	github.com/golang/protobuf v1.5.3
+	google.golang.org/grpc v1.60.1
+)
+
+require (
+	golang.org/x/net v0.16.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20231002182017-d307bd883b97 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
+)
+
+go 1.21.4
@@ -0,0 +1,372 @@
+package runtime
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Receiver is the receiving half of a gRPC stream, delivering responses of
+// type Resp. All generated server-streaming and bidirectional clients satisfy
+// this interface.
+type Receiver[Resp proto.Message] interface {
+	// Recv returns the next response from the stream.
+	Recv() (Resp, error)
+}
+
+// BiStream is a bidirectional gRPC stream sending requests of type Req and
+// receiving responses of type Resp.
+type BiStream[Req, Resp proto.Message] interface {
+	Receiver[Resp]
+
+	// Send sends the given request to the stream.
+	Send(Req) error
+
+	// CloseSend closes the request stream.
+	CloseSend() error
+}
+
+// StartSync executes a unary RPC call using the specified serialized msg
+// request. The request is deserialized into the message returned by newProto,
+// and call is used to execute the RPC in a blocking manner. The result is
+// delivered to the callback exactly once.
+func StartSync(msg []byte, callback Callback, newProto func() proto.Message,
+	call func(context.Context, proto.Message) (proto.Message, error)) {
+
+	// We must make a copy of the passed byte slice, as there is no
+	// guarantee the contents won't be changed while the go routine is
+	// executing.
+	data := make([]byte, len(msg))
+	copy(data[:], msg[:])
+
+	go func() {
+		// Get an empty proto of the desired type, and deserialize msg
+		// as this proto type.
+		req := newProto()
+		err := proto.Unmarshal(data, req)
+		if err != nil {
+			callback.OnError(err)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// Now execute the RPC call.
+		resp, err := call(ctx, req)
+		if err != nil {
+			callback.OnError(err)
+			return
+		}
+
+		// We serialize the response before returning it to the caller.
+		b, err := proto.Marshal(resp)
+		if err != nil {
+			callback.OnError(err)
+			return
+		}
+
+		callback.OnResponse(b)
+	}()
+}
+
+// StartReadStream executes a server-streaming RPC call using the specified
+// serialized msg request. The client is retrieved using getClient and the
+// stream is opened by call, after which all responses are delivered to
+// rStream. T is the request message type and Req the pointer to it.
+func StartReadStream[C any, T any, Req interface {
+	*T
+	proto.Message
+}, Resp proto.Message](msg []byte, rStream RecvStream,
+	getClient func(context.Context) (C, func(), error),
+	call func(context.Context, C, Req) (Receiver[Resp], error)) {
+
+	// We must make a copy of the passed byte slice, as there is no
+	// guarantee the contents won't be changed while the go routine is
+	// executing.
+	data := make([]byte, len(msg))
+	copy(data[:], msg[:])
+
+	go func() {
+		// Get a new proto of the desired type and deserialize the
+		// passed msg as this type.
+		req := Req(new(T))
+		err := proto.Unmarshal(data, req)
+		if err != nil {
+			rStream.OnError(err)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// Get the gRPC client.
+		client, closeClient, err := getClient(ctx)
+		if err != nil {
+			rStream.OnError(err)
+			return
+		}
+		defer closeClient()
+
+		// Call the desired method on the client using the decoded gRPC
+		// request, and get the receive stream back.
+		stream, err := call(ctx, client, req)
+		if err != nil {
+			rStream.OnError(err)
+			return
+		}
+
+		forwardResponses(stream, rStream)
+	}()
+}
+
+// StartBiStream executes a bidirectional streaming RPC call, sending messages
+// coming from the returned SendStream. The client is retrieved using getClient
+// and the stream is opened by call, after which all responses are delivered to
+// rStream. T is the request message type and Req the pointer to it.
+func StartBiStream[C any, T any, Req interface {
+	*T
+	proto.Message
+}, Resp proto.Message](rStream RecvStream,
+	getClient func(context.Context) (C, func(), error),
+	call func(context.Context, C) (BiStream[Req, Resp], error)) (
+	SendStream, error) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Get the gRPC client.
+	client, closeClient, err := getClient(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// Start a bidirectional stream for the desired RPC method.
+	stream, err := call(ctx, client)
+	if err != nil {
+		cancel()
+		closeClient()
+		return nil, err
+	}
+
+	// We create a sendStream which is a wrapper for the methods we
+	// will expose to the caller via the SendStream interface.
+	ss := &sendStream{
+		send: func(msg []byte) error {
+			// Get an empty proto and deserialize the message
+			// coming from the caller.
+			req := Req(new(T))
+			err := proto.Unmarshal(msg, req)
+			if err != nil {
+				return err
+			}
+
+			// Send the request to the server.
+			return stream.Send(req)
+		},
+		stop: stream.CloseSend,
+	}
+
+	// Now launch a goroutine that will handle the asynchronous stream of
+	// responses.
+	go func() {
+		defer cancel()
+		defer closeClient()
+
+		forwardResponses[Resp](stream, rStream)
+	}()
+
+	// Return the send stream to the caller, which then can be used to pass
+	// messages to the server.
+	return ss, nil
+}
+
+// StartPagination executes a list-style RPC call repeatedly, starting with the
+// specified serialized msg request. Each page of results is delivered to
+// rStream, after which nextPage is used to move the request to the next page.
+// Once it returns false, all pages have been retrieved and io.EOF is
+// delivered.
+func StartPagination[C any, T any, Req interface {
+	*T
+	proto.Message
+}, Resp proto.Message](msg []byte, rStream RecvStream,
+	getClient func(context.Context) (C, func(), error),
+	call func(context.Context, C, Req) (Resp, error),
+	nextPage func(Req, Resp) bool) {
+
+	// We must make a copy of the passed byte slice, as there is no
+	// guarantee the contents won't be changed while the go routine is
+	// executing.
+	data := make([]byte, len(msg))
+	copy(data[:], msg[:])
+
+	go func() {
+		// Get a new proto of the desired type and deserialize the
+		// passed msg as this type.
+		req := Req(new(T))
+		err := proto.Unmarshal(data, req)
+		if err != nil {
+			rStream.OnError(err)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// Get the gRPC client.
+		client, closeClient, err := getClient(ctx)
+		if err != nil {
+			rStream.OnError(err)
+			return
+		}
+		defer closeClient()
+
+		for {
+			// Fetch the current page.
+			resp, err := call(ctx, client, req)
+			if err != nil {
+				rStream.OnError(err)
+				return
+			}
+
+			// Serialize the page before returning it to the
+			// caller.
+			b, err := proto.Marshal(resp)
+			if err != nil {
+				rStream.OnError(err)
+				return
+			}
+			rStream.OnResponse(b)
+
+			// Move on to the next page, if there is any.
+			if !nextPage(req, resp) {
+				rStream.OnError(io.EOF)
+				return
+			}
+		}
+	}()
+}
+
+// MaxPaymentStreamRetries is the maximum number of consecutive attempts of
+// StartPaymentStream to re-track a payment after its stream dropped.
+const MaxPaymentStreamRetries = 5
+
+// StartPaymentStream executes a payment streaming RPC call with the specified
+// serialized msg request, delivering the payment updates to rStream. If the
+// stream drops before it is done, the payment is re-tracked using track.
+// Updates equal to the last delivered one are skipped, as the re-tracked
+// stream starts with the current state of the payment.
+func StartPaymentStream[C any, T any, Req interface {
+	*T
+	proto.Message
+}, Resp proto.Message](msg []byte, rStream RecvStream,
+	getClient func(context.Context) (C, func(), error),
+	call func(context.Context, C, Req) (Receiver[Resp], error),
+	track func(context.Context, C, Resp) (Receiver[Resp], error)) {
+
+	// We must make a copy of the passed byte slice, as there is no
+	// guarantee the contents won't be changed while the go routine is
+	// executing.
+	data := make([]byte, len(msg))
+	copy(data[:], msg[:])
+
+	go func() {
+		// Get a new proto of the desired type and deserialize the
+		// passed msg as this type.
+		req := Req(new(T))
+		err := proto.Unmarshal(data, req)
+		if err != nil {
+			rStream.OnError(err)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// Get the gRPC client.
+		client, closeClient, err := getClient(ctx)
+		if err != nil {
+			rStream.OnError(err)
+			return
+		}
+		defer closeClient()
+
+		stream, err := call(ctx, client, req)
+		if err != nil {
+			rStream.OnError(err)
+			return
+		}
+
+		var (
+			last    Resp
+			tracked bool
+			retries int
+		)
+		for {
+			resp, err := stream.Recv()
+			if err == nil {
+				retries = 0
+
+				// Skip the update if it was already delivered.
+				if tracked && proto.Equal(last, resp) {
+					continue
+				}
+				last, tracked = resp, true
+
+				// Serialize the update before returning it to
+				// the caller.
+				b, err := proto.Marshal(resp)
+				if err != nil {
+					rStream.OnError(err)
+					return
+				}
+				rStream.OnResponse(b)
+
+				continue
+			}
+
+			// The stream dropped, so we re-track the payment.
+			// This is only possible once we know the payment from
+			// a first update.
+			for err != nil {
+				retries++
+				if !tracked || status.Code(err) != codes.Unavailable ||
+					retries > MaxPaymentStreamRetries {
+
+					rStream.OnError(err)
+					return
+				}
+
+				time.Sleep(time.Duration(retries) * time.Second)
+				stream, err = track(ctx, client, last)
+			}
+		}
+	}()
+}
+
+// forwardResponses reads responses from the stream until an error is
+// encountered, delivering each serialized response to rStream.
+func forwardResponses[Resp proto.Message](stream Receiver[Resp],
+	rStream RecvStream) {
+
+	for {
+		// Read a response from the stream.
+		resp, err := stream.Recv()
+		if err != nil {
+			rStream.OnError(err)
+			return
+		}
+
+		// Serialize the response before returning it to the caller.
+		b, err := proto.Marshal(resp)
+		if err != nil {
+			rStream.OnError(err)
+			return
+		}
+		rStream.OnResponse(b)
+	}
+}
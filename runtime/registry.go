@@ -0,0 +1,76 @@
+package runtime
+
+import (
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// serializedCalls is the registry of the serialized methods and streams
+// currently executed.
+var serializedCalls = struct {
+	sync.Mutex
+	active map[string]struct{}
+}{
+	active: make(map[string]struct{}),
+}
+
+// AcquireMethod marks the serialized method as in progress, returning an error
+// if it already is. The returned function must be called once the call is
+// done.
+func AcquireMethod(method string) (func(), error) {
+	serializedCalls.Lock()
+	defer serializedCalls.Unlock()
+
+	if _, ok := serializedCalls.active[method]; ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s "+
+			"already in progress", method)
+	}
+	serializedCalls.active[method] = struct{}{}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			serializedCalls.Lock()
+			delete(serializedCalls.active, method)
+			serializedCalls.Unlock()
+		})
+	}, nil
+}
+
+// SerializedStream is a RecvStream of a serialized method, which releases the
+// method once the stream has ended.
+type SerializedStream struct {
+	RecvStream
+
+	release func()
+}
+
+// OnError is called once the stream has ended.
+func (s *SerializedStream) OnError(err error) {
+	s.release()
+	s.RecvStream.OnError(err)
+}
+
+// Release releases the method of the stream, e.g. if the stream couldn't be
+// started. Calling it more than once has no effect.
+func (s *SerializedStream) Release() {
+	s.release()
+}
+
+// AcquireStream marks the serialized streaming method as in progress until the
+// returned stream has ended, returning an error if it already is.
+func AcquireStream(method string, rStream RecvStream) (*SerializedStream,
+	error) {
+
+	release, err := AcquireMethod(method)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SerializedStream{
+		RecvStream: rStream,
+		release:    release,
+	}, nil
+}
@@ -0,0 +1,67 @@
+// Package runtime contains the plumbing shared by all code generated by
+// falafel when the use_runtime=1 parameter is set. Keeping it in a separate
+// versioned module means bug fixes can be picked up with a dependency bump,
+// instead of requiring every downstream project to regenerate its stubs.
+package runtime
+
+// Callback is an interface that is passed in by callers of the library, and
+// specifies where the responses should be delivered.
+type Callback interface {
+	// OnResponse is called by the library when a response from the daemon
+	// for the associated RPC call is received. The reponse is a serialized
+	// protobuf for the expected response, and must be deserialized by the
+	// caller.
+	OnResponse([]byte)
+
+	// OnError is called by the library if any error is encountered during
+	// the execution of the RPC call.
+	OnError(error)
+}
+
+// RecvStream is an interface that is passed in by callers of the library, and
+// specifies where the streaming responses should be delivered.
+type RecvStream interface {
+	// OnResponse is called by the library when a new stream response from
+	// the daemon for the associated RPC call is available. The reponse is
+	// a serialized protobuf for the expected response, and must be
+	// deserialized by the caller.
+	OnResponse([]byte)
+
+	// OnError is called by the library if any error is encountered during
+	// the execution of the RPC call, or if the response stream ends. No
+	// more stream responses will be received after this.
+	OnError(error)
+}
+
+// SendStream is an interface that the caller of the library can use to send
+// requests to the server during the execution of a bidirectional streaming RPC
+// call, or stop the stream.
+type SendStream interface {
+	// Send sends the serialized protobuf request to the server.
+	Send([]byte) error
+
+	// Stop closes the bidirecrional connection.
+	Stop() error
+}
+
+// sendStream is an internal struct that satisifies the SendStream interface.
+// We use it to wrap customizable send and stop methods, that can be tuned to
+// the specific RPC call in question.
+type sendStream struct {
+	send func([]byte) error
+	stop func() error
+}
+
+// Send sends the serialized protobuf request to the server.
+//
+// Part of the SendStream interface.
+func (s *sendStream) Send(req []byte) error {
+	return s.send(req)
+}
+
+// Stop closes the bidirectional connection.
+//
+// Part of the SendStream interface.
+func (s *sendStream) Stop() error {
+	return s.stop()
+}
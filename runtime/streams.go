@@ -0,0 +1,342 @@
+package runtime
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/status"
+)
+
+// ClientStream is a client-streaming gRPC stream sending requests of type Req,
+// and receiving a single response of type Resp once the request stream is
+// closed.
+type ClientStream[Req, Resp proto.Message] interface {
+	// Send sends the given request to the stream.
+	Send(Req) error
+
+	// CloseAndRecv closes the request stream and returns the response.
+	CloseAndRecv() (Resp, error)
+
+	// Context returns the context of the stream.
+	Context() context.Context
+}
+
+// ClientStreamAdapter adapts a client-streaming gRPC stream to a bidirectional
+// one, such that it can be started with StartBiStream. Its only response is
+// received once the request stream is closed.
+type ClientStreamAdapter[Req, Resp proto.Message] struct {
+	stream ClientStream[Req, Resp]
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	received  bool
+}
+
+// NewClientStreamAdapter creates a ClientStreamAdapter for the stream.
+func NewClientStreamAdapter[Req, Resp proto.Message](
+	stream ClientStream[Req, Resp]) *ClientStreamAdapter[Req, Resp] {
+
+	return &ClientStreamAdapter[Req, Resp]{
+		stream: stream,
+		closed: make(chan struct{}),
+	}
+}
+
+// Send sends the given request to the stream.
+func (a *ClientStreamAdapter[Req, Resp]) Send(req Req) error {
+	return a.stream.Send(req)
+}
+
+// CloseSend closes the request stream, after which the response is received.
+func (a *ClientStreamAdapter[Req, Resp]) CloseSend() error {
+	a.closeOnce.Do(func() {
+		close(a.closed)
+	})
+
+	return nil
+}
+
+// Recv blocks until the request stream is closed and returns the response.
+// Any further call returns io.EOF.
+func (a *ClientStreamAdapter[Req, Resp]) Recv() (Resp, error) {
+	var zero Resp
+	if a.received {
+		return zero, io.EOF
+	}
+
+	select {
+	case <-a.closed:
+	case <-a.stream.Context().Done():
+		return zero, a.stream.Context().Err()
+	}
+
+	a.received = true
+	return a.stream.CloseAndRecv()
+}
+
+// ClientStreamCallback wraps the Callback of a client-streaming call, which
+// is started as a bidirectional stream, dropping the io.EOF that ends the
+// stream after the response was delivered.
+type ClientStreamCallback struct {
+	Callback
+}
+
+// OnError is called if any error is encountered during the execution of the
+// RPC call.
+func (c *ClientStreamCallback) OnError(err error) {
+	if err == io.EOF {
+		return
+	}
+
+	c.Callback.OnError(err)
+}
+
+// InitialStream is a RecvStream that delivers the first response of a stream
+// to a separate callback.
+type InitialStream struct {
+	initial  Callback
+	rStream  RecvStream
+	received bool
+}
+
+// NewInitialStream creates a new InitialStream delivering the first response
+// to initial and all following responses to rStream.
+func NewInitialStream(initial Callback, rStream RecvStream) *InitialStream {
+	return &InitialStream{
+		initial: initial,
+		rStream: rStream,
+	}
+}
+
+// OnResponse is called for every response received on the stream.
+func (s *InitialStream) OnResponse(b []byte) {
+	if !s.received {
+		s.received = true
+		s.initial.OnResponse(b)
+		return
+	}
+
+	s.rStream.OnResponse(b)
+}
+
+// OnError is called once the stream has ended.
+func (s *InitialStream) OnError(err error) {
+	if !s.received {
+		s.initial.OnError(err)
+		return
+	}
+
+	s.rStream.OnError(err)
+}
+
+// StreamTransform is an interface that can be passed in when subscribing to a
+// stream, to filter, down-sample or rewrite its responses before they are
+// delivered to the caller.
+type StreamTransform interface {
+	// Transform is called with every serialized response of the stream.
+	// It returns the serialized response of the same type that is
+	// delivered instead, or nil to drop the response. If an error is
+	// returned, the stream is ended with it.
+	Transform([]byte) ([]byte, error)
+}
+
+// TransformedStream is a stream passing all responses received through a
+// StreamTransform.
+type TransformedStream[Resp proto.Message] struct {
+	Receiver[Resp]
+
+	transform StreamTransform
+}
+
+// NewTransformedStream creates a new TransformedStream passing the responses
+// of stream through transform.
+func NewTransformedStream[Resp proto.Message](stream Receiver[Resp],
+	transform StreamTransform) *TransformedStream[Resp] {
+
+	return &TransformedStream[Resp]{
+		Receiver:  stream,
+		transform: transform,
+	}
+}
+
+// Recv returns the next response of the stream that isn't dropped by the
+// transform.
+func (s *TransformedStream[Resp]) Recv() (Resp, error) {
+	for {
+		resp, err := s.Receiver.Recv()
+		if err != nil {
+			return resp, err
+		}
+
+		b, err := proto.Marshal(resp)
+		if err != nil {
+			return resp, err
+		}
+
+		b, err = s.transform.Transform(b)
+		if err != nil {
+			return resp, err
+		}
+		if b == nil {
+			continue
+		}
+
+		// Unmarshal resets the response before decoding the
+		// transformed one into it.
+		if err := proto.Unmarshal(b, resp); err != nil {
+			return resp, err
+		}
+
+		return resp, nil
+	}
+}
+
+// StreamDemand applies backpressure to a stream. The stream reads ahead up to
+// the buffer size of responses, but only delivers as many of them as were
+// requested.
+type StreamDemand struct {
+	// bufferSize is the number of responses read ahead of the demand.
+	bufferSize int
+
+	// credits is the number of requested responses that weren't delivered
+	// yet.
+	credits int64
+
+	// requested is signalled whenever more responses are requested.
+	requested chan struct{}
+
+	// mtx guards access to credits.
+	mtx sync.Mutex
+}
+
+// NewStreamDemand creates a new demand for a single stream, which reads ahead
+// up to bufferSize responses. Once the buffer is full, the stream isn't read
+// until more responses are requested, so the server is slowed down by gRPC's
+// flow control. No responses are delivered before they are requested.
+func NewStreamDemand(bufferSize int) *StreamDemand {
+	if bufferSize < 0 {
+		bufferSize = 0
+	}
+
+	return &StreamDemand{
+		bufferSize: bufferSize,
+		requested:  make(chan struct{}, 1),
+	}
+}
+
+// Request requests n more responses, which are delivered as soon as they are
+// received.
+func (d *StreamDemand) Request(n int64) {
+	if n <= 0 {
+		return
+	}
+
+	d.mtx.Lock()
+	d.credits += n
+	d.mtx.Unlock()
+
+	select {
+	case d.requested <- struct{}{}:
+	default:
+	}
+}
+
+// acquire blocks until a response is requested and takes it from the demand.
+// It returns false if the context is done first.
+func (d *StreamDemand) acquire(ctx context.Context) bool {
+	for {
+		d.mtx.Lock()
+		if d.credits > 0 {
+			d.credits--
+			d.mtx.Unlock()
+
+			return true
+		}
+		d.mtx.Unlock()
+
+		select {
+		case <-d.requested:
+
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// demandResult is a result of a stream read ahead by a DemandStream.
+type demandResult[Resp proto.Message] struct {
+	resp Resp
+	err  error
+}
+
+// DemandStream is a stream only returning the responses requested from its
+// StreamDemand. The responses are read ahead into a buffer of the demand's
+// size.
+type DemandStream[Resp proto.Message] struct {
+	Receiver[Resp]
+
+	ctx     context.Context
+	demand  *StreamDemand
+	results chan demandResult[Resp]
+}
+
+// NewDemandStream creates a new DemandStream reading ahead the responses of
+// stream until ctx is done. If demand is nil, stream is returned unchanged.
+func NewDemandStream[Resp proto.Message](ctx context.Context,
+	stream Receiver[Resp], demand *StreamDemand) Receiver[Resp] {
+
+	if demand == nil {
+		return stream
+	}
+
+	s := &DemandStream[Resp]{
+		Receiver: stream,
+		ctx:      ctx,
+		demand:   demand,
+		results: make(
+			chan demandResult[Resp], demand.bufferSize,
+		),
+	}
+
+	go func() {
+		for {
+			resp, err := stream.Recv()
+
+			select {
+			case s.results <- demandResult[Resp]{resp, err}:
+
+			case <-ctx.Done():
+				return
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return s
+}
+
+// Recv returns the next response once it is requested. The error ending the
+// stream is returned without being requested, after all responses before it.
+func (s *DemandStream[Resp]) Recv() (Resp, error) {
+	var result demandResult[Resp]
+	select {
+	case result = <-s.results:
+
+	case <-s.ctx.Done():
+		return result.resp, status.FromContextError(s.ctx.Err()).Err()
+	}
+
+	if result.err != nil {
+		return result.resp, result.err
+	}
+	if !s.demand.acquire(s.ctx) {
+		return result.resp, status.FromContextError(s.ctx.Err()).Err()
+	}
+
+	return result.resp, nil
+}
@@ -0,0 +1,133 @@
+package runtime
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrTaskTimeout is returned by Task.Await if the task isn't completed within
+// the timeout. The call isn't affected by this and can be awaited again.
+var ErrTaskTimeout = status.Error(codes.DeadlineExceeded,
+	"task not completed within timeout")
+
+// Task is the pending result of a call. Instead of passing in a callback when
+// starting the call, the result can be awaited, or delivered to callbacks
+// registered later on.
+type Task struct {
+	// done is closed once the result is set.
+	done chan struct{}
+
+	mu        sync.Mutex
+	resp      []byte
+	err       error
+	callbacks []Callback
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+// NewTask creates a new pending Task.
+func NewTask() *Task {
+	return &Task{
+		done: make(chan struct{}),
+	}
+}
+
+// Await blocks until the task is completed, and returns the serialized
+// response or the error of the call. If the task isn't completed within
+// timeoutMs milliseconds, ErrTaskTimeout is returned. A timeout of zero or
+// less waits until the task is completed.
+func (t *Task) Await(timeoutMs int64) ([]byte, error) {
+	var timeout <-chan time.Time
+	if timeoutMs > 0 {
+		timer := time.NewTimer(time.Duration(timeoutMs) * time.Millisecond)
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	select {
+	case <-t.done:
+		return t.resp, t.err
+
+	case <-timeout:
+		return nil, ErrTaskTimeout
+	}
+}
+
+// OnResult delivers the result of the task to the callback once it is
+// completed, or right away if it already is. Several callbacks can be
+// registered, each of them is called once.
+func (t *Task) OnResult(callback Callback) {
+	t.mu.Lock()
+	select {
+	case <-t.done:
+		t.mu.Unlock()
+
+		go t.deliver(callback)
+		return
+
+	default:
+	}
+
+	t.callbacks = append(t.callbacks, callback)
+	t.mu.Unlock()
+}
+
+// Cancel cancels the call of the task. The task is completed with the
+// cancellation error, unless it already is completed.
+func (t *Task) Cancel() {
+	t.mu.Lock()
+	t.cancelled = true
+	cancel := t.cancel
+	t.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// Bind derives the context of the call from ctx, such that it is cancelled
+// by Cancel.
+func (t *Task) Bind(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.cancelled {
+		cancel()
+	}
+	t.cancel = cancel
+
+	return ctx, cancel
+}
+
+// Complete sets the result of the task and delivers it to the registered
+// callbacks. It must only be called once.
+func (t *Task) Complete(resp []byte, err error) {
+	t.mu.Lock()
+	t.resp, t.err = resp, err
+	close(t.done)
+
+	callbacks := t.callbacks
+	t.callbacks = nil
+	t.mu.Unlock()
+
+	for _, callback := range callbacks {
+		t.deliver(callback)
+	}
+}
+
+// deliver delivers the result of the completed task to the callback.
+func (t *Task) deliver(callback Callback) {
+	if t.err != nil {
+		callback.OnError(t.err)
+		return
+	}
+
+	callback.OnResponse(t.resp)
+}
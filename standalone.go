@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/pluginpb"
+)
+
+// isStandalone returns whether falafel was started with the arguments of the
+// standalone mode, instead of being run by protoc.
+func isStandalone(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	return strings.HasPrefix(args[0], "--descriptor_set") ||
+		strings.HasPrefix(args[0], "--reflect")
+}
+
+// runStandalone generates the stubs of the services found in a descriptor set,
+// either read from a file or fetched from a running gRPC server using server
+// reflection, without protoc. The descriptors are handed to the plugin f like
+// a request of protoc, and the generated files are written to the output
+// directory.
+func runStandalone(args []string, f func(*protogen.Plugin) error) error {
+	flags := flag.NewFlagSet("falafel", flag.ContinueOnError)
+	descriptorSet := flags.String("descriptor_set", "", "file holding "+
+		"a serialized google.protobuf.FileDescriptorSet")
+	reflectAddr := flags.String("reflect", "", "address of a gRPC server "+
+		"with server reflection enabled")
+	grpcurlFlags := flags.String("grpcurl_flags", "", "space separated "+
+		"flags passed to grpcurl when using --reflect, e.g. -plaintext")
+	outDir := flags.String("out", ".", "directory the files are "+
+		"generated into")
+	param := flags.String("param", "", "comma separated parameters, "+
+		"as passed to the plugin by protoc")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var (
+		set *descriptorpb.FileDescriptorSet
+		err error
+	)
+	switch {
+	case *descriptorSet != "" && *reflectAddr != "":
+		return fmt.Errorf("only one of --descriptor_set and --reflect " +
+			"can be set")
+
+	case *descriptorSet != "":
+		set, err = readDescriptorSet(*descriptorSet)
+
+	case *reflectAddr != "":
+		set, err = reflectDescriptorSet(
+			*reflectAddr, strings.Fields(*grpcurlFlags),
+		)
+	}
+	if err != nil {
+		return err
+	}
+
+	files, err := sortDescriptors(set.GetFile())
+	if err != nil {
+		return err
+	}
+
+	// The files to generate are given as arguments, and default to all
+	// files defining services.
+	generate := flags.Args()
+	if len(generate) == 0 {
+		generate = serviceFiles(files)
+	}
+	if len(generate) == 0 {
+		return fmt.Errorf("no services found")
+	}
+
+	req := &pluginpb.CodeGeneratorRequest{
+		FileToGenerate: generate,
+		Parameter:      proto.String(*param),
+		ProtoFile:      files,
+	}
+	addImportPaths(req)
+
+	gen, err := protogen.Options{}.New(req)
+	if err != nil {
+		return err
+	}
+	if err := f(gen); err != nil {
+		return err
+	}
+
+	resp := gen.Response()
+	if resp.Error != nil {
+		return fmt.Errorf("%s", resp.GetError())
+	}
+
+	return writeFiles(*outDir, resp.GetFile())
+}
+
+// readDescriptorSet reads the serialized descriptor set from the file, as
+// created with protoc --include_imports -o, buf build -o or grpcurl
+// -protoset-out.
+func readDescriptorSet(path string) (*descriptorpb.FileDescriptorSet,
+	error) {
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(b, set); err != nil {
+		return nil, fmt.Errorf("invalid descriptor set %s: %w", path,
+			err)
+	}
+
+	return set, nil
+}
+
+// reflectDescriptorSet fetches the descriptors of all services of the gRPC
+// server at the address using server reflection. The reflection client of
+// grpcurl is used, so it must be installed.
+func reflectDescriptorSet(addr string,
+	grpcurlFlags []string) (*descriptorpb.FileDescriptorSet, error) {
+
+	dir, err := os.MkdirTemp("", "falafel")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "reflection.protoset")
+	args := append(grpcurlFlags, "-protoset-out", path, addr, "describe")
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("grpcurl", args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+
+		return nil, fmt.Errorf("unable to reflect %s: %w", addr, err)
+	}
+
+	return readDescriptorSet(path)
+}
+
+// sortDescriptors returns the descriptors ordered such that every file follows
+// its dependencies, as protoc does. Dependencies missing from the set are taken
+// from the files linked into falafel, which include the well-known types.
+func sortDescriptors(files []*descriptorpb.FileDescriptorProto) (
+	[]*descriptorpb.FileDescriptorProto, error) {
+
+	byName := make(map[string]*descriptorpb.FileDescriptorProto)
+	for _, file := range files {
+		byName[file.GetName()] = file
+	}
+
+	var (
+		sorted []*descriptorpb.FileDescriptorProto
+		added  = make(map[string]bool)
+		add    func(name string) error
+	)
+	add = func(name string) error {
+		if added[name] {
+			return nil
+		}
+		added[name] = true
+
+		file, ok := byName[name]
+		if !ok {
+			fd, err := protoregistry.GlobalFiles.FindFileByPath(name)
+			if err != nil {
+				return fmt.Errorf("missing dependency %s", name)
+			}
+			file = protodesc.ToFileDescriptorProto(fd)
+		}
+
+		for _, dep := range file.GetDependency() {
+			if err := add(dep); err != nil {
+				return err
+			}
+		}
+		sorted = append(sorted, file)
+
+		return nil
+	}
+	for _, file := range files {
+		if err := add(file.GetName()); err != nil {
+			return nil, err
+		}
+	}
+
+	return sorted, nil
+}
+
+// serviceFiles returns the names of the files defining services, leaving out
+// the reflection service, which is always served when using --reflect.
+func serviceFiles(files []*descriptorpb.FileDescriptorProto) []string {
+	var names []string
+	for _, file := range files {
+		if len(file.GetService()) == 0 ||
+			strings.HasPrefix(file.GetPackage(), "grpc.reflection.") {
+
+			continue
+		}
+		names = append(names, file.GetName())
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// writeFiles writes the generated files to the output directory.
+func writeFiles(outDir string,
+	files []*pluginpb.CodeGeneratorResponse_File) error {
+
+	for _, file := range files {
+		path := filepath.Join(outDir, file.GetName())
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+
+		err := os.WriteFile(path, []byte(file.GetContent()), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
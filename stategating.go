@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+
+	"google.golang.org/protobuf/compiler/protogen"
+)
+
+// stateGatingParams holds the methods and types used by the generated gating
+// of calls on the state of the node.
+type stateGatingParams struct {
+	unlockParams
+
+	// Block indicates whether calls made before the RPC server is active
+	// block until it is, instead of failing with ErrRPCNotActive.
+	Block bool
+}
+
+// detectStateGating looks up lnd's State service in the generated files, whose
+// SubscribeState method reports whether the RPC server is active. It returns
+// nil if there is none.
+func detectStateGating(gen *protogen.Plugin,
+	imports *goImports) *stateGatingParams {
+
+	p := detectLndMethods(gen, imports)
+	if p.SubscribeMethod == "" {
+		return nil
+	}
+
+	return &stateGatingParams{
+		unlockParams: *p,
+	}
+}
+
+// stateGated returns whether the calls of the service are gated on the RPC
+// server being active. This is the case for all services except the State
+// service itself and the service unlocking the wallet, which are served
+// before.
+func (p *stateGatingParams) stateGated(service *protogen.Service) bool {
+	if p == nil {
+		return false
+	}
+
+	return service.GoName != p.StateService &&
+		service.GoName != p.UnlockService
+}
+
+// genStateGating creates the check gating calls on the RPC server of the node
+// being active, as reported by the State service.
+func genStateGating(gen *protogen.Plugin, file *protogen.File, pkg,
+	buildTag, mode string, param map[string]string) {
+
+	imports := newGoImports(
+		pkg, split(param["import_aliases"], " "),
+		split(param["import_rewrites"], " "),
+	)
+	p := detectStateGating(gen, imports)
+	if p == nil {
+		log.Fatal("state_gating requires a SubscribeState method")
+	}
+
+	p.ToolName = versionString
+	p.Package = pkg
+	p.BuildTag = buildTag
+	p.Imports = imports.imports()
+	p.Block = mode == "block"
+
+	filename := "./stategating_generated.go"
+	g := gen.NewGeneratedFile(filename, file.GoImportPath)
+	executeTemplate(g, stateGatingTemplate, p)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+)
+
+// swiftKeywords are the Swift keywords that can't be used as the base name of
+// a function. Functions whose Swift name would be one of them keep the name
+// given by gomobile.
+var swiftKeywords = map[string]bool{
+	"associatedtype": true, "class": true, "deinit": true, "enum": true,
+	"extension": true, "fileprivate": true, "func": true, "import": true,
+	"init": true, "inout": true, "internal": true, "let": true,
+	"open": true, "operator": true, "private": true, "protocol": true,
+	"public": true, "rethrows": true, "static": true, "struct": true,
+	"subscript": true, "typealias": true, "var": true, "break": true,
+	"case": true, "catch": true, "continue": true, "default": true,
+	"defer": true, "do": true, "else": true, "fallthrough": true,
+	"for": true, "guard": true, "if": true, "in": true, "repeat": true,
+	"return": true, "throw": true, "switch": true, "where": true,
+	"while": true, "as": true, "is": true, "nil": true, "self": true,
+	"super": true, "throws": true, "true": true, "false": true,
+	"try": true,
+}
+
+// swiftSignature returns the Swift name of the function as given in API notes,
+// including the argument labels, e.g. getInfo(_:callback:). The first argument
+// is unlabeled, the others are labeled with the names of the Go parameters.
+// Functions returning an error take the error pointer added by gomobile as last
+// argument, labeled error.
+func swiftSignature(fn *ast.FuncDecl) string {
+	var labels []string
+	for _, field := range fn.Type.Params.List {
+		if len(field.Names) == 0 {
+			labels = append(labels, "_")
+			continue
+		}
+		for _, name := range field.Names {
+			labels = append(labels, name.Name)
+		}
+	}
+	if len(labels) > 0 {
+		labels[0] = "_"
+	}
+
+	if results := fn.Type.Results; results != nil {
+		last := results.List[len(results.List)-1]
+		if ident, ok := last.Type.(*ast.Ident); ok &&
+			ident.Name == "error" {
+
+			labels = append(labels, "error")
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(lowerCamel(fn.Name.Name) + "(")
+	for _, label := range labels {
+		b.WriteString(label + ":")
+	}
+	b.WriteString(")")
+
+	return b.String()
+}
+
+// isVariadic returns whether the function takes a variadic parameter, such as
+// the call options of the typed APIs. Variadic functions aren't bound by
+// gomobile.
+func isVariadic(fn *ast.FuncDecl) bool {
+	params := fn.Type.Params.List
+	if len(params) == 0 {
+		return false
+	}
+
+	_, ok := params[len(params)-1].Type.(*ast.Ellipsis)
+	return ok
+}
+
+// genSwiftNames creates <Package>.apinotes, mapping the Objective-C names
+// gomobile gives the exported functions of the package, e.g.
+// LndmobileGetInfo, to idiomatic Swift names, e.g. getInfo(_:callback:). The
+// functions are read from the Go files generated so far, so it must be called
+// after all other files of the package are created.
+func genSwiftNames(gen *protogen.Plugin, param map[string]string,
+	changes *changeFilter) {
+
+	if param["js_stubs"] == "1" {
+		log.Fatal("swift_naming is not supported with js_stubs")
+	}
+
+	// The functions of the services that aren't regenerated would be
+	// missing.
+	if changes.incremental {
+		log.Fatal("swift_naming is not supported with incremental " +
+			"generation")
+	}
+
+	pkg := param["package_name"]
+	prefix := upperCase(pkg)
+
+	resp := gen.Response()
+	if resp.Error != nil {
+		// The error is reported by the final response.
+		return
+	}
+
+	names := make(map[string]string)
+	for _, file := range resp.GetFile() {
+		name := file.GetName()
+		if path.Ext(name) != ".go" ||
+			strings.HasSuffix(name, "_test.go") {
+
+			continue
+		}
+
+		f, err := parser.ParseFile(
+			token.NewFileSet(), name, file.GetContent(),
+			parser.SkipObjectResolution,
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if f.Name.Name != pkg {
+			continue
+		}
+
+		// Only exported, non-generic functions are bound by
+		// gomobile.
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv != nil || !fn.Name.IsExported() ||
+				fn.Type.TypeParams != nil {
+
+				continue
+			}
+			if swiftKeywords[lowerCamel(fn.Name.Name)] ||
+				isVariadic(fn) {
+
+				continue
+			}
+
+			// Fallback stubs define the same functions as the
+			// APIs they replace.
+			names[prefix+fn.Name.Name] = swiftSignature(fn)
+		}
+	}
+
+	objcNames := make([]string, 0, len(names))
+	for objcName := range names {
+		objcNames = append(objcNames, objcName)
+	}
+	sort.Strings(objcNames)
+
+	taken := make(map[string]string)
+	for _, objcName := range objcNames {
+		name := names[objcName]
+		if other, ok := taken[name]; ok {
+			log.Fatalf("%s and %s both map to the Swift name %s",
+				other, objcName, name)
+		}
+		taken[name] = objcName
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Code generated by %s. DO NOT EDIT.\n", versionString)
+	fmt.Fprintf(&b, "---\nName: %s\nFunctions:\n", prefix)
+	for _, objcName := range objcNames {
+		fmt.Fprintf(&b, "- Name: %s\n  SwiftName: '%s'\n", objcName,
+			names[objcName])
+	}
+
+	for _, f := range gen.Files {
+		if !f.Generate {
+			continue
+		}
+
+		filename := "./" + prefix + ".apinotes"
+		g := gen.NewGeneratedFile(filename, f.GoImportPath)
+		if _, err := g.Write([]byte(b.String())); err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+)
+
+// symbolManifest lists the exported API functions generated into a package,
+// so runs generating other packages bound into the same gomobile framework can
+// detect colliding symbols.
+type symbolManifest struct {
+	// Package is the name of the package the symbols are generated into.
+	Package string `json:"package"`
+
+	// Symbols are the exported API functions.
+	Symbols []apiSymbol `json:"symbols"`
+}
+
+// apiSymbol is an exported API function generated for a method.
+type apiSymbol struct {
+	// Name is the name of the function.
+	Name string `json:"name"`
+
+	// Service is the name of the service the method belongs to.
+	Service string `json:"service"`
+
+	// File is the path of the proto file defining the service.
+	File string `json:"file"`
+
+	// prefixedName is the name of the function if the API is prefixed
+	// with the service name.
+	prefixedName string
+}
+
+// methodSymbols returns the names of all exported functions generated for the
+// method.
+func methodSymbols(p rpcParams, typedResponses bool) []string {
+	name := p.ApiPrefix + p.MethodName
+	names := []string{name}
+	if typedResponses {
+		names = append(names, "Unmarshal"+name+"Response")
+	}
+	if p.Pagination != nil {
+		names = append(names, name+"All")
+	}
+	if p.LongPoll {
+		names = append(names, name+"Poll")
+	}
+	if p.InitialResponse {
+		names = append(names, name+"WithInitial")
+	}
+	if p.PaymentTracking != nil {
+		names = append(names, name+"Reliable")
+	}
+	if p.Upload != nil {
+		names = append(names, name+"Upload")
+	}
+	if p.Typed {
+		names = append(names, name+"Typed")
+	}
+	if p.StreamTransform {
+		names = append(names, name+"Transformed")
+	}
+	if p.Backpressure {
+		names = append(names, name+"WithDemand")
+	}
+	if p.StreamHandle {
+		names = append(names, name+"WithHandle")
+	}
+	if p.Progress {
+		names = append(names, name+"WithProgress")
+	}
+	if p.WithContext {
+		names = append(names, name+"WithContext")
+	}
+
+	return names
+}
+
+// newAPISymbols returns the exported functions generated for the method of the
+// given file.
+func newAPISymbols(file *protogen.File, p rpcParams,
+	typedResponses bool) []apiSymbol {
+
+	prefixed := p
+	prefixed.ApiPrefix = p.ServiceName
+
+	names := methodSymbols(p, typedResponses)
+	prefixedNames := methodSymbols(prefixed, typedResponses)
+
+	symbols := make([]apiSymbol, len(names))
+	for i, name := range names {
+		symbols[i] = apiSymbol{
+			Name:         name,
+			Service:      p.ServiceName,
+			File:         file.Desc.Path(),
+			prefixedName: prefixedNames[i],
+		}
+	}
+
+	return symbols
+}
+
+// genSymbolManifest creates the manifest of the exported API functions
+// generated in this run.
+func genSymbolManifest(gen *protogen.Plugin, param map[string]string,
+	symbols []apiSymbol) {
+
+	for _, f := range gen.Files {
+		if !f.Generate {
+			continue
+		}
+
+		sort.Slice(symbols, func(i, j int) bool {
+			return symbols[i].Name < symbols[j].Name
+		})
+
+		manifest := symbolManifest{
+			Package: param["package_name"],
+			Symbols: symbols,
+		}
+		b, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		filename := "./falafel_symbols.json"
+		g := gen.NewGeneratedFile(filename, f.GoImportPath)
+		if _, err := g.Write(append(b, '\n')); err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+}
+
+// checkSymbols makes sure none of the exported API functions generated in
+// this run collide with those listed in the symbol manifests of other runs,
+// given as space separated list of paths. For each collision, an api_prefix
+// override resolving it is suggested if there is one.
+func checkSymbols(paths string, symbols []apiSymbol) {
+	// Map each symbol of the other runs to the package it is generated
+	// into.
+	others := make(map[string]string)
+	for _, p := range strings.Fields(paths) {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			log.Fatalf("unable to read symbol manifest: %v", err)
+		}
+
+		var manifest symbolManifest
+		if err := json.Unmarshal(b, &manifest); err != nil {
+			log.Fatalf("invalid symbol manifest %s: %v", p, err)
+		}
+
+		for _, symbol := range manifest.Symbols {
+			others[symbol.Name] = manifest.Package
+		}
+	}
+
+	var collisions []string
+	for _, symbol := range symbols {
+		pkg, ok := others[symbol.Name]
+		if !ok {
+			continue
+		}
+
+		collision := fmt.Sprintf("%s of service %s collides with "+
+			"package %s", symbol.Name, symbol.Service, pkg)
+
+		_, prefixedTaken := others[symbol.prefixedName]
+		if symbol.prefixedName != symbol.Name && !prefixedTaken {
+			collision += fmt.Sprintf(", set file.%s.api_prefix=1 "+
+				"to generate %s instead", symbol.File,
+				symbol.prefixedName)
+		}
+		collisions = append(collisions, collision)
+	}
+
+	if len(collisions) > 0 {
+		log.Fatalf("duplicate symbols:\n%s",
+			strings.Join(collisions, "\n"))
+	}
+}
@@ -6,8 +6,17 @@ type headerParams struct {
 	ToolName  string
 	FileName  string
 	Package   string
-	TargetPkg string
+	Imports   []goImport
 	BuildTags string
+
+	// Proto indicates whether the generated file references the proto
+	// package, which is not the case for services with only streaming
+	// methods.
+	Proto bool
+
+	// File holds the file-level information and options of the proto
+	// file defining the service.
+	File protoFile
 }
 
 var headerTemplate = template.Must(template.New("header").Parse(`// Code generated by {{.ToolName}}. DO NOT EDIT.
@@ -19,12 +28,16 @@ package {{.Package}}
 
 import (
 	"context"
-	"net"
-
+{{- range .Imports}}{{if .Std}}
+	{{if .Alias}}{{.Alias}} {{end}}"{{.Path}}"
+{{- end}}{{end}}
+{{if .Proto}}
 	"github.com/golang/protobuf/proto"
+{{- end}}
 	"google.golang.org/grpc"
-
-	"{{.TargetPkg}}"
+{{range .Imports}}{{if not .Std}}
+	{{if .Alias}}{{.Alias}} {{end}}"{{.Path}}"
+{{- end}}{{end}}
 )
 `))
 
@@ -49,16 +62,71 @@ type jsHeaderParams struct {
 	// <Package>.<ServiceName>.<MethodName>
 	Package string
 
-	// AdditionalImports is a set of imports to be included.
-	AdditionalImports map[string]struct{}
+	// OutputPackage is the golang package that's used for the generated
+	// go file if it differs from Package, in which case the types of the
+	// proto's own package are imported.
+	OutputPackage string
+
+	// Imports is the list of additional imports to be included.
+	Imports []goImport
 
 	// BuildTag an optional golang build tag that should be added to the
 	// header of the generated file.
 	BuildTag string
 
+	// TypedResponses indicates whether helpers unmarshaling the JSON
+	// responses into the concrete response types should be generated.
+	TypedResponses bool
+
+	// GzipJSON indicates whether the JSON responses should be compressed
+	// with gzip and delivered base64 encoded.
+	GzipJSON bool
+
+	// CamelCaseAliases indicates whether the methods should also be
+	// registered under their camelCase names.
+	CamelCaseAliases bool
+
+	// StreamFraming is the framing used to deliver several streamed
+	// responses in one callback, either "ndjson" or "length_prefixed", or
+	// empty if each response is delivered on its own.
+	StreamFraming string
+
+	// ErrorContext indicates whether the errors delivered to the callback
+	// should be prefixed with the method they originate from.
+	ErrorContext bool
+
+	// FieldMasks indicates whether any streaming method only delivers the
+	// response fields selected by its field mask.
+	FieldMasks bool
+
+	// Timeouts indicates whether a variant of the registration taking a
+	// timeout for every call should be generated.
+	Timeouts bool
+
+	// DiscardUnknown indicates whether unknown fields of the JSON requests
+	// are dropped instead of failing the call.
+	DiscardUnknown bool
+
+	// SendStreamMethods is the list of client-streaming and bidirectional
+	// RPCs, which are registered separately as they send a stream of
+	// requests.
+	SendStreamMethods []jsRpcParams
+
+	// ClientStreams indicates whether any of the send stream methods is
+	// client-streaming, receiving its response once the stream is closed.
+	ClientStreams bool
+
 	// Methods is the main list of RPCs that are defined within the given
 	// proto file.
 	Methods []jsRpcParams
+
+	// BuilderMethods is the list of RPCs whose request builders should be
+	// generated, or empty if they aren't requested.
+	BuilderMethods []jsRpcParams
+
+	// RequiredFields indicates whether any request built by the request
+	// builders has required fields.
+	RequiredFields bool
 }
 
 // jsRpcParam is a struct with all information about a single RPC method.
@@ -66,486 +134,11285 @@ type jsRpcParams struct {
 	// MethodName is the RPC method's name.
 	MethodName string
 
+	// FullMethod is the full gRPC method name, e.g.
+	// /lnrpc.Lightning/GetInfo.
+	FullMethod string
+
 	// ServiceName is the original case gRPC service name as defined in the
 	// proto file.
 	ServiceName string
 
+	// TargetName is the name the proto's own package is imported as, if
+	// the stubs are generated into a different package.
+	TargetName string
+
 	// RequestType is the full name of the gRPC request type.
 	RequestType string
 
+	// ResponseType is the full name of the gRPC response type.
+	ResponseType string
+
 	// ResponseStreaming is a boolean indicating whether the response is
 	// unary or streaming. For a streaming response the callback can be
 	// multiple times, once for each gRPC response received from the stream.
 	ResponseStreaming bool
+
+	// GzipJSON indicates whether the JSON responses should be compressed
+	// with gzip and delivered base64 encoded.
+	GzipJSON bool
+
+	// JSONCodecs indicates whether requests and responses are converted
+	// with marshalJSON and unmarshalJSON, which apply the registered JSON
+	// field codecs and resolver, and normalize lists and maps if
+	// requested.
+	JSONCodecs bool
+
+	// StreamFraming is the framing used to deliver several streamed
+	// responses in one callback, either "ndjson" or "length_prefixed", or
+	// empty if each response is delivered on its own.
+	StreamFraming string
+
+	// Defaults are the default values injected into unset fields of the
+	// request before it is dispatched.
+	Defaults []requestDefault
+
+	// FieldMask holds the paths of the response fields that are delivered
+	// for a streaming method, or is empty if all fields are delivered.
+	FieldMask []string
+
+	// Compressor is the name the gzip compressor of gRPC is imported as if
+	// the payloads of the method are compressed, or empty otherwise.
+	Compressor string
+
+	// RequiredFields are the proto names of the request fields the request
+	// builder fails on if they are unset.
+	RequiredFields []string
 }
 
-var jsTemplate = template.Must(template.New("jsHeader").Funcs(funcMap).Parse(`// Code generated by {{.ToolName}}. DO NOT EDIT.
-// source: {{.FileName}}
-{{if .BuildTag}}
-{{.BuildTag}}
-{{end}}
+// jsInflateTemplate creates the JavaScript helper used to decode the gzip
+// compressed responses of the JSON stubs.
+var jsInflateTemplate = template.Must(template.New("jsInflate").Parse(`// Code generated by {{.}}. DO NOT EDIT.
+
+// falafelInflate decodes a base64 encoded, gzip compressed JSON response as
+// delivered by the generated stubs, and returns the parsed JSON object.
+async function falafelInflate(payload) {
+    const bytes = Uint8Array.from(atob(payload), c => c.charCodeAt(0));
+    const stream = new Blob([bytes]).stream().pipeThrough(
+        new DecompressionStream('gzip'),
+    );
+    const text = await new Response(stream).text();
+    return JSON.parse(text);
+}
+`))
+
+// kotlinParams is a struct that holds all data passed in to the Kotlin
+// coroutine helpers template.
+type kotlinParams struct {
+	ToolName string
+
+	// Package is the Kotlin package of the helpers.
+	Package string
+
+	// BindingsPackage is the Java package of the gomobile bindings, and
+	// BindingsClass the class holding their static methods.
+	BindingsPackage string
+	BindingsClass   string
+}
+
+// kotlinRuntimeTemplate creates the Kotlin helpers adapting the callbacks of
+// the gomobile bindings to suspend functions and flows, shared by the coroutine
+// wrappers of all services.
+var kotlinRuntimeTemplate = template.Must(template.New("kotlinRuntime").Parse(`// Code generated by {{.ToolName}}. DO NOT EDIT.
+
 package {{.Package}}
 
-import (
-	"context"
+import {{.BindingsPackage}}.Callback
+import {{.BindingsPackage}}.CancelToken
+import {{.BindingsPackage}}.{{.BindingsClass}}
+import {{.BindingsPackage}}.RecvStream
+import {{.BindingsPackage}}.SendStream
+import kotlin.coroutines.resume
+import kotlin.coroutines.resumeWithException
+import kotlinx.coroutines.CompletableDeferred
+import kotlinx.coroutines.channels.ProducerScope
+import kotlinx.coroutines.channels.awaitClose
+import kotlinx.coroutines.channels.trySendBlocking
+import kotlinx.coroutines.flow.Flow
+import kotlinx.coroutines.flow.callbackFlow
+import kotlinx.coroutines.launch
+import kotlinx.coroutines.suspendCancellableCoroutine
 
-	gateway "github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
-{{- range $key, $value := .AdditionalImports }}
-	"{{ $key }}"
-{{- end }}
-	"google.golang.org/grpc"
-	"google.golang.org/protobuf/encoding/protojson"
-)
+/**
+ * callError returns the error delivered by the bindings, which aren't
+ * annotated and may therefore pass null.
+ */
+private fun callError(error: Exception?): Exception =
+    error ?: IllegalStateException("call failed without an error")
 
-{{- define "unaryRpcFunc"}}
-		req := &{{.RequestType}}{}
-		err := marshaler.Unmarshal([]byte(reqJSON), req)
-		if err != nil {
-			callback("", err)
-			return
-		}
+/**
+ * responseStream returns a RecvStream delivering the responses to the flow,
+ * and closing it once the stream ends. The end of a stream is signalled by
+ * the EOF error, which closes the flow normally.
+ */
+private fun ProducerScope<ByteArray>.responseStream(): RecvStream =
+    object : RecvStream {
+        override fun onResponse(response: ByteArray?) {
+            // Waiting for room in the channel slows down the stream to
+            // the pace of the collector.
+            trySendBlocking(response ?: ByteArray(0))
+        }
 
-		client := New{{$.ServiceName}}Client(conn)
-		resp, err := client.{{.MethodName}}(ctx, req)
-		if err != nil {
-			callback("", err)
-			return
-		}
+        override fun onError(error: Exception?) {
+            if (error == null || error.message == "EOF") {
+                close()
+            } else {
+                close(error)
+            }
+        }
+    }
 
-		respBytes, err := marshaler.Marshal(resp)
-		if err != nil {
-			callback("", err)
-			return
-		}
-		callback(string(respBytes), nil)
-{{- end}}
+/**
+ * unaryCall starts a unary call, and suspends until its response arrives.
+ * Cancelling the coroutine cancels the call.
+ */
+internal suspend fun unaryCall(
+    start: (CancelToken, Callback) -> Unit,
+): ByteArray = suspendCancellableCoroutine { cont ->
+    val token = {{.BindingsClass}}.newCancelToken()
+    cont.invokeOnCancellation { token.cancel() }
 
-{{- define "streamRpcFunc"}}
-		req := &{{.RequestType}}{}
-		err := marshaler.Unmarshal([]byte(reqJSON), req)
-		if err != nil {
-			callback("", err)
-			return
-		}
+    start(token, object : Callback {
+        override fun onResponse(response: ByteArray?) {
+            cont.resume(response ?: ByteArray(0))
+        }
 
-		client := New{{.ServiceName}}Client(conn)
-		stream, err := client.{{.MethodName}}(ctx, req)
-		if err != nil {
-			callback("", err)
-			return
-		}
+        override fun onError(error: Exception?) {
+            cont.resumeWithException(callError(error))
+        }
+    })
+}
 
-		go func() {
-			for {
-				select {
-				case <-stream.Context().Done():
-					callback("", stream.Context().Err())
-					return
-				default:
-				}
+/**
+ * serverStream returns a flow of the responses of a server-streaming call,
+ * which is started once the flow is collected. Cancelling the collection
+ * ends the stream.
+ */
+internal fun serverStream(
+    start: (CancelToken, RecvStream) -> Unit,
+): Flow<ByteArray> = callbackFlow {
+    val token = {{.BindingsClass}}.newCancelToken()
+    start(token, responseStream())
+    awaitClose { token.cancel() }
+}
 
-				resp, err := stream.Recv()
-				if err != nil {
-					callback("", err)
-					return
-				}
+/**
+ * bidiStream returns a flow of the responses of a bidirectional call, which
+ * is started once the flow is collected. The requests are sent as they are
+ * emitted, and the request stream is closed once they are exhausted.
+ * Cancelling the collection ends the stream.
+ */
+internal fun bidiStream(
+    requests: Flow<ByteArray>,
+    start: (CancelToken, RecvStream) -> SendStream,
+): Flow<ByteArray> = callbackFlow {
+    val token = {{.BindingsClass}}.newCancelToken()
+    val sendStream = try {
+        start(token, responseStream())
+    } catch (e: Exception) {
+        token.cancel()
+        throw e
+    }
 
-				respBytes, err := marshaler.Marshal(resp)
-				if err != nil {
-					callback("", err)
-					return
-				}
-				callback(string(respBytes), nil)
-			}
-		}()
-{{- end}}
+    val sender = launch {
+        requests.collect { sendStream.send(it) }
+        sendStream.stop()
+    }
+    awaitClose {
+        sender.cancel()
+        token.cancel()
+    }
+}
 
-func Register{{.ServiceName | UpperCase}}JSONCallbacks(registry map[string]func(ctx context.Context,
-	conn *grpc.ClientConn, reqJSON string, callback func(string, error))) {
+/**
+ * clientStream sends the requests to a client-streaming call, and suspends
+ * until its response arrives once all of them are sent. Cancelling the
+ * coroutine cancels the call.
+ */
+internal suspend fun clientStream(
+    requests: Flow<ByteArray>,
+    start: (CancelToken, Callback) -> SendStream,
+): ByteArray {
+    val token = {{.BindingsClass}}.newCancelToken()
+    val result = CompletableDeferred<ByteArray>()
+    try {
+        val sendStream = start(token, object : Callback {
+            override fun onResponse(response: ByteArray?) {
+                result.complete(response ?: ByteArray(0))
+            }
 
-	marshaler := &gateway.JSONPb{
-		MarshalOptions: protojson.MarshalOptions{
-			UseProtoNames:   true,
-			EmitUnpopulated: true,
-		},
-	}
+            override fun onError(error: Exception?) {
+                result.completeExceptionally(callError(error))
+            }
+        })
 
-{{- range $meth := .Methods}}
+        requests.collect { sendStream.send(it) }
+        sendStream.stop()
 
-	registry["{{$.Package}}.{{$.ServiceName}}.{{$meth.MethodName}}"] = func(ctx context.Context,
-		conn *grpc.ClientConn, reqJSON string, callback func(string, error)) {
-{{- if $meth.ResponseStreaming }}
-{{template "streamRpcFunc" $meth}}
-{{- else }}
-{{template "unaryRpcFunc" $meth}}
-{{- end }}
-	}{{- end}}
+        return result.await()
+    } finally {
+        // The token is no longer needed once the call is done, and
+        // cancels it otherwise.
+        token.cancel()
+    }
 }
 `))
 
-type listenersParams struct {
-	ToolName  string
-	Package   string
-	Listeners []string
+// ffiParams is a struct that holds all data passed in to the templates of the
+// C ABI shim and the Dart FFI bindings.
+type ffiParams struct {
+	ToolName string
+	FileName string
+	Package  string
+	BuildTag string
+
+	// Prefix is the prefix of the C symbols exported by the shim, which
+	// is the package name.
+	Prefix string
+
+	// Methods are the methods of the service whose calls are exported.
+	Methods []rpcParams
 }
 
-var listenersTemplate = template.Must(template.New("mem").
-	Funcs(funcMap).
-	Parse(`// Code generated by {{.ToolName}} DO NOT EDIT.
+// ffiHeaderTemplate creates the C header declaring the callback the results of
+// the calls made through the C ABI are delivered to. It is included by the
+// cgo preambles of all files of the shim.
+var ffiHeaderTemplate = template.Must(template.New("ffiHeader").Parse(`// Code generated by {{.ToolName}}. DO NOT EDIT.
+
+#ifndef FALAFEL_FFI_H
+#define FALAFEL_FFI_H
+
+#include <stdint.h>
+#include <stdlib.h>
+
+// The kinds of results delivered to a FalafelCallback: a response, the error
+// ending the call, or the end of a stream.
+#define FALAFEL_RESPONSE 0
+#define FALAFEL_ERROR 1
+#define FALAFEL_END 2
+
+// FalafelCallback is called with the results of the call with the given ID.
+// The data is allocated with malloc and must be freed by the callee, since
+// it is read after the callback returned if the callee is asynchronous, like
+// a NativeCallable.listener of Dart. Errors are UTF-8 messages.
+typedef void (*FalafelCallback)(int64_t call, int32_t kind, uint8_t *data,
+	int64_t len);
+
+// falafel_invoke calls the callback, as Go can't call C function pointers.
+static inline void falafel_invoke(FalafelCallback callback, int64_t call,
+	int32_t kind, uint8_t *data, int64_t len) {
+
+	callback(call, kind, data, len);
+}
+
+#endif
+`))
+
+// ffiRuntimeTemplate creates the part of the C ABI shim shared by all
+// services, which tracks the calls made through it and exports the functions
+// managing them.
+var ffiRuntimeTemplate = template.Must(template.New("ffiRuntime").Parse(`// Code generated by {{.ToolName}}. DO NOT EDIT.
+
+{{.BuildTag}}
+
 package {{.Package}}
 
+/*
+#include "falafel_ffi.h"
+*/
+import "C"
+
 import (
+	"errors"
+	"io"
 	"sync"
-
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/test/bufconn"
+	"unsafe"
 )
-var (
-{{- range $lis := .Listeners}}
-	// {{$lis}} is a global in-memory buffer listeners that is
-	// referenced by the generated mobile APIs, such that all client calls
-	// will be going through it.
-	{{$lis}} = bufconn.Listen(100)
 
-{{end}}
-	// serviceDialOptions is a global map from service names to a method
-	// that is used to retrieve extra grpc options we'll apply every time
-	// we dial the service's grpc server, such as TLS certificates.
-	serviceDialOptions = make(map[string]func() ([]grpc.DialOption, error))
+// ffiCall is a call started through the C ABI, which delivers its results to
+// the C callback it was started with. It is the Callback or RecvStream of the
+// call.
+type ffiCall struct {
+	id       C.int64_t
+	callback C.FalafelCallback
 
-	// defaultDialOptions returns extra grpc options we'll apply in case
-	// the service is not found in the serviceDialOptions.
-	defaultDialOptions = func() ([]grpc.DialOption, error){
-		return nil, nil
-	}
+	// single indicates whether the call delivers a single response,
+	// which ends it.
+	single bool
 
-	// serviceDialOptionsMtx is a mutex used to grant exclusive access
-	// to the above options variables.
-	serviceDialOptionsMtx sync.Mutex
+	// token cancels the call.
+	token *CancelToken
+
+	// stream is the send stream of a client-streaming or bidirectional
+	// call.
+	stream SendStream
+}
+
+var (
+	// ffiCallsMtx guards ffiCalls and the streams of the calls.
+	ffiCallsMtx sync.Mutex
+
+	// ffiCalls are the calls started through the C ABI that didn't end
+	// yet, by their ID.
+	ffiCalls = make(map[int64]*ffiCall)
 )
 
+// newFFICall registers a new call with the given ID, whose results are
+// delivered to callback.
+func newFFICall(id C.int64_t, callback C.FalafelCallback,
+	single bool) *ffiCall {
 
-// RecreateListeners will re-create the in-memory listeners that will be
-// referenced by the generated mobile APIs. This has to be called if the gRPC
-// server has been restarted
-func RecreateListeners() {
-{{- range $lis := .Listeners}}
-	{{$lis}} = bufconn.Listen(100)
-{{- end}}
+	c := &ffiCall{
+		id:       id,
+		callback: callback,
+		single:   single,
+		token:    NewCancelToken(),
+	}
+
+	ffiCallsMtx.Lock()
+	ffiCalls[int64(id)] = c
+	ffiCallsMtx.Unlock()
+
+	return c
 }
 
-// setDefaultDialOption sets the global default gprc option method.
-func setDefaultDialOption(f func()([]grpc.DialOption, error)) {
-	serviceDialOptionsMtx.Lock()
-	defer serviceDialOptionsMtx.Unlock()
+// lookupFFICall returns the call with the given ID, or nil if it ended.
+func lookupFFICall(id C.int64_t) *ffiCall {
+	ffiCallsMtx.Lock()
+	defer ffiCallsMtx.Unlock()
 
-	defaultDialOptions  = f
+	return ffiCalls[int64(id)]
 }
 
-`))
+// setStream sets the send stream of the call, unless it already ended.
+func (c *ffiCall) setStream(stream SendStream) {
+	ffiCallsMtx.Lock()
+	defer ffiCallsMtx.Unlock()
 
-type serviceParams struct {
-	ServiceName string
-	TargetName  string
-	Listener    string
+	if ffiCalls[int64(c.id)] == c {
+		c.stream = stream
+	}
 }
 
-var serviceTemplate = template.Must(template.New("service").Funcs(funcMap).Parse(`
+// sendStream returns the send stream of the call.
+func (c *ffiCall) sendStream() (SendStream, error) {
+	ffiCallsMtx.Lock()
+	defer ffiCallsMtx.Unlock()
 
-// set{{.ServiceName | UpperCase}}DialOption sets the given method as the way
-// to retrieve gprc options for the service.
-func set{{.ServiceName | UpperCase}}DialOption(f func()([]grpc.DialOption, error)) {
-	serviceDialOptionsMtx.Lock()
-	defer serviceDialOptionsMtx.Unlock()
+	if c.stream == nil {
+		return nil, errors.New("call has no send stream")
+	}
 
-	serviceDialOptions["{{.ServiceName}}"] = f
+	return c.stream, nil
 }
 
+// end unregisters the call, and releases its token.
+func (c *ffiCall) end() {
+	ffiCallsMtx.Lock()
+	delete(ffiCalls, int64(c.id))
+	ffiCallsMtx.Unlock()
 
-// apply{{.ServiceName | UpperCase}}DialOptions returns extra grpc options to
-// use when calling the service.
-func apply{{.ServiceName | UpperCase}}DialOptions() ([]grpc.DialOption, error) {
-	serviceDialOptionsMtx.Lock()
-	defer serviceDialOptionsMtx.Unlock()
+	c.token.Cancel()
+}
 
-	// First check the service options map, if there are any options
-	// specific to this service.
-	f, ok := serviceDialOptions["{{.ServiceName}}"]
-	if ok {
-		return f()
+// OnResponse delivers a response of the call.
+func (c *ffiCall) OnResponse(resp []byte) {
+	if c.single {
+		c.end()
 	}
 
-	// Otherwise return the default options.
-	return defaultDialOptions()
+	c.deliver(C.FALAFEL_RESPONSE, resp)
 }
 
-// get{{.ServiceName | UpperCase}}Conn dials {{.ServiceName}} with the current dial options,
-// and returns the grpc client connection.
-func get{{.ServiceName | UpperCase}}Conn() (*grpc.ClientConn, func(), error) {
-	conn, err := {{.Listener}}.Dial()
-	if err != nil {
-		return nil, nil, err
-	}
+// OnError delivers the error ending the call, or the end of its stream.
+func (c *ffiCall) OnError(err error) {
+	c.end()
 
-	// Set up a custom dialer using the listener conn.
-	dialer := func(context.Context, string) (net.Conn, error) {
-		return conn, nil
+	if errors.Is(err, io.EOF) {
+		c.deliver(C.FALAFEL_END, nil)
+		return
 	}
 
-	// Create a dial options array.
-	opts := []grpc.DialOption{
-		grpc.WithContextDialer(dialer),
-	}
+	c.deliver(C.FALAFEL_ERROR, []byte(err.Error()))
+}
 
-	// Apply any extra server options.
-	extraOpts, err := apply{{.ServiceName | UpperCase}}DialOptions()
-	if err != nil {
-		return nil, nil, err
+// deliver passes a result of the call to its callback. The data is copied to
+// C memory, which the callback frees.
+func (c *ffiCall) deliver(kind C.int32_t, data []byte) {
+	var p unsafe.Pointer
+	if len(data) > 0 {
+		p = C.CBytes(data)
 	}
 
-	opts = append(opts, extraOpts...)
-
-	// As address we use "localhost" to mimic a local connection.
-	address := "localhost"
-	clientConn, err := grpc.Dial(address, opts...)
-	if err != nil {
-		conn.Close()
-		return nil, nil, err
-	}
+	C.falafel_invoke(
+		c.callback, c.id, kind, (*C.uint8_t)(p), C.int64_t(len(data)),
+	)
+}
 
-	closeConn := func() {
-		conn.Close()
+// ffiError returns the message of err as C string, which the caller frees, or
+// nil if there is no error.
+func ffiError(err error) *C.char {
+	if err == nil {
+		return nil
 	}
 
-	return clientConn, closeConn, nil
+	return C.CString(err.Error())
 }
 
-// get{{.ServiceName}}Client returns a client connection to the server listening
-// on lis.
-func get{{.ServiceName}}Client() ({{.TargetName}}.{{.ServiceName}}Client, func(), error) {
-	clientConn, closeConn, err := get{{.ServiceName | UpperCase}}Conn()
-	if err != nil {
-		return nil, nil, err
-	}
-	client := {{.TargetName}}.New{{.ServiceName}}Client(clientConn)
-	return client, closeConn, nil
+// {{.Prefix}}_Alloc allocates size bytes of C memory, e.g. for the requests
+// passed to the calls, which must be freed with {{.Prefix}}_Free.
+//
+//export {{.Prefix}}_Alloc
+func {{.Prefix}}_Alloc(size C.int64_t) unsafe.Pointer {
+	return C.malloc(C.size_t(size))
 }
-`))
 
-type rpcParams struct {
-	ServiceName string
-	MethodName  string
-	RequestType string
-	Comment     string
-	ApiPrefix   string
+// {{.Prefix}}_Free frees C memory allocated by the library, such as the data
+// delivered to the callbacks and the error messages.
+//
+//export {{.Prefix}}_Free
+func {{.Prefix}}_Free(p unsafe.Pointer) {
+	C.free(p)
 }
 
-var (
-	syncTemplate = template.Must(template.New("sync").Parse(`
-{{.Comment}}
+// {{.Prefix}}_Cancel cancels the call with the given ID. Calls that already
+// ended are ignored.
 //
-// NOTE: This method produces a single result or error, and the callback will
-// be called only once.
-func {{.ApiPrefix}}{{.MethodName}}(msg []byte, callback Callback) {
-	s := &syncHandler{
-		newProto: func() proto.Message {
-			return &{{.RequestType}}{}
-		},
-		getSync: func(ctx context.Context,
-			req proto.Message) (proto.Message, error) {
+//export {{.Prefix}}_Cancel
+func {{.Prefix}}_Cancel(call C.int64_t) {
+	if c := lookupFFICall(call); c != nil {
+		c.token.Cancel()
+	}
+}
 
-			// Get the gRPC client.
-			client, closeClient, err := get{{.ServiceName}}Client()
-			if err != nil {
-				return nil, err
-			}
-			defer closeClient()
+// {{.Prefix}}_Send sends the serialized request to the stream of the
+// client-streaming or bidirectional call with the given ID. The request is
+// copied, so it can be freed once the function returns. The error message is
+// returned, or NULL if the request was sent.
+//
+//export {{.Prefix}}_Send
+func {{.Prefix}}_Send(call C.int64_t, msg unsafe.Pointer,
+	msgLen C.int64_t) *C.char {
 
-			r := req.(*{{.RequestType}})
-			return client.{{.MethodName}}(ctx, r)
-		},
+	c := lookupFFICall(call)
+	if c == nil {
+		return ffiError(io.EOF)
 	}
-	s.start(msg, callback)
+
+	stream, err := c.sendStream()
+	if err != nil {
+		return ffiError(err)
+	}
+
+	return ffiError(stream.Send(C.GoBytes(msg, C.int(msgLen))))
+}
+
+// {{.Prefix}}_Stop closes the request stream of the client-streaming or
+// bidirectional call with the given ID. The error message is returned, or
+// NULL if the stream was closed.
+//
+//export {{.Prefix}}_Stop
+func {{.Prefix}}_Stop(call C.int64_t) *C.char {
+	c := lookupFFICall(call)
+	if c == nil {
+		return nil
+	}
+
+	stream, err := c.sendStream()
+	if err != nil {
+		return ffiError(err)
+	}
+
+	return ffiError(stream.Stop())
 }
 `))
 
-	readStreamTemplate = template.Must(template.New("readStream").Parse(`
-{{.Comment}}
+// ffiTemplate creates the C ABI shim of a service, exporting a function per
+// method that starts a call through the WithContext API of the method.
+var ffiTemplate = template.Must(template.New("ffi").Parse(`// Code generated by {{.ToolName}}. DO NOT EDIT.
+// source: {{.FileName}}
+
+{{.BuildTag}}
+
+package {{.Package}}
+
+/*
+#include "falafel_ffi.h"
+*/
+import "C"
+
+import (
+	"unsafe"
+)
+{{- range .Methods}}
+{{- if not .ClientStream}}
+
+// {{$.Prefix}}_{{.ApiPrefix}}{{.MethodName}} starts a call of {{.MethodName}} with the given ID, delivering
+// its {{if .ServerStream}}responses{{else}}response{{end}} to callback. The request is copied, so it can be freed
+// once the function returns.
 //
-// NOTE: This method produces a stream of responses, and the receive stream can
-// be called zero or more times. After EOF error is returned, no more responses
-// will be produced.
-func {{.ApiPrefix}}{{.MethodName}}(msg []byte, rStream RecvStream) {
-	s := &readStreamHandler{
-		newProto: func() proto.Message {
-			return &{{.RequestType}}{}
-		},
-		recvStream: func(ctx context.Context,
-			req proto.Message) (*receiver, func(), error) {
+//export {{$.Prefix}}_{{.ApiPrefix}}{{.MethodName}}
+func {{$.Prefix}}_{{.ApiPrefix}}{{.MethodName}}(call C.int64_t, callback C.FalafelCallback,
+	msg unsafe.Pointer, msgLen C.int64_t) {
 
-			// Get the gRPC client.
-			client, closeClient, err := get{{.ServiceName}}Client()
-			if err != nil {
-				return nil, nil, err
-			}
+	c := newFFICall(call, callback, {{not .ServerStream}})
+	{{.ApiPrefix}}{{.MethodName}}WithContext(
+		c.token, C.GoBytes(msg, C.int(msgLen)), c,
+	)
+}
+{{- else}}
 
-			r := req.(*{{.RequestType}})
-			stream, err := client.{{.MethodName}}(ctx, r)
-			if err != nil {
-				closeClient()
-				return nil, nil, err
-			}
-			return &receiver{
-				recv: func() (proto.Message, error) {
-					return stream.Recv()
-				},
-			}, closeClient, nil
+// {{$.Prefix}}_{{.ApiPrefix}}{{.MethodName}} starts a call of {{.MethodName}} with the given ID, delivering
+// its {{if .ServerStream}}responses{{else}}response{{end}} to callback. The requests are sent with {{$.Prefix}}_Send
+// and closed with {{$.Prefix}}_Stop.
+//
+//export {{$.Prefix}}_{{.ApiPrefix}}{{.MethodName}}
+func {{$.Prefix}}_{{.ApiPrefix}}{{.MethodName}}(call C.int64_t, callback C.FalafelCallback) {
+	c := newFFICall(call, callback, {{not .ServerStream}})
+	stream, err := {{.ApiPrefix}}{{.MethodName}}WithContext(c.token, c)
+	if err != nil {
+		c.OnError(err)
+		return
+	}
+	c.setStream(stream)
+}
+{{- end}}
+{{- end}}
+`))
+
+// dartRuntimeTemplate creates the Dart helpers starting the calls through the C
+// ABI shim and dispatching their results, shared by the bindings of all
+// services.
+var dartRuntimeTemplate = template.Must(template.New("dartRuntime").Parse(`// Code generated by {{.ToolName}}. DO NOT EDIT.
+
+import 'dart:async';
+import 'dart:convert';
+import 'dart:ffi';
+import 'dart:typed_data';
+
+/// The native signature of the callback the results of the calls are
+/// delivered to, see falafel_ffi.h.
+typedef FalafelCallbackNative = Void Function(
+    Int64 call, Int32 kind, Pointer<Uint8> data, Int64 len);
+
+/// A pointer to the callback the results of the calls are delivered to.
+typedef FalafelCallbackPointer = Pointer<NativeFunction<FalafelCallbackNative>>;
+
+/// The signature of the functions starting unary and server-streaming calls.
+typedef FalafelRequestCallNative = Void Function(Int64 call,
+    FalafelCallbackPointer callback, Pointer<Uint8> msg, Int64 msgLen);
+typedef FalafelRequestCall = void Function(
+    int call, FalafelCallbackPointer callback, Pointer<Uint8> msg, int msgLen);
+
+/// The signature of the functions starting client-streaming and bidirectional
+/// calls.
+typedef FalafelStreamCallNative = Void Function(
+    Int64 call, FalafelCallbackPointer callback);
+typedef FalafelStreamCall = void Function(
+    int call, FalafelCallbackPointer callback);
+
+const _response = 0;
+const _error = 1;
+
+/// FalafelException is the error a call made through the C ABI failed with.
+class FalafelException implements Exception {
+  FalafelException(this.message);
+
+  final String message;
+
+  @override
+  String toString() => 'FalafelException: $message';
+}
+
+/// _Call receives the results of a call.
+class _Call {
+  _Call(this.onResponse, this.onError, this.onEnd, {this.single = false});
+
+  /// single is true if the call delivers a single response, which ends it.
+  final bool single;
+
+  final void Function(Uint8List) onResponse;
+  final void Function(FalafelException) onError;
+  final void Function() onEnd;
+}
+
+/// FalafelFfi starts the calls through the C ABI of the library, and
+/// dispatches their results to the isolate that created it. A single instance
+/// should be kept for the lifetime of the isolate, as the library may still
+/// deliver the results of cancelled calls.
+class FalafelFfi {
+  FalafelFfi(this.library);
+
+  /// The library built with go build -buildmode=c-shared.
+  final DynamicLibrary library;
+
+  late final _callback =
+      NativeCallable<FalafelCallbackNative>.listener(_dispatch);
+
+  final _calls = <int, _Call>{};
+  var _nextCall = 1;
+
+  late final _alloc = library.lookupFunction<Pointer<Uint8> Function(Int64),
+      Pointer<Uint8> Function(int)>('{{.Prefix}}_Alloc');
+  late final _free = library.lookupFunction<Void Function(Pointer<Uint8>),
+      void Function(Pointer<Uint8>)>('{{.Prefix}}_Free');
+  late final _cancel = library.lookupFunction<Void Function(Int64),
+      void Function(int)>('{{.Prefix}}_Cancel');
+  late final _send = library.lookupFunction<
+      Pointer<Uint8> Function(Int64, Pointer<Uint8>, Int64),
+      Pointer<Uint8> Function(int, Pointer<Uint8>, int)>('{{.Prefix}}_Send');
+  late final _stop = library.lookupFunction<Pointer<Uint8> Function(Int64),
+      Pointer<Uint8> Function(int)>('{{.Prefix}}_Stop');
+
+  /// unary starts a unary call, and completes with its response. Completing
+  /// cancel cancels the call.
+  Future<Uint8List> unary(FalafelRequestCall start, Uint8List request,
+      {Future<void>? cancel}) {
+    final completer = Completer<Uint8List>();
+    final id = _register(_Call(
+      completer.complete,
+      completer.completeError,
+      () => completer.completeError(
+          FalafelException('call ended without a response')),
+      single: true,
+    ));
+    _cancelOn(id, cancel);
+
+    _withMessage(request, (msg, len) {
+      start(id, _callback.nativeFunction, msg, len);
+    });
+
+    return completer.future;
+  }
+
+  /// serverStream returns the responses of a server-streaming call, which is
+  /// started once the stream is listened to. Cancelling the subscription
+  /// cancels the call.
+  Stream<Uint8List> serverStream(FalafelRequestCall start, Uint8List request) {
+    late final StreamController<Uint8List> controller;
+    late final int id;
+    controller = StreamController<Uint8List>(
+      onListen: () {
+        id = _register(_streamCall(controller, null));
+        _withMessage(request, (msg, len) {
+          start(id, _callback.nativeFunction, msg, len);
+        });
+      },
+      onCancel: () => _cancelCall(id),
+    );
+
+    return controller.stream;
+  }
+
+  /// bidiStream returns the responses of a bidirectional call, which is
+  /// started once the stream is listened to. The requests are sent as they
+  /// are emitted, and the request stream is closed once they are exhausted.
+  /// Cancelling the subscription cancels the call.
+  Stream<Uint8List> bidiStream(
+      FalafelStreamCall start, Stream<Uint8List> requests) {
+    late final StreamController<Uint8List> controller;
+    late final int id;
+    StreamSubscription<Uint8List>? sender;
+    controller = StreamController<Uint8List>(
+      onListen: () {
+        id = _register(_streamCall(controller, () => sender?.cancel()));
+        start(id, _callback.nativeFunction);
+        sender = _sendAll(id, requests);
+      },
+      onCancel: () {
+        sender?.cancel();
+        _cancelCall(id);
+      },
+    );
+
+    return controller.stream;
+  }
+
+  /// clientStream sends the requests to a client-streaming call as they are
+  /// emitted, closes the request stream once they are exhausted, and
+  /// completes with the response. Completing cancel cancels the call.
+  Future<Uint8List> clientStream(
+      FalafelStreamCall start, Stream<Uint8List> requests,
+      {Future<void>? cancel}) {
+    final completer = Completer<Uint8List>();
+    StreamSubscription<Uint8List>? sender;
+    final id = _register(_Call(
+      (resp) {
+        sender?.cancel();
+        completer.complete(resp);
+      },
+      (err) {
+        sender?.cancel();
+        completer.completeError(err);
+      },
+      () {
+        sender?.cancel();
+        completer.completeError(
+            FalafelException('call ended without a response'));
+      },
+      single: true,
+    ));
+    _cancelOn(id, cancel);
+
+    start(id, _callback.nativeFunction);
+    sender = _sendAll(id, requests);
+
+    return completer.future;
+  }
+
+  /// _dispatch delivers a result of a call. It is called by the library
+  /// through the native callable, and frees the data it is given.
+  void _dispatch(int id, int kind, Pointer<Uint8> data, int len) {
+    final bytes = len > 0
+        ? Uint8List.fromList(data.asTypedList(len))
+        : Uint8List(0);
+    if (data != nullptr) {
+      _free(data);
+    }
+
+    final call = _calls[id];
+    if (call == null) {
+      return;
+    }
+
+    switch (kind) {
+      case _response:
+        if (call.single) {
+          _calls.remove(id);
+        }
+        call.onResponse(bytes);
+
+      case _error:
+        _calls.remove(id);
+        call.onError(FalafelException(utf8.decode(bytes)));
+
+      default:
+        _calls.remove(id);
+        call.onEnd();
+    }
+  }
+
+  /// _register registers a new call, and returns its ID.
+  int _register(_Call call) {
+    final id = _nextCall++;
+    _calls[id] = call;
+
+    return id;
+  }
+
+  /// _streamCall returns the _Call delivering the results of a streaming call
+  /// to controller. stopSending is called once the call ended.
+  _Call _streamCall(
+      StreamController<Uint8List> controller, void Function()? stopSending) {
+    return _Call(
+      controller.add,
+      (err) {
+        stopSending?.call();
+        controller.addError(err);
+        controller.close();
+      },
+      () {
+        stopSending?.call();
+        controller.close();
+      },
+    );
+  }
+
+  /// _cancelOn cancels the call once cancel completes.
+  void _cancelOn(int id, Future<void>? cancel) {
+    cancel?.then((_) {
+      final call = _calls.remove(id);
+      if (call != null) {
+        _cancel(id);
+        call.onError(FalafelException('call cancelled'));
+      }
+    });
+  }
+
+  /// _cancelCall cancels the call, unless it already ended. Its remaining
+  /// results are dropped.
+  void _cancelCall(int id) {
+    if (_calls.remove(id) != null) {
+      _cancel(id);
+    }
+  }
+
+  /// _sendAll sends the requests to the stream of the call as they are
+  /// emitted, and closes the request stream once they are exhausted. If a
+  /// request can't be sent, the call fails, unless the stream ended and the
+  /// error is delivered by the library.
+  StreamSubscription<Uint8List> _sendAll(int id, Stream<Uint8List> requests) {
+    late final StreamSubscription<Uint8List> sender;
+    sender = requests.listen(
+      (request) {
+        final err = _withMessage(request, (msg, len) => _send(id, msg, len));
+        if (err != nullptr) {
+          sender.cancel();
+          _fail(id, _takeString(err));
+        }
+      },
+      onError: (Object err) => _fail(id, err.toString()),
+      onDone: () {
+        final err = _stop(id);
+        if (err != nullptr) {
+          _fail(id, _takeString(err));
+        }
+      },
+      cancelOnError: true,
+    );
+
+    return sender;
+  }
+
+  /// _fail cancels the call and fails it with the error, unless it already
+  /// ended. The end of the stream is delivered with the status of the call
+  /// by the library, and is therefore ignored.
+  void _fail(int id, String err) {
+    if (err == 'EOF') {
+      return;
+    }
+
+    final call = _calls.remove(id);
+    if (call != null) {
+      _cancel(id);
+      call.onError(FalafelException(err));
+    }
+  }
+
+  /// _withMessage passes msg in C memory to fn, and frees it afterwards, as
+  /// the library copies it.
+  T _withMessage<T>(Uint8List msg, T Function(Pointer<Uint8>, int) fn) {
+    final p = _alloc(msg.isEmpty ? 1 : msg.length);
+    try {
+      p.asTypedList(msg.length).setAll(0, msg);
+      return fn(p, msg.length);
+    } finally {
+      _free(p);
+    }
+  }
+
+  /// _takeString decodes and frees a NUL-terminated string returned by the
+  /// library.
+  String _takeString(Pointer<Uint8> p) {
+    var len = 0;
+    while (p[len] != 0) {
+      len++;
+    }
+
+    final s = utf8.decode(p.asTypedList(len));
+    _free(p);
+
+    return s;
+  }
+}
+`))
+
+// reactNativeParams is a struct that holds all data passed in to the templates
+// of the React Native method table.
+type reactNativeParams struct {
+	ToolName string
+	FileName string
+	Package  string
+	BuildTag string
+
+	// JSONEncoding indicates whether the payloads of the mobile APIs are
+	// JSON-encoded, which are passed as strings as they are instead of
+	// base64-encoded.
+	JSONEncoding bool
+
+	// Module is the name of the TurboModule of the service.
+	Module string
+
+	// Methods are the methods of the service in its TurboModule spec.
+	Methods []reactNativeMethod
+}
+
+// reactNativeMethod is a method of the TurboModule spec of a service.
+type reactNativeMethod struct {
+	rpcParams
+
+	// Name is the name of the method in the spec.
+	Name string
+}
+
+// reactNativeRuntimeTemplate creates the part of the React Native method table
+// shared by all services, which tracks the calls started through it and
+// exports the functions the native modules call.
+var reactNativeRuntimeTemplate = template.Must(template.New("reactNativeRuntime").Parse(`// Code generated by {{.ToolName}}. DO NOT EDIT.
+{{if .BuildTag}}
+{{.BuildTag}}
+{{end}}
+package {{.Package}}
+
+import (
+{{- if not .JSONEncoding}}
+	"encoding/base64"
+{{- end}}
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ReactNativeEvents is an interface that is used to receive the results of
+// the calls started through ReactNativeCall. The native module of a
+// TurboModule settles the promises of its methods returning a single
+// response with them, and emits the results of its streams as events.
+// Payloads are {{if .JSONEncoding}}JSON-encoded protos{{else}}base64-encoded serialized protos{{end}}.
+type ReactNativeEvents interface {
+	// OnResponse is called with a response of the call with the given
+	// ID.
+	OnResponse(id string, response string)
+
+	// OnError is called with the message of the error ending the call
+	// with the given ID.
+	OnError(id string, message string)
+
+	// OnEnd is called once the response stream of the call with the given
+	// ID ended.
+	OnEnd(id string)
+}
+
+// rnMethod starts the calls of a method of a TurboModule spec through its
+// WithContext API.
+type rnMethod struct {
+	// single indicates whether the method delivers a single response,
+	// which ends the call.
+	single bool
+
+	// call starts a call of a method taking a single request.
+	call func(token *CancelToken, msg []byte, c *rnCall)
+
+	// open starts a call of a method taking a stream of requests.
+	open func(token *CancelToken, c *rnCall) (SendStream, error)
+}
+
+// rnCall is a call started through ReactNativeCall, which delivers its
+// results to the events it was started with. It is the Callback or RecvStream
+// of the call.
+type rnCall struct {
+	id     string
+	events ReactNativeEvents
+	single bool
+
+	// token cancels the call.
+	token *CancelToken
+
+	// stream is the send stream of a client-streaming or bidirectional
+	// call.
+	stream SendStream
+}
+
+var (
+	// rnMethods maps the methods of the TurboModule specs, by their
+	// module and name, e.g. Lightning.getInfo, to the functions starting
+	// their calls.
+	rnMethods = make(map[string]rnMethod)
+
+	// rnCallsMtx guards rnCalls and the streams of the calls.
+	rnCallsMtx sync.Mutex
+
+	// rnCalls are the calls started through ReactNativeCall that didn't
+	// end yet, by their ID.
+	rnCalls = make(map[string]*rnCall)
+)
+
+// lookupRNCall returns the call with the given ID, or nil if it ended.
+func lookupRNCall(id string) *rnCall {
+	rnCallsMtx.Lock()
+	defer rnCallsMtx.Unlock()
+
+	return rnCalls[id]
+}
+
+// setStream sets the send stream of the call, unless it already ended.
+func (c *rnCall) setStream(stream SendStream) {
+	rnCallsMtx.Lock()
+	defer rnCallsMtx.Unlock()
+
+	if rnCalls[c.id] == c {
+		c.stream = stream
+	}
+}
+
+// sendStream returns the send stream of the call.
+func (c *rnCall) sendStream() (SendStream, error) {
+	rnCallsMtx.Lock()
+	defer rnCallsMtx.Unlock()
+
+	if c.stream == nil {
+		return nil, errors.New("call has no send stream")
+	}
+
+	return c.stream, nil
+}
+
+// end unregisters the call, and releases its token.
+func (c *rnCall) end() {
+	rnCallsMtx.Lock()
+	if rnCalls[c.id] == c {
+		delete(rnCalls, c.id)
+	}
+	rnCallsMtx.Unlock()
+
+	c.token.Cancel()
+}
+
+// OnResponse delivers a response of the call.
+func (c *rnCall) OnResponse(resp []byte) {
+	if c.single {
+		c.end()
+	}
+
+	c.events.OnResponse(c.id, encodeRNPayload(resp))
+}
+
+// OnError delivers the error ending the call, or the end of its stream.
+func (c *rnCall) OnError(err error) {
+	c.end()
+
+	if errors.Is(err, io.EOF) {
+		c.events.OnEnd(c.id)
+		return
+	}
+
+	c.events.OnError(c.id, err.Error())
+}
+
+// encodeRNPayload encodes a payload of the mobile APIs as string, as
+// TurboModules can't pass bytes.
+func encodeRNPayload(payload []byte) string {
+{{- if .JSONEncoding}}
+	return string(payload)
+{{- else}}
+	return base64.StdEncoding.EncodeToString(payload)
+{{- end}}
+}
+
+// decodeRNPayload decodes a payload of the mobile APIs passed by a TurboModule.
+func decodeRNPayload(payload string) ([]byte, error) {
+{{- if .JSONEncoding}}
+	return []byte(payload), nil
+{{- else}}
+	return base64.StdEncoding.DecodeString(payload)
+{{- end}}
+}
+
+// ReactNativeCall starts a call of the method with the given name in the
+// TurboModule spec of module, e.g. getInfo of Lightning, identified by id. The
+// ID must not be used by another call that didn't end yet. The request is
+// ignored by client-streaming and bidirectional methods, whose requests are
+// sent with ReactNativeSend. An error is only returned if the call couldn't be
+// started, its results are delivered to events otherwise.
+func ReactNativeCall(module, method, id, request string,
+	events ReactNativeEvents) error {
+
+	m, ok := rnMethods[module+"."+method]
+	if !ok {
+		return fmt.Errorf("unknown method %s of module %s", method,
+			module)
+	}
+
+	var msg []byte
+	if m.call != nil {
+		var err error
+		msg, err = decodeRNPayload(request)
+		if err != nil {
+			return fmt.Errorf("unable to decode request: %w", err)
+		}
+	}
+
+	c := &rnCall{
+		id:     id,
+		events: events,
+		single: m.single,
+		token:  NewCancelToken(),
+	}
+
+	rnCallsMtx.Lock()
+	if _, ok := rnCalls[id]; ok {
+		rnCallsMtx.Unlock()
+		return fmt.Errorf("call %s already started", id)
+	}
+	rnCalls[id] = c
+	rnCallsMtx.Unlock()
+
+	if m.call != nil {
+		m.call(c.token, msg, c)
+		return nil
+	}
+
+	stream, err := m.open(c.token, c)
+	if err != nil {
+		c.end()
+		return err
+	}
+	c.setStream(stream)
+
+	return nil
+}
+
+// ReactNativeSend sends the request to the stream of the client-streaming or
+// bidirectional call with the given ID.
+func ReactNativeSend(id, request string) error {
+	c := lookupRNCall(id)
+	if c == nil {
+		return io.EOF
+	}
+
+	stream, err := c.sendStream()
+	if err != nil {
+		return err
+	}
+
+	msg, err := decodeRNPayload(request)
+	if err != nil {
+		return fmt.Errorf("unable to decode request: %w", err)
+	}
+
+	return stream.Send(msg)
+}
+
+// ReactNativeCloseSend closes the request stream of the client-streaming or
+// bidirectional call with the given ID. Calls that already ended are ignored.
+func ReactNativeCloseSend(id string) error {
+	c := lookupRNCall(id)
+	if c == nil {
+		return nil
+	}
+
+	stream, err := c.sendStream()
+	if err != nil {
+		return err
+	}
+
+	return stream.Stop()
+}
+
+// ReactNativeCancel cancels the call with the given ID. Calls that already
+// ended are ignored.
+func ReactNativeCancel(id string) {
+	if c := lookupRNCall(id); c != nil {
+		c.token.Cancel()
+	}
+}
+`))
+
+// reactNativeTemplate creates the method table of the TurboModule spec of a
+// service, registering a function per method that starts a call through the
+// WithContext API of the method.
+var reactNativeTemplate = template.Must(template.New("reactNative").Parse(`// Code generated by {{.ToolName}}. DO NOT EDIT.
+// source: {{.FileName}}
+{{if .BuildTag}}
+{{.BuildTag}}
+{{end}}
+package {{.Package}}
+
+func init() {
+	// Register the methods of the TurboModule spec of the service, such
+	// that they can be called through ReactNativeCall.
+{{- range .Methods}}
+	rnMethods["{{$.Module}}.{{.Name}}"] = rnMethod{
+		single: {{not .ServerStream}},
+{{- if .ClientStream}}
+		open: func(token *CancelToken, c *rnCall) (SendStream, error) {
+			return {{.ApiPrefix}}{{.MethodName}}WithContext(token, c)
+		},
+{{- else}}
+		call: func(token *CancelToken, msg []byte, c *rnCall) {
+			{{.ApiPrefix}}{{.MethodName}}WithContext(token, msg, c)
 		},
+{{- end}}
+	}
+{{- end}}
+}
+`))
+
+// jsonCodecsParams is a struct that holds all data passed in to the JSON codecs
+// template.
+type jsonCodecsParams struct {
+	ToolName string
+	Package  string
+	BuildTag string
+
+	// Codecs indicates whether the JSON field codecs and the resolver can
+	// be registered.
+	Codecs bool
+
+	// EmptyLists is how empty lists and maps of responses are encoded,
+	// either emit or omit, or empty if lists and maps aren't normalized.
+	EmptyLists string
+
+	// Times is how the times of responses are encoded, either rfc3339 or
+	// epoch, or empty if times aren't converted.
+	Times string
+}
+
+// jsonCodecsTemplate creates the registry of the JSON field codecs and the
+// resolver used by the JSON stubs, together with the functions applying them,
+// normalizing lists and maps and converting times.
+var jsonCodecsTemplate = template.Must(template.New("jsonCodecs").Parse(`// Code generated by {{.ToolName}}. DO NOT EDIT.
+{{if .BuildTag}}
+{{.BuildTag}}
+{{end}}
+package {{.Package}}
+
+import (
+	"encoding/json"
+{{- if .Times}}
+	"fmt"
+	"strconv"
+{{- end}}
+	"strings"
+{{- if .Codecs}}
+	"sync"
+{{- end}}
+{{- if .Times}}
+	"time"
+{{- end}}
+
+	gateway "github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+{{- if .Codecs}}
+	"google.golang.org/protobuf/reflect/protoregistry"
+{{- end}}
+)
+{{- if .Codecs}}
+
+// JSONFieldCodec converts the JSON encoding of a field crossing the JSON
+// boundary, for fields that round-trip poorly through the standard encoding,
+// such as google.protobuf.Any or map<string, bytes> fields.
+type JSONFieldCodec interface {
+	// Encode converts the standard JSON encoding of the field value of a
+	// response into the representation used by the host.
+	Encode(value []byte) ([]byte, error)
+
+	// Decode converts the field value of a request from the
+	// representation used by the host into the standard JSON encoding.
+	Decode(value []byte) ([]byte, error)
+}
+
+// JSONResolver resolves the message types embedded in google.protobuf.Any
+// fields.
+type JSONResolver interface {
+	protoregistry.ExtensionTypeResolver
+	protoregistry.MessageTypeResolver
+}
+
+var (
+	// jsonCodecs are the registered field codecs, keyed by the full name
+	// of the field.
+	jsonCodecs = make(map[protoreflect.FullName]JSONFieldCodec)
+
+	// jsonResolver is the resolver set by the host, if any.
+	jsonResolver JSONResolver
+
+	// jsonCodecsMtx guards access to the codecs and the resolver.
+	jsonCodecsMtx sync.RWMutex
+)
+
+// RegisterJSONFieldCodec registers the codec for the field with the given full
+// name, e.g. lnrpc.Invoice.features. A nil codec removes the registered one.
+func RegisterJSONFieldCodec(field string, codec JSONFieldCodec) {
+	jsonCodecsMtx.Lock()
+	defer jsonCodecsMtx.Unlock()
+
+	if codec == nil {
+		delete(jsonCodecs, protoreflect.FullName(field))
+		return
+	}
+
+	jsonCodecs[protoreflect.FullName(field)] = codec
+}
+
+// SetJSONResolver sets the resolver used for the message types embedded in
+// google.protobuf.Any fields, instead of the global registry. A nil resolver
+// restores the global registry.
+func SetJSONResolver(resolver JSONResolver) {
+	jsonCodecsMtx.Lock()
+	defer jsonCodecsMtx.Unlock()
+
+	jsonResolver = resolver
+}
+{{- end}}
+
+// marshalJSON marshals the response{{if .Codecs}} using the registered resolver and codecs{{end}}.
+{{- if eq .EmptyLists "omit"}}
+// Empty lists and maps are omitted instead of being encoded as [] or {}.
+{{- end}}
+{{- if eq .Times "rfc3339"}}
+// Times are encoded as RFC 3339 strings.
+{{- else if eq .Times "epoch"}}
+// Times and durations are encoded as numbers of seconds.
+{{- end}}
+func marshalJSON(marshaler *gateway.JSONPb, resp proto.Message) ([]byte,
+	error) {
+{{- if .Codecs}}
+
+	jsonCodecsMtx.RLock()
+	defer jsonCodecsMtx.RUnlock()
+
+	m := *marshaler
+	if jsonResolver != nil {
+		m.MarshalOptions.Resolver = jsonResolver
+	}
+
+	b, err := m.Marshal(resp)
+{{- else}}
+
+	b, err := marshaler.Marshal(resp)
+{{- end}}
+	if err != nil {
+		return nil, err
+	}
+{{- if eq .EmptyLists "omit"}}
+
+	b, err = normalizeJSONLists(resp.ProtoReflect().Descriptor(), b, true)
+	if err != nil {
+		return nil, err
+	}
+{{- end}}
+{{- if .Times}}
+
+	b, err = convertJSONTimes(resp.ProtoReflect().Descriptor(), b, true)
+	if err != nil {
+		return nil, err
+	}
+{{- end}}
+{{- if .Codecs}}
+
+	return applyJSONCodecs(resp.ProtoReflect().Descriptor(), b, true)
+{{- else}}
+
+	return b, nil
+{{- end}}
+}
+
+// unmarshalJSON unmarshals the request{{if .Codecs}} using the registered resolver and
+// codecs{{end}}.
+{{- if .EmptyLists}}
+// Null elements of lists and null values of maps are dropped, as they can't be
+// unmarshaled.
+{{- end}}
+{{- if .Times}}
+// Times may be given either as RFC 3339 strings or as numbers of seconds.
+{{- end}}
+func unmarshalJSON(marshaler *gateway.JSONPb, reqJSON string,
+	req proto.Message) error {
+{{- if .Codecs}}
+
+	jsonCodecsMtx.RLock()
+	defer jsonCodecsMtx.RUnlock()
+
+	b, err := applyJSONCodecs(
+		req.ProtoReflect().Descriptor(), []byte(reqJSON), false,
+	)
+	if err != nil {
+		return err
+	}
+{{- end}}
+{{- if .EmptyLists}}
+
+	b{{if .Codecs}}, err ={{else}}, err :={{end}} normalizeJSONLists(
+		req.ProtoReflect().Descriptor(), {{if .Codecs}}b{{else}}[]byte(reqJSON){{end}}, false,
+	)
+	if err != nil {
+		return err
+	}
+{{- end}}
+{{- if .Times}}
+
+	b{{if or .Codecs .EmptyLists}}, err ={{else}}, err :={{end}} convertJSONTimes(
+		req.ProtoReflect().Descriptor(), {{if or .Codecs .EmptyLists}}b{{else}}[]byte(reqJSON){{end}}, false,
+	)
+	if err != nil {
+		return err
+	}
+{{- end}}
+{{- if .Codecs}}
+
+	m := *marshaler
+	if jsonResolver != nil {
+		m.UnmarshalOptions.Resolver = jsonResolver
+	}
+
+	return m.Unmarshal(b, req)
+{{- else}}
+
+	return marshaler.Unmarshal(b, req)
+{{- end}}
+}
+{{- if .Codecs}}
+
+// applyJSONCodecs encodes or decodes the fields of the JSON encoded message b
+// of the given type that have a registered codec. The caller must hold the
+// read lock of jsonCodecsMtx.
+func applyJSONCodecs(desc protoreflect.MessageDescriptor, b []byte,
+	encode bool) ([]byte, error) {
+
+	if len(jsonCodecs) == 0 {
+		return b, nil
+	}
+
+	return transformJSONMessage(desc, b, encode)
+}
+
+// transformJSONMessage applies the codecs to the fields of a single JSON
+// encoded message, recursing into nested messages.
+func transformJSONMessage(desc protoreflect.MessageDescriptor,
+	value json.RawMessage, encode bool) (json.RawMessage, error) {
+
+	// Well-known types have a special JSON encoding and null values have
+	// no fields, so there is nothing to transform.
+	if strings.HasPrefix(string(desc.FullName()), "google.protobuf.") ||
+		string(value) == "null" {
+
+		return value, nil
+	}
+
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(value, &obj); err != nil {
+		return nil, err
+	}
+
+	fields := desc.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+
+		// Requests may use either the proto or the JSON field name.
+		name := string(field.Name())
+		fieldValue, ok := obj[name]
+		if !ok {
+			name = field.JSONName()
+			if fieldValue, ok = obj[name]; !ok {
+				continue
+			}
+		}
+
+		var err error
+		switch codec, ok := jsonCodecs[field.FullName()]; {
+		case ok && encode:
+			fieldValue, err = codec.Encode(fieldValue)
+
+		case ok:
+			fieldValue, err = codec.Decode(fieldValue)
+
+		case field.IsMap() &&
+			field.MapValue().Kind() == protoreflect.MessageKind:
+
+			fieldValue, err = transformJSONMap(
+				field.MapValue().Message(), fieldValue, encode,
+			)
+
+		case field.IsList() &&
+			field.Kind() == protoreflect.MessageKind:
+
+			fieldValue, err = transformJSONList(
+				field.Message(), fieldValue, encode,
+			)
+
+		case !field.IsMap() && !field.IsList() &&
+			field.Kind() == protoreflect.MessageKind:
+
+			fieldValue, err = transformJSONMessage(
+				field.Message(), fieldValue, encode,
+			)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		obj[name] = fieldValue
+	}
+
+	return json.Marshal(obj)
+}
+
+// transformJSONList applies the codecs to a JSON encoded list of messages.
+func transformJSONList(desc protoreflect.MessageDescriptor,
+	value json.RawMessage, encode bool) (json.RawMessage, error) {
+
+	if string(value) == "null" {
+		return value, nil
+	}
+
+	var list []json.RawMessage
+	if err := json.Unmarshal(value, &list); err != nil {
+		return nil, err
+	}
+
+	for i := range list {
+		var err error
+		list[i], err = transformJSONMessage(desc, list[i], encode)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(list)
+}
+
+// transformJSONMap applies the codecs to a JSON encoded map of messages.
+func transformJSONMap(desc protoreflect.MessageDescriptor,
+	value json.RawMessage, encode bool) (json.RawMessage, error) {
+
+	if string(value) == "null" {
+		return value, nil
+	}
+
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(value, &entries); err != nil {
+		return nil, err
+	}
+
+	for key, entry := range entries {
+		var err error
+		entries[key], err = transformJSONMessage(desc, entry, encode)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(entries)
+}
+{{- end}}
+{{- if .EmptyLists}}
+
+// normalizeJSONLists normalizes the lists and maps of the JSON encoded message
+// b of the given type, recursing into nested messages. Empty lists and maps of
+// encoded responses are removed, while null elements of lists and null values
+// of maps are dropped from the requests being decoded.
+func normalizeJSONLists(desc protoreflect.MessageDescriptor,
+	value json.RawMessage, encode bool) (json.RawMessage, error) {
+
+	// Well-known types have a special JSON encoding and null values have
+	// no fields, so there is nothing to normalize.
+	if strings.HasPrefix(string(desc.FullName()), "google.protobuf.") ||
+		string(value) == "null" {
+
+		return value, nil
+	}
+
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(value, &obj); err != nil {
+		return nil, err
+	}
+
+	fields := desc.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+
+		// Requests may use either the proto or the JSON field name.
+		name := string(field.Name())
+		fieldValue, ok := obj[name]
+		if !ok {
+			name = field.JSONName()
+			if fieldValue, ok = obj[name]; !ok {
+				continue
+			}
+		}
+
+		var err error
+		switch {
+		case field.IsMap():
+			fieldValue, err = normalizeJSONMap(
+				field.MapValue(), fieldValue, encode,
+			)
+
+		case field.IsList():
+			fieldValue, err = normalizeJSONList(field, fieldValue, encode)
+
+		case field.Kind() == protoreflect.MessageKind:
+			fieldValue, err = normalizeJSONLists(
+				field.Message(), fieldValue, encode,
+			)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Empty lists and maps are returned as nil if they are
+		// omitted.
+		if fieldValue == nil {
+			delete(obj, name)
+			continue
+		}
+
+		obj[name] = fieldValue
+	}
+
+	return json.Marshal(obj)
+}
+
+// normalizeJSONList normalizes a JSON encoded list field. It returns nil if the
+// list of an encoded response is empty.
+func normalizeJSONList(field protoreflect.FieldDescriptor,
+	value json.RawMessage, encode bool) (json.RawMessage, error) {
+
+	if string(value) == "null" {
+		return value, nil
+	}
+
+	var list []json.RawMessage
+	if err := json.Unmarshal(value, &list); err != nil {
+		return nil, err
+	}
+
+	elems := list[:0]
+	for _, elem := range list {
+		if !encode && string(elem) == "null" && !acceptsJSONNull(field) {
+			continue
+		}
+
+		if field.Kind() == protoreflect.MessageKind {
+			var err error
+			elem, err = normalizeJSONLists(field.Message(), elem, encode)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		elems = append(elems, elem)
+	}
+	if encode && len(elems) == 0 {
+		return nil, nil
+	}
+
+	return json.Marshal(elems)
+}
+
+// normalizeJSONMap normalizes a JSON encoded map field, given the field holding
+// its values. It returns nil if the map of an encoded response is empty.
+func normalizeJSONMap(field protoreflect.FieldDescriptor,
+	value json.RawMessage, encode bool) (json.RawMessage, error) {
+
+	if string(value) == "null" {
+		return value, nil
+	}
+
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(value, &entries); err != nil {
+		return nil, err
+	}
+
+	for key, entry := range entries {
+		if !encode && string(entry) == "null" && !acceptsJSONNull(field) {
+			delete(entries, key)
+			continue
+		}
+
+		if field.Kind() == protoreflect.MessageKind {
+			var err error
+			entries[key], err = normalizeJSONLists(
+				field.Message(), entry, encode,
+			)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if encode && len(entries) == 0 {
+		return nil, nil
+	}
+
+	return json.Marshal(entries)
+}
+
+// acceptsJSONNull returns true if null is a valid JSON value of the elements of
+// the field, which is only the case for google.protobuf.Value.
+func acceptsJSONNull(field protoreflect.FieldDescriptor) bool {
+	return field.Kind() == protoreflect.MessageKind &&
+		field.Message().FullName() == "google.protobuf.Value"
+}
+{{- end}}
+{{- if .Times}}
+
+// convertJSONTimes converts the times of the JSON encoded message b of the given
+// type, recursing into nested messages. These are the google.protobuf.Timestamp
+// and google.protobuf.Duration fields, and the integer fields holding unix
+// times, as found by jsonUnixTime. Times of encoded responses are given as
+{{- if eq .Times "epoch"}}
+// numbers of seconds, while requests may give them as numbers of seconds or
+// RFC 3339 strings.
+{{- else}}
+// RFC 3339 strings, while requests may give them as RFC 3339 strings or in the
+// unit of the field.
+{{- end}}
+func convertJSONTimes(desc protoreflect.MessageDescriptor,
+	value json.RawMessage, encode bool) (json.RawMessage, error) {
+
+	// Well-known types have a special JSON encoding and null values have
+	// no fields, so there is nothing to convert.
+	if strings.HasPrefix(string(desc.FullName()), "google.protobuf.") ||
+		string(value) == "null" {
+
+		return value, nil
+	}
+
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(value, &obj); err != nil {
+		return nil, err
+	}
+
+	fields := desc.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+
+		// Requests may use either the proto or the JSON field name.
+		name := string(field.Name())
+		fieldValue, ok := obj[name]
+		if !ok {
+			name = field.JSONName()
+			if fieldValue, ok = obj[name]; !ok {
+				continue
+			}
+		}
+
+		// The values of maps are converted like singular fields.
+		elem := field
+		if field.IsMap() {
+			elem = field.MapValue()
+		}
+
+		var convert func(json.RawMessage) (json.RawMessage, error)
+		switch {
+		case elem.Kind() != protoreflect.MessageKind:
+			isTime, nanos := jsonUnixTime(elem)
+			if !isTime {
+				continue
+			}
+			convert = func(v json.RawMessage) (json.RawMessage, error) {
+				return convertJSONUnixTime(v, nanos, encode)
+			}
+
+		case elem.Message().FullName() == "google.protobuf.Timestamp":
+			convert = func(v json.RawMessage) (json.RawMessage, error) {
+				return convertJSONTimestamp(v, encode)
+			}
+
+		case elem.Message().FullName() == "google.protobuf.Duration":
+			convert = func(v json.RawMessage) (json.RawMessage, error) {
+				return convertJSONDuration(v, encode)
+			}
+
+		default:
+			msg := elem.Message()
+			convert = func(v json.RawMessage) (json.RawMessage, error) {
+				return convertJSONTimes(msg, v, encode)
+			}
+		}
+
+		fieldValue, err := convertJSONValues(field, fieldValue, convert)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time of field %s: %w",
+				field.FullName(), err)
+		}
+
+		obj[name] = fieldValue
+	}
+
+	return json.Marshal(obj)
+}
+
+// convertJSONValues applies convert to the JSON encoded value of a singular
+// field, or to each element of a list or value of a map.
+func convertJSONValues(field protoreflect.FieldDescriptor,
+	value json.RawMessage,
+	convert func(json.RawMessage) (json.RawMessage, error)) (
+	json.RawMessage, error) {
+
+	if string(value) == "null" {
+		return value, nil
+	}
+
+	switch {
+	case field.IsList():
+		var list []json.RawMessage
+		if err := json.Unmarshal(value, &list); err != nil {
+			return nil, err
+		}
+
+		for i := range list {
+			var err error
+			list[i], err = convert(list[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return json.Marshal(list)
+
+	case field.IsMap():
+		var entries map[string]json.RawMessage
+		if err := json.Unmarshal(value, &entries); err != nil {
+			return nil, err
+		}
+
+		for key, entry := range entries {
+			var err error
+			entries[key], err = convert(entry)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return json.Marshal(entries)
+
+	default:
+		return convert(value)
+	}
+}
+
+// jsonUnixTime returns whether the integer field holds a unix time, which is
+// assumed for fields named timestamp or ending in _timestamp, _date or _time,
+// e.g. creation_date. These hold seconds, unless their name ends in _ns, e.g.
+// creation_time_ns, in which case nanos is true.
+func jsonUnixTime(field protoreflect.FieldDescriptor) (bool, bool) {
+	switch field.Kind() {
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind,
+		protoreflect.Sfixed32Kind, protoreflect.Uint32Kind,
+		protoreflect.Fixed32Kind, protoreflect.Int64Kind,
+		protoreflect.Sint64Kind, protoreflect.Sfixed64Kind,
+		protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+
+	default:
+		return false, false
+	}
+
+	name := string(field.Name())
+	nanos := strings.HasSuffix(name, "_ns")
+	name = strings.TrimSuffix(name, "_ns")
+
+	isTime := name == "timestamp" || strings.HasSuffix(name, "_timestamp") ||
+		strings.HasSuffix(name, "_date") || strings.HasSuffix(name, "_time")
+
+	return isTime, nanos
+}
+
+// convertJSONUnixTime converts the JSON encoded value of an integer field
+// holding a unix time in seconds, or in nanoseconds if nanos is true.
+func convertJSONUnixTime(value json.RawMessage, nanos,
+	encode bool) (json.RawMessage, error) {
+
+	// The standard encoding gives 64-bit integers as strings.
+	var s string
+	if err := json.Unmarshal(value, &s); err != nil {
+		s = string(value)
+	} else if !encode {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			// Anything but a time is left to the standard
+			// encoding.
+			return value, nil
+		}
+
+		if nanos {
+			return json.Marshal(strconv.FormatInt(t.UnixNano(), 10))
+		}
+
+		return json.Marshal(strconv.FormatInt(t.Unix(), 10))
+	}
+{{- if eq .Times "epoch"}}
+
+	// Requests give numbers in seconds.
+	if !encode {
+		if !nanos {
+			return value, nil
+		}
+
+		ns, err := parseJSONSeconds(value)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(strconv.FormatInt(ns, 10))
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if nanos {
+		return formatJSONSeconds(n), nil
+	}
+
+	return json.RawMessage(strconv.FormatInt(n, 10)), nil
+{{- else}}
+
+	// Requests give numbers in the unit of the field.
+	if !encode {
+		return value, nil
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	// An unset time is encoded as null rather than the epoch.
+	if n == 0 {
+		return json.RawMessage("null"), nil
+	}
+
+	t := time.Unix(n, 0)
+	if nanos {
+		t = time.Unix(0, n)
+	}
+
+	return json.Marshal(t.UTC().Format(time.RFC3339Nano))
+{{- end}}
+}
+
+// convertJSONTimestamp converts the JSON encoded value of a
+// google.protobuf.Timestamp, which the standard encoding gives as RFC 3339
+// string.
+func convertJSONTimestamp(value json.RawMessage,
+	encode bool) (json.RawMessage, error) {
+
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+{{- if eq .Times "epoch"}}
+		if !encode {
+			return value, nil
+		}
+
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, err
+		}
+
+		return formatJSONSeconds(t.UnixNano()), nil
+{{- else}}
+		return value, nil
+{{- end}}
+	}
+
+	// Requests may give the time in seconds.
+	ns, err := parseJSONSeconds(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(time.Unix(0, ns).UTC().Format(time.RFC3339Nano))
+}
+
+// convertJSONDuration converts the JSON encoded value of a
+// google.protobuf.Duration, which the standard encoding gives as string of
+// seconds with an s suffix, e.g. "1.5s".
+func convertJSONDuration(value json.RawMessage,
+	encode bool) (json.RawMessage, error) {
+
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+{{- if eq .Times "epoch"}}
+		if !encode {
+			return value, nil
+		}
+
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, err
+		}
+
+		return formatJSONSeconds(int64(d)), nil
+{{- else}}
+		return value, nil
+{{- end}}
+	}
+
+	// Requests may give the duration as number of seconds.
+	ns, err := parseJSONSeconds(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(string(formatJSONSeconds(ns)) + "s")
+}
+
+// parseJSONSeconds parses a JSON number of seconds, which may have a fraction,
+// into nanoseconds.
+func parseJSONSeconds(value json.RawMessage) (int64, error) {
+	var n json.Number
+	if err := json.Unmarshal(value, &n); err != nil {
+		return 0, err
+	}
+
+	d, err := time.ParseDuration(n.String() + "s")
+	if err != nil {
+		return 0, fmt.Errorf("invalid seconds %s", n)
+	}
+
+	return int64(d), nil
+}
+
+// formatJSONSeconds formats the nanoseconds as JSON number of seconds, with a
+// fraction only if needed.
+func formatJSONSeconds(ns int64) json.RawMessage {
+	sign := ""
+	if ns < 0 {
+		sign, ns = "-", -ns
+	}
+
+	s := sign + strconv.FormatInt(ns/int64(time.Second), 10)
+	if frac := ns % int64(time.Second); frac != 0 {
+		s += strings.TrimRight(fmt.Sprintf(".%09d", frac), "0")
+	}
+
+	return json.RawMessage(s)
+}
+{{- end}}
+`))
+
+var jsTemplate = template.Must(template.New("jsHeader").Funcs(funcMap).Parse(`// Code generated by {{.ToolName}}. DO NOT EDIT.
+// source: {{.FileName}}
+{{if .BuildTag}}
+{{.BuildTag}}
+{{end}}
+package {{if .OutputPackage}}{{.OutputPackage}}{{else}}{{.Package}}{{end}}
+
+import (
+{{- if .GzipJSON}}
+	"bytes"
+	"compress/gzip"
+{{- end}}
+	"context"
+{{- if .GzipJSON}}
+	"encoding/base64"
+{{- end}}
+{{- if .FieldMasks}}
+	"encoding/json"
+{{- end}}
+{{- if or .ErrorContext .RequiredFields}}
+	"fmt"
+{{- end}}
+{{- if .ErrorContext}}
+	"io"
+{{- end}}
+{{- if eq .StreamFraming "length_prefixed"}}
+	"strconv"
+{{- end}}
+{{- if or .ErrorContext .FieldMasks}}
+	"strings"
+{{- end}}
+{{- if .ClientStreams}}
+	"sync"
+{{- end}}
+{{- if .Timeouts}}
+	"time"
+{{- end}}
+{{- if eq .StreamFraming "length_prefixed"}}
+	"unicode/utf16"
+{{- end}}
+
+	gateway "github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+{{- range .Imports }}
+	{{if .Alias}}{{.Alias}} {{end}}"{{.Path}}"
+{{- end }}
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+{{- if .RequiredFields}}
+	"google.golang.org/protobuf/reflect/protoreflect"
+{{- end}}
+)
+
+{{- define "unaryRpcFunc"}}
+		req := &{{.RequestType}}{}
+{{- if .JSONCodecs}}
+		err := unmarshalJSON(marshaler, reqJSON, req)
+{{- else}}
+		err := marshaler.Unmarshal([]byte(reqJSON), req)
+{{- end}}
+		if err != nil {
+			callback("", err)
+			return
+		}
+{{- if .Defaults}}
+
+		// Inject the defaults of unset request fields.
+{{- range .Defaults}}
+		if {{.Unset "req"}} {
+			req.{{.Field}} = {{.Value}}
+		}
+{{- end}}
+{{- end}}
+
+		client := {{if .TargetName}}{{.TargetName}}.{{end}}New{{.ServiceName}}Client(conn)
+		resp, err := client.{{.MethodName}}(ctx, req{{if .Compressor}}, grpc.UseCompressor({{.Compressor}}.Name){{end}})
+		if err != nil {
+			callback("", err)
+			return
+		}
+
+{{- if .JSONCodecs}}
+		respBytes, err := marshalJSON(marshaler, resp)
+{{- else}}
+		respBytes, err := marshaler.Marshal(resp)
+{{- end}}
+		if err != nil {
+			callback("", err)
+			return
+		}
+{{- if .GzipJSON}}
+
+		respJSON, err := encodeResponse(respBytes)
+		if err != nil {
+			callback("", err)
+			return
+		}
+		callback(respJSON, nil)
+{{- else}}
+		callback(string(respBytes), nil)
+{{- end}}
+{{- end}}
+
+{{- define "streamRpcFunc"}}
+		req := &{{.RequestType}}{}
+{{- if .JSONCodecs}}
+		err := unmarshalJSON(marshaler, reqJSON, req)
+{{- else}}
+		err := marshaler.Unmarshal([]byte(reqJSON), req)
+{{- end}}
+		if err != nil {
+			callback("", err)
+			return
+		}
+{{- if .Defaults}}
+
+		// Inject the defaults of unset request fields.
+{{- range .Defaults}}
+		if {{.Unset "req"}} {
+			req.{{.Field}} = {{.Value}}
+		}
+{{- end}}
+{{- end}}
+
+		client := {{if .TargetName}}{{.TargetName}}.{{end}}New{{.ServiceName}}Client(conn)
+		stream, err := client.{{.MethodName}}(ctx, req{{if .Compressor}}, grpc.UseCompressor({{.Compressor}}.Name){{end}})
+		if err != nil {
+			callback("", err)
+			return
+		}
+{{- if .FieldMask}}
+
+		// Only the fields selected by the field mask are delivered.
+		fieldMask := []string{
+{{- range $i, $path := .FieldMask}}{{if $i}}, {{end}}"{{$path}}"{{end -}}
+		}
+{{- end}}
+{{- if .StreamFraming}}
+
+		// Receive the responses in the background, so all responses
+		// received while a chunk is delivered are batched into the
+		// next one.
+		frames := make(chan []byte, maxStreamBatch-1)
+		var recvErr error
+		go func() {
+			defer close(frames)
+
+			for {
+				select {
+				case <-stream.Context().Done():
+					recvErr = stream.Context().Err()
+					return
+				default:
+				}
+
+				resp, err := stream.Recv()
+				if err != nil {
+					recvErr = err
+					return
+				}
+
+{{- if .JSONCodecs}}
+				respBytes, err := marshalJSON(marshaler, resp)
+{{- else}}
+				respBytes, err := marshaler.Marshal(resp)
+{{- end}}
+				if err != nil {
+					recvErr = err
+					return
+				}
+{{- if .FieldMask}}
+
+				respBytes, err = pruneJSON(respBytes, fieldMask)
+				if err != nil {
+					recvErr = err
+					return
+				}
+{{- end}}
+
+				frames <- respBytes
+			}
+		}()
+
+		go func() {
+			for respBytes := range frames {
+				chunk := appendFrame(nil, respBytes)
+				for n := len(frames); n > 0; n-- {
+					chunk = appendFrame(chunk, <-frames)
+				}
+{{- if .GzipJSON}}
+
+				respJSON, err := encodeResponse(chunk)
+				if err != nil {
+					callback("", err)
+					return
+				}
+				callback(respJSON, nil)
+{{- else}}
+				callback(string(chunk), nil)
+{{- end}}
+			}
+
+			callback("", recvErr)
+		}()
+{{- else}}
+
+		go func() {
+			for {
+				select {
+				case <-stream.Context().Done():
+					callback("", stream.Context().Err())
+					return
+				default:
+				}
+
+				resp, err := stream.Recv()
+				if err != nil {
+					callback("", err)
+					return
+				}
+
+{{- if .JSONCodecs}}
+				respBytes, err := marshalJSON(marshaler, resp)
+{{- else}}
+				respBytes, err := marshaler.Marshal(resp)
+{{- end}}
+				if err != nil {
+					callback("", err)
+					return
+				}
+{{- if .FieldMask}}
+
+				respBytes, err = pruneJSON(respBytes, fieldMask)
+				if err != nil {
+					callback("", err)
+					return
+				}
+{{- end}}
+{{- if .GzipJSON}}
+
+				respJSON, err := encodeResponse(respBytes)
+				if err != nil {
+					callback("", err)
+					return
+				}
+				callback(respJSON, nil)
+{{- else}}
+				callback(string(respBytes), nil)
+{{- end}}
+			}
+		}()
+{{- end}}
+{{- end}}
+
+{{- define "jsEncodeResponse"}}
+{{- if .GzipJSON}}
+
+	// encodeResponse compresses a JSON response with gzip and encodes it
+	// as base64, so it crosses the boundary as a much smaller string.
+	encodeResponse := func(respBytes []byte) (string, error) {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(respBytes); err != nil {
+			return "", err
+		}
+		if err := w.Close(); err != nil {
+			return "", err
+		}
+
+		return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+	}
+{{- end}}
+{{- end}}
+
+{{- define "jsMethodError"}}
+{{- if .ErrorContext}}
+
+	// withMethodError prefixes the errors delivered to the callback with
+	// the service and method they originate from. The io.EOF marking the
+	// end of a stream is passed on unchanged.
+	withMethodError := func(method string,
+		callback func(string, error)) func(string, error) {
+
+		method = strings.TrimPrefix(method, "/")
+		return func(resp string, err error) {
+			if err != nil && err != io.EOF {
+				err = fmt.Errorf("%s: %w", method, err)
+			}
+			callback(resp, err)
+		}
+	}
+{{- end}}
+{{- end}}
+
+{{- define "sendStreamRpcFunc"}}
+		client := {{if .TargetName}}{{.TargetName}}.{{end}}New{{.ServiceName}}Client(conn)
+		stream, err := client.{{.MethodName}}(ctx{{if .Compressor}}, grpc.UseCompressor({{.Compressor}}.Name){{end}})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// send deserializes a JSON request and sends it to the
+		// stream.
+		send := func(reqJSON string) error {
+			req := &{{.RequestType}}{}
+{{- if .JSONCodecs}}
+			err := unmarshalJSON(marshaler, reqJSON, req)
+{{- else}}
+			err := marshaler.Unmarshal([]byte(reqJSON), req)
+{{- end}}
+			if err != nil {
+				return err
+			}
+
+			return stream.Send(req)
+		}
+{{- if .ResponseStreaming}}
+
+		go func() {
+			for {
+				resp, err := stream.Recv()
+				if err != nil {
+					callback("", err)
+					return
+				}
+{{template "jsDeliverResponse" .}}
+			}
+		}()
+
+		return send, stream.CloseSend, nil
+{{- else}}
+
+		// The only response is received once the request stream is
+		// closed.
+		var closeOnce sync.Once
+		closeSend := func() error {
+			closeOnce.Do(func() {
+				go func() {
+					resp, err := stream.CloseAndRecv()
+					if err != nil {
+						callback("", err)
+						return
+					}
+{{template "jsDeliverResponse" .}}
+				}()
+			})
+
+			return nil
+		}
+
+		return send, closeSend, nil
+{{- end}}
+{{- end}}
+
+{{- define "jsDeliverResponse"}}
+{{- if .JSONCodecs}}
+				respBytes, err := marshalJSON(marshaler, resp)
+{{- else}}
+				respBytes, err := marshaler.Marshal(resp)
+{{- end}}
+				if err != nil {
+					callback("", err)
+					return
+				}
+{{- if .GzipJSON}}
+
+				respJSON, err := encodeResponse(respBytes)
+				if err != nil {
+					callback("", err)
+					return
+				}
+				callback(respJSON, nil)
+{{- else}}
+				callback(string(respBytes), nil)
+{{- end}}
+{{- end}}
+
+func Register{{.ServiceName | UpperCase}}JSONCallbacks(registry map[string]func(ctx context.Context,
+	conn *grpc.ClientConn, reqJSON string, callback func(string, error))) {
+
+	marshaler := &gateway.JSONPb{
+		MarshalOptions: protojson.MarshalOptions{
+			UseProtoNames:   true,
+			EmitUnpopulated: true,
+		},
+{{- if .DiscardUnknown}}
+		UnmarshalOptions: protojson.UnmarshalOptions{
+			DiscardUnknown: true,
+		},
+{{- end}}
+	}
+{{- template "jsEncodeResponse" .}}
+
+{{- if .StreamFraming}}
+
+	// maxStreamBatch is the maximum number of streamed responses that are
+	// delivered in one chunk.
+	const maxStreamBatch = 100
+
+{{- if eq .StreamFraming "ndjson"}}
+
+	// appendFrame appends a streamed response to the chunk, terminated by
+	// a newline.
+	appendFrame := func(chunk, respBytes []byte) []byte {
+		chunk = append(chunk, respBytes...)
+		return append(chunk, '\n')
+	}
+{{- else}}
+
+	// appendFrame appends a streamed response to the chunk, prefixed with
+	// its length in UTF-16 code units as used by JavaScript strings,
+	// followed by a colon.
+	appendFrame := func(chunk, respBytes []byte) []byte {
+		var length int64
+		for _, r := range string(respBytes) {
+			length += int64(utf16.RuneLen(r))
+		}
+
+		chunk = strconv.AppendInt(chunk, length, 10)
+		chunk = append(chunk, ':')
+		return append(chunk, respBytes...)
+	}
+{{- end}}
+{{- end}}
+{{- if .FieldMasks}}
+
+	// pruneJSON removes all fields from a JSON encoded message that are
+	// not selected by the field mask. Nested fields are selected with
+	// dotted paths, e.g. route.hops, repeated messages are pruned
+	// element-wise.
+	var pruneJSON func(value []byte, paths []string) ([]byte, error)
+	pruneJSON = func(value []byte, paths []string) ([]byte, error) {
+		if len(value) > 0 && value[0] == '[' {
+			var list []json.RawMessage
+			if err := json.Unmarshal(value, &list); err != nil {
+				return nil, err
+			}
+
+			for i := range list {
+				var err error
+				list[i], err = pruneJSON(list[i], paths)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			return json.Marshal(list)
+		}
+
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(value, &fields); err != nil {
+			return nil, err
+		}
+		if fields == nil {
+			return value, nil
+		}
+
+		keep := make(map[string]bool)
+		nested := make(map[string][]string)
+		for _, path := range paths {
+			name, rest, found := strings.Cut(path, ".")
+			if found {
+				nested[name] = append(nested[name], rest)
+			} else {
+				keep[name] = true
+			}
+		}
+
+		for name, field := range fields {
+			switch {
+			case keep[name]:
+
+			case nested[name] != nil:
+				var err error
+				fields[name], err = pruneJSON(field, nested[name])
+				if err != nil {
+					return nil, err
+				}
+
+			default:
+				delete(fields, name)
+			}
+		}
+
+		return json.Marshal(fields)
+	}
+{{- end}}
+{{- template "jsMethodError" .}}
+{{- range $meth := .Methods}}
+
+	registry["{{$.Package}}.{{$.ServiceName}}.{{$meth.MethodName}}"] = func(ctx context.Context,
+		conn *grpc.ClientConn, reqJSON string, callback func(string, error)) {
+{{- if $.ErrorContext}}
+
+		callback = withMethodError("{{$meth.FullMethod}}", callback)
+{{- end}}
+{{- if $meth.ResponseStreaming }}
+{{template "streamRpcFunc" $meth}}
+{{- else }}
+{{template "unaryRpcFunc" $meth}}
+{{- end }}
+	}{{- end}}
+{{- if .CamelCaseAliases}}
+
+	// Register the methods under their camelCase names as well, as
+	// expected by JavaScript consumers.
+{{- range $meth := .Methods}}
+	registry["{{$.Package}}.{{$.ServiceName}}.{{$meth.MethodName | LowerCase}}"] =
+		registry["{{$.Package}}.{{$.ServiceName}}.{{$meth.MethodName}}"]
+{{- end}}
+{{- end}}
+}
+{{- if .SendStreamMethods}}
+
+// Register{{.ServiceName | UpperCase}}JSONSendStreams registers the client-streaming and
+// bidirectional methods, which send a stream of requests. Calling a method
+// starts the stream and returns a function sending a JSON request to it, and a
+// function closing the request stream. The JSON responses are delivered to the
+// callback, for client-streaming methods a single one once the request stream
+// is closed.
+func Register{{.ServiceName | UpperCase}}JSONSendStreams(registry map[string]func(ctx context.Context,
+	conn *grpc.ClientConn, callback func(string, error)) (
+	func(string) error, func() error, error)) {
+
+	marshaler := &gateway.JSONPb{
+		MarshalOptions: protojson.MarshalOptions{
+			UseProtoNames:   true,
+			EmitUnpopulated: true,
+		},
+{{- if .DiscardUnknown}}
+		UnmarshalOptions: protojson.UnmarshalOptions{
+			DiscardUnknown: true,
+		},
+{{- end}}
+	}
+{{- template "jsEncodeResponse" .}}
+{{- template "jsMethodError" .}}
+{{- range $meth := .SendStreamMethods}}
+
+	registry["{{$.Package}}.{{$.ServiceName}}.{{$meth.MethodName}}"] = func(ctx context.Context,
+		conn *grpc.ClientConn, callback func(string, error)) (
+		func(string) error, func() error, error) {
+{{- if $.ErrorContext}}
+
+		callback = withMethodError("{{$meth.FullMethod}}", callback)
+{{- end}}
+{{template "sendStreamRpcFunc" $meth}}
+	}
+{{- end}}
+{{- if .CamelCaseAliases}}
+
+	// Register the methods under their camelCase names as well, as
+	// expected by JavaScript consumers.
+{{- range $meth := .SendStreamMethods}}
+	registry["{{$.Package}}.{{$.ServiceName}}.{{$meth.MethodName | LowerCase}}"] =
+		registry["{{$.Package}}.{{$.ServiceName}}.{{$meth.MethodName}}"]
+{{- end}}
+{{- end}}
+}
+{{- end}}
+{{- if .BuilderMethods}}
+
+// Register{{.ServiceName | UpperCase}}JSONRequestBuilders registers a builder for the request of
+// each method under the name of the method. A builder parses the fields of the
+// request given as JSON object, accepting both the proto and the JSON names of
+// the fields, and fails if a field is unknown or a required field is unset. It
+// returns the request in the JSON encoding expected by the stubs.
+func Register{{.ServiceName | UpperCase}}JSONRequestBuilders(registry map[string]func(
+	fieldsJSON string) (string, error)) {
+
+	marshaler := &gateway.JSONPb{
+		MarshalOptions: protojson.MarshalOptions{
+			UseProtoNames: true,
+		},
+	}
+{{- if .RequiredFields}}
+
+	// checkRequired returns an error naming the first of the required
+	// fields that is unset in the request.
+	checkRequired := func(req protoreflect.ProtoMessage,
+		fields ...string) error {
+
+		msg := req.ProtoReflect()
+		for _, name := range fields {
+			field := msg.Descriptor().Fields().ByName(
+				protoreflect.Name(name),
+			)
+			if !msg.Has(field) {
+				return fmt.Errorf("missing required field %s of %s",
+					name, msg.Descriptor().FullName())
+			}
+		}
+
+		return nil
+	}
+{{- end}}
+{{- range $meth := .BuilderMethods}}
+
+	registry["{{$.Package}}.{{$.ServiceName}}.{{$meth.MethodName}}"] = func(
+		fieldsJSON string) (string, error) {
+
+		req := &{{$meth.RequestType}}{}
+{{- if $meth.JSONCodecs}}
+		err := unmarshalJSON(marshaler, fieldsJSON, req)
+{{- else}}
+		err := marshaler.Unmarshal([]byte(fieldsJSON), req)
+{{- end}}
+		if err != nil {
+			return "", err
+		}
+{{- if $meth.RequiredFields}}
+
+		err = checkRequired(req{{range $meth.RequiredFields}}, "{{.}}"{{end}})
+		if err != nil {
+			return "", err
+		}
+{{- end}}
+{{if $meth.JSONCodecs}}
+		reqBytes, err := marshalJSON(marshaler, req)
+{{- else}}
+		reqBytes, err := marshaler.Marshal(req)
+{{- end}}
+		if err != nil {
+			return "", err
+		}
+
+		return string(reqBytes), nil
+	}
+{{- end}}
+{{- if .CamelCaseAliases}}
+
+	// Register the builders under the camelCase names of the methods as
+	// well, as expected by JavaScript consumers.
+{{- range $meth := .BuilderMethods}}
+	registry["{{$.Package}}.{{$.ServiceName}}.{{$meth.MethodName | LowerCase}}"] =
+		registry["{{$.Package}}.{{$.ServiceName}}.{{$meth.MethodName}}"]
+{{- end}}
+{{- end}}
+}
+{{- end}}
+{{- if .Timeouts}}
+
+// Register{{.ServiceName | UpperCase}}JSONCallbacksWithTimeout registers the methods of
+// Register{{.ServiceName | UpperCase}}JSONCallbacks with an additional timeout in milliseconds. The
+// call, or the whole stream of a streaming call, fails with a deadline exceeded
+// error once the timeout expires. A timeout of zero or less doesn't bound the
+// call.
+func Register{{.ServiceName | UpperCase}}JSONCallbacksWithTimeout(registry map[string]func(
+	ctx context.Context, conn *grpc.ClientConn, reqJSON string,
+	timeoutMs int64, callback func(string, error))) {
+
+	calls := make(map[string]func(ctx context.Context,
+		conn *grpc.ClientConn, reqJSON string, callback func(string, error)))
+	Register{{.ServiceName | UpperCase}}JSONCallbacks(calls)
+
+	// withTimeout bounds the call with a deadline derived from the
+	// timeout. The deadline is released once the call is done, which is
+	// after the response of a unary call, or once a stream has ended.
+	withTimeout := func(call func(ctx context.Context,
+		conn *grpc.ClientConn, reqJSON string,
+		callback func(string, error)),
+		streaming bool) func(ctx context.Context, conn *grpc.ClientConn,
+		reqJSON string, timeoutMs int64, callback func(string, error)) {
+
+		return func(ctx context.Context, conn *grpc.ClientConn,
+			reqJSON string, timeoutMs int64,
+			callback func(string, error)) {
+
+			if timeoutMs <= 0 {
+				call(ctx, conn, reqJSON, callback)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(
+				ctx, time.Duration(timeoutMs)*time.Millisecond,
+			)
+			call(ctx, conn, reqJSON, func(resp string, err error) {
+				callback(resp, err)
+				if !streaming || err != nil {
+					cancel()
+				}
+			})
+		}
+	}
+
+	// streaming is the set of server-streaming methods.
+	streaming := map[string]bool{
+{{- range $meth := .Methods}}
+{{- if $meth.ResponseStreaming}}
+		"{{$.Package}}.{{$.ServiceName}}.{{$meth.MethodName}}": true,
+{{- if $.CamelCaseAliases}}
+		"{{$.Package}}.{{$.ServiceName}}.{{$meth.MethodName | LowerCase}}": true,
+{{- end}}
+{{- end}}
+{{- end}}
+	}
+
+	for name, call := range calls {
+		registry[name] = withTimeout(call, streaming[name])
+	}
+}
+{{- end}}
+{{- if .TypedResponses}}
+{{- range $meth := .Methods}}
+
+// Unmarshal{{$.ServiceName}}{{$meth.MethodName}}Response unmarshals the JSON
+// response delivered for {{$.Package}}.{{$.ServiceName}}.{{$meth.MethodName}} into its
+// concrete type.
+func Unmarshal{{$.ServiceName}}{{$meth.MethodName}}Response(respJSON string) (
+	*{{$meth.ResponseType}}, error) {
+
+	resp := &{{$meth.ResponseType}}{}
+	err := protojson.Unmarshal([]byte(respJSON), resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+{{- end}}
+{{- end}}
+`))
+
+type listenersParams struct {
+	ToolName  string
+	Package   string
+	BuildTag  string
+	Listeners []string
+
+	// Transport is the in-memory transport the listeners are created
+	// with, either bufconn, pipe or unix.
+	Transport string
+
+	// ServiceGating indicates whether services can be disabled at
+	// runtime using SetServiceEnabled.
+	ServiceGating bool
+
+	// CallDraining indicates whether in-flight calls can be drained before
+	// the listeners are re-created.
+	CallDraining bool
+
+	// SerializedMethods indicates whether the guards rejecting concurrent
+	// calls of serialized methods should be generated.
+	SerializedMethods bool
+
+	// UseRuntime indicates whether the guards of the serialized methods
+	// are imported from the shared runtime package.
+	UseRuntime bool
+
+	// ProgressMethods indicates whether the sources reporting the progress
+	// of long-running methods can be registered.
+	ProgressMethods bool
+
+	// WithContext indicates whether the tokens cancelling the calls of
+	// the WithContext APIs should be generated.
+	WithContext bool
+
+	// CallTimeouts indicates whether the helper bounding calls by the
+	// timeout passed to the unary methods should be generated.
+	CallTimeouts bool
+
+	// StreamHandles indicates whether the handles returned by the
+	// WithHandle APIs of streaming methods should be generated.
+	StreamHandles bool
+
+	// GlobalMetadata indicates whether metadata added to every call can
+	// be set using SetGlobalMetadata.
+	GlobalMetadata bool
+
+	// MetadataProvider indicates whether a provider of the metadata
+	// attached to each call can be set using SetMetadataProvider.
+	MetadataProvider bool
+
+	// ServerInterceptors indicates whether server interceptors can be
+	// registered for the server serving the in-memory listeners.
+	ServerInterceptors bool
+
+	// ConnPool indicates whether the client connections to the listeners
+	// are pooled per service.
+	ConnPool bool
+
+	// ConnectionObserver indicates whether observers can be notified of
+	// the state of the listeners using RegisterConnectionObserver.
+	ConnectionObserver bool
+
+	// DialOptions indicates whether extra dial options can be injected
+	// using SetDialOptions and SetServiceDialOptions.
+	DialOptions bool
+
+	// GRPCCompat is the grpc-go baseline the code is written against,
+	// either legacy, latest or empty for the default.
+	GRPCCompat string
+}
+
+var listenersTemplate = template.Must(template.New("mem").
+	Funcs(funcMap).
+	Parse(`// Code generated by {{.ToolName}} DO NOT EDIT.
+{{if .BuildTag}}
+{{.BuildTag}}
+{{end}}
+package {{.Package}}
+
+import (
+{{- if or .GlobalMetadata .MetadataProvider .ProgressMethods .WithContext .CallTimeouts .StreamHandles .ConnPool}}
+	"context"
+{{- end}}
+{{- if or (eq .Transport "unix") .ConnPool}}
+	"fmt"
+{{- end}}
+{{- if or (ne .Transport "bufconn") .ConnPool .ConnectionObserver}}
+	"net"
+{{- end}}
+{{- if eq .Transport "unix"}}
+	"os"
+{{- end}}
+	"sync"
+{{- if eq .Transport "unix"}}
+	"sync/atomic"
+{{- end}}
+{{- if or .CallTimeouts .ConnPool}}
+	"time"
+{{- end}}
+{{if and .SerializedMethods .UseRuntime}}
+	"github.com/lightninglabs/falafel/runtime"
+{{- end}}
+	"google.golang.org/grpc"
+{{- if or .ServiceGating (and .SerializedMethods (not .UseRuntime))}}
+	"google.golang.org/grpc/codes"
+{{- end}}
+{{- if .ConnPool}}
+	"google.golang.org/grpc/connectivity"
+{{- end}}
+{{- if or .GlobalMetadata .MetadataProvider}}
+	"google.golang.org/grpc/metadata"
+{{- end}}
+{{- if or .ServiceGating (and .SerializedMethods (not .UseRuntime))}}
+	"google.golang.org/grpc/status"
+{{- end}}
+{{- if eq .Transport "bufconn"}}
+	"google.golang.org/grpc/test/bufconn"
+{{- end}}
+)
+{{- define "newListener"}}
+{{- if eq .Transport "pipe"}}newPipeListener()
+{{- else if eq .Transport "unix"}}newUnixListener()
+{{- else}}bufconn.Listen(100)
+{{- end}}
+{{- end}}
+{{- define "listenerType"}}
+{{- if eq .Transport "pipe"}}*pipeListener
+{{- else if eq .Transport "unix"}}*unixListener
+{{- else}}*bufconn.Listener
+{{- end}}
+{{- end}}
+{{- define "listenerField"}}
+{{- if eq .Transport "pipe"}}pipeListener
+{{- else if eq .Transport "unix"}}unixListener
+{{- else}}Listener
+{{- end}}
+{{- end}}
+var (
+{{- range $lis := .Listeners}}
+	// {{$lis}} is a global in-memory buffer listeners that is
+	// referenced by the generated mobile APIs, such that all client calls
+	// will be going through it.
+	{{$lis}} = {{if $.ConnectionObserver}}newObservedListener("{{$lis}}", {{template "newListener" $}}){{else}}{{template "newListener" $}}{{end}}
+
+{{end}}
+	// serviceDialOptions is a global map from service names to a method
+	// that is used to retrieve extra grpc options we'll apply every time
+	// we dial the service's grpc server, such as TLS certificates.
+	serviceDialOptions = make(map[string]func() ([]grpc.DialOption, error))
+
+	// defaultDialOptions returns extra grpc options we'll apply in case
+	// the service is not found in the serviceDialOptions.
+	defaultDialOptions = func() ([]grpc.DialOption, error){
+		return nil, nil
+	}
+
+{{- if .DialOptions}}
+
+	// injectedDialOptions are the options set with SetDialOptions, which
+	// are applied when dialing every service.
+	injectedDialOptions []grpc.DialOption
+
+	// serviceInjectedDialOptions are the options set with
+	// SetServiceDialOptions, keyed by service name.
+	serviceInjectedDialOptions = make(map[string][]grpc.DialOption)
+{{- end}}
+
+	// serviceDialOptionsMtx is a mutex used to grant exclusive access
+	// to the above options variables.
+	serviceDialOptionsMtx sync.Mutex
+)
+
+
+// RecreateListeners will re-create the in-memory listeners that will be
+// referenced by the generated mobile APIs. This has to be called if the gRPC
+// server has been restarted
+func RecreateListeners() {
+{{- if .ConnPool}}
+	listenersMtx.Lock()
+{{- end}}
+{{- range $lis := .Listeners}}
+	{{$lis}} = {{if $.ConnectionObserver}}newObservedListener("{{$lis}}", {{template "newListener" $}}){{else}}{{template "newListener" $}}{{end}}
+{{- end}}
+{{- if .ConnPool}}
+	listenersMtx.Unlock()
+
+	// The pooled connections are bound to the old listeners, so they are
+	// closed for the next calls to dial the new ones.
+	CloseConnections()
+{{- end}}
+{{- if .CallDraining}}
+
+	// Resume the calls waiting for the new listeners.
+	listenersRecreated()
+{{- end}}
+}
+
+// setDefaultDialOption sets the global default gprc option method.
+func setDefaultDialOption(f func()([]grpc.DialOption, error)) {
+	serviceDialOptionsMtx.Lock()
+	defer serviceDialOptionsMtx.Unlock()
+
+	defaultDialOptions  = f
+}
+{{- if .DialOptions}}
+
+// SetDialOptions sets extra options applied when dialing every service, such as
+// interceptors, maximum message sizes or keepalive settings. They are applied
+// after the options of setDefaultDialOption and the per-service options, and
+// replace the options set by a previous call.
+func SetDialOptions(opts ...grpc.DialOption) {
+	serviceDialOptionsMtx.Lock()
+	defer serviceDialOptionsMtx.Unlock()
+
+	injectedDialOptions = opts
+}
+
+// SetServiceDialOptions sets extra options applied when dialing the service with
+// the given name, e.g. Lightning, after those set with SetDialOptions. They
+// replace the options set for the service by a previous call.
+func SetServiceDialOptions(service string, opts ...grpc.DialOption) {
+	serviceDialOptionsMtx.Lock()
+	defer serviceDialOptionsMtx.Unlock()
+
+	serviceInjectedDialOptions[service] = opts
+}
+{{- end}}
+{{- if .ConnPool}}
+
+// pooledClientConn is a client connection shared by all calls of a service,
+// which is dialed once on first use.
+type pooledClientConn struct {
+	once sync.Once
+	conn *grpc.ClientConn
+	err  error
+}
+
+var (
+	// connPool holds the pooled connection of every service used since
+	// the connections were last closed.
+	connPool = make(map[string]*pooledClientConn)
+
+	// connPoolMtx guards connPool.
+	connPoolMtx sync.Mutex
+
+	// connPoolDialers maps the names of the services to the functions
+	// dialing their pooled connections. It is only written on package
+	// initialization.
+	connPoolDialers = make(map[string]func() (*grpc.ClientConn, error))
+
+	// listenersMtx guards the listeners against being re-created while
+	// they are read to dial a pooled connection.
+	listenersMtx sync.RWMutex
+)
+
+// pooledConn returns the pooled client connection of the service, dialing it
+// on first use. Concurrent callers wait for the same dial to complete, and a
+// failed dial is not pooled, such that the next call retries it. The returned
+// close function is a no-op, as the connection is shared.
+func pooledConn(service string) (*grpc.ClientConn, func(), error) {
+	for {
+		connPoolMtx.Lock()
+		pc, ok := connPool[service]
+		if !ok {
+			pc = &pooledClientConn{}
+			connPool[service] = pc
+		}
+		connPoolMtx.Unlock()
+
+		pc.once.Do(func() {
+			pc.conn, pc.err = connPoolDialers[service]()
+		})
+		if pc.err != nil {
+			connPoolMtx.Lock()
+			if connPool[service] == pc {
+				delete(connPool, service)
+			}
+			connPoolMtx.Unlock()
+
+			return nil, nil, pc.err
+		}
+
+		// The connection was closed by CloseConnections before it was
+		// dialed, so a new one is looked up.
+		if pc.conn == nil {
+			continue
+		}
+
+		return pc.conn, func() {}, nil
+	}
+}
+
+// dialPooledListener creates a client connection to the given in-memory
+// listener using the passed extra dial options. A new in-memory connection is
+// dialed every time the client connection (re)connects, such that the pooled
+// connection survives the loss of its transport.
+func dialPooledListener(lis interface{ Dial() (net.Conn, error) },
+	extraOpts ...grpc.DialOption) (*grpc.ClientConn, error) {
+
+	dialer := func(ctx context.Context, _ string) (net.Conn, error) {
+		// Dialing the in-memory listener blocks until the server
+		// accepts the connection, so it is done in the background to
+		// honor the context.
+		type dialResult struct {
+			conn net.Conn
+			err  error
+		}
+		result := make(chan dialResult, 1)
+		go func() {
+			conn, err := lis.Dial()
+			result <- dialResult{conn, err}
+		}()
+
+		select {
+		case r := <-result:
+			return r.conn, r.err
+
+		case <-ctx.Done():
+			// Close the connection once the dial completes, as no
+			// one is left to use it.
+			go func() {
+				if r := <-result; r.err == nil {
+					r.conn.Close()
+				}
+			}()
+
+			return nil, ctx.Err()
+		}
+	}
+
+	opts := []grpc.DialOption{
+		grpc.WithContextDialer(dialer),
+	}
+	opts = append(opts, extraOpts...)
+{{- if eq .GRPCCompat "latest"}}
+
+	// As target we use "localhost" to mimic a local connection, which is
+	// passed through to the dialer.
+	return grpc.NewClient("passthrough:///localhost", opts...)
+{{- else}}
+
+	// As address we use "localhost" to mimic a local connection.
+	return grpc.Dial("localhost", opts...)
+{{- end}}
+}
+
+// InitConnections dials the pooled client connections of all services and
+// starts connecting them in the background, such that the first calls don't
+// wait for the connections to be set up. Connections already pooled are
+// reused.
+func InitConnections() error {
+	for service := range connPoolDialers {
+{{- if eq .GRPCCompat "legacy"}}
+		// Older grpc-go versions start connecting once dialed.
+		_, _, err := pooledConn(service)
+		if err != nil {
+			return fmt.Errorf("unable to dial %s: %w", service, err)
+		}
+{{- else}}
+		conn, _, err := pooledConn(service)
+		if err != nil {
+			return fmt.Errorf("unable to dial %s: %w", service, err)
+		}
+
+		conn.Connect()
+{{- end}}
+	}
+
+	return nil
+}
+
+// WaitConnectionsReady initializes the pooled client connections of all
+// services and blocks until they are ready, or the timeout given in
+// milliseconds expires. It serves as ready signal of the in-memory
+// connections, e.g. after the server has been started.
+func WaitConnectionsReady(timeoutMs int64) error {
+	if err := InitConnections(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), time.Duration(timeoutMs)*time.Millisecond,
+	)
+	defer cancel()
+
+	for service := range connPoolDialers {
+		conn, _, err := pooledConn(service)
+		if err != nil {
+			return fmt.Errorf("unable to dial %s: %w", service, err)
+		}
+
+		for {
+			state := conn.GetState()
+			if state == connectivity.Ready {
+				break
+			}
+{{- if ne .GRPCCompat "legacy"}}
+
+			// An idle connection only reconnects when asked to.
+			if state == connectivity.Idle {
+				conn.Connect()
+			}
+{{- end}}
+
+			if !conn.WaitForStateChange(ctx, state) {
+				return fmt.Errorf("connection to %s not ready "+
+					"after %dms: %v", service, timeoutMs, state)
+			}
+		}
+	}
+
+	return nil
+}
+
+// CloseConnections closes the pooled client connections of all services. The
+// calls in flight on them fail, and the next call of each service dials a new
+// connection.
+func CloseConnections() {
+	connPoolMtx.Lock()
+	pool := connPool
+	connPool = make(map[string]*pooledClientConn)
+	connPoolMtx.Unlock()
+
+	for _, pc := range pool {
+		// Wait for a dial in progress to complete, or prevent a
+		// pending one from starting.
+		pc.once.Do(func() {})
+		if pc.conn != nil {
+			pc.conn.Close()
+		}
+	}
+}
+{{- end}}
+{{- if .ConnectionObserver}}
+
+// ConnectionObserver is an interface that is passed in by callers of the
+// library to be notified of the state of the in-memory listeners, e.g. to show
+// the status of the daemon without polling it with calls.
+type ConnectionObserver interface {
+	// OnReady is called once the server starts accepting connections on
+	// the listener with the given name, e.g. lightningLis.
+	OnReady(listener string)
+
+	// OnClosed is called once the listener is closed, e.g. because the
+	// server was stopped.
+	OnClosed(listener string)
+
+	// OnError is called if accepting a connection on the listener failed
+	// for another reason than the listener being closed.
+	OnError(listener string, err error)
+}
+
+var (
+	// connObservers are the registered connection observers.
+	connObservers []ConnectionObserver
+
+	// readyListeners holds the listeners currently accepting connections,
+	// which are reported to observers registered later.
+	readyListeners = make(map[*observedListener]struct{})
+
+	// connObserversMtx guards connObservers and readyListeners, and
+	// serializes the notifications, such that they are delivered in
+	// order.
+	connObserversMtx sync.Mutex
+)
+
+// RegisterConnectionObserver registers the observer to be notified of the state
+// of the in-memory listeners. OnReady is called right away for the listeners
+// already accepting connections. The observers are called one at a time, and
+// must not register other observers.
+func RegisterConnectionObserver(observer ConnectionObserver) {
+	if observer == nil {
+		return
+	}
+
+	connObserversMtx.Lock()
+	defer connObserversMtx.Unlock()
+
+	connObservers = append(connObservers, observer)
+	for lis := range readyListeners {
+		observer.OnReady(lis.name)
+	}
+}
+
+// observedListener is an in-memory listener notifying the connection observers
+// of its state.
+type observedListener struct {
+	{{template "listenerType" .}}
+
+	name      string
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newObservedListener wraps the in-memory listener with the given name.
+func newObservedListener(name string,
+	lis {{template "listenerType" .}}) *observedListener {
+
+	return &observedListener{
+		{{template "listenerField" .}}: lis,
+		name:     name,
+		closed:   make(chan struct{}),
+	}
+}
+
+// Accept waits for and returns the next connection dialed to the listener. The
+// listener is reported ready once the server accepts connections, and again
+// after accepting a connection failed.
+func (l *observedListener) Accept() (net.Conn, error) {
+	l.setReady()
+
+	conn, err := l.{{template "listenerField" .}}.Accept()
+	if err != nil {
+		select {
+		// The observers were notified when the listener was closed.
+		case <-l.closed:
+
+		default:
+			l.setDown(func(observer ConnectionObserver) {
+				observer.OnError(l.name, err)
+			})
+		}
+	}
+
+	return conn, err
+}
+
+// Close closes the listener, and reports it closed.
+func (l *observedListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+
+		l.setDown(func(observer ConnectionObserver) {
+			observer.OnClosed(l.name)
+		})
+	})
+
+	return l.{{template "listenerField" .}}.Close()
+}
+
+// setReady notifies the observers that the listener accepts connections,
+// unless it was already reported ready.
+func (l *observedListener) setReady() {
+	connObserversMtx.Lock()
+	defer connObserversMtx.Unlock()
+
+	// A closed listener doesn't accept connections anymore.
+	select {
+	case <-l.closed:
+		return
+
+	default:
+	}
+
+	if _, ok := readyListeners[l]; ok {
+		return
+	}
+	readyListeners[l] = struct{}{}
+
+	for _, observer := range connObservers {
+		observer.OnReady(l.name)
+	}
+}
+
+// setDown marks the listener as no longer accepting connections, and notifies
+// the observers by calling notify for each of them.
+func (l *observedListener) setDown(notify func(ConnectionObserver)) {
+	connObserversMtx.Lock()
+	defer connObserversMtx.Unlock()
+
+	delete(readyListeners, l)
+	for _, observer := range connObservers {
+		notify(observer)
+	}
+}
+{{- end}}
+{{- if eq .Transport "pipe"}}
+
+// pipeListener is an in-memory listener handing out the server side of a
+// net.Pipe for each connection dialed, such that no buffers are shared
+// between the client and the server.
+type pipeListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newPipeListener creates a new pipe listener.
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Accept waits for and returns the next connection dialed to the listener.
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the listener. Connections already accepted are not closed.
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+
+	return nil
+}
+
+// Addr returns the address of the listener.
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// Dial creates a connection to the listener, waiting for it to be accepted.
+func (l *pipeListener) Dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+
+	case <-l.done:
+		_ = client.Close()
+		_ = server.Close()
+
+		return nil, net.ErrClosed
+	}
+}
+
+// pipeAddr is the address of a pipe listener.
+type pipeAddr struct{}
+
+// Network returns the name of the network.
+func (pipeAddr) Network() string {
+	return "pipe"
+}
+
+// String returns the address as a string.
+func (pipeAddr) String() string {
+	return "pipe"
+}
+{{- end}}
+{{- if eq .Transport "unix"}}
+
+// unixListenerSeq numbers the unix listeners created by this process, such
+// that a listener can be re-created while the previous one is still open.
+var unixListenerSeq uint64
+
+// unixListener is a listener bound to an abstract unix socket, which only
+// exists in memory and disappears once the listener is closed. Abstract
+// sockets are only supported on Linux, including Android.
+type unixListener struct {
+	lis  net.Listener
+	addr string
+	err  error
+}
+
+// newUnixListener binds a new unix listener to an abstract socket unique to
+// this process. If binding fails, the error is returned by all methods of the
+// listener.
+func newUnixListener() *unixListener {
+	addr := fmt.Sprintf("@{{.Package}}-%d-%d", os.Getpid(),
+		atomic.AddUint64(&unixListenerSeq, 1))
+
+	lis, err := net.Listen("unix", addr)
+
+	return &unixListener{
+		lis:  lis,
+		addr: addr,
+		err:  err,
+	}
+}
+
+// Accept waits for and returns the next connection dialed to the listener.
+func (l *unixListener) Accept() (net.Conn, error) {
+	if l.err != nil {
+		return nil, l.err
+	}
+
+	return l.lis.Accept()
+}
+
+// Close closes the listener.
+func (l *unixListener) Close() error {
+	if l.err != nil {
+		return nil
+	}
+
+	return l.lis.Close()
+}
+
+// Addr returns the address of the listener.
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.addr, Net: "unix"}
+}
+
+// Dial creates a connection to the listener.
+func (l *unixListener) Dial() (net.Conn, error) {
+	if l.err != nil {
+		return nil, l.err
+	}
+
+	return net.Dial("unix", l.addr)
+}
+{{- end}}
+{{- if .ServiceGating}}
+
+var (
+	// disabledServices is the set of services that have been disabled at
+	// runtime. Calls to their methods fail with an Unimplemented error.
+	disabledServices = make(map[string]struct{})
+
+	// disabledServicesMtx guards access to disabledServices.
+	disabledServicesMtx sync.RWMutex
+)
+
+// SetServiceEnabled enables or disables the service with the given name at
+// runtime. All services are enabled by default. Calls to methods of a disabled
+// service fail with an Unimplemented error.
+func SetServiceEnabled(name string, enabled bool) {
+	disabledServicesMtx.Lock()
+	defer disabledServicesMtx.Unlock()
+
+	if enabled {
+		delete(disabledServices, name)
+	} else {
+		disabledServices[name] = struct{}{}
+	}
+}
+
+// checkServiceEnabled returns an Unimplemented error if the service with the
+// given name has been disabled.
+func checkServiceEnabled(name string) error {
+	disabledServicesMtx.RLock()
+	defer disabledServicesMtx.RUnlock()
+
+	if _, ok := disabledServices[name]; ok {
+		return status.Errorf(codes.Unimplemented, "service %s is "+
+			"disabled", name)
+	}
+
+	return nil
+}
+{{- end}}
+{{- if and .SerializedMethods .UseRuntime}}
+
+// acquireMethod marks the serialized method as in progress, returning an error
+// if it already is. The returned function must be called once the call is
+// done.
+func acquireMethod(method string) (func(), error) {
+	return runtime.AcquireMethod(method)
+}
+
+// serializedStream is a RecvStream of a serialized method, which releases the
+// method once the stream has ended.
+type serializedStream struct {
+	*runtime.SerializedStream
+}
+
+// release releases the method of the stream, e.g. if the stream couldn't be
+// started.
+func (s *serializedStream) release() {
+	s.Release()
+}
+
+// acquireStream marks the serialized streaming method as in progress until the
+// returned stream has ended, returning an error if it already is.
+func acquireStream(method string, rStream RecvStream) (*serializedStream,
+	error) {
+
+	stream, err := runtime.AcquireStream(method, rStream)
+	if err != nil {
+		return nil, err
+	}
+
+	return &serializedStream{SerializedStream: stream}, nil
+}
+{{- else if .SerializedMethods}}
+
+// serializedCalls is the set of serialized methods currently executed.
+var serializedCalls = struct {
+	sync.Mutex
+	active map[string]struct{}
+}{
+	active: make(map[string]struct{}),
+}
+
+// acquireMethod marks the serialized method as in progress, returning an error
+// if it already is. The returned function must be called once the call is
+// done.
+func acquireMethod(method string) (func(), error) {
+	serializedCalls.Lock()
+	defer serializedCalls.Unlock()
+
+	if _, ok := serializedCalls.active[method]; ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s "+
+			"already in progress", method)
+	}
+	serializedCalls.active[method] = struct{}{}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			serializedCalls.Lock()
+			delete(serializedCalls.active, method)
+			serializedCalls.Unlock()
+		})
+	}, nil
+}
+
+// serializedStream is a RecvStream of a serialized method, which releases the
+// method once the stream has ended.
+type serializedStream struct {
+	RecvStream
+
+	release func()
+}
+
+// OnError is called once the stream has ended.
+func (s *serializedStream) OnError(err error) {
+	s.release()
+	s.RecvStream.OnError(err)
+}
+
+// acquireStream marks the serialized streaming method as in progress until the
+// returned stream has ended, returning an error if it already is.
+func acquireStream(method string, rStream RecvStream) (*serializedStream,
+	error) {
+
+	release, err := acquireMethod(method)
+	if err != nil {
+		return nil, err
+	}
+
+	return &serializedStream{
+		RecvStream: rStream,
+		release:    release,
+	}, nil
+}
+{{- end}}
+{{- if .GlobalMetadata}}
+
+var (
+	// globalMetadata is the metadata added to the outgoing context of
+	// every call.
+	globalMetadata metadata.MD
+
+	// globalMetadataMtx guards access to globalMetadata.
+	globalMetadataMtx sync.RWMutex
+)
+
+// SetGlobalMetadata sets the metadata that is added to the outgoing context of
+// every call made through the generated APIs, merged with any metadata of the
+// call itself. This can be used to tag the calls with identifiers, such as a
+// session or device ID, consumed by server-side interceptors. Passing nil
+// removes it.
+func SetGlobalMetadata(md map[string]string) {
+	globalMetadataMtx.Lock()
+	defer globalMetadataMtx.Unlock()
+
+	globalMetadata = metadata.New(md)
+}
+
+// SetGlobalMetadataValue sets a single key of the metadata added to every call,
+// as maps can't be passed in through gomobile. An empty value removes the key.
+func SetGlobalMetadataValue(key, value string) {
+	globalMetadataMtx.Lock()
+	defer globalMetadataMtx.Unlock()
+
+	md := globalMetadata.Copy()
+	if md == nil {
+		md = metadata.MD{}
+	}
+	if value == "" {
+		md.Delete(key)
+	} else {
+		md.Set(key, value)
+	}
+	globalMetadata = md
+}
+
+// withGlobalMetadata merges the global metadata into the outgoing metadata of
+// the context.
+func withGlobalMetadata(ctx context.Context) context.Context {
+	globalMetadataMtx.RLock()
+	md := globalMetadata
+	globalMetadataMtx.RUnlock()
+
+	if md.Len() == 0 {
+		return ctx
+	}
+
+	callMD, _ := metadata.FromOutgoingContext(ctx)
+	return metadata.NewOutgoingContext(ctx, metadata.Join(md, callMD))
+}
+
+// globalMetadataDialOptions returns the dial options adding the global
+// metadata to every unary and streaming call.
+func globalMetadataDialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(func(ctx context.Context,
+			method string, req, reply interface{},
+			cc *grpc.ClientConn, invoker grpc.UnaryInvoker,
+			opts ...grpc.CallOption) error {
+
+			return invoker(
+				withGlobalMetadata(ctx), method, req, reply, cc,
+				opts...,
+			)
+		}),
+		grpc.WithChainStreamInterceptor(func(ctx context.Context,
+			desc *grpc.StreamDesc, cc *grpc.ClientConn,
+			method string, streamer grpc.Streamer,
+			opts ...grpc.CallOption) (grpc.ClientStream, error) {
+
+			return streamer(
+				withGlobalMetadata(ctx), desc, cc, method,
+				opts...,
+			)
+		}),
+	}
+}
+{{- end}}
+{{- if .MetadataProvider}}
+
+var (
+	// metadataProvider returns the metadata attached to each call, or is
+	// nil if no provider is set.
+	metadataProvider func(method string) map[string]string
+
+	// metadataProviderMtx guards access to metadataProvider.
+	metadataProviderMtx sync.RWMutex
+)
+
+// SetMetadataProvider sets the provider consulted before every unary and
+// streaming call made through the generated APIs. It is called with the full
+// method name, e.g. /lnrpc.Lightning/GetInfo, and the metadata it returns, such
+// as the hex encoded macaroon of an lnd-style daemon, is attached to the call
+// as outgoing metadata, merged with any metadata of the call itself. Passing
+// nil removes it.
+func SetMetadataProvider(provider func(method string) map[string]string) {
+	metadataProviderMtx.Lock()
+	defer metadataProviderMtx.Unlock()
+
+	metadataProvider = provider
+}
+
+// withProvidedMetadata merges the metadata returned by the provider for the
+// method into the outgoing metadata of the context.
+func withProvidedMetadata(ctx context.Context,
+	method string) context.Context {
+
+	metadataProviderMtx.RLock()
+	provider := metadataProvider
+	metadataProviderMtx.RUnlock()
+
+	if provider == nil {
+		return ctx
+	}
+
+	md := metadata.New(provider(method))
+	if md.Len() == 0 {
+		return ctx
+	}
+
+	callMD, _ := metadata.FromOutgoingContext(ctx)
+	return metadata.NewOutgoingContext(ctx, metadata.Join(md, callMD))
+}
+
+// metadataProviderDialOptions returns the dial options attaching the metadata
+// of the provider to every unary and streaming call.
+func metadataProviderDialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(func(ctx context.Context,
+			method string, req, reply interface{},
+			cc *grpc.ClientConn, invoker grpc.UnaryInvoker,
+			opts ...grpc.CallOption) error {
+
+			return invoker(
+				withProvidedMetadata(ctx, method), method, req,
+				reply, cc, opts...,
+			)
+		}),
+		grpc.WithChainStreamInterceptor(func(ctx context.Context,
+			desc *grpc.StreamDesc, cc *grpc.ClientConn,
+			method string, streamer grpc.Streamer,
+			opts ...grpc.CallOption) (grpc.ClientStream, error) {
+
+			return streamer(
+				withProvidedMetadata(ctx, method), desc, cc,
+				method, opts...,
+			)
+		}),
+	}
+}
+{{- end}}
+{{- if .ServerInterceptors}}
+
+var (
+	// unaryServerInterceptors are the unary interceptors registered for
+	// the server serving the in-memory listeners.
+	unaryServerInterceptors []grpc.UnaryServerInterceptor
+
+	// streamServerInterceptors are the stream interceptors registered for
+	// the server serving the in-memory listeners.
+	streamServerInterceptors []grpc.StreamServerInterceptor
+
+	// serverInterceptorsMtx guards access to the above interceptors.
+	serverInterceptorsMtx sync.Mutex
+)
+
+// RegisterUnaryServerInterceptor registers a unary interceptor, e.g. for
+// authentication, logging or panic recovery, for the server serving the
+// in-memory listeners. Interceptors are run in the order they are registered
+// in, and only apply to servers created with the options of ServerOptions
+// afterwards.
+func RegisterUnaryServerInterceptor(interceptor grpc.UnaryServerInterceptor) {
+	serverInterceptorsMtx.Lock()
+	defer serverInterceptorsMtx.Unlock()
+
+	unaryServerInterceptors = append(unaryServerInterceptors, interceptor)
+}
+
+// RegisterStreamServerInterceptor registers a stream interceptor for the
+// server serving the in-memory listeners, see
+// RegisterUnaryServerInterceptor.
+func RegisterStreamServerInterceptor(
+	interceptor grpc.StreamServerInterceptor) {
+
+	serverInterceptorsMtx.Lock()
+	defer serverInterceptorsMtx.Unlock()
+
+	streamServerInterceptors = append(
+		streamServerInterceptors, interceptor,
+	)
+}
+
+// ServerOptions returns the options chaining all registered server
+// interceptors. They must be passed to grpc.NewServer when creating the server
+// serving the in-memory listeners, the same way interceptors are set for a
+// server serving TCP listeners:
+//
+//	server := grpc.NewServer(append(ServerOptions(), opts...)...)
+func ServerOptions() []grpc.ServerOption {
+	serverInterceptorsMtx.Lock()
+	defer serverInterceptorsMtx.Unlock()
+
+	unary := make(
+		[]grpc.UnaryServerInterceptor, len(unaryServerInterceptors),
+	)
+	copy(unary, unaryServerInterceptors)
+
+	stream := make(
+		[]grpc.StreamServerInterceptor, len(streamServerInterceptors),
+	)
+	copy(stream, streamServerInterceptors)
+
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...),
+	}
+}
+{{- end}}
+{{- if .CallTimeouts}}
+
+// withCallTimeout derives the context of a call from ctx, bounded by the given
+// timeout in milliseconds. A timeout of zero or less doesn't bound the call.
+func withCallTimeout(ctx context.Context,
+	timeoutMs int64) (context.Context, context.CancelFunc) {
+
+	if timeoutMs <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(
+		ctx, time.Duration(timeoutMs)*time.Millisecond,
+	)
+}
+{{- end}}
+{{- if .WithContext}}
+
+// CancelToken is an opaque handle passed to the WithContext APIs, which cancels
+// all calls started with it once it is cancelled.
+type CancelToken struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewCancelToken creates a new token that isn't cancelled yet.
+func NewCancelToken() *CancelToken {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &CancelToken{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Cancel cancels all calls started with the token. Calls started with it
+// afterwards are cancelled right away.
+func (t *CancelToken) Cancel() {
+	t.cancel()
+}
+
+// IsCancelled returns true if the token has been cancelled.
+func (t *CancelToken) IsCancelled() bool {
+	return t.ctx.Err() != nil
+}
+
+// bind derives the context of a call from ctx, such that it is also cancelled
+// once the token is cancelled. A nil token never cancels the call.
+func (t *CancelToken) bind(ctx context.Context) context.Context {
+	if t == nil {
+		return ctx
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-t.ctx.Done():
+			cancel()
+
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx
+}
+{{- end}}
+{{- if .StreamHandles}}
+
+// StreamHandle is returned by the WithHandle APIs of server-streaming methods,
+// and stops the stream once it is no longer needed.
+type StreamHandle struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newStreamHandle creates a new handle of a stream that isn't stopped yet.
+func newStreamHandle() *StreamHandle {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &StreamHandle{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Stop cancels the stream and releases its resources. Unless the stream has
+// ended before, a Canceled error is delivered to the receive stream. Calling
+// Stop more than once has no effect.
+func (h *StreamHandle) Stop() {
+	h.cancel()
+}
+
+// IsStopped returns true if the stream has been stopped.
+func (h *StreamHandle) IsStopped() bool {
+	return h.ctx.Err() != nil
+}
+
+// bind derives the context of the stream from ctx, such that it is also
+// cancelled once the handle is stopped.
+func (h *StreamHandle) bind(ctx context.Context) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-h.ctx.Done():
+			cancel()
+
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx
+}
+
+// BiStreamHandle is returned by the WithHandle APIs of bidirectional streaming
+// methods. Requests are sent on it, and it stops the stream once it is no
+// longer needed.
+type BiStreamHandle struct {
+	handle  *StreamHandle
+	sStream SendStream
+}
+
+// Send sends the serialized request to the server.
+func (h *BiStreamHandle) Send(msg []byte) error {
+	return h.sStream.Send(msg)
+}
+
+// CloseSend closes the sending direction of the stream, while responses are
+// still delivered until the server ends the stream.
+func (h *BiStreamHandle) CloseSend() error {
+	return h.sStream.Stop()
+}
+
+// Stop cancels the stream in both directions and releases its resources.
+// Unless the stream has ended before, a Canceled error is delivered to the
+// receive stream. Calling Stop more than once has no effect.
+func (h *BiStreamHandle) Stop() {
+	h.handle.Stop()
+}
+
+// IsStopped returns true if the stream has been stopped.
+func (h *BiStreamHandle) IsStopped() bool {
+	return h.handle.IsStopped()
+}
+{{- end}}
+{{- if .ProgressMethods}}
+
+// ProgressCallback is an interface that is passed in by callers of the
+// library to receive the progress of a long-running call.
+type ProgressCallback interface {
+	// OnProgress is called by the library whenever the progress of the
+	// call changes. Done and total are given in units specific to the
+	// method, with a total of zero if it is unknown, and stage describes
+	// the current step of the call.
+	OnProgress(done, total int64, stage string)
+}
+
+// ProgressSource reports the progress of a call of a long-running method by
+// calling report, until the context is cancelled once the call returns. It
+// must return once the context is cancelled.
+type ProgressSource func(ctx context.Context,
+	report func(done, total int64, stage string))
+
+var (
+	// progressSources are the sources reporting the progress of the
+	// long-running methods, keyed by full method name.
+	progressSources = make(map[string]ProgressSource)
+
+	// progressSourcesMtx guards access to progressSources.
+	progressSourcesMtx sync.RWMutex
+)
+
+// RegisterProgressSource registers the source reporting the progress of the
+// calls of the method with the given full name, e.g.
+// /lnrpc.WalletUnlocker/InitWallet. It is started for each call of the
+// method's WithProgress API. A nil source removes the registered one.
+func RegisterProgressSource(method string, source ProgressSource) {
+	progressSourcesMtx.Lock()
+	defer progressSourcesMtx.Unlock()
+
+	if source == nil {
+		delete(progressSources, method)
+		return
+	}
+	progressSources[method] = source
+}
+
+// startProgress starts the progress source registered for the method, if any,
+// delivering its reports to the progress callback. The returned function stops
+// the source, and returns once it is stopped, so no progress is delivered
+// after the result of the call.
+func startProgress(ctx context.Context, method string,
+	progress ProgressCallback) func() {
+
+	progressSourcesMtx.RLock()
+	source := progressSources[method]
+	progressSourcesMtx.RUnlock()
+
+	if source == nil || progress == nil {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		source(ctx, func(done, total int64, stage string) {
+			// Reports after the call returned are dropped.
+			if ctx.Err() != nil {
+				return
+			}
+			progress.OnProgress(done, total, stage)
+		})
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+{{- end}}
+`))
+
+type serviceParams struct {
+	ServiceName   string
+	TargetName    string
+	Listener      string
+	ServiceGating bool
+
+	// Lifecycle indicates whether the embedded node is started on the
+	// first call of a method.
+	Lifecycle bool
+
+	// StateGating indicates whether calls are gated on the RPC server of
+	// the node being active.
+	StateGating bool
+
+	// GlobalMetadata indicates whether the metadata set with
+	// SetGlobalMetadata should be added to every call.
+	GlobalMetadata bool
+
+	// MetadataProvider indicates whether the metadata returned by the
+	// provider set with SetMetadataProvider should be attached to every
+	// call.
+	MetadataProvider bool
+
+	// ConnPool indicates whether the calls of the service share a pooled
+	// client connection.
+	ConnPool bool
+
+	// DialOptions indicates whether the options injected with
+	// SetDialOptions and SetServiceDialOptions should be applied.
+	DialOptions bool
+
+	// File holds the file-level information and options of the proto
+	// file defining the service.
+	File protoFile
+}
+
+var serviceTemplate = template.Must(template.New("service").Funcs(funcMap).Parse(`
+
+// set{{.ServiceName | UpperCase}}DialOption sets the given method as the way
+// to retrieve gprc options for the service.
+func set{{.ServiceName | UpperCase}}DialOption(f func()([]grpc.DialOption, error)) {
+	serviceDialOptionsMtx.Lock()
+	defer serviceDialOptionsMtx.Unlock()
+
+	serviceDialOptions["{{.ServiceName}}"] = f
+}
+
+
+// apply{{.ServiceName | UpperCase}}DialOptions returns extra grpc options to
+// use when calling the service.
+func apply{{.ServiceName | UpperCase}}DialOptions() ([]grpc.DialOption, error) {
+	serviceDialOptionsMtx.Lock()
+	defer serviceDialOptionsMtx.Unlock()
+
+	// First check the service options map, if there are any options
+	// specific to this service.
+	f, ok := serviceDialOptions["{{.ServiceName}}"]
+{{- if .DialOptions}}
+	if !ok {
+		// Otherwise use the default options.
+		f = defaultDialOptions
+	}
+
+	opts, err := f()
+	if err != nil {
+		return nil, err
+	}
+
+	// Append the injected options, copying the returned options so they
+	// aren't modified.
+	opts = append(opts[:len(opts):len(opts)], injectedDialOptions...)
+	opts = append(opts, serviceInjectedDialOptions["{{.ServiceName}}"]...)
+
+	return opts, nil
+{{- else}}
+	if ok {
+		return f()
+	}
+
+	// Otherwise return the default options.
+	return defaultDialOptions()
+{{- end}}
+}
+
+{{- if .ConnPool}}
+
+func init() {
+	// Register the service, such that its connection is dialed by
+	// InitConnections.
+	connPoolDialers["{{.ServiceName}}"] = dial{{.ServiceName | UpperCase}}Conn
+}
+
+// get{{.ServiceName | UpperCase}}Conn returns the pooled grpc client connection
+// to {{.ServiceName}}, dialing it on first use. The returned close function is a
+// no-op, as the connection is shared by all calls of the service.
+func get{{.ServiceName | UpperCase}}Conn() (*grpc.ClientConn, func(), error) {
+	return pooledConn("{{.ServiceName}}")
+}
+
+// dial{{.ServiceName | UpperCase}}Conn dials {{.ServiceName}} with the current dial options,
+// and returns the grpc client connection to be pooled.
+func dial{{.ServiceName | UpperCase}}Conn() (*grpc.ClientConn, error) {
+	// Apply any extra server options.
+	extraOpts, err := apply{{.ServiceName | UpperCase}}DialOptions()
+	if err != nil {
+		return nil, err
+	}
+{{- if .GlobalMetadata}}
+
+	// Add the global metadata to every call.
+	extraOpts = append(extraOpts, globalMetadataDialOptions()...)
+{{- end}}
+{{- if .MetadataProvider}}
+
+	// Attach the metadata of the provider to every call.
+	extraOpts = append(extraOpts, metadataProviderDialOptions()...)
+{{- end}}
+
+	listenersMtx.RLock()
+	lis := {{.Listener}}
+	listenersMtx.RUnlock()
+
+	return dialPooledListener(lis, extraOpts...)
+}
+{{- else}}
+
+// get{{.ServiceName | UpperCase}}Conn dials {{.ServiceName}} with the current dial options,
+// and returns the grpc client connection.
+func get{{.ServiceName | UpperCase}}Conn() (*grpc.ClientConn, func(), error) {
+	// Apply any extra server options.
+	extraOpts, err := apply{{.ServiceName | UpperCase}}DialOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+{{- if .GlobalMetadata}}
+
+	// Add the global metadata to every call.
+	extraOpts = append(extraOpts, globalMetadataDialOptions()...)
+{{- end}}
+{{- if .MetadataProvider}}
+
+	// Attach the metadata of the provider to every call.
+	extraOpts = append(extraOpts, metadataProviderDialOptions()...)
+{{- end}}
+
+	return dialListener({{.Listener}}, extraOpts...)
+}
+{{- end}}
+
+// get{{.ServiceName}}Client returns a client connection to the server listening
+// on lis.
+{{- if .StateGating}} The wait for the RPC server of the node to become active is
+// abandoned once ctx is done.
+{{- end}}
+func get{{.ServiceName}}Client(ctx context.Context) ({{.TargetName}}.{{.ServiceName}}Client, func(), error) {
+{{- if .ServiceGating}}
+	// Make sure the service hasn't been disabled at runtime.
+	if err := checkServiceEnabled("{{.ServiceName}}"); err != nil {
+		return nil, nil, err
+	}
+
+{{end}}
+{{- if .Lifecycle}}
+	// Start the embedded node if it isn't running yet.
+	if err := ensureNodeStarted(); err != nil {
+		return nil, nil, err
+	}
+
+{{end}}
+{{- if .StateGating}}
+	// Make sure the RPC server of the node is active, which requires the
+	// wallet to be unlocked.
+	if err := checkRPCActive(ctx); err != nil {
+		return nil, nil, err
+	}
+
+{{end}}
+	clientConn, closeConn, err := get{{.ServiceName | UpperCase}}Conn()
+	if err != nil {
+		return nil, nil, err
+	}
+	client := {{.TargetName}}.New{{.ServiceName}}Client(clientConn)
+	return client, closeConn, nil
+}
+`))
+
+type rpcParams struct {
+	ServiceName  string
+	TargetName   string
+	MethodName   string
+	FullMethod   string
+	RequestType  string
+	ResponseType string
+	Comment      string
+	ApiPrefix    string
+
+	// RequestMessage and ResponseMessage are the full proto names of the
+	// request and response messages, e.g. lnrpc.GetInfoResponse, which
+	// the serialized payloads passed to and from the API hold.
+	RequestMessage  string
+	ResponseMessage string
+
+	// JSONEncoding indicates whether the payloads passed to and from the
+	// API are encoded as JSON instead of being serialized.
+	JSONEncoding bool
+
+	ClientStream bool
+	ServerStream bool
+
+	// Pagination holds the fields used to page through the results of
+	// a list-style RPC, or nil if no pagination helper is generated.
+	Pagination *paginationParams
+
+	// LongPoll indicates whether a long-poll adapter should be generated
+	// for the server-streaming method.
+	LongPoll bool
+
+	// Notification indicates whether the server-streaming method should
+	// be registered as a source of the notification demultiplexer.
+	Notification bool
+
+	// PaymentTracking holds what is needed to re-track the payment of a
+	// payment stream, or nil if no reconnect-safe wrapper is generated.
+	PaymentTracking *paymentTrackingParams
+
+	// Upload holds what is needed to send a payload in chunks to the
+	// client-streaming method, or nil if no upload helper is generated.
+	Upload *uploadParams
+
+	// Typed indicates whether a variant of the method taking and
+	// returning the Go messages instead of their serialization should be
+	// generated.
+	Typed bool
+
+	// InitialResponse indicates whether a helper delivering the first
+	// response of the stream separately should be generated.
+	InitialResponse bool
+
+	// Serialized indicates whether concurrent calls of the method should
+	// be rejected.
+	Serialized bool
+
+	// Defaults are the default values injected into unset fields of the
+	// request before it is dispatched.
+	Defaults []requestDefault
+
+	// StreamTransform indicates whether a variant of the server-streaming
+	// method passing the responses through a StreamTransform should be
+	// generated.
+	StreamTransform bool
+
+	// Backpressure indicates whether a variant of the server-streaming
+	// method only delivering the responses requested from a StreamDemand
+	// should be generated.
+	Backpressure bool
+
+	// Task indicates whether a variant of the unary method returning a
+	// Task should be generated.
+	Task bool
+
+	// Progress indicates whether a variant of the unary method delivering
+	// the progress of the call should be generated.
+	Progress bool
+
+	// WithContext indicates whether a variant of the method taking a
+	// CancelToken should be generated.
+	WithContext bool
+
+	// StreamHandle indicates whether a variant of the streaming method
+	// returning a handle that stops the stream should be generated.
+	StreamHandle bool
+
+	// TimeoutParam indicates whether the unary method takes a timeout
+	// bounding the call.
+	TimeoutParam bool
+
+	// Facade indicates whether the unexported API function should be
+	// registered with the exported facade.
+	Facade bool
+
+	// Compressor is the name the gzip compressor of gRPC is imported as if
+	// the payloads of the method are compressed, or empty otherwise.
+	Compressor string
+}
+
+// Encoding describes how the payloads passed to and from the API are encoded,
+// as used in its documentation.
+func (r rpcParams) Encoding() string {
+	if r.JSONEncoding {
+		return "JSON-encoded"
+	}
+
+	return "serialized"
+}
+
+var (
+	syncTemplate = template.Must(template.New("sync").Parse(`
+{{- define "syncCall"}}
+{{- if .Serialized}}
+
+			// Only one call of the method may be executed at a
+			// time.
+			release, err := acquireMethod("{{.FullMethod}}")
+			if err != nil {
+				return nil, err
+			}
+			defer release()
+{{- end}}
+
+			// Get the gRPC client.
+			client, closeClient, err := get{{.ServiceName}}Client(ctx)
+			if err != nil {
+				return nil, err
+			}
+			defer closeClient()
+
+			r := req.(*{{.RequestType}})
+{{- if .Defaults}}
+
+			// Inject the defaults of unset request fields.
+{{- range .Defaults}}
+			if {{.Unset "r"}} {
+				r.{{.Field}} = {{.Value}}
+			}
+{{- end}}
+{{end}}
+			return client.{{.MethodName}}(ctx, r{{if .Compressor}}, grpc.UseCompressor({{.Compressor}}.Name){{end}})
+{{- end}}
+{{.Comment}}
+//
+// The request is a {{.Encoding}} {{.RequestMessage}}, and the callback receives a
+// {{.Encoding}} {{.ResponseMessage}}.
+//
+// NOTE: This method produces a single result or error, and the callback will
+// be called only once.
+{{- if .TimeoutParam}} The call fails with a deadline exceeded error once
+// timeoutMs milliseconds have passed, unless the timeout is zero or less.
+func {{.ApiPrefix}}{{.MethodName}}(msg []byte, timeoutMs int64, callback Callback) {
+{{- else}}
+func {{.ApiPrefix}}{{.MethodName}}(msg []byte, callback Callback) {
+{{- end}}
+	s := &syncHandler{
+		method: "{{.FullMethod}}",
+		newProto: func() proto.Message {
+			return &{{.RequestType}}{}
+		},
+		getSync: func(ctx context.Context,
+			req proto.Message) (proto.Message, error) {
+{{- if .TimeoutParam}}
+
+			// The call is bounded by the timeout, if one is given.
+			ctx, cancel := withCallTimeout(ctx, timeoutMs)
+			defer cancel()
+{{- end}}
+{{- template "syncCall" .}}
+		},
+	}
+	s.start(msg, callback)
+}
+`))
+
+	taskTemplate = template.Must(template.Must(
+		syncTemplate.Clone()).New("task").Parse(`
+
+// {{.ApiPrefix}}{{.MethodName}}Task calls {{.MethodName}}, returning a Task that is completed with
+// its result instead of delivering it to a callback.
+func {{.ApiPrefix}}{{.MethodName}}Task(msg []byte) *Task {
+	task := newTask()
+	s := &syncHandler{
+		method: "{{.FullMethod}}",
+		newProto: func() proto.Message {
+			return &{{.RequestType}}{}
+		},
+		getSync: func(ctx context.Context,
+			req proto.Message) (proto.Message, error) {
+
+			// The call is cancelled together with the task.
+			ctx, cancel := task.bind(ctx)
+			defer cancel()
+{{- template "syncCall" .}}
+		},
+	}
+	s.start(msg, &taskCallback{task: task})
+
+	return task
+}
+`))
+
+	progressTemplate = template.Must(template.Must(
+		syncTemplate.Clone()).New("progress").Parse(`
+
+// {{.ApiPrefix}}{{.MethodName}}WithProgress calls {{.MethodName}}, delivering the progress
+// reported by the source registered for the method to the progress callback
+// until the result is delivered to the callback.
+func {{.ApiPrefix}}{{.MethodName}}WithProgress(msg []byte, callback Callback,
+	progress ProgressCallback) {
+
+	s := &syncHandler{
+		method: "{{.FullMethod}}",
+		newProto: func() proto.Message {
+			return &{{.RequestType}}{}
+		},
+		getSync: func(ctx context.Context,
+			req proto.Message) (proto.Message, error) {
+
+			// The progress is reported while the call is executed.
+			stopProgress := startProgress(
+				ctx, "{{.FullMethod}}", progress,
+			)
+			defer stopProgress()
+{{- template "syncCall" .}}
+		},
+	}
+	s.start(msg, callback)
+}
+`))
+
+	contextTemplate = template.Must(template.Must(
+		syncTemplate.Clone()).New("context").Parse(`
+{{- define "startBiStreamWithContext"}}startBiStream("{{.FullMethod}}", rStream,
+		func(ctx context.Context) ({{.TargetName}}.{{.ServiceName}}Client, func(), error) {
+			// The wait for the client is abandoned together with the token.
+			return get{{.ServiceName}}Client(token.bind(ctx))
+		},
+		func(ctx context.Context, client {{.TargetName}}.{{.ServiceName}}Client) (
+			biStream[*{{.RequestType}}, *{{.ResponseType}}], error) {
+
+			// The stream is ended together with the token.
+			ctx = token.bind(ctx)
+
+			return client.{{.MethodName}}(ctx{{if .Compressor}}, grpc.UseCompressor({{.Compressor}}.Name){{end}})
+		},
+	)
+{{- end}}
+{{- define "startClientStreamWithContext"}}startBiStream("{{.FullMethod}}", callback,
+		func(ctx context.Context) ({{.TargetName}}.{{.ServiceName}}Client, func(), error) {
+			// The wait for the client is abandoned together with the token.
+			return get{{.ServiceName}}Client(token.bind(ctx))
+		},
+		func(ctx context.Context, client {{.TargetName}}.{{.ServiceName}}Client) (
+			biStream[*{{.RequestType}}, *{{.ResponseType}}], error) {
+
+			// The stream is ended together with the token.
+			ctx = token.bind(ctx)
+
+			stream, err := client.{{.MethodName}}(ctx{{if .Compressor}}, grpc.UseCompressor({{.Compressor}}.Name){{end}})
+			if err != nil {
+				return nil, err
+			}
+
+			return newClientStreamAdapter[*{{.RequestType}}, *{{.ResponseType}}](
+				stream,
+			), nil
+		},
+	)
+{{- end}}
+{{- if and (not .ClientStream) (not .ServerStream)}}
+
+// {{.ApiPrefix}}{{.MethodName}}WithContext calls {{.MethodName}}, cancelling the call once the
+// token is cancelled. A nil token never cancels the call.
+func {{.ApiPrefix}}{{.MethodName}}WithContext(token *CancelToken, msg []byte,
+	callback Callback) {
+
+	s := &syncHandler{
+		method: "{{.FullMethod}}",
+		newProto: func() proto.Message {
+			return &{{.RequestType}}{}
+		},
+		getSync: func(ctx context.Context,
+			req proto.Message) (proto.Message, error) {
+
+			// The call is cancelled together with the token.
+			ctx = token.bind(ctx)
+{{- template "syncCall" .}}
+		},
+	}
+	s.start(msg, callback)
+}
+{{- else if not .ClientStream}}
+
+// {{.ApiPrefix}}{{.MethodName}}WithContext calls {{.MethodName}}, ending the stream once the
+// token is cancelled. A nil token never ends the stream.
+func {{.ApiPrefix}}{{.MethodName}}WithContext(token *CancelToken, msg []byte,
+	rStream RecvStream) {
+{{- if .Serialized}}
+
+	// Only one stream of the method may be open at a time.
+	guarded, err := acquireStream("{{.FullMethod}}", rStream)
+	if err != nil {
+		go rStream.OnError(err)
+		return
+	}
+	rStream = guarded
+{{- end}}
+
+	startReadStream("{{.FullMethod}}", msg, rStream,
+		func(ctx context.Context) ({{.TargetName}}.{{.ServiceName}}Client, func(), error) {
+			// The wait for the client is abandoned together with the token.
+			return get{{.ServiceName}}Client(token.bind(ctx))
+		},
+		func(ctx context.Context, client {{.TargetName}}.{{.ServiceName}}Client,
+			req *{{.RequestType}}) (recvStream[*{{.ResponseType}}], error) {
+
+			// The stream is ended together with the token.
+			ctx = token.bind(ctx)
+{{- if .Defaults}}
+
+			// Inject the defaults of unset request fields.
+{{- range .Defaults}}
+			if {{.Unset "req"}} {
+				req.{{.Field}} = {{.Value}}
+			}
+{{- end}}
+{{- end}}
+
+			return client.{{.MethodName}}(ctx, req{{if .Compressor}}, grpc.UseCompressor({{.Compressor}}.Name){{end}})
+		},
+	)
+}
+{{- else}}
+
+// {{.ApiPrefix}}{{.MethodName}}WithContext calls {{.MethodName}}, ending the stream once the
+// token is cancelled. A nil token never ends the stream.
+{{- if .ServerStream}}
+func {{.ApiPrefix}}{{.MethodName}}WithContext(token *CancelToken, rStream RecvStream) (
+	SendStream, error) {
+{{- else}}
+func {{.ApiPrefix}}{{.MethodName}}WithContext(token *CancelToken, callback Callback) (
+	SendStream, error) {
+
+	callback = &clientStreamCallback{Callback: callback}
+{{- end}}
+{{- if .Serialized}}
+
+	// Only one stream of the method may be open at a time.
+	guarded, err := acquireStream("{{.FullMethod}}", {{if .ServerStream}}rStream{{else}}callback{{end}})
+	if err != nil {
+		return nil, err
+	}
+	{{if .ServerStream}}rStream{{else}}callback{{end}} = guarded
+
+	sStream, err := {{if .ServerStream}}{{template "startBiStreamWithContext" .}}{{else}}{{template "startClientStreamWithContext" .}}{{end}}
+	if err != nil {
+		guarded.release()
+		return nil, err
+	}
+
+	return sStream, nil
+{{- else}}
+
+	return {{if .ServerStream}}{{template "startBiStreamWithContext" .}}{{else}}{{template "startClientStreamWithContext" .}}{{end}}
+{{- end}}
+}
+{{- end}}
+`))
+
+	handleTemplate = template.Must(template.New("handle").Parse(`
+{{- define "startBiStreamWithHandle"}}startBiStream("{{.FullMethod}}", rStream,
+		func(ctx context.Context) ({{.TargetName}}.{{.ServiceName}}Client, func(), error) {
+			// The wait for the client is abandoned together with the handle.
+			return get{{.ServiceName}}Client(handle.bind(ctx))
+		},
+		func(ctx context.Context, client {{.TargetName}}.{{.ServiceName}}Client) (
+			biStream[*{{.RequestType}}, *{{.ResponseType}}], error) {
+
+			// The stream is stopped together with the handle.
+			ctx = handle.bind(ctx)
+
+			return client.{{.MethodName}}(ctx{{if .Compressor}}, grpc.UseCompressor({{.Compressor}}.Name){{end}})
+		},
+	)
+{{- end}}
+{{- if .ClientStream}}
+
+// {{.ApiPrefix}}{{.MethodName}}WithHandle calls {{.MethodName}}, returning a handle that sends the
+// requests and stops the stream once it is no longer needed.
+func {{.ApiPrefix}}{{.MethodName}}WithHandle(rStream RecvStream) (*BiStreamHandle, error) {
+	handle := newStreamHandle()
+{{- if .Serialized}}
+
+	// Only one stream of the method may be open at a time.
+	guarded, err := acquireStream("{{.FullMethod}}", rStream)
+	if err != nil {
+		return nil, err
+	}
+	rStream = guarded
+{{- end}}
+
+	sStream, err := {{template "startBiStreamWithHandle" .}}
+	if err != nil {
+{{- if .Serialized}}
+		guarded.release()
+{{- end}}
+		handle.Stop()
+
+		return nil, err
+	}
+
+	return &BiStreamHandle{
+		handle:  handle,
+		sStream: sStream,
+	}, nil
+}
+{{- else}}
+
+// {{.ApiPrefix}}{{.MethodName}}WithHandle calls {{.MethodName}}, returning a handle that stops the
+// stream once it is no longer needed.
+func {{.ApiPrefix}}{{.MethodName}}WithHandle(msg []byte, rStream RecvStream) *StreamHandle {
+	handle := newStreamHandle()
+{{- if .Serialized}}
+
+	// Only one stream of the method may be open at a time.
+	guarded, err := acquireStream("{{.FullMethod}}", rStream)
+	if err != nil {
+		go rStream.OnError(err)
+		return handle
+	}
+	rStream = guarded
+{{- end}}
+
+	startReadStream("{{.FullMethod}}", msg, rStream,
+		func(ctx context.Context) ({{.TargetName}}.{{.ServiceName}}Client, func(), error) {
+			// The wait for the client is abandoned together with the handle.
+			return get{{.ServiceName}}Client(handle.bind(ctx))
+		},
+		func(ctx context.Context, client {{.TargetName}}.{{.ServiceName}}Client,
+			req *{{.RequestType}}) (recvStream[*{{.ResponseType}}], error) {
+
+			// The stream is stopped together with the handle.
+			ctx = handle.bind(ctx)
+{{- if .Defaults}}
+
+			// Inject the defaults of unset request fields.
+{{- range .Defaults}}
+			if {{.Unset "req"}} {
+				req.{{.Field}} = {{.Value}}
+			}
+{{- end}}
+{{- end}}
+
+			return client.{{.MethodName}}(ctx, req{{if .Compressor}}, grpc.UseCompressor({{.Compressor}}.Name){{end}})
+		},
+	)
+
+	return handle
+}
+{{- end}}
+`))
+
+	readStreamTemplate = template.Must(template.New("readStream").Parse(`
+{{.Comment}}
+//
+// The request is a {{.Encoding}} {{.RequestMessage}}, and the receive stream
+// receives {{.Encoding}} {{.ResponseMessage}} responses.
+//
+// NOTE: This method produces a stream of responses, and the receive stream can
+// be called zero or more times. After EOF error is returned, no more responses
+// will be produced.
+func {{.ApiPrefix}}{{.MethodName}}(msg []byte, rStream RecvStream) {
+{{- if .StreamTransform}}
+	{{.ApiPrefix}}{{.MethodName}}Transformed(msg, nil, rStream)
+}
+
+// {{.ApiPrefix}}{{.MethodName}}Transformed calls {{.MethodName}}, passing each response through
+// transform before it is delivered to the receive stream. If transform is nil,
+// the responses are delivered unchanged.
+func {{.ApiPrefix}}{{.MethodName}}Transformed(msg []byte, transform StreamTransform,
+	rStream RecvStream) {
+
+{{- end}}
+{{- if .Serialized}}
+	// Only one stream of the method may be open at a time.
+	guarded, err := acquireStream("{{.FullMethod}}", rStream)
+	if err != nil {
+		go rStream.OnError(err)
+		return
+	}
+	rStream = guarded
+
+{{end}}
+	startReadStream("{{.FullMethod}}", msg, rStream, get{{.ServiceName}}Client,
+		func(ctx context.Context, client {{.TargetName}}.{{.ServiceName}}Client,
+			req *{{.RequestType}}) (recvStream[*{{.ResponseType}}], error) {
+{{- if .Defaults}}
+
+			// Inject the defaults of unset request fields.
+{{- range .Defaults}}
+			if {{.Unset "req"}} {
+				req.{{.Field}} = {{.Value}}
+			}
+{{- end}}
+{{- end}}
+{{- if .StreamTransform}}
+
+			stream, err := client.{{.MethodName}}(ctx, req{{if .Compressor}}, grpc.UseCompressor({{.Compressor}}.Name){{end}})
+			if err != nil || transform == nil {
+				return stream, err
+			}
+
+			return newTransformedStream[*{{.ResponseType}}](stream, transform), nil
+{{- else}}
+
+			return client.{{.MethodName}}(ctx, req{{if .Compressor}}, grpc.UseCompressor({{.Compressor}}.Name){{end}})
+{{- end}}
+		},
+	)
+}
+`))
+
+	demandTemplate = template.Must(template.New("demand").Parse(`
+
+// {{.ApiPrefix}}{{.MethodName}}WithDemand calls {{.MethodName}}, only delivering as many
+// responses as were requested from demand. A nil demand delivers all responses
+// as they are received.
+func {{.ApiPrefix}}{{.MethodName}}WithDemand(msg []byte, demand *StreamDemand,
+	rStream RecvStream) {
+{{- if .Serialized}}
+
+	// Only one stream of the method may be open at a time.
+	guarded, err := acquireStream("{{.FullMethod}}", rStream)
+	if err != nil {
+		go rStream.OnError(err)
+		return
+	}
+	rStream = guarded
+{{- end}}
+
+	startReadStream("{{.FullMethod}}", msg, rStream, get{{.ServiceName}}Client,
+		func(ctx context.Context, client {{.TargetName}}.{{.ServiceName}}Client,
+			req *{{.RequestType}}) (recvStream[*{{.ResponseType}}], error) {
+{{- if .Defaults}}
+
+			// Inject the defaults of unset request fields.
+{{- range .Defaults}}
+			if {{.Unset "req"}} {
+				req.{{.Field}} = {{.Value}}
+			}
+{{- end}}
+{{- end}}
+
+			stream, err := client.{{.MethodName}}(ctx, req{{if .Compressor}}, grpc.UseCompressor({{.Compressor}}.Name){{end}})
+			if err != nil {
+				return nil, err
+			}
+
+			return newDemandStream[*{{.ResponseType}}](ctx, stream, demand), nil
+		},
+	)
+}
+`))
+
+	biStreamTemplate = template.Must(template.New("biStream").Parse(`
+{{- define "startBiStream"}}startBiStream("{{.FullMethod}}", rStream, get{{.ServiceName}}Client,
+		func(ctx context.Context, client {{.TargetName}}.{{.ServiceName}}Client) (
+			biStream[*{{.RequestType}}, *{{.ResponseType}}], error) {
+
+			return client.{{.MethodName}}(ctx{{if .Compressor}}, grpc.UseCompressor({{.Compressor}}.Name){{end}})
+		},
+	)
+{{- end}}
+{{.Comment}}
+//
+// The send stream accepts {{.Encoding}} {{.RequestMessage}} requests, and the
+// receive stream receives {{.Encoding}} {{.ResponseMessage}} responses.
+//
+// NOTE: This method produces a stream of responses, and the receive stream can
+// be called zero or more times. After EOF error is returned, no more responses
+// will be produced. The send stream can accept zero or more requests before it
+// is closed.
+func {{.ApiPrefix}}{{.MethodName}}(rStream RecvStream) (SendStream, error) {
+{{- if .Serialized}}
+	// Only one stream of the method may be open at a time.
+	guarded, err := acquireStream("{{.FullMethod}}", rStream)
+	if err != nil {
+		return nil, err
+	}
+	rStream = guarded
+
+	sStream, err := {{template "startBiStream" .}}
+	if err != nil {
+		guarded.release()
+		return nil, err
+	}
+
+	return sStream, nil
+{{- else}}
+	return {{template "startBiStream" .}}
+{{- end}}
+}
+`))
+)
+
+// clientStreamTemplate creates the API of a client-streaming RPC, which is
+// started as a bidirectional stream whose only response is received once the
+// send stream is stopped.
+var clientStreamTemplate = template.Must(template.New("clientStream").Parse(`
+{{- define "startClientStream"}}startBiStream("{{.FullMethod}}", callback, get{{.ServiceName}}Client,
+		func(ctx context.Context, client {{.TargetName}}.{{.ServiceName}}Client) (
+			biStream[*{{.RequestType}}, *{{.ResponseType}}], error) {
+
+			stream, err := client.{{.MethodName}}(ctx{{if .Compressor}}, grpc.UseCompressor({{.Compressor}}.Name){{end}})
+			if err != nil {
+				return nil, err
+			}
+
+			return newClientStreamAdapter[*{{.RequestType}}, *{{.ResponseType}}](
+				stream,
+			), nil
+		},
+	)
+{{- end}}
+{{.Comment}}
+//
+// The send stream accepts {{.Encoding}} {{.RequestMessage}} requests, and the
+// callback receives a {{.Encoding}} {{.ResponseMessage}}.
+//
+// NOTE: The send stream can accept zero or more requests before it is stopped.
+// This method produces a single result or error once the send stream is
+// stopped, and the callback will be called only once.
+func {{.ApiPrefix}}{{.MethodName}}(callback Callback) (SendStream, error) {
+	callback = &clientStreamCallback{Callback: callback}
+{{- if .Serialized}}
+
+	// Only one stream of the method may be open at a time.
+	guarded, err := acquireStream("{{.FullMethod}}", callback)
+	if err != nil {
+		return nil, err
+	}
+	callback = guarded
+
+	sStream, err := {{template "startClientStream" .}}
+	if err != nil {
+		guarded.release()
+		return nil, err
+	}
+
+	return sStream, nil
+{{- else}}
+
+	return {{template "startClientStream" .}}
+{{- end}}
+}
+`))
+
+// paginationTemplate creates a helper for list-style RPCs that pages through
+// all results, delivering each page to the receive stream.
+var paginationTemplate = template.Must(template.New("pagination").Parse(`
+// {{.ApiPrefix}}{{.MethodName}}All calls {{.MethodName}} repeatedly, starting at the offset
+// of the passed request, and delivers each page of results to the receive
+// stream until all results have been retrieved.
+//
+// NOTE: This method produces a stream of responses, and the receive stream can
+// be called zero or more times. After EOF error is returned, no more responses
+// will be produced.
+func {{.ApiPrefix}}{{.MethodName}}All(msg []byte, rStream RecvStream) {
+	startPagination("{{.FullMethod}}", msg, rStream, get{{.ServiceName}}Client,
+		func(ctx context.Context, client {{.TargetName}}.{{.ServiceName}}Client,
+			req *{{.RequestType}}) (*{{.ResponseType}}, error) {
+
+			return client.{{.MethodName}}(ctx, req{{if .Compressor}}, grpc.UseCompressor({{.Compressor}}.Name){{end}})
+		},
+		func(req *{{.RequestType}}, resp *{{.ResponseType}}) bool {
+			next := resp.{{.Pagination.NextOffset}}
+{{- if .Pagination.Reversed}}
+			if req.{{.Pagination.Reversed}} {
+				next = resp.{{.Pagination.PrevOffset}}
+			}
+{{- end}}
+
+			// We stop once a page is empty or the offset doesn't
+			// advance anymore.
+			if len(resp.{{.Pagination.Results}}) == 0 ||
+				next == req.{{.Pagination.Offset}} {
+
+				return false
+			}
+
+			req.{{.Pagination.Offset}} = next
+			return true
+		},
+	)
+}
+`))
+
+// longPollTemplate creates the long-poll adapter of a server-streaming RPC,
+// which registers the stream such that its responses can be polled.
+var longPollTemplate = template.Must(template.New("longPoll").Parse(`
+// {{.ApiPrefix}}{{.MethodName}}Poll starts {{.ApiPrefix}}{{.MethodName}} and returns the ID of the
+// stream, which can be used with PollStream to retrieve the responses in
+// batches. This is an alternative for transports where streams are
+// impractical.
+func {{.ApiPrefix}}{{.MethodName}}Poll(msg []byte) int64 {
+	return startPollStream(func(rStream RecvStream) {
+		{{.ApiPrefix}}{{.MethodName}}(msg, rStream)
+	})
+}
+`))
+
+// longPollRegistryParams is a struct that holds all data passed in to the
+// long-poll registry template.
+type longPollRegistryParams struct {
+	ToolName string
+	Package  string
+	BuildTag string
+}
+
+// longPollRegistryTemplate creates the registry of the streams started by the
+// long-poll adapters, together with the methods to poll and close them.
+var longPollRegistryTemplate = template.Must(template.New("longPollRegistry").Parse(`// Code generated by {{.ToolName}} DO NOT EDIT.
+{{if .BuildTag}}
+{{.BuildTag}}
+{{end}}
+package {{.Package}}
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// pollStream is a RecvStream that buffers the responses of a stream until
+// they are retrieved with PollStream.
+type pollStream struct {
+	mu     sync.Mutex
+	msgs   [][]byte
+	err    error
+	closed bool
+
+	// notify is signalled whenever a response or error is added.
+	notify chan struct{}
+}
+
+// OnResponse is called for every response received on the stream.
+func (p *pollStream) OnResponse(b []byte) {
+	p.mu.Lock()
+	if !p.closed {
+		p.msgs = append(p.msgs, b)
+	}
+	p.mu.Unlock()
+
+	p.signal()
+}
+
+// OnError is called once the stream has ended.
+func (p *pollStream) OnError(err error) {
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.mu.Unlock()
+
+	p.signal()
+}
+
+// signal wakes up a waiting poller, if any.
+func (p *pollStream) signal() {
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pollStreams is the registry of all streams started by the long-poll
+// adapters, keyed by their stream ID.
+var pollStreams = struct {
+	sync.Mutex
+	nextID  int64
+	streams map[int64]*pollStream
+}{
+	streams: make(map[int64]*pollStream),
+}
+
+// startPollStream registers a new stream and starts it by calling start with
+// the stream's buffer. The ID of the new stream is returned.
+func startPollStream(start func(RecvStream)) int64 {
+	p := &pollStream{
+		notify: make(chan struct{}, 1),
+	}
+
+	pollStreams.Lock()
+	pollStreams.nextID++
+	id := pollStreams.nextID
+	pollStreams.streams[id] = p
+	pollStreams.Unlock()
+
+	start(p)
+
+	return id
+}
+
+// PollStream waits up to timeoutMs milliseconds for responses of the stream
+// with the given ID, and delivers at most maxMessages of them to rStream. A
+// maxMessages value of zero means all buffered responses are delivered. If no
+// responses arrive before the timeout, nothing is delivered.
+//
+// NOTE: The receive stream is called before PollStream returns. Once the
+// stream has ended, its error (io.EOF if it finished normally) is delivered
+// after the last response, and the stream ID is released.
+func PollStream(id int64, maxMessages int, timeoutMs int64,
+	rStream RecvStream) error {
+
+	pollStreams.Lock()
+	p, ok := pollStreams.streams[id]
+	pollStreams.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown stream ID %d", id)
+	}
+
+	timeout := time.NewTimer(time.Duration(timeoutMs) * time.Millisecond)
+	defer timeout.Stop()
+
+	for {
+		p.mu.Lock()
+		n := len(p.msgs)
+		if maxMessages > 0 && n > maxMessages {
+			n = maxMessages
+		}
+		batch := p.msgs[:n]
+		p.msgs = p.msgs[n:]
+		streamErr := p.err
+		done := streamErr != nil && len(p.msgs) == 0
+		p.mu.Unlock()
+
+		if n > 0 || done {
+			for _, b := range batch {
+				rStream.OnResponse(b)
+			}
+
+			if done {
+				ClosePollStream(id)
+				rStream.OnError(streamErr)
+			}
+
+			return nil
+		}
+
+		select {
+		case <-p.notify:
+		case <-timeout.C:
+			return nil
+		}
+	}
+}
+
+// ClosePollStream releases the stream with the given ID, discarding all of its
+// buffered and future responses.
+func ClosePollStream(id int64) {
+	pollStreams.Lock()
+	p, ok := pollStreams.streams[id]
+	delete(pollStreams.streams, id)
+	pollStreams.Unlock()
+
+	if !ok {
+		return
+	}
+
+	p.mu.Lock()
+	p.closed = true
+	p.msgs = nil
+	p.mu.Unlock()
+}
+`))
+
+// initialResponseTemplate creates the helper of a stream that delivers its first
+// response, such as a handshake or acknowledgement, separately.
+var initialResponseTemplate = template.Must(template.New("initialResponse").Parse(`
+// {{.ApiPrefix}}{{.MethodName}}WithInitial calls {{.MethodName}}, delivering the first response of
+// the stream, such as a handshake, to the initial callback and all following
+// responses to the receive stream. If the stream fails before the first
+// response, the error is only delivered to the initial callback.
+{{- if .ClientStream}}
+func {{.ApiPrefix}}{{.MethodName}}WithInitial(initial Callback, rStream RecvStream) (
+	SendStream, error) {
+
+	return {{.ApiPrefix}}{{.MethodName}}(newInitialStream(initial, rStream))
+}
+{{- else}}
+func {{.ApiPrefix}}{{.MethodName}}WithInitial(msg []byte, initial Callback, rStream RecvStream) {
+	{{.ApiPrefix}}{{.MethodName}}(msg, newInitialStream(initial, rStream))
+}
+{{- end}}
+`))
+
+// paymentStreamTemplate creates the reconnect-safe wrapper of a payment
+// stream.
+var paymentStreamTemplate = template.Must(template.New("paymentStream").Parse(`
+// {{.ApiPrefix}}{{.MethodName}}Reliable calls {{.MethodName}}, and re-tracks the payment using
+// {{.PaymentTracking.TrackMethod}} if the stream drops before the payment is final. Updates
+// that were already delivered are skipped, such that the receive stream gets a
+// deduplicated sequence of payment states.
+//
+// NOTE: This method produces a stream of responses, and the receive stream can
+// be called zero or more times. After EOF error is returned, no more responses
+// will be produced.
+func {{.ApiPrefix}}{{.MethodName}}Reliable(msg []byte, rStream RecvStream) {
+	startPaymentStream("{{.FullMethod}}", msg, rStream, get{{.ServiceName}}Client,
+		func(ctx context.Context, client {{.TargetName}}.{{.ServiceName}}Client,
+			req *{{.RequestType}}) (recvStream[*{{.ResponseType}}], error) {
+
+			return client.{{.MethodName}}(ctx, req{{if .Compressor}}, grpc.UseCompressor({{.Compressor}}.Name){{end}})
+		},
+		func(ctx context.Context, client {{.TargetName}}.{{.ServiceName}}Client,
+			payment *{{.ResponseType}}) (recvStream[*{{.ResponseType}}], error) {
+{{- if .PaymentTracking.HexPkg}}
+
+			hash, err := {{.PaymentTracking.HexPkg}}.DecodeString(payment.{{.PaymentTracking.ResponseHash}})
+			if err != nil {
+				return nil, err
+			}
+{{- else}}
+
+			hash := payment.{{.PaymentTracking.ResponseHash}}
+{{- end}}
+
+			return client.{{.PaymentTracking.TrackMethod}}(ctx, &{{.PaymentTracking.TrackRequestType}}{
+				{{.PaymentTracking.TrackHash}}: hash,
+			})
+		},
+	)
+}
+`))
+
+// typedTemplate creates the variant of a method taking and returning the Go
+// messages, for callers written in Go.
+var typedTemplate = template.Must(template.New("typed").Parse(`
+{{- define "typedCallOptions"}}
+{{- if .Compressor}}
+
+	opts = append([]grpc.CallOption{grpc.UseCompressor({{.Compressor}}.Name)},
+		opts...)
+{{- end}}
+{{- end}}
+{{- if and (not .ClientStream) (not .ServerStream)}}
+// {{.ApiPrefix}}{{.MethodName}}Typed calls {{.MethodName}} with the request message and returns the
+// response message. Unlike {{.ApiPrefix}}{{.MethodName}}, the messages aren't serialized, which
+// saves callers written in Go the round trip through bytes. It can't be bound
+// by gomobile.
+func {{.ApiPrefix}}{{.MethodName}}Typed(ctx context.Context, req *{{.RequestType}},
+	opts ...grpc.CallOption) (*{{.ResponseType}}, error) {
+
+	client, closeClient, err := get{{.ServiceName}}Client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer closeClient()
+{{- template "typedCallOptions" .}}
+
+	return client.{{.MethodName}}(ctx, req, opts...)
+}
+{{- else}}
+// {{.ApiPrefix}}{{.MethodName}}Typed starts {{.MethodName}} and returns the stream of its
+// messages. Unlike {{.ApiPrefix}}{{.MethodName}}, the messages aren't serialized, which saves
+// callers written in Go the round trip through bytes. It can't be bound by
+// gomobile.
+//
+// NOTE: The connection of the stream is released once the stream ends or ctx
+// is cancelled.
+{{- if .ClientStream}}
+func {{.ApiPrefix}}{{.MethodName}}Typed(ctx context.Context, opts ...grpc.CallOption) (
+	{{.TargetName}}.{{.ServiceName}}_{{.MethodName}}Client, error) {
+{{- else}}
+func {{.ApiPrefix}}{{.MethodName}}Typed(ctx context.Context, req *{{.RequestType}},
+	opts ...grpc.CallOption) ({{.TargetName}}.{{.ServiceName}}_{{.MethodName}}Client, error) {
+{{- end}}
+
+	client, closeClient, err := get{{.ServiceName}}Client(ctx)
+	if err != nil {
+		return nil, err
+	}
+{{- template "typedCallOptions" .}}
+
+	stream, err := client.{{.MethodName}}(ctx, {{if not .ClientStream}}req, {{end}}opts...)
+	if err != nil {
+		closeClient()
+		return nil, err
+	}
+
+	// The context of the stream is done once the stream ends.
+	go func() {
+		<-stream.Context().Done()
+		closeClient()
+	}()
+
+	return stream, nil
+}
+{{- end}}
+`))
+
+// uploadTemplate creates the helper sending a large payload to a
+// client-streaming RPC in chunks.
+var uploadTemplate = template.Must(template.New("upload").Parse(`
+// {{.ApiPrefix}}{{.MethodName}}Upload calls {{.MethodName}}, sending the payload split into
+// chunks of at most chunkSize bytes. Each chunk is sent in the {{.Upload.Field}} field of a
+// copy of the passed request, such that its other fields are sent with every
+// chunk. The send stream is stopped once all chunks are sent, and an empty
+// payload is sent as a single empty chunk.
+//
+// NOTE: This method produces a single result or error once all chunks are
+// sent, and the callback will be called only once.
+func {{.ApiPrefix}}{{.MethodName}}Upload(msg []byte, payload []byte, chunkSize int64,
+	callback Callback) {
+
+	if chunkSize <= 0 {
+		go callback.OnError({{.Upload.FmtPkg}}.Errorf("invalid chunk size %d", chunkSize))
+		return
+	}
+
+	// The request is encoded once without the payload, and each chunk is
+	// appended to it as the {{.Upload.Field}} field.
+	req := &{{.RequestType}}{}
+	if err := proto.Unmarshal(msg, req); err != nil {
+		go callback.OnError(err)
+		return
+	}
+	req.{{.Upload.Field}} = nil
+
+	head, err := proto.Marshal(req)
+	if err != nil {
+		go callback.OnError(err)
+		return
+	}
+
+	sStream, err := {{.ApiPrefix}}{{.MethodName}}(callback)
+	if err != nil {
+		go callback.OnError(err)
+		return
+	}
+
+	// We must make a copy of the passed byte slice, as there is no
+	// guarantee the contents won't be changed while the go routine is
+	// executing.
+	data := make([]byte, len(payload))
+	copy(data[:], payload[:])
+
+	go func() {
+		for first := true; first || len(data) > 0; first = false {
+			n := int64(len(data))
+			if n > chunkSize {
+				n = chunkSize
+			}
+
+			chunk := append([]byte(nil), head...)
+			chunk = {{.Upload.WirePkg}}.AppendTag(chunk, {{.Upload.Number}}, {{.Upload.WirePkg}}.BytesType)
+			chunk = {{.Upload.WirePkg}}.AppendBytes(chunk, data[:n])
+			data = data[n:]
+
+			// A failed send means the stream has ended, and its
+			// error is delivered once the send stream is stopped.
+			if err := sStream.Send(chunk); err != nil {
+				break
+			}
+		}
+
+		_ = sStream.Stop()
+	}()
+}
+`))
+
+// notificationSourcesTemplate registers the subscriptions of a service with
+// the notification demultiplexer.
+var facadeMethodsTemplate = template.Must(template.New("facadeMethods").Parse(`
+func init() {
+	// Register the API functions of the service, such that they can be
+	// called through the facade.
+{{- range .}}
+{{- if .ClientStream}}
+	facadeStreams["{{.FullMethod}}"] = func(rStream RecvStream) (SendStream, error) {
+		return {{.ApiPrefix}}{{.MethodName}}(rStream)
+	}
+{{- else if .ServerStream}}
+	facadeSubscriptions["{{.FullMethod}}"] = {{.ApiPrefix}}{{.MethodName}}
+{{- else if .TimeoutParam}}
+	facadeCalls["{{.FullMethod}}"] = func(msg []byte, callback Callback) {
+		{{.ApiPrefix}}{{.MethodName}}(msg, 0, callback)
+	}
+{{- else}}
+	facadeCalls["{{.FullMethod}}"] = {{.ApiPrefix}}{{.MethodName}}
+{{- end}}
+{{- end}}
+}
+`))
+
+var notificationSourcesTemplate = template.Must(template.New("notificationSources").Parse(`
+func init() {
+	// Register the subscriptions of the service, such that they can be
+	// added to Notifications.
+{{- range .}}
+	notificationSources["{{.ApiPrefix}}{{.MethodName}}"] = {{.ApiPrefix}}{{.MethodName}}
+{{- end}}
+}
+`))
+
+// methodTypesTemplate registers the request and response types of the methods
+// of a service with the type registry.
+var methodTypesTemplate = template.Must(template.New("methodTypes").Parse(`
+func init() {
+	// Register the request and response types of the methods, such that
+	// they can be looked up by their full method name.
+{{- range .}}
+	methodTypes["{{.FullMethod}}"] = newMethodTypes(
+		&{{.RequestType}}{}, &{{.ResponseType}}{},
+	)
+{{- end}}
+}
+`))
+
+// serviceInterfaceParams is a struct that holds all data passed in to the
+// serviceInterface template.
+type serviceInterfaceParams struct {
+	// ServiceName is the gRPC service name as defined in the proto file.
+	ServiceName string
+
+	// Methods are the methods of the service.
+	Methods []rpcParams
+}
+
+// serviceInterfaceTemplate creates an interface with the API functions of a
+// service as methods, together with its default implementation calling them.
+var serviceInterfaceTemplate = template.Must(template.New("serviceInterface").Parse(`
+{{- define "apiMethod"}}
+{{- if and .ClientStream .ServerStream}}
+	{{.MethodName}}(rStream RecvStream) (SendStream, error)
+{{- else if .ClientStream}}
+	{{.MethodName}}(callback Callback) (SendStream, error)
+{{- else if .ServerStream}}
+	{{.MethodName}}(msg []byte, rStream RecvStream)
+{{- else if .TimeoutParam}}
+	{{.MethodName}}(msg []byte, timeoutMs int64, callback Callback)
+{{- else}}
+	{{.MethodName}}(msg []byte, callback Callback)
+{{- end}}
+{{- if .Pagination}}
+	{{.MethodName}}All(msg []byte, rStream RecvStream)
+{{- end}}
+{{- if .StreamTransform}}
+	{{.MethodName}}Transformed(msg []byte, transform StreamTransform, rStream RecvStream)
+{{- end}}
+{{- if .Backpressure}}
+	{{.MethodName}}WithDemand(msg []byte, demand *StreamDemand, rStream RecvStream)
+{{- end}}
+{{- if .StreamHandle}}
+{{- if .ClientStream}}
+	{{.MethodName}}WithHandle(rStream RecvStream) (*BiStreamHandle, error)
+{{- else}}
+	{{.MethodName}}WithHandle(msg []byte, rStream RecvStream) *StreamHandle
+{{- end}}
+{{- end}}
+{{- if .Task}}
+	{{.MethodName}}Task(msg []byte) *Task
+{{- end}}
+{{- if .Progress}}
+	{{.MethodName}}WithProgress(msg []byte, callback Callback, progress ProgressCallback)
+{{- end}}
+{{- if .WithContext}}
+{{- if and .ClientStream .ServerStream}}
+	{{.MethodName}}WithContext(token *CancelToken, rStream RecvStream) (SendStream, error)
+{{- else if .ClientStream}}
+	{{.MethodName}}WithContext(token *CancelToken, callback Callback) (SendStream, error)
+{{- else if .ServerStream}}
+	{{.MethodName}}WithContext(token *CancelToken, msg []byte, rStream RecvStream)
+{{- else}}
+	{{.MethodName}}WithContext(token *CancelToken, msg []byte, callback Callback)
+{{- end}}
+{{- end}}
+{{- if .InitialResponse}}
+{{- if .ClientStream}}
+	{{.MethodName}}WithInitial(initial Callback, rStream RecvStream) (SendStream, error)
+{{- else}}
+	{{.MethodName}}WithInitial(msg []byte, initial Callback, rStream RecvStream)
+{{- end}}
+{{- end}}
+{{- if .PaymentTracking}}
+	{{.MethodName}}Reliable(msg []byte, rStream RecvStream)
+{{- end}}
+{{- if .Upload}}
+	{{.MethodName}}Upload(msg []byte, payload []byte, chunkSize int64, callback Callback)
+{{- end}}
+{{- if .LongPoll}}
+	{{.MethodName}}Poll(msg []byte) int64
+{{- end}}
+{{- end}}
+
+// {{.ServiceName}}API is implemented by the generated API functions of the
+// {{.ServiceName}} service, such that Go code can depend on it instead of the
+// functions and swap in another implementation, e.g. a mock in tests.
+type {{.ServiceName}}API interface {
+{{- range .Methods}}
+{{- template "apiMethod" .}}
+{{- end}}
+}
+
+// default{{.ServiceName}}API implements {{.ServiceName}}API by calling the
+// generated API functions.
+type default{{.ServiceName}}API struct{}
+
+// New{{.ServiceName}}API returns the {{.ServiceName}}API implemented by the
+// generated API functions.
+func New{{.ServiceName}}API() {{.ServiceName}}API {
+	return default{{.ServiceName}}API{}
+}
+{{range .Methods}}
+{{- $recv := printf "default%sAPI" $.ServiceName}}
+{{- $fn := printf "%s%s" .ApiPrefix .MethodName}}
+{{- if and .ClientStream .ServerStream}}
+func ({{$recv}}) {{.MethodName}}(rStream RecvStream) (SendStream, error) {
+	return {{$fn}}(rStream)
+}
+{{- else if .ClientStream}}
+func ({{$recv}}) {{.MethodName}}(callback Callback) (SendStream, error) {
+	return {{$fn}}(callback)
+}
+{{- else if .ServerStream}}
+func ({{$recv}}) {{.MethodName}}(msg []byte, rStream RecvStream) {
+	{{$fn}}(msg, rStream)
+}
+{{- else if .TimeoutParam}}
+func ({{$recv}}) {{.MethodName}}(msg []byte, timeoutMs int64, callback Callback) {
+	{{$fn}}(msg, timeoutMs, callback)
+}
+{{- else}}
+func ({{$recv}}) {{.MethodName}}(msg []byte, callback Callback) {
+	{{$fn}}(msg, callback)
+}
+{{- end}}
+{{- if .Pagination}}
+
+func ({{$recv}}) {{.MethodName}}All(msg []byte, rStream RecvStream) {
+	{{$fn}}All(msg, rStream)
+}
+{{- end}}
+{{- if .StreamTransform}}
+
+func ({{$recv}}) {{.MethodName}}Transformed(msg []byte, transform StreamTransform,
+	rStream RecvStream) {
+
+	{{$fn}}Transformed(msg, transform, rStream)
+}
+{{- end}}
+{{- if .Backpressure}}
+
+func ({{$recv}}) {{.MethodName}}WithDemand(msg []byte, demand *StreamDemand,
+	rStream RecvStream) {
+
+	{{$fn}}WithDemand(msg, demand, rStream)
+}
+{{- end}}
+{{- if .StreamHandle}}
+{{- if .ClientStream}}
+
+func ({{$recv}}) {{.MethodName}}WithHandle(rStream RecvStream) (*BiStreamHandle, error) {
+	return {{$fn}}WithHandle(rStream)
+}
+{{- else}}
+
+func ({{$recv}}) {{.MethodName}}WithHandle(msg []byte, rStream RecvStream) *StreamHandle {
+	return {{$fn}}WithHandle(msg, rStream)
+}
+{{- end}}
+{{- end}}
+{{- if .Task}}
+
+func ({{$recv}}) {{.MethodName}}Task(msg []byte) *Task {
+	return {{$fn}}Task(msg)
+}
+{{- end}}
+{{- if .Progress}}
+
+func ({{$recv}}) {{.MethodName}}WithProgress(msg []byte, callback Callback,
+	progress ProgressCallback) {
+
+	{{$fn}}WithProgress(msg, callback, progress)
+}
+{{- end}}
+{{- if .WithContext}}
+{{- if and .ClientStream .ServerStream}}
+
+func ({{$recv}}) {{.MethodName}}WithContext(token *CancelToken, rStream RecvStream) (
+	SendStream, error) {
+
+	return {{$fn}}WithContext(token, rStream)
+}
+{{- else if .ClientStream}}
+
+func ({{$recv}}) {{.MethodName}}WithContext(token *CancelToken, callback Callback) (
+	SendStream, error) {
+
+	return {{$fn}}WithContext(token, callback)
+}
+{{- else if .ServerStream}}
+
+func ({{$recv}}) {{.MethodName}}WithContext(token *CancelToken, msg []byte,
+	rStream RecvStream) {
+
+	{{$fn}}WithContext(token, msg, rStream)
+}
+{{- else}}
+
+func ({{$recv}}) {{.MethodName}}WithContext(token *CancelToken, msg []byte,
+	callback Callback) {
+
+	{{$fn}}WithContext(token, msg, callback)
+}
+{{- end}}
+{{- end}}
+{{- if .InitialResponse}}
+{{- if .ClientStream}}
+
+func ({{$recv}}) {{.MethodName}}WithInitial(initial Callback, rStream RecvStream) (
+	SendStream, error) {
+
+	return {{$fn}}WithInitial(initial, rStream)
+}
+{{- else}}
+
+func ({{$recv}}) {{.MethodName}}WithInitial(msg []byte, initial Callback,
+	rStream RecvStream) {
+
+	{{$fn}}WithInitial(msg, initial, rStream)
+}
+{{- end}}
+{{- end}}
+{{- if .PaymentTracking}}
+
+func ({{$recv}}) {{.MethodName}}Reliable(msg []byte, rStream RecvStream) {
+	{{$fn}}Reliable(msg, rStream)
+}
+{{- end}}
+{{- if .Upload}}
+
+func ({{$recv}}) {{.MethodName}}Upload(msg []byte, payload []byte, chunkSize int64,
+	callback Callback) {
+
+	{{$fn}}Upload(msg, payload, chunkSize, callback)
+}
+{{- end}}
+{{- if .LongPoll}}
+
+func ({{$recv}}) {{.MethodName}}Poll(msg []byte) int64 {
+	return {{$fn}}Poll(msg)
+}
+{{- end}}
+{{end}}`))
+
+// notificationsParams is a struct that holds all data passed in to the
+// notifications template.
+type apiVersionParams struct {
+	ToolName string
+	Package  string
+	BuildTag string
+
+	// Version is the JSON encoded description of the generated API.
+	Version string
+}
+
+// apiVersionTemplate creates the function describing the generated API.
+var apiVersionTemplate = template.Must(template.New("apiVersion").Parse(`// Code generated by {{.ToolName}} DO NOT EDIT.
+{{if .BuildTag}}
+{{.BuildTag}}
+{{end}}
+package {{.Package}}
+
+// GeneratedAPIVersion returns a JSON object describing the generated API. It
+// holds the falafel version the API was generated with, the SHA-256 digest of
+// the source proto descriptors and the enabled feature flags:
+// {"falafel_version": "", "proto_digest": "", "features": []}
+func GeneratedAPIVersion() string {
+	return {{printf "%q" .Version}}
+}
+`))
+
+type storageParams struct {
+	ToolName string
+	Package  string
+	BuildTag string
+}
+
+// storageTemplate creates the interface through which the generated layers
+// persist their state in a storage implemented by the host.
+var storageTemplate = template.Must(template.New("storage").Parse(`// Code generated by {{.ToolName}} DO NOT EDIT.
+{{if .BuildTag}}
+{{.BuildTag}}
+{{end}}
+package {{.Package}}
+
+import (
+	"sync"
+)
+
+// Storage is implemented by the host to persist the state of the generated
+// layers, such as cached responses and queued calls, in a database of its
+// choice. The values are grouped into namespaces, so the layers never share
+// keys with each other.
+type Storage interface {
+	// Get returns the value stored under the key in the namespace, or nil
+	// if there is none.
+	Get(namespace, key string) ([]byte, error)
+
+	// Put stores the value under the key in the namespace, replacing any
+	// previous value.
+	Put(namespace, key string, value []byte) error
+
+	// Delete removes the value stored under the key in the namespace. It
+	// must not fail if there is none.
+	Delete(namespace, key string) error
+}
+
+var (
+	// storage is the storage set by the host, if any.
+	storage Storage
+
+	// storageMtx guards access to the storage.
+	storageMtx sync.RWMutex
+)
+
+// SetStorage sets the storage the generated layers persist their state in. A
+// nil storage disables persistence, keeping the state in memory only.
+func SetStorage(s Storage) {
+	storageMtx.Lock()
+	defer storageMtx.Unlock()
+
+	storage = s
+}
+
+// currentStorage returns the storage set by the host, or nil if there is none.
+func currentStorage() Storage {
+	storageMtx.RLock()
+	defer storageMtx.RUnlock()
+
+	return storage
+}
+`))
+
+type lifecycleParams struct {
+	ToolName string
+	Package  string
+	BuildTag string
+
+	// ReadyService is the name of the service that is served once the
+	// node is ready, or empty if the node is ready once it is started.
+	ReadyService string
+
+	// StateGating indicates whether the RPC server must be checked to be
+	// active again after the node is shut down.
+	StateGating bool
+
+	// GRPCCompat is the grpc-go baseline the code is written against,
+	// either legacy, latest or empty for the default.
+	GRPCCompat string
+}
+
+// lifecycleTemplate creates the helper that ties the generated APIs to the
+// lifecycle of the embedded node.
+var lifecycleTemplate = template.Must(template.New("lifecycle").
+	Funcs(funcMap).
+	Parse(`// Code generated by {{.ToolName}} DO NOT EDIT.
+{{if .BuildTag}}
+{{.BuildTag}}
+{{end}}
+package {{.Package}}
+
+import (
+{{- if .ReadyService}}
+	"context"
+	"fmt"
+{{- end}}
+	"sync"
+{{- if .ReadyService}}
+	"time"
+
+	"google.golang.org/grpc/connectivity"
+{{- end}}
+)
+
+{{- if .ReadyService}}
+
+// nodeReadyTimeout is the maximum time waited for the node to become ready
+// after it has been started.
+var nodeReadyTimeout = time.Minute
+{{- end}}
+
+// nodeLifecycle holds the functions starting and stopping the embedded node.
+var nodeLifecycle struct {
+	sync.Mutex
+
+	start func() error
+	stop  func()
+
+	// running is true if the node has been started and is ready.
+	running bool
+}
+
+// BindToLifecycle ties the generated APIs to the lifecycle of the embedded
+// node. The node is started by calling start on the first call of any method
+// and stopped by calling stop on Shutdown. Calls are held back until the node
+// has become ready.
+func BindToLifecycle(start func() error, stop func()) {
+	nodeLifecycle.Lock()
+	defer nodeLifecycle.Unlock()
+
+	nodeLifecycle.start = start
+	nodeLifecycle.stop = stop
+}
+
+// Shutdown stops the embedded node if it is running, and re-creates the
+// in-memory listeners so the node can be started again by the next call.
+func Shutdown() {
+	nodeLifecycle.Lock()
+	defer nodeLifecycle.Unlock()
+
+	if !nodeLifecycle.running {
+		return
+	}
+
+	if nodeLifecycle.stop != nil {
+		nodeLifecycle.stop()
+	}
+	nodeLifecycle.running = false
+{{- if .StateGating}}
+
+	// The wallet must be unlocked again once the node is restarted.
+	resetRPCState()
+{{- end}}
+
+	RecreateListeners()
+}
+
+// ensureNodeStarted starts the embedded node if it has been bound using
+// BindToLifecycle and isn't running yet, and waits until it is ready.
+func ensureNodeStarted() error {
+	nodeLifecycle.Lock()
+	defer nodeLifecycle.Unlock()
+
+	if nodeLifecycle.running || nodeLifecycle.start == nil {
+		return nil
+	}
+
+	if err := nodeLifecycle.start(); err != nil {
+		return err
+	}
+{{- if .ReadyService}}
+
+	if err := waitNodeReady(); err != nil {
+		if nodeLifecycle.stop != nil {
+			nodeLifecycle.stop()
+		}
+		RecreateListeners()
+
+		return err
+	}
+{{- end}}
+	nodeLifecycle.running = true
+
+	return nil
+}
+{{- if .ReadyService}}
+
+// waitNodeReady waits until the {{.ReadyService}} service accepts connections.
+func waitNodeReady() error {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), nodeReadyTimeout,
+	)
+	defer cancel()
+
+	// Dialing the in-memory listener blocks until the server accepts
+	// the connection, so it is done in the background.
+	ready := make(chan error, 1)
+	go func() {
+		conn, closeConn, err := get{{.ReadyService | UpperCase}}Conn()
+		if err != nil {
+			ready <- err
+			return
+		}
+		defer closeConn()
+{{if ne .GRPCCompat "legacy"}}
+		conn.Connect()
+{{- end}}
+		for {
+			state := conn.GetState()
+			if state == connectivity.Ready {
+				ready <- nil
+				return
+			}
+
+			if !conn.WaitForStateChange(ctx, state) {
+				ready <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-ready:
+		return err
+
+	case <-ctx.Done():
+		return fmt.Errorf("node not ready after %v", nodeReadyTimeout)
+	}
+}
+{{- end}}
+`))
+
+// unlockTemplate creates the helper unlocking the wallet and waiting until the
+// RPC server is active.
+var unlockTemplate = template.Must(template.New("unlock").Parse(`// Code generated by {{.ToolName}} DO NOT EDIT.
+{{if .BuildTag}}
+{{.BuildTag}}
+{{end}}
+package {{.Package}}
+
+import (
+	"context"
+	"time"
+{{range .Imports}}
+	{{if .Alias}}{{.Alias}} {{end}}"{{.Path}}"
+{{- end}}
+)
+
+// UnlockCallback is an interface that is passed to UnlockAndWait, and is
+// notified about the progress of unlocking the wallet.
+type UnlockCallback interface {
+	// OnProgress is called with the name of every state the node reaches
+	// while the wallet is unlocked, e.g. UNLOCKED.
+	OnProgress(state string)
+
+	// OnReady is called once the RPC server is active.
+	OnReady()
+
+	// OnError is called if the wallet couldn't be unlocked, or the RPC
+	// server didn't become active in time.
+	OnError(error)
+}
+
+// UnlockAndWait unlocks the wallet with the given password using
+// {{.UnlockService}}.{{.UnlockMethod}}, and waits until the RPC server is active as reported
+// by {{.StateService}}.{{.SubscribeMethod}}. The progress is reported to callback. If the RPC
+// server isn't active after timeoutMs milliseconds, callback.OnError is called.
+func UnlockAndWait(password []byte, timeoutMs int64, callback UnlockCallback) {
+	// We must make a copy of the passed password, as there is no
+	// guarantee the contents won't be changed while the go routine is
+	// executing.
+	pw := make([]byte, len(password))
+	copy(pw, password)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(
+			context.Background(),
+			time.Duration(timeoutMs)*time.Millisecond,
+		)
+		defer cancel()
+
+		if err := unlockAndWait(ctx, pw, callback); err != nil {
+			callback.OnError(err)
+			return
+		}
+
+		callback.OnReady()
+	}()
+}
+
+// unlockAndWait unlocks the wallet and blocks until the RPC server is active.
+func unlockAndWait(ctx context.Context, password []byte,
+	callback UnlockCallback) error {
+
+	// Subscribe to the state before unlocking the wallet, such that no
+	// state change is missed.
+	stateClient, closeState, err := get{{.StateService}}Client(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeState()
+
+	states, err := stateClient.{{.SubscribeMethod}}(ctx, &{{.SubscribeRequest}}{})
+	if err != nil {
+		return err
+	}
+
+	unlockClient, closeUnlock, err := get{{.UnlockService}}Client(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeUnlock()
+
+	_, err = unlockClient.{{.UnlockMethod}}(ctx, &{{.UnlockRequest}}{
+		{{.PasswordField}}: password,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Wait for the RPC server to become active.
+	for {
+		resp, err := states.Recv()
+		if err != nil {
+			return err
+		}
+
+		state := resp.{{.StateField}}
+		callback.OnProgress(state.String())
+
+		switch state {
+		case {{range $i, $s := .ActiveStates}}{{if $i}}, {{end}}{{$s}}{{end}}:
+			return nil
+		}
+	}
+}
+`))
+
+// previewTemplate creates the helpers rendering redacted, size-capped previews
+// of the requests and responses for logging.
+var previewTemplate = template.Must(template.New("preview").Parse(`// Code generated by {{.ToolName}} DO NOT EDIT.
+{{if .BuildTag}}
+{{.BuildTag}}
+{{end}}
+package {{.Package}}
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+const (
+	// defaultPreviewLen is the length previews are capped at if no
+	// positive maximum length is given.
+	defaultPreviewLen = 512
+
+	// previewValueLen is the length string and bytes values are capped at
+	// within a preview, such that a single large value doesn't take up the
+	// whole preview.
+	previewValueLen = 64
+)
+
+// previewRedacted holds the full names of the fields whose values are left out
+// of the previews, as they hold secrets.
+var previewRedacted = map[protoreflect.FullName]bool{
+{{- range .Redacted}}
+	"{{.}}": true,
+{{- end}}
+}
+
+// PreviewMessage renders a redacted human-readable preview of the serialized
+// request or response of the method with the given full name, e.g.
+// /lnrpc.Lightning/GetInfo, as passed to the serialization hook. The preview
+// is capped at maxLen bytes, or 512 if maxLen isn't positive.
+func PreviewMessage(method string, payload []byte, request bool,
+	maxLen int) string {
+
+	desc, err := previewMethod(method)
+	if err != nil {
+		return fmt.Sprintf("<%d bytes: %v>", len(payload), err)
+	}
+
+	msgDesc := desc.Output()
+	if request {
+		msgDesc = desc.Input()
+	}
+	msgType, err := protoregistry.GlobalTypes.FindMessageByName(
+		msgDesc.FullName(),
+	)
+	if err != nil {
+		return fmt.Sprintf("<%d bytes: %v>", len(payload), err)
+	}
+
+	msg := msgType.New().Interface()
+	if err := proto.Unmarshal(payload, msg); err != nil {
+		return fmt.Sprintf("<%d bytes: %v>", len(payload), err)
+	}
+
+	return PreviewProto(msg, maxLen)
+}
+
+// PreviewProto renders a redacted human-readable preview of msg, e.g. for
+// logging in server interceptors. The preview is capped at maxLen bytes, or
+// 512 if maxLen isn't positive.
+func PreviewProto(msg proto.Message, maxLen int) string {
+	if msg == nil {
+		return "<nil>"
+	}
+	if maxLen <= 0 {
+		maxLen = defaultPreviewLen
+	}
+
+	w := &previewWriter{max: maxLen}
+	w.message(msg.ProtoReflect())
+
+	return w.String()
+}
+
+// previewMethod returns the descriptor of the method with the given full name.
+func previewMethod(method string) (protoreflect.MethodDescriptor, error) {
+	service, name, ok := strings.Cut(strings.TrimPrefix(method, "/"), "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid method %s", method)
+	}
+
+	desc, err := protoregistry.GlobalFiles.FindDescriptorByName(
+		protoreflect.FullName(service),
+	)
+	if err != nil {
+		return nil, err
+	}
+	serviceDesc, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a service", service)
+	}
+
+	methodDesc := serviceDesc.Methods().ByName(protoreflect.Name(name))
+	if methodDesc == nil {
+		return nil, fmt.Errorf("unknown method %s", method)
+	}
+
+	return methodDesc, nil
+}
+
+// previewWriter renders a preview, truncating it once its maximum length is
+// reached.
+type previewWriter struct {
+	b         strings.Builder
+	max       int
+	truncated bool
+}
+
+// write appends s to the preview, up to its maximum length.
+func (w *previewWriter) write(s string) {
+	if w.truncated {
+		return
+	}
+
+	if w.b.Len()+len(s) > w.max {
+		s = s[:w.max-w.b.Len()]
+		w.truncated = true
+	}
+	w.b.WriteString(s)
+}
+
+// String returns the preview, ending with an ellipsis if it was truncated.
+func (w *previewWriter) String() string {
+	if !w.truncated {
+		return w.b.String()
+	}
+
+	// The preview may have been cut in the middle of a character.
+	return strings.ToValidUTF8(w.b.String(), "") + "..."
+}
+
+// message renders the fields of the message that are set, in the order of
+// their declaration.
+func (w *previewWriter) message(m protoreflect.Message) {
+	w.write("{")
+
+	fields := m.Descriptor().Fields()
+	first := true
+	for i := 0; i < fields.Len() && !w.truncated; i++ {
+		fd := fields.Get(i)
+		if !m.Has(fd) {
+			continue
+		}
+
+		if !first {
+			w.write(", ")
+		}
+		first = false
+		w.write(string(fd.Name()) + ": ")
+
+		switch {
+		case previewRedacted[fd.FullName()]:
+			w.write("[redacted]")
+
+		case fd.IsList():
+			w.list(fd, m.Get(fd).List())
+
+		case fd.IsMap():
+			w.mapEntries(fd, m.Get(fd).Map())
+
+		default:
+			w.value(fd, m.Get(fd))
+		}
+	}
+
+	w.write("}")
+}
+
+// list renders the elements of the repeated field.
+func (w *previewWriter) list(fd protoreflect.FieldDescriptor,
+	list protoreflect.List) {
+
+	w.write("[")
+	for i := 0; i < list.Len() && !w.truncated; i++ {
+		if i > 0 {
+			w.write(", ")
+		}
+		w.value(fd, list.Get(i))
+	}
+	w.write("]")
+}
+
+// mapEntries renders the entries of the map field, sorted by key.
+func (w *previewWriter) mapEntries(fd protoreflect.FieldDescriptor,
+	m protoreflect.Map) {
+
+	keys := make([]protoreflect.MapKey, 0, m.Len())
+	m.Range(func(key protoreflect.MapKey, _ protoreflect.Value) bool {
+		keys = append(keys, key)
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+
+	w.write("{")
+	for i, key := range keys {
+		if w.truncated {
+			break
+		}
+		if i > 0 {
+			w.write(", ")
+		}
+		w.value(fd.MapKey(), key.Value())
+		w.write(": ")
+		w.value(fd.MapValue(), m.Get(key))
+	}
+	w.write("}")
+}
+
+// value renders a single value of the field. Long strings are cut, and long
+// bytes values are only rendered by their length.
+func (w *previewWriter) value(fd protoreflect.FieldDescriptor,
+	v protoreflect.Value) {
+
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		w.message(v.Message())
+
+	case protoreflect.EnumKind:
+		enumValue := fd.Enum().Values().ByNumber(v.Enum())
+		if enumValue == nil {
+			w.write(strconv.Itoa(int(v.Enum())))
+			return
+		}
+		w.write(string(enumValue.Name()))
+
+	case protoreflect.StringKind:
+		s := v.String()
+		if len(s) > previewValueLen {
+			s = strings.ToValidUTF8(s[:previewValueLen], "") + "..."
+		}
+		w.write(strconv.Quote(s))
+
+	case protoreflect.BytesKind:
+		b := v.Bytes()
+		if len(b) > previewValueLen/2 {
+			w.write(fmt.Sprintf("<%d bytes>", len(b)))
+			return
+		}
+		w.write(hex.EncodeToString(b))
+
+	default:
+		w.write(fmt.Sprint(v.Interface()))
+	}
+}
+`))
+
+// stateGatingTemplate creates the check gating the calls of services on the RPC
+// server of the node being active.
+var stateGatingTemplate = template.Must(template.New("stateGating").Parse(`// Code generated by {{.ToolName}} DO NOT EDIT.
+{{if .BuildTag}}
+{{.BuildTag}}
+{{end}}
+package {{.Package}}
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+{{range .Imports}}
+	{{if .Alias}}{{.Alias}} {{end}}"{{.Path}}"
+{{- end}}
+)
+
+{{- if .Block}}
+
+// ErrRPCNotActive is returned by calls of services requiring the RPC server of
+// the node to be active if the state of the node can't be determined.
+{{- else}}
+
+// ErrRPCNotActive is returned by calls of services requiring the RPC server of
+// the node to be active, if they are made before it is, e.g. because the
+// wallet hasn't been unlocked yet.
+{{- end}}
+var ErrRPCNotActive = status.Error(codes.Unavailable,
+	"RPC server not active, unlock the wallet first")
+
+// rpcStateTimeout is how long a call waits for {{.StateService}}.{{.SubscribeMethod}} to
+// report the state of the node before failing with ErrRPCNotActive, e.g.
+// because the {{.StateService}} service isn't served yet.
+const rpcStateTimeout = 3 * time.Second
+
+var (
+	// rpcStateMtx guards the state of the node reported by the
+	// subscription.
+	rpcStateMtx sync.Mutex
+
+	// rpcActive is true once {{.StateService}}.{{.SubscribeMethod}} reported that the
+	// RPC server is active.
+	rpcActive bool
+
+	// rpcStateKnown is true once the current subscription reported the
+	// state of the node.
+	rpcStateKnown bool
+
+	// rpcStateErr is the error the last subscription ended with.
+	rpcStateErr error
+
+	// rpcStateChanged is closed and replaced whenever the state is
+	// reported or the subscription ends.
+	rpcStateChanged = make(chan struct{})
+
+	// rpcStateCancel cancels the current subscription. It is nil if none
+	// is running.
+	rpcStateCancel context.CancelFunc
+
+	// rpcStateID identifies the current subscription, such that ended
+	// subscriptions don't report their state anymore.
+	rpcStateID uint64
+)
+
+{{- if .Block}}
+
+// checkRPCActive blocks until the RPC server of the node is active, as
+// reported by {{.StateService}}.{{.SubscribeMethod}}. ErrRPCNotActive is returned if the state
+// isn't reported within rpcStateTimeout, and the error of ctx once it is done.
+{{- else}}
+
+// checkRPCActive returns ErrRPCNotActive if the RPC server of the node isn't
+// active yet, as reported by {{.StateService}}.{{.SubscribeMethod}}, or if the state isn't
+// reported within rpcStateTimeout. The error of ctx is returned if it is done
+// before the state is reported.
+{{- end}}
+func checkRPCActive(ctx context.Context) error {
+	timeout := time.NewTimer(rpcStateTimeout)
+	defer timeout.Stop()
+
+	started := false
+	for {
+		rpcStateMtx.Lock()
+		if rpcActive {
+			rpcStateMtx.Unlock()
+			return nil
+		}
+
+		// Report the error of the subscription this call waited for.
+		if started && rpcStateCancel == nil && rpcStateErr != nil {
+			err := rpcStateErr
+			rpcStateMtx.Unlock()
+			return err
+		}
+
+		// The state is tracked by a single subscription shared by all
+		// calls, which is started by the first of them.
+		if rpcStateCancel == nil {
+			startRPCStateLocked()
+			started = true
+		}
+		known, changed := rpcStateKnown, rpcStateChanged
+		rpcStateMtx.Unlock()
+{{- if .Block}}
+
+		// Wait for the RPC server to become active, but only as long
+		// as the state of the node is known.
+		timeoutC := timeout.C
+		if known {
+			timeoutC = nil
+		}
+
+		select {
+		case <-changed:
+		case <-timeoutC:
+			return ErrRPCNotActive
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+{{- else}}
+
+		if known {
+			return ErrRPCNotActive
+		}
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return ErrRPCNotActive
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+{{- end}}
+	}
+}
+
+// startRPCStateLocked starts the subscription tracking the state of the node.
+// The caller must hold rpcStateMtx.
+func startRPCStateLocked() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	rpcStateID++
+	rpcStateCancel = cancel
+	rpcStateKnown = false
+	rpcStateErr = nil
+
+	go watchRPCState(ctx, rpcStateID)
+}
+
+// watchRPCState subscribes to the state of the node, reporting it until the
+// RPC server is active or the subscription fails.
+func watchRPCState(ctx context.Context, id uint64) {
+	err := func() error {
+		client, closeClient, err := get{{.StateService}}Client(ctx)
+		if err != nil {
+			return err
+		}
+		defer closeClient()
+
+		states, err := client.{{.SubscribeMethod}}(ctx, &{{.SubscribeRequest}}{})
+		if err != nil {
+			return err
+		}
+
+		for {
+			resp, err := states.Recv()
+			if err != nil {
+				return err
+			}
+
+			switch resp.{{.StateField}} {
+			case {{range $i, $s := .ActiveStates}}{{if $i}}, {{end}}{{$s}}{{end}}:
+				// Once active, the state isn't checked
+				// anymore until it is reset.
+				reportRPCState(id, true, nil)
+				return nil
+			}
+			reportRPCState(id, false, nil)
+		}
+	}()
+	if err != nil {
+		reportRPCState(id, false, err)
+	}
+}
+
+// reportRPCState records the state reported by the subscription with the given
+// ID, which ends it if the RPC server is active or err is set. Reports of
+// subscriptions that already ended are ignored.
+func reportRPCState(id uint64, active bool, err error) {
+	rpcStateMtx.Lock()
+	defer rpcStateMtx.Unlock()
+
+	if id != rpcStateID || rpcStateCancel == nil {
+		return
+	}
+
+	rpcActive = active
+	rpcStateKnown = true
+	if active || err != nil {
+		rpcStateCancel()
+		rpcStateCancel = nil
+		rpcStateErr = err
+	}
+
+	close(rpcStateChanged)
+	rpcStateChanged = make(chan struct{})
+}
+
+// resetRPCState forgets the state of the node and ends its subscription, such
+// that it is checked again by the next call, e.g. once the node is restarted.
+func resetRPCState() {
+	rpcStateMtx.Lock()
+	defer rpcStateMtx.Unlock()
+
+	if rpcStateCancel != nil {
+		rpcStateCancel()
+		rpcStateCancel = nil
+	}
+	rpcActive = false
+	rpcStateKnown = false
+	rpcStateErr = nil
+
+	close(rpcStateChanged)
+	rpcStateChanged = make(chan struct{})
+}
+`))
+
+// grpcWebTemplate creates the plumbing shared by the gRPC-Web handlers, which
+// translates gRPC-Web requests into calls over the in-memory listeners.
+var grpcWebTemplate = template.Must(template.New("grpcWeb").Parse(`// Code generated by {{.ToolName}} DO NOT EDIT.
+{{if .BuildTag}}
+{{.BuildTag}}
+{{end}}
+package {{.Package}}
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// grpcWebContentType is the content type of gRPC-Web requests and
+	// responses carrying binary protobuf messages.
+	grpcWebContentType = "application/grpc-web+proto"
+
+	// grpcWebTrailerFlag marks the frame of a gRPC-Web response carrying
+	// the trailers instead of a message.
+	grpcWebTrailerFlag = 0x80
+
+	// grpcWebMaxMessageSize is the maximum size of the message of a
+	// gRPC-Web request.
+	grpcWebMaxMessageSize = 4 << 20
+)
+
+// grpcWebSkippedHeaders are the HTTP headers of gRPC-Web requests that are
+// not forwarded to the services as metadata.
+var grpcWebSkippedHeaders = map[string]bool{
+	"accept":          true,
+	"accept-encoding": true,
+	"accept-language": true,
+	"connection":      true,
+	"content-length":  true,
+	"content-type":    true,
+	"host":            true,
+	"origin":          true,
+	"referer":         true,
+	"te":              true,
+	"user-agent":      true,
+	"x-grpc-web":      true,
+	"x-user-agent":    true,
+}
+
+// grpcWebHandler is an http.Handler that translates gRPC-Web requests into
+// calls of the methods of a service, and their responses into gRPC-Web
+// responses. Only the binary format is supported, not the base64 encoded
+// application/grpc-web-text format.
+type grpcWebHandler struct {
+	// getConn returns a client connection to the service.
+	getConn func() (*grpc.ClientConn, func(), error)
+
+	// methods maps the full names of the methods served by the handler to
+	// whether they are server-streaming.
+	methods map[string]bool
+}
+
+// ServeHTTP forwards the message of the gRPC-Web request to the method named by
+// the request path, and writes the responses and the final status of the call
+// as gRPC-Web frames. The responses of server-streaming methods are flushed as
+// they are received.
+func (h *grpcWebHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "gRPC-Web requests must use POST",
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/grpc-web" &&
+		!strings.HasPrefix(contentType, grpcWebContentType) {
+
+		http.Error(w, fmt.Sprintf("unsupported content type %s",
+			contentType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// From here on, all errors are reported through the status in the
+	// trailers.
+	w.Header().Set("Content-Type", grpcWebContentType)
+
+	serverStream, ok := h.methods[r.URL.Path]
+	if !ok {
+		writeGRPCWebTrailers(w, status.Newf(codes.Unimplemented,
+			"method %s not supported by gRPC-Web", r.URL.Path), nil)
+		return
+	}
+
+	msg, err := readGRPCWebMessage(r.Body)
+	if err != nil {
+		writeGRPCWebTrailers(w, status.Convert(err), nil)
+		return
+	}
+
+	conn, closeConn, err := h.getConn()
+	if err != nil {
+		writeGRPCWebTrailers(w, status.Convert(err), nil)
+		return
+	}
+	defer closeConn()
+
+	// The request headers are passed on as metadata, such that e.g. the
+	// macaroon of the caller reaches the service.
+	ctx := metadata.NewOutgoingContext(
+		r.Context(), grpcWebMetadata(r.Header),
+	)
+	desc := &grpc.StreamDesc{
+		ServerStreams: serverStream,
+	}
+	stream, err := conn.NewStream(
+		ctx, desc, r.URL.Path, grpc.ForceCodec(grpcWebCodec{}),
+	)
+	if err != nil {
+		writeGRPCWebTrailers(w, status.Convert(err), nil)
+		return
+	}
+
+	// An error sending the request is returned by RecvMsg below.
+	if err := stream.SendMsg(msg); err == nil {
+		_ = stream.CloseSend()
+	}
+
+	// If the headers can't be received, the error is returned by RecvMsg
+	// as well.
+	if header, err := stream.Header(); err == nil {
+		addGRPCWebHeaders(w.Header(), header)
+	}
+
+	flusher, _ := w.(http.Flusher)
+	for {
+		var resp []byte
+		err := stream.RecvMsg(&resp)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeGRPCWebTrailers(
+				w, status.Convert(err), stream.Trailer(),
+			)
+			return
+		}
+
+		// If the response can't be written, the client is gone and
+		// the call is cancelled with the context of the request.
+		if err := writeGRPCWebFrame(w, 0, resp); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		// Unary methods have a single response.
+		if !serverStream {
+			break
+		}
+	}
+
+	writeGRPCWebTrailers(w, status.New(codes.OK, ""), stream.Trailer())
+}
+
+// readGRPCWebMessage reads the message of a gRPC-Web request, which is
+// prefixed by a flag byte and its length.
+func readGRPCWebMessage(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"unable to read message: %v", err)
+	}
+
+	if prefix[0] != 0 {
+		return nil, status.Error(codes.Unimplemented,
+			"compressed messages are not supported")
+	}
+
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > grpcWebMaxMessageSize {
+		return nil, status.Errorf(codes.ResourceExhausted,
+			"message of %d bytes exceeds the maximum of %d bytes",
+			size, grpcWebMaxMessageSize)
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"unable to read message: %v", err)
+	}
+
+	return msg, nil
+}
+
+// writeGRPCWebFrame writes a gRPC-Web frame with the given flag and payload.
+func writeGRPCWebFrame(w io.Writer, flag byte, payload []byte) error {
+	var prefix [5]byte
+	prefix[0] = flag
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(payload)))
+
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+
+	return err
+}
+
+// writeGRPCWebTrailers writes the frame carrying the status of the call and the
+// trailers sent by the service, if any.
+func writeGRPCWebTrailers(w io.Writer, st *status.Status,
+	trailer metadata.MD) {
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "grpc-status: %d\r\n", st.Code())
+	if st.Message() != "" {
+		fmt.Fprintf(&b, "grpc-message: %s\r\n",
+			url.PathEscape(st.Message()))
+	}
+	for key, values := range trailer {
+		// The trailers of calls failing without a response include
+		// the headers, whose content type doesn't apply.
+		if key == "content-type" {
+			continue
+		}
+
+		for _, value := range values {
+			fmt.Fprintf(&b, "%s: %s\r\n", key,
+				grpcWebHeaderValue(key, value))
+		}
+	}
+
+	_ = writeGRPCWebFrame(w, grpcWebTrailerFlag, []byte(b.String()))
+}
+
+// grpcWebMetadata returns the headers of a gRPC-Web request as the metadata of
+// the call, leaving out the HTTP specific ones and those reserved by gRPC.
+func grpcWebMetadata(header http.Header) metadata.MD {
+	md := metadata.MD{}
+	for key, values := range header {
+		key = strings.ToLower(key)
+		if grpcWebSkippedHeaders[key] ||
+			strings.HasPrefix(key, "grpc-") {
+
+			continue
+		}
+
+		for _, value := range values {
+			// Binary metadata is base64 encoded in headers.
+			if strings.HasSuffix(key, "-bin") {
+				b, err := base64.StdEncoding.DecodeString(value)
+				if err != nil {
+					continue
+				}
+				value = string(b)
+			}
+			md.Append(key, value)
+		}
+	}
+
+	return md
+}
+
+// addGRPCWebHeaders adds the headers sent by the service to the headers of the
+// gRPC-Web response.
+func addGRPCWebHeaders(header http.Header, md metadata.MD) {
+	for key, values := range md {
+		if key == "content-type" {
+			continue
+		}
+
+		for _, value := range values {
+			header.Add(key, grpcWebHeaderValue(key, value))
+		}
+	}
+}
+
+// grpcWebHeaderValue returns the value of the metadata key as it is sent in a
+// header, with binary values base64 encoded.
+func grpcWebHeaderValue(key, value string) string {
+	if strings.HasSuffix(key, "-bin") {
+		return base64.StdEncoding.EncodeToString([]byte(value))
+	}
+
+	return value
+}
+
+// grpcWebCodec passes the messages of gRPC-Web requests and responses through
+// unchanged, as they are already serialized.
+type grpcWebCodec struct{}
+
+// Marshal returns the serialized message.
+func (grpcWebCodec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+
+	return b, nil
+}
+
+// Unmarshal copies the serialized message, as data may be reused once it
+// returns.
+func (grpcWebCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	*b = append([]byte(nil), data...)
+
+	return nil
+}
+
+// Name returns the name of the proto codec, as the messages are serialized
+// protobuf messages.
+func (grpcWebCodec) Name() string {
+	return "proto"
+}
+`))
+
+// grpcWebHandlerTemplate creates the constructor of the gRPC-Web handler of a
+// service.
+var grpcWebHandlerTemplate = template.Must(template.New("grpcWebHandler").
+	Funcs(funcMap).
+	Parse(`// Code generated by {{.ToolName}} DO NOT EDIT.
+// source: {{.FileName}}
+{{if .BuildTags}}
+{{.BuildTags}}
+{{end}}
+package {{.Package}}
+
+import (
+	"net/http"
+{{- if or .ServiceGating .Lifecycle}}
+
+	"google.golang.org/grpc"
+{{- end}}
+)
+
+{{- define "handlerConn"}}
+{{- if or .ServiceGating .Lifecycle}}
+		getConn: func() (*grpc.ClientConn, func(), error) {
+{{- if .ServiceGating}}
+			// Make sure the service hasn't been disabled at
+			// runtime.
+			err := checkServiceEnabled("{{.ServiceName}}")
+			if err != nil {
+				return nil, nil, err
+			}
+{{- end}}
+{{- if .Lifecycle}}
+{{- if .ServiceGating}}
+{{end}}
+			// Start the embedded node if it isn't running yet.
+			if err := ensureNodeStarted(); err != nil {
+				return nil, nil, err
+			}
+{{- end}}
+
+			return get{{.ServiceName | UpperCase}}Conn()
+		},
+{{- else}}
+		getConn: get{{.ServiceName | UpperCase}}Conn,
+{{- end}}
+{{- end}}
+
+// New{{.ServiceName}}GRPCWebHandler returns an http.Handler serving the methods
+// of {{.ServiceName}} to gRPC-Web clients, such as browsers, over the in-memory
+// listener of the service. The requests must be routed to the handler by their
+// path, which is the full name of the called method. Client-streaming methods
+// can't be called through gRPC-Web and are rejected as unimplemented.
+func New{{.ServiceName}}GRPCWebHandler() http.Handler {
+	return &grpcWebHandler{
+{{- template "handlerConn" .}}
+		methods: map[string]bool{
+{{- range .Methods}}
+			"{{.FullMethod}}": {{.ServerStream}},
+{{- end}}
+		},
+	}
+}
+`))
+
+// restTemplate creates the router plumbing shared by the REST handlers, which
+// maps REST requests to calls over the in-memory listeners like grpc-gateway.
+var restTemplate = template.Must(template.New("rest").Parse(`// Code generated by {{.ToolName}} DO NOT EDIT.
+{{if .BuildTag}}
+{{.BuildTag}}
+{{end}}
+package {{.Package}}
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+var (
+	// restMarshaler marshals the responses like the default marshaler
+	// of grpc-gateway.
+	restMarshaler = protojson.MarshalOptions{
+		EmitUnpopulated: true,
+	}
+
+{{- if .RejectUnknown}}
+
+	// restUnmarshaler unmarshals the request bodies, rejecting unknown
+	// fields.
+	restUnmarshaler = protojson.UnmarshalOptions{}
+{{- else}}
+
+	// restUnmarshaler unmarshals the request bodies like the default
+	// marshaler of grpc-gateway.
+	restUnmarshaler = protojson.UnmarshalOptions{
+		DiscardUnknown: true,
+	}
+{{- end}}
+)
+
+// restSegment is a segment of the path template of a REST route.
+type restSegment struct {
+	// literal is the path segment matched literally, unless wildcard is
+	// set.
+	literal string
+
+	// wildcard is * to match any single segment, or ** to match all
+	// remaining segments.
+	wildcard string
+
+	// field is the dotted path of the request field the segment is bound
+	// to, if any. Consecutive segments bound to the same field are joined
+	// with a slash.
+	field string
+}
+
+// restRoute is the REST endpoint of a method, given by an HTTP rule of its
+// google.api.http option.
+type restRoute struct {
+	// method is the HTTP method of the endpoint.
+	method string
+
+	// segments and verb are the parsed path template of the endpoint.
+	segments []restSegment
+	verb     string
+
+	// body is the request field the request body is mapped to, * for the
+	// whole request, or empty if there is no body.
+	body string
+
+	// responseBody is the response field returned as response body, or
+	// empty for the whole response.
+	responseBody string
+
+	// fullMethod is the full name of the called method.
+	fullMethod string
+
+	// serverStream indicates whether the method is server-streaming.
+	serverStream bool
+
+	// newRequest and newResponse return new messages of the request and
+	// response types of the method.
+	newRequest  func() proto.Message
+	newResponse func() proto.Message
+}
+
+// match returns the values of the request fields bound by the path, and whether
+// the path matches the route.
+func (r *restRoute) match(path string) (map[string]string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if r.verb != "" {
+		last := parts[len(parts)-1]
+		if !strings.HasSuffix(last, ":"+r.verb) {
+			return nil, false
+		}
+		parts[len(parts)-1] = strings.TrimSuffix(last, ":"+r.verb)
+	}
+
+	values := make(map[string]string)
+	bind := func(field, part string) {
+		if field == "" {
+			return
+		}
+		if value, ok := values[field]; ok {
+			part = value + "/" + part
+		}
+		values[field] = part
+	}
+
+	i := 0
+	for _, segment := range r.segments {
+		if segment.wildcard == "**" {
+			bind(segment.field, strings.Join(parts[i:], "/"))
+			i = len(parts)
+			continue
+		}
+
+		if i == len(parts) {
+			return nil, false
+		}
+		part, err := url.PathUnescape(parts[i])
+		if err != nil {
+			return nil, false
+		}
+		i++
+
+		if segment.wildcard == "" && part != segment.literal {
+			return nil, false
+		}
+		bind(segment.field, part)
+	}
+	if i != len(parts) {
+		return nil, false
+	}
+
+	return values, true
+}
+
+// restHandler is an http.Handler that maps REST requests to calls of the
+// methods of a service, following the HTTP rules of the methods.
+type restHandler struct {
+	// getConn returns a client connection to the service.
+	getConn func() (*grpc.ClientConn, func(), error)
+
+	// routes are the REST endpoints of the methods.
+	routes []restRoute
+}
+
+// ServeHTTP calls the method whose route matches the request, and writes its
+// response as JSON. The responses of server-streaming methods are written as
+// newline-delimited {"result": ...} objects, followed by an {"error": ...}
+// object if the stream fails.
+func (h *restHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		route         *restRoute
+		values        map[string]string
+		pathSupported bool
+	)
+	for i := range h.routes {
+		v, ok := h.routes[i].match(r.URL.EscapedPath())
+		if !ok {
+			continue
+		}
+		pathSupported = true
+
+		if h.routes[i].method == r.Method {
+			route, values = &h.routes[i], v
+			break
+		}
+	}
+	switch {
+	case route == nil && pathSupported:
+		writeRESTError(w, http.StatusMethodNotAllowed,
+			status.New(codes.Unimplemented, "Method Not Allowed"))
+		return
+
+	case route == nil:
+		writeRESTError(w, http.StatusNotFound,
+			status.New(codes.NotFound, "Not Found"))
+		return
+	}
+
+	req := route.newRequest()
+	if err := decodeRESTRequest(route, r, values, req); err != nil {
+		writeRESTError(w, http.StatusBadRequest,
+			status.New(codes.InvalidArgument, err.Error()))
+		return
+	}
+
+	conn, closeConn, err := h.getConn()
+	if err != nil {
+		st := status.Convert(err)
+		writeRESTError(w, restHTTPStatus(st.Code()), st)
+		return
+	}
+	defer closeConn()
+
+	ctx := metadata.NewOutgoingContext(r.Context(), restMetadata(r.Header))
+	if !route.serverStream {
+		resp := route.newResponse()
+		err := conn.Invoke(ctx, route.fullMethod, req, resp)
+		if err != nil {
+			st := status.Convert(err)
+			writeRESTError(w, restHTTPStatus(st.Code()), st)
+			return
+		}
+
+		b, err := marshalRESTResponse(route, resp)
+		if err != nil {
+			writeRESTError(w, http.StatusInternalServerError,
+				status.New(codes.Internal, err.Error()))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(b)
+		return
+	}
+
+	desc := &grpc.StreamDesc{
+		ServerStreams: true,
+	}
+	stream, err := conn.NewStream(ctx, desc, route.fullMethod)
+	if err != nil {
+		st := status.Convert(err)
+		writeRESTError(w, restHTTPStatus(st.Code()), st)
+		return
+	}
+
+	// An error sending the request is returned by RecvMsg below.
+	if err := stream.SendMsg(req); err == nil {
+		_ = stream.CloseSend()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	flusher, _ := w.(http.Flusher)
+	for {
+		resp := route.newResponse()
+		err := stream.RecvMsg(resp)
+		if err == io.EOF {
+			return
+		}
+
+		var b []byte
+		if err == nil {
+			b, err = marshalRESTResponse(route, resp)
+		}
+		if err != nil {
+			writeRESTStreamError(w, status.Convert(err))
+			return
+		}
+
+		// If the response can't be written, the client is gone and
+		// the call is cancelled with the context of the request.
+		_, err = fmt.Fprintf(w, "{\"result\":%s}\n", b)
+		if err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// decodeRESTRequest sets the fields of the request from the body, the fields
+// bound by the path and the query parameters of the REST request. The query
+// parameters set the fields that aren't set by the path or the body.
+func decodeRESTRequest(route *restRoute, r *http.Request,
+	values map[string]string, req proto.Message) error {
+
+	if route.body != "" {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+
+		if len(body) > 0 {
+			if err := decodeRESTBody(route.body, body, req); err != nil {
+				return err
+			}
+		}
+	}
+
+	for field, value := range values {
+		_, err := setRESTField(req.ProtoReflect(), field, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	if route.body == "*" {
+		return nil
+	}
+	for param, paramValues := range r.URL.Query() {
+		if _, ok := values[param]; ok || param == route.body ||
+			strings.HasPrefix(param, route.body+".") {
+
+			continue
+		}
+
+{{- if .RejectUnknown}}
+
+		for _, value := range paramValues {
+			ok, err := setRESTField(req.ProtoReflect(), param, value)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("unknown query parameter %s",
+					param)
+			}
+		}
+{{- else}}
+
+		// Unknown query parameters are ignored.
+		for _, value := range paramValues {
+			_, err := setRESTField(req.ProtoReflect(), param, value)
+			if err != nil {
+				return err
+			}
+		}
+{{- end}}
+	}
+
+	return nil
+}
+
+// decodeRESTBody unmarshals the JSON request body into the request, or into the
+// request field given by bodyField if it isn't *.
+func decodeRESTBody(bodyField string, body []byte, req proto.Message) error {
+	if bodyField == "*" {
+		return restUnmarshaler.Unmarshal(body, req)
+	}
+
+	// The body is wrapped into a message holding only the field, so it is
+	// unmarshaled like any other field.
+	msg := req.ProtoReflect()
+	field := msg.Descriptor().Fields().ByName(protoreflect.Name(bodyField))
+	wrapped := fmt.Sprintf("{%q:%s}", field.JSONName(), body)
+
+	tmp := msg.New()
+	err := restUnmarshaler.Unmarshal([]byte(wrapped), tmp.Interface())
+	if err != nil {
+		return err
+	}
+	msg.Set(field, tmp.Get(field))
+
+	return nil
+}
+
+// setRESTField sets the field of the message with the given dotted path, whose
+// parts are either proto or JSON field names, to the value parsed from a path
+// segment or query parameter. Values of repeated fields are appended. It
+// returns false if there is no such field.
+func setRESTField(msg protoreflect.Message, path, value string) (bool, error) {
+	// Look up all fields first, so no nested messages are created for
+	// unknown fields.
+	names := strings.Split(path, ".")
+	fields := make([]protoreflect.FieldDescriptor, len(names))
+	desc := msg.Descriptor()
+	for i, name := range names {
+		field := desc.Fields().ByName(protoreflect.Name(name))
+		if field == nil {
+			field = desc.Fields().ByJSONName(name)
+		}
+		if field == nil || field.IsMap() {
+			return false, nil
+		}
+
+		if i < len(names)-1 {
+			if field.IsList() ||
+				field.Kind() != protoreflect.MessageKind {
+
+				return false, nil
+			}
+			desc = field.Message()
+		}
+		fields[i] = field
+	}
+
+	for _, field := range fields[:len(fields)-1] {
+		msg = msg.Mutable(field).Message()
+	}
+	field := fields[len(fields)-1]
+
+	v, err := parseRESTValue(msg, field, value)
+	if err != nil {
+		return true, fmt.Errorf("invalid value %q of %s: %w", value,
+			path, err)
+	}
+
+	if field.IsList() {
+		msg.Mutable(field).List().Append(v)
+	} else {
+		msg.Set(field, v)
+	}
+
+	return true, nil
+}
+
+// parseRESTValue parses the value of the field of the message given as string.
+// Messages, such as well-known types, are parsed from their JSON encoding.
+func parseRESTValue(msg protoreflect.Message, field protoreflect.FieldDescriptor,
+	value string) (protoreflect.Value, error) {
+
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		b, err := strconv.ParseBool(value)
+		return protoreflect.ValueOfBool(b), err
+
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind,
+		protoreflect.Sfixed32Kind:
+
+		n, err := strconv.ParseInt(value, 10, 32)
+		return protoreflect.ValueOfInt32(int32(n)), err
+
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind,
+		protoreflect.Sfixed64Kind:
+
+		n, err := strconv.ParseInt(value, 10, 64)
+		return protoreflect.ValueOfInt64(n), err
+
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		n, err := strconv.ParseUint(value, 10, 32)
+		return protoreflect.ValueOfUint32(uint32(n)), err
+
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		n, err := strconv.ParseUint(value, 10, 64)
+		return protoreflect.ValueOfUint64(n), err
+
+	case protoreflect.FloatKind:
+		f, err := strconv.ParseFloat(value, 32)
+		return protoreflect.ValueOfFloat32(float32(f)), err
+
+	case protoreflect.DoubleKind:
+		f, err := strconv.ParseFloat(value, 64)
+		return protoreflect.ValueOfFloat64(f), err
+
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(value), nil
+
+	// Bytes are base64 encoded, using either the standard or the URL
+	// safe alphabet.
+	case protoreflect.BytesKind:
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			b, err = base64.URLEncoding.DecodeString(value)
+		}
+		return protoreflect.ValueOfBytes(b), err
+
+	// Enums are given by the name or the number of the value.
+	case protoreflect.EnumKind:
+		enumValue := field.Enum().Values().ByName(
+			protoreflect.Name(value),
+		)
+		if enumValue != nil {
+			return protoreflect.ValueOfEnum(enumValue.Number()), nil
+		}
+
+		n, err := strconv.ParseInt(value, 10, 32)
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(n)), err
+	}
+
+	var fieldValue protoreflect.Value
+	if field.IsList() {
+		fieldValue = msg.Mutable(field).List().NewElement()
+	} else {
+		fieldValue = msg.NewField(field)
+	}
+
+	// Strings are quoted to be valid JSON, while other JSON values such
+	// as numbers of wrapper types are parsed as given.
+	b := []byte(value)
+	if !json.Valid(b) {
+		b = []byte(strconv.Quote(value))
+	}
+	err := restUnmarshaler.Unmarshal(b, fieldValue.Message().Interface())
+
+	return fieldValue, err
+}
+
+// marshalRESTResponse marshals the response, or only the response field given
+// by the route's responseBody.
+func marshalRESTResponse(route *restRoute, resp proto.Message) ([]byte,
+	error) {
+
+	b, err := restMarshaler.Marshal(resp)
+	if err != nil || route.responseBody == "" {
+		return b, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	field := resp.ProtoReflect().Descriptor().Fields().ByName(
+		protoreflect.Name(route.responseBody),
+	)
+
+	return fields[field.JSONName()], nil
+}
+
+// restMetadata returns the metadata of the call given by the headers of the
+// REST request. Like for grpc-gateway, these are the headers prefixed with
+// Grpc-Metadata-, e.g. Grpc-Metadata-Macaroon, and the Authorization header.
+func restMetadata(header http.Header) metadata.MD {
+	md := metadata.MD{}
+	for key, values := range header {
+		key = strings.ToLower(key)
+		switch {
+		case key == "authorization":
+
+		case strings.HasPrefix(key, "grpc-metadata-"):
+			key = strings.TrimPrefix(key, "grpc-metadata-")
+
+		default:
+			continue
+		}
+
+		md.Append(key, values...)
+	}
+
+	return md
+}
+
+// writeRESTError writes the status as JSON error response with the given HTTP
+// status code.
+func writeRESTError(w http.ResponseWriter, code int, st *status.Status) {
+	b, err := restMarshaler.Marshal(st.Proto())
+	if err != nil {
+		code = http.StatusInternalServerError
+		b = []byte("{\"code\":13,\"message\":\"failed to marshal error\"}")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(b)
+}
+
+// writeRESTStreamError writes the status as the final {"error": ...} object of
+// a stream.
+func writeRESTStreamError(w http.ResponseWriter, st *status.Status) {
+	b, err := restMarshaler.Marshal(st.Proto())
+	if err != nil {
+		b = []byte("{\"code\":13,\"message\":\"failed to marshal error\"}")
+	}
+
+	_, _ = fmt.Fprintf(w, "{\"error\":%s}\n", b)
+}
+
+// restHTTPStatus returns the HTTP status code of the gRPC status code, like
+// grpc-gateway.
+func restHTTPStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+
+	case codes.Canceled:
+		return 499
+
+	case codes.InvalidArgument, codes.FailedPrecondition,
+		codes.OutOfRange:
+
+		return http.StatusBadRequest
+
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+
+	case codes.NotFound:
+		return http.StatusNotFound
+
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+
+	default:
+		return http.StatusInternalServerError
+	}
+}
+`))
+
+// restHandlerTemplate creates the constructor of the REST handler of a service.
+var restHandlerTemplate = template.Must(template.Must(
+	grpcWebHandlerTemplate.Clone()).New("restHandler").Parse(`// Code generated by {{.ToolName}} DO NOT EDIT.
+// source: {{.FileName}}
+{{if .BuildTags}}
+{{.BuildTags}}
+{{end}}
+package {{.Package}}
+
+import (
+	"net/http"
+{{- range .Imports}}{{if .Std}}
+	{{if .Alias}}{{.Alias}} {{end}}"{{.Path}}"
+{{- end}}{{end}}
+{{if or .ServiceGating .Lifecycle}}
+	"google.golang.org/grpc"
+{{- end}}
+	"google.golang.org/protobuf/proto"
+{{range .Imports}}{{if not .Std}}
+	{{if .Alias}}{{.Alias}} {{end}}"{{.Path}}"
+{{- end}}{{end}}
+)
+
+// New{{.ServiceName}}RESTHandler returns an http.Handler serving the methods of
+// {{.ServiceName}} annotated with google.api.http rules as REST endpoints, like
+// grpc-gateway but without a network hop, by calling them over the in-memory
+// listener of the service. The responses of server-streaming methods are
+// written as newline-delimited {"result": ...} objects.
+func New{{.ServiceName}}RESTHandler() http.Handler {
+	return &restHandler{
+{{- template "handlerConn" .}}
+		routes: []restRoute{
+{{- range .Routes}}
+			{
+				// {{.Method}} {{.Path}}
+				method: {{printf "%q" .Method}},
+				segments: []restSegment{
+{{- range .Segments}}
+					{ {{- if .Literal}}literal: {{printf "%q" .Literal}}{{else}}wildcard: "{{.Wildcard}}"{{end}}{{if .Field}}, field: {{printf "%q" .Field}}{{end -}} },
+{{- end}}
+				},
+{{- if .Verb}}
+				verb: {{printf "%q" .Verb}},
+{{- end}}
+{{- if .Body}}
+				body: {{printf "%q" .Body}},
+{{- end}}
+{{- if .ResponseBody}}
+				responseBody: {{printf "%q" .ResponseBody}},
+{{- end}}
+				fullMethod: "{{.RPC.FullMethod}}",
+{{- if .RPC.ServerStream}}
+				serverStream: true,
+{{- end}}
+				newRequest: func() proto.Message {
+					return &{{.RPC.RequestType}}{}
+				},
+				newResponse: func() proto.Message {
+					return &{{.RPC.ResponseType}}{}
+				},
+			},
+{{- end}}
+		},
+	}
+}
+`))
+
+type facadeParams struct {
+	ToolName string
+	Package  string
+	BuildTag string
+}
+
+// facadeTemplate creates the exported facade through which the unexported API
+// functions are called by their full method name.
+var facadeTemplate = template.Must(template.New("facade").Parse(`// Code generated by {{.ToolName}} DO NOT EDIT.
+{{if .BuildTag}}
+{{.BuildTag}}
+{{end}}
+package {{.Package}}
+
+import (
+	"fmt"
+)
+
+var (
+	// facadeCalls maps the full names of the unary methods to their API
+	// functions.
+	facadeCalls = make(map[string]func([]byte, Callback))
+
+	// facadeSubscriptions maps the full names of the server-streaming
+	// methods to their API functions.
+	facadeSubscriptions = make(map[string]func([]byte, RecvStream))
+
+	// facadeStreams maps the full names of the client-streaming and
+	// bidirectional methods to their API functions.
+	facadeStreams = make(map[string]func(RecvStream) (SendStream, error))
+)
+
+// Call calls the unary method with the given full name, e.g.
+// /lnrpc.Lightning/GetInfo, using the serialized request msg. The serialized
+// response or error is delivered to the callback. An error is only returned if
+// the method is unknown.
+func Call(method string, msg []byte, callback Callback) error {
+	call, ok := facadeCalls[method]
+	if !ok {
+		return fmt.Errorf("unknown unary method %s", method)
+	}
+
+	call(msg, callback)
+
+	return nil
+}
+
+// Subscribe starts the server-streaming method with the given full name, e.g.
+// /lnrpc.Lightning/SubscribeInvoices, using the serialized request msg. The
+// serialized responses are delivered to rStream. An error is only returned if
+// the method is unknown.
+func Subscribe(method string, msg []byte, rStream RecvStream) error {
+	subscribe, ok := facadeSubscriptions[method]
+	if !ok {
+		return fmt.Errorf("unknown server-streaming method %s", method)
+	}
+
+	subscribe(msg, rStream)
+
+	return nil
+}
+
+// OpenStream starts the client-streaming or bidirectional method with the
+// given full name, e.g. /lnrpc.Lightning/ChannelAcceptor, and returns the
+// stream used to send the serialized requests. The serialized responses are
+// delivered to rStream, for client-streaming methods a single one once the
+// request stream is closed.
+func OpenStream(method string, rStream RecvStream) (SendStream, error) {
+	open, ok := facadeStreams[method]
+	if !ok {
+		return nil, fmt.Errorf("unknown streaming method %s", method)
+	}
+
+	return open(rStream)
+}
+`))
+
+type typeRegistryParams struct {
+	ToolName string
+	Package  string
+	BuildTag string
+}
+
+// typeRegistryTemplate creates the registry of the request and response types
+// of all methods, so generic tooling can marshal and unmarshal the messages of
+// any method by its full name.
+var typeRegistryTemplate = template.Must(template.New("typeRegistry").Parse(`// Code generated by {{.ToolName}} DO NOT EDIT.
+{{if .BuildTag}}
+{{.BuildTag}}
+{{end}}
+package {{.Package}}
+
+import (
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// MethodTypes holds the message types of the request and response of a
+// method, which create new messages to marshal and unmarshal them into.
+type MethodTypes struct {
+	// Request is the type of the request, or of the requests sent to
+	// the stream of client-streaming and bidirectional methods.
+	Request protoreflect.MessageType
+
+	// Response is the type of the response, or of the responses of the
+	// stream of server-streaming and bidirectional methods.
+	Response protoreflect.MessageType
+}
+
+// methodTypes maps the full names of all methods to the types of their
+// requests and responses. It is only written to when the package is
+// initialized.
+var methodTypes = make(map[string]MethodTypes)
+
+// newMethodTypes returns the types of the given request and response messages.
+func newMethodTypes(req, resp proto.Message) MethodTypes {
+	return MethodTypes{
+		Request:  proto.MessageV2(req).ProtoReflect().Type(),
+		Response: proto.MessageV2(resp).ProtoReflect().Type(),
+	}
+}
+
+// LookupMethodTypes returns the types of the request and response of the
+// method with the given full name, e.g. /lnrpc.Lightning/GetInfo, and whether
+// the method is known.
+func LookupMethodTypes(method string) (MethodTypes, bool) {
+	types, ok := methodTypes[method]
+	return types, ok
+}
+
+// RegisteredMethods returns the sorted full names of all methods whose types
+// can be looked up with LookupMethodTypes.
+func RegisteredMethods() []string {
+	methods := make([]string, 0, len(methodTypes))
+	for method := range methodTypes {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	return methods
+}
+`))
+
+type notificationsParams struct {
+	ToolName string
+	Package  string
+	BuildTag string
+}
+
+// notificationsTemplate creates the demultiplexer that delivers the messages
+// of several subscriptions through one callback.
+var notificationsTemplate = template.Must(template.New("notifications").Parse(`// Code generated by {{.ToolName}} DO NOT EDIT.
+{{if .BuildTag}}
+{{.BuildTag}}
+{{end}}
+package {{.Package}}
+
+import (
+	"fmt"
+	"sync"
+)
+
+// NotificationCallback is an interface that is used to receive the messages of
+// all subscriptions started by Notifications, tagged with the name of the
+// method they originate from.
+type NotificationCallback interface {
+	// OnNotification is called for every message received on one of
+	// the subscriptions.
+	OnNotification(method string, msg []byte)
+
+	// OnError is called once a subscription has ended. Its error is
+	// io.EOF if it finished normally.
+	OnError(method string, err error)
+}
+
+// notificationSources are all subscriptions that can be added to
+// Notifications, keyed by the name of their method.
+var notificationSources = make(map[string]func([]byte, RecvStream))
+
+// notificationSource is a subscription added to Notifications.
+type notificationSource struct {
+	method string
+	msg    []byte
+	start  func([]byte, RecvStream)
+}
+
+// Notifications is a set of subscriptions, for example to invoices,
+// transactions and channel events, whose messages are all delivered through
+// one callback.
+type Notifications struct {
+	sources []notificationSource
+}
+
+// NewNotifications creates a new empty set of subscriptions.
+func NewNotifications() *Notifications {
+	return &Notifications{}
+}
+
+// Add adds the subscription method with the serialized msg request to the set.
+// The method is the name of the generated API, for example SubscribeInvoices.
+func (n *Notifications) Add(method string, msg []byte) error {
+	start, ok := notificationSources[method]
+	if !ok {
+		return fmt.Errorf("unknown subscription %s", method)
+	}
+
+	// We must make a copy of the passed byte slice, as there is no
+	// guarantee the contents won't be changed before the subscription is
+	// started.
+	data := make([]byte, len(msg))
+	copy(data[:], msg[:])
+
+	n.sources = append(n.sources, notificationSource{
+		method: method,
+		msg:    data,
+		start:  start,
+	})
+
+	return nil
+}
+
+// Start opens all subscriptions of the set, delivering their messages through
+// the callback. The callback is never called concurrently.
+func (n *Notifications) Start(callback NotificationCallback) {
+	var mu sync.Mutex
+	for _, source := range n.sources {
+		source.start(source.msg, &notificationStream{
+			method:   source.method,
+			mu:       &mu,
+			callback: callback,
+		})
+	}
+}
+
+// notificationStream is a RecvStream that tags the messages of a subscription
+// with its method before delivering them to the shared callback.
+type notificationStream struct {
+	method   string
+	mu       *sync.Mutex
+	callback NotificationCallback
+}
+
+// OnResponse is called for every message received on the subscription.
+func (s *notificationStream) OnResponse(b []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.callback.OnNotification(s.method, b)
+}
+
+// OnError is called once the subscription has ended.
+func (s *notificationStream) OnError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.callback.OnError(s.method, err)
+}
+`))
+
+// permissionsParams is a struct that holds all data passed in to the
+// permissions template.
+type permissionsParams struct {
+	// ToolName is the name of this tool, used only for the comment in the
+	// first line of the template.
+	ToolName string
+
+	// FileName is the original proto file the service is defined in.
+	FileName string
+
+	// Package is the golang package that's used for the generated go file.
+	Package string
+
+	// ServiceName is the gRPC service name as defined in the proto file.
+	ServiceName string
+
+	// Methods holds the permissions of all methods of the service.
+	Methods []methodPermissions
+}
+
+// methodPermissions holds the macaroon permissions of a single RPC method.
+type methodPermissions struct {
+	// FullMethod is the full gRPC method name of the method.
+	FullMethod string
+
+	// Ops are the permissions required to call the method. If empty, a
+	// TODO entry is generated instead.
+	Ops []permissionOp
+}
+
+// permissionOp is a single entity:action macaroon permission.
+type permissionOp struct {
+	Entity string
+	Action string
+}
+
+var permissionsTemplate = template.Must(template.New("permissions").Funcs(funcMap).Parse(`// Code generated by {{.ToolName}}. DO NOT EDIT.
+// source: {{.FileName}}
+
+package {{.Package}}
+
+import "gopkg.in/macaroon-bakery.v2/bakery"
+
+// {{.ServiceName | LowerCase}}Permissions is a map of all RPC methods of the
+// {{.ServiceName}} service and the macaroon permissions required to call them.
+var {{.ServiceName | LowerCase}}Permissions = map[string][]bakery.Op{
+{{- range .Methods}}
+	"{{.FullMethod}}": {
+{{- range .Ops}}
+		{Entity: "{{.Entity}}", Action: "{{.Action}}"},
+{{- else}}
+		// TODO: annotate the method with the (falafel.permissions)
+		// option to define the required permissions.
+{{- end}}
+	},
+{{- end}}
+}
+`))
+
+// fallbackParams is a struct that holds all data passed in to the fallback
+// template.
+type fallbackParams struct {
+	ToolName string
+	FileName string
+	Package  string
+	Imports  []goImport
+
+	// BuildConstraint is the build constraint of the fallback file, the
+	// negation of the constraint of the regular service file.
+	BuildConstraint string
+
+	// ServiceName is the gRPC service name as defined in the proto file.
+	ServiceName string
+
+	// Tags is the build constraint required to build the service.
+	Tags string
+
+	// TypedResponses indicates whether typed response helpers should be
+	// generated.
+	TypedResponses bool
+
+	// Methods are the methods of the service.
+	Methods []rpcParams
+}
+
+// fallbackTemplate creates the fallback file of a service. It is cloned from
+// the responseHelperTemplate so the typed response helpers can be included.
+var fallbackTemplate = template.Must(template.Must(
+	responseHelperTemplate.Clone()).New("fallback").Parse(`// Code generated by {{.ToolName}}. DO NOT EDIT.
+// source: {{.FileName}}
+
+//go:build {{.BuildConstraint}}
+
+package {{.Package}}
+
+import (
+{{- if .TypedResponses}}
+	"github.com/golang/protobuf/proto"
+{{- end}}
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+{{range .Imports}}
+	{{if .Alias}}{{.Alias}} {{end}}"{{.Path}}"
+{{- end}}
+)
+
+// err{{.ServiceName}}NotBuilt is returned by all methods of the {{.ServiceName}}
+// service, as it was excluded by the build tags.
+var err{{.ServiceName}}NotBuilt = status.Error(codes.Unimplemented,
+	"{{.ServiceName}} service not built with {{.Tags}}")
+{{range .Methods}}
+{{.Comment}}
+//
+// NOTE: The {{$.ServiceName}} service was not built, this method always fails.
+{{- if and .ClientStream .ServerStream}}
+func {{.ApiPrefix}}{{.MethodName}}(rStream RecvStream) (SendStream, error) {
+	return nil, err{{$.ServiceName}}NotBuilt
+}
+{{- else if .ClientStream}}
+func {{.ApiPrefix}}{{.MethodName}}(callback Callback) (SendStream, error) {
+	return nil, err{{$.ServiceName}}NotBuilt
+}
+{{- else if .ServerStream}}
+func {{.ApiPrefix}}{{.MethodName}}(msg []byte, rStream RecvStream) {
+	go rStream.OnError(err{{$.ServiceName}}NotBuilt)
+}
+{{- else if .TimeoutParam}}
+func {{.ApiPrefix}}{{.MethodName}}(msg []byte, timeoutMs int64, callback Callback) {
+	go callback.OnError(err{{$.ServiceName}}NotBuilt)
+}
+{{- else}}
+func {{.ApiPrefix}}{{.MethodName}}(msg []byte, callback Callback) {
+	go callback.OnError(err{{$.ServiceName}}NotBuilt)
+}
+{{- end}}
+{{- if .Pagination}}
+
+// {{.ApiPrefix}}{{.MethodName}}All pages through all results of {{.MethodName}}.
+//
+// NOTE: The {{$.ServiceName}} service was not built, this method always fails.
+func {{.ApiPrefix}}{{.MethodName}}All(msg []byte, rStream RecvStream) {
+	go rStream.OnError(err{{$.ServiceName}}NotBuilt)
+}
+{{- end}}
+{{- if .StreamTransform}}
+
+// {{.ApiPrefix}}{{.MethodName}}Transformed calls {{.MethodName}}, passing each response through
+// transform.
+//
+// NOTE: The {{$.ServiceName}} service was not built, this method always fails.
+func {{.ApiPrefix}}{{.MethodName}}Transformed(msg []byte, transform StreamTransform,
+	rStream RecvStream) {
+
+	go rStream.OnError(err{{$.ServiceName}}NotBuilt)
+}
+{{- end}}
+{{- if .Backpressure}}
+
+// {{.ApiPrefix}}{{.MethodName}}WithDemand calls {{.MethodName}}, only delivering the requested
+// responses.
+//
+// NOTE: The {{$.ServiceName}} service was not built, this method always fails.
+func {{.ApiPrefix}}{{.MethodName}}WithDemand(msg []byte, demand *StreamDemand,
+	rStream RecvStream) {
+
+	go rStream.OnError(err{{$.ServiceName}}NotBuilt)
+}
+{{- end}}
+{{- if .StreamHandle}}
+
+// {{.ApiPrefix}}{{.MethodName}}WithHandle calls {{.MethodName}}, returning a handle that stops the
+// stream.
+//
+// NOTE: The {{$.ServiceName}} service was not built, this method always fails.
+{{- if .ClientStream}}
+func {{.ApiPrefix}}{{.MethodName}}WithHandle(rStream RecvStream) (*BiStreamHandle, error) {
+	return nil, err{{$.ServiceName}}NotBuilt
+}
+{{- else}}
+func {{.ApiPrefix}}{{.MethodName}}WithHandle(msg []byte, rStream RecvStream) *StreamHandle {
+	go rStream.OnError(err{{$.ServiceName}}NotBuilt)
+
+	return newStreamHandle()
+}
+{{- end}}
+{{- end}}
+{{- if .Task}}
+
+// {{.ApiPrefix}}{{.MethodName}}Task calls {{.MethodName}}, returning a Task that is completed with
+// its result.
+//
+// NOTE: The {{$.ServiceName}} service was not built, the task always fails.
+func {{.ApiPrefix}}{{.MethodName}}Task(msg []byte) *Task {
+	task := newTask()
+	go task.complete(nil, err{{$.ServiceName}}NotBuilt)
+
+	return task
+}
+{{- end}}
+{{- if .Progress}}
+
+// {{.ApiPrefix}}{{.MethodName}}WithProgress calls {{.MethodName}}, delivering its progress.
+//
+// NOTE: The {{$.ServiceName}} service was not built, this method always fails.
+func {{.ApiPrefix}}{{.MethodName}}WithProgress(msg []byte, callback Callback,
+	progress ProgressCallback) {
+
+	go callback.OnError(err{{$.ServiceName}}NotBuilt)
+}
+{{- end}}
+{{- if .WithContext}}
+
+// {{.ApiPrefix}}{{.MethodName}}WithContext calls {{.MethodName}}, cancelling it once the token is
+// cancelled.
+//
+// NOTE: The {{$.ServiceName}} service was not built, this method always fails.
+{{- if and .ClientStream .ServerStream}}
+func {{.ApiPrefix}}{{.MethodName}}WithContext(token *CancelToken, rStream RecvStream) (
+	SendStream, error) {
+
+	return nil, err{{$.ServiceName}}NotBuilt
+}
+{{- else if .ClientStream}}
+func {{.ApiPrefix}}{{.MethodName}}WithContext(token *CancelToken, callback Callback) (
+	SendStream, error) {
+
+	return nil, err{{$.ServiceName}}NotBuilt
+}
+{{- else if .ServerStream}}
+func {{.ApiPrefix}}{{.MethodName}}WithContext(token *CancelToken, msg []byte,
+	rStream RecvStream) {
+
+	go rStream.OnError(err{{$.ServiceName}}NotBuilt)
+}
+{{- else}}
+func {{.ApiPrefix}}{{.MethodName}}WithContext(token *CancelToken, msg []byte,
+	callback Callback) {
+
+	go callback.OnError(err{{$.ServiceName}}NotBuilt)
+}
+{{- end}}
+{{- end}}
+{{- if .InitialResponse}}
+
+// {{.ApiPrefix}}{{.MethodName}}WithInitial calls {{.MethodName}}, delivering the first response
+// separately.
+//
+// NOTE: The {{$.ServiceName}} service was not built, this method always fails.
+{{- if .ClientStream}}
+func {{.ApiPrefix}}{{.MethodName}}WithInitial(initial Callback, rStream RecvStream) (
+	SendStream, error) {
+
+	return nil, err{{$.ServiceName}}NotBuilt
+}
+{{- else}}
+func {{.ApiPrefix}}{{.MethodName}}WithInitial(msg []byte, initial Callback, rStream RecvStream) {
+	go initial.OnError(err{{$.ServiceName}}NotBuilt)
+}
+{{- end}}
+{{- end}}
+{{- if .PaymentTracking}}
+
+// {{.ApiPrefix}}{{.MethodName}}Reliable calls {{.MethodName}}, re-tracking the payment if the
+// stream drops.
+//
+// NOTE: The {{$.ServiceName}} service was not built, this method always fails.
+func {{.ApiPrefix}}{{.MethodName}}Reliable(msg []byte, rStream RecvStream) {
+	go rStream.OnError(err{{$.ServiceName}}NotBuilt)
+}
+{{- end}}
+{{- if .Upload}}
+
+// {{.ApiPrefix}}{{.MethodName}}Upload calls {{.MethodName}}, sending the payload in chunks.
+//
+// NOTE: The {{$.ServiceName}} service was not built, this method always fails.
+func {{.ApiPrefix}}{{.MethodName}}Upload(msg []byte, payload []byte, chunkSize int64,
+	callback Callback) {
+
+	go callback.OnError(err{{$.ServiceName}}NotBuilt)
+}
+{{- end}}
+{{- if .LongPoll}}
+
+// {{.ApiPrefix}}{{.MethodName}}Poll starts {{.ApiPrefix}}{{.MethodName}} for use with PollStream.
+//
+// NOTE: The {{$.ServiceName}} service was not built, the stream always fails.
+func {{.ApiPrefix}}{{.MethodName}}Poll(msg []byte) int64 {
+	return startPollStream(func(rStream RecvStream) {
+		{{.ApiPrefix}}{{.MethodName}}(msg, rStream)
+	})
+}
+{{- end}}
+{{- if $.TypedResponses}}
+{{template "responseHelper" .}}
+{{- end}}
+{{end}}`))
+
+// apiTestsParams is a struct that holds all data passed in to the apiTests
+// template.
+type apiTestsParams struct {
+	ToolName  string
+	FileName  string
+	Package   string
+	Imports   []goImport
+	BuildTags string
+
+	// ServiceName is the gRPC service name as defined in the proto file.
+	ServiceName string
+
+	// TargetName is the name the target package is referenced by.
+	TargetName string
+
+	// Listener is the in-memory listener the service is served on.
+	Listener string
+
+	// Unary indicates whether the service has unary methods, whose mock
+	// implementations take a context.
+	Unary bool
+
+	// ClientStreams indicates whether the service has client-streaming
+	// methods, whose mock implementations read the requests until EOF.
+	ClientStreams bool
+
+	// Methods are the methods of the service.
+	Methods []rpcParams
+}
+
+// apiTestsTemplate creates the test of the generated APIs of a service, which
+// serves a mock implementation of the service on its in-memory listener and
+// calls each API once.
+var apiTestsTemplate = template.Must(template.New("apiTests").Parse(`// Code generated by {{.ToolName}}. DO NOT EDIT.
+// source: {{.FileName}}
+{{if .BuildTags}}
+{{.BuildTags}}
+{{end}}
+package {{.Package}}
+
+import (
+{{- if .Unary}}
+	"context"
+{{- end}}
+{{- if .ClientStreams}}
+	"io"
+{{- end}}
+{{- range .Imports}}{{if .Std}}
+	{{if .Alias}}{{.Alias}} {{end}}"{{.Path}}"
+{{- end}}{{end}}
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+{{range .Imports}}{{if not .Std}}
+	{{if .Alias}}{{.Alias}} {{end}}"{{.Path}}"
+{{- end}}{{end}}
+)
+
+// mock{{.ServiceName}}Server is a mock implementation of the {{.ServiceName}}
+// service, answering each call with an empty response.
+type mock{{.ServiceName}}Server struct {
+	{{.TargetName}}.Unimplemented{{.ServiceName}}Server
+}
+{{- range .Methods}}
+{{- if and (not .ClientStream) (not .ServerStream)}}
+
+// {{.MethodName}} answers the call with an empty response.
+func (s *mock{{$.ServiceName}}Server) {{.MethodName}}(_ context.Context,
+	_ *{{.RequestType}}) (*{{.ResponseType}}, error) {
+
+	return &{{.ResponseType}}{}, nil
+}
+{{- else if not .ClientStream}}
+
+// {{.MethodName}} sends a single empty response before ending the stream.
+func (s *mock{{$.ServiceName}}Server) {{.MethodName}}(_ *{{.RequestType}},
+	stream {{$.TargetName}}.{{$.ServiceName}}_{{.MethodName}}Server) error {
+
+	return stream.Send(&{{.ResponseType}}{})
+}
+{{- else if not .ServerStream}}
+
+// {{.MethodName}} answers with an empty response once all requests have been
+// received.
+func (s *mock{{$.ServiceName}}Server) {{.MethodName}}(
+	stream {{$.TargetName}}.{{$.ServiceName}}_{{.MethodName}}Server) error {
+
+	for {
+		_, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&{{.ResponseType}}{})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+{{- else}}
+
+// {{.MethodName}} answers each request received with an empty response.
+func (s *mock{{$.ServiceName}}Server) {{.MethodName}}(
+	stream {{$.TargetName}}.{{$.ServiceName}}_{{.MethodName}}Server) error {
+
+	for {
+		_, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+
+		if err := stream.Send(&{{.ResponseType}}{}); err != nil {
+			return err
+		}
+	}
+}
+{{- end}}
+{{- end}}
+
+// mock{{.ServiceName}}Callback receives the first response or error delivered
+// by an API of the {{.ServiceName}} service.
+type mock{{.ServiceName}}Callback struct {
+	responses chan []byte
+	errors    chan error
+}
+
+// newMock{{.ServiceName}}Callback creates a new callback.
+func newMock{{.ServiceName}}Callback() *mock{{.ServiceName}}Callback {
+	return &mock{{.ServiceName}}Callback{
+		responses: make(chan []byte, 1),
+		errors:    make(chan error, 1),
+	}
+}
+
+// OnResponse keeps the response, unless one has been received already.
+func (c *mock{{.ServiceName}}Callback) OnResponse(resp []byte) {
+	select {
+	case c.responses <- resp:
+	default:
+	}
+}
+
+// OnError keeps the error, unless one has been received already.
+func (c *mock{{.ServiceName}}Callback) OnError(err error) {
+	select {
+	case c.errors <- err:
+	default:
+	}
+}
+
+// startMock{{.ServiceName}}Server serves the mock implementation of the
+// {{.ServiceName}} service on its in-memory listener until the test ends.
+func startMock{{.ServiceName}}Server(t *testing.T) {
+	t.Helper()
+
+	setDefaultDialOption(func() ([]grpc.DialOption, error) {
+		return []grpc.DialOption{
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		}, nil
+	})
+
+	server := grpc.NewServer()
+	{{.TargetName}}.Register{{.ServiceName}}Server(
+		server, &mock{{.ServiceName}}Server{},
+	)
+
+	lis := {{.Listener}}
+	go func() {
+		_ = server.Serve(lis)
+	}()
+
+	// Stopping the server closes the listener, so the listeners are
+	// re-created for the tests that follow.
+	t.Cleanup(func() {
+		server.Stop()
+		RecreateListeners()
+	})
+}
+
+// Test{{.ServiceName}}API calls each generated API of the {{.ServiceName}}
+// service against a mock implementation, and checks that a response is
+// delivered.
+func Test{{.ServiceName}}API(t *testing.T) {
+	startMock{{.ServiceName}}Server(t)
+
+	tests := []struct {
+		name     string
+		request  proto.Message
+		response proto.Message
+		call     func(t *testing.T, msg []byte,
+			cb *mock{{.ServiceName}}Callback)
+	}{
+{{- range .Methods}}
+		{
+			name:     "{{.ApiPrefix}}{{.MethodName}}",
+			request:  &{{.RequestType}}{},
+			response: &{{.ResponseType}}{},
+			call: func(t *testing.T, msg []byte,
+				cb *mock{{$.ServiceName}}Callback) {
+{{- if .TimeoutParam}}
+
+				{{.ApiPrefix}}{{.MethodName}}(msg, 0, cb)
+{{- else if not .ClientStream}}
+
+				{{.ApiPrefix}}{{.MethodName}}(msg, cb)
+{{- else}}
+
+				stream, err := {{.ApiPrefix}}{{.MethodName}}(cb)
+				if err != nil {
+					t.Fatalf("unable to start stream: %v", err)
+				}
+{{- if .ServerStream}}
+				t.Cleanup(func() {
+					_ = stream.Stop()
+				})
+{{- end}}
+
+				if err := stream.Send(msg); err != nil {
+					t.Fatalf("unable to send request: %v", err)
+				}
+{{- if not .ServerStream}}
+
+				// The response is only delivered once the
+				// stream is stopped.
+				if err := stream.Stop(); err != nil {
+					t.Fatalf("unable to stop stream: %v", err)
+				}
+{{- end}}
+{{- end}}
+			},
+		},
+{{- end}}
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			msg, err := proto.Marshal(test.request)
+			if err != nil {
+				t.Fatalf("unable to marshal request: %v", err)
+			}
+
+			cb := newMock{{.ServiceName}}Callback()
+			test.call(t, msg, cb)
+
+			select {
+			case resp := <-cb.responses:
+				err := proto.Unmarshal(resp, test.response)
+				if err != nil {
+					t.Fatalf("unable to unmarshal response: %v",
+						err)
+				}
+
+			case err := <-cb.errors:
+				t.Fatalf("call failed: %v", err)
+
+			case <-time.After(10 * time.Second):
+				t.Fatal("timeout waiting for response")
+			}
+		})
+	}
+}
+`))
+
+// responseHelperTemplate creates a helper that unmarshals the serialized
+// responses of a method into the concrete response type.
+var responseHelperTemplate = template.Must(template.New("responseHelper").Parse(`
+// Unmarshal{{.ApiPrefix}}{{.MethodName}}Response unmarshals a {{.Encoding}} response
+// delivered by {{.ApiPrefix}}{{.MethodName}} into its concrete type.
+func Unmarshal{{.ApiPrefix}}{{.MethodName}}Response(b []byte) (*{{.ResponseType}}, error) {
+	resp := &{{.ResponseType}}{}
+{{- if .JSONEncoding}}
+	err := jsonUnmarshaler.Unmarshal(b, resp)
+{{- else}}
+	err := proto.Unmarshal(b, resp)
+{{- end}}
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+`))
+
+type memRpcParams struct {
+	ToolName string
+	Package  string
+	BuildTag string
+
+	// SerializationHooks indicates whether the SerializationHook
+	// interface should be generated.
+	SerializationHooks bool
+
+	// FaultInjection indicates whether the FaultInjector interface should
+	// be generated.
+	FaultInjection bool
+
+	// Throttling indicates whether the bandwidth throttle should be
+	// generated.
+	Throttling bool
+
+	// Pagination indicates whether the pagination helper used by the
+	// generated XxxAll methods should be generated.
+	Pagination bool
+
+	// PaymentTracking indicates whether the helper used by the generated
+	// reconnect-safe payment stream wrappers should be generated.
+	PaymentTracking bool
+
+	// InitialResponse indicates whether the stream used by the generated
+	// XxxWithInitial methods should be generated.
+	InitialResponse bool
+
+	// PprofLabels indicates whether the goroutines serving the RPCs
+	// should be labeled with their method.
+	PprofLabels bool
+
+	// CallDraining indicates whether in-flight calls should be tracked,
+	// such that they can be drained before the listeners are re-created.
+	CallDraining bool
+
+	// StreamBuffer indicates whether the responses of streams should be
+	// delivered through bounded buffers.
+	StreamBuffer bool
+
+	// ErrorContext indicates whether the errors delivered to the caller
+	// should be prefixed with the method they originate from.
+	ErrorContext bool
+
+	// StreamTransforms indicates whether the streams used by the
+	// generated XxxTransformed methods should be generated.
+	StreamTransforms bool
+
+	// StreamBackpressure indicates whether the StreamDemand used by the
+	// generated XxxWithDemand methods should be generated.
+	StreamBackpressure bool
+
+	// RequestErrors indicates whether the errors of deserializing
+	// requests should locate the malformed data.
+	RequestErrors bool
+
+	// CallbackDispatcher indicates whether the callbacks can be routed
+	// through a dispatcher set with SetCallbackDispatcher.
+	CallbackDispatcher bool
+
+	// StreamDelivery is how the responses of streams are delivered, either
+	// ordered, concurrent, or empty to deliver them directly from the
+	// goroutine receiving them.
+	StreamDelivery string
+
+	// UsageStats indicates whether the usage of every method should be
+	// recorded for UsageSnapshot.
+	UsageStats bool
+
+	// OpenMetrics indicates whether the usage of every method should also
+	// be exported in the OpenMetrics text format.
+	OpenMetrics bool
+
+	// StreamStats indicates whether the open streams should be tracked
+	// for ListOpenStreams.
+	StreamStats bool
+
+	// ClientStreams indicates whether the adapter used to start
+	// client-streaming RPCs should be generated.
+	ClientStreams bool
+
+	// Tasks indicates whether the Task returned by the generated XxxTask
+	// methods should be generated.
+	Tasks bool
+
+	// StreamHeartbeats indicates whether streams should be ended once no
+	// response arrived within the timeout set with SetStreamHeartbeat.
+	StreamHeartbeats bool
+
+	// GenCallbacks indicates whether the Callback, RecvStream and
+	// SendStream interfaces are created in their own file, and must
+	// therefore be left out.
+	GenCallbacks bool
+
+	// JSONEncoding indicates whether the requests and responses crossing
+	// the library boundary are encoded as JSON instead of being
+	// serialized.
+	JSONEncoding bool
+
+	// DiscardUnknown indicates whether unknown fields of JSON-encoded
+	// requests should be ignored instead of failing the call.
+	DiscardUnknown bool
+
+	// GRPCCompat is the grpc-go baseline the code is written against,
+	// either legacy, latest or empty for the default.
+	GRPCCompat string
+}
+
+var memRpcTemplate = template.Must(template.New("mem").Parse(`// Code generated by {{.ToolName}} DO NOT EDIT.
+{{if .BuildTag}}
+{{.BuildTag}}
+{{end}}
+package {{.Package}}
+
+import (
+	"context"
+{{- if or .UsageStats .StreamStats}}
+	"encoding/json"
+{{- end}}
+{{- if or .StreamBuffer .ErrorContext .RequestErrors .OpenMetrics}}
+	"fmt"
+{{- end}}
+{{- if or .Pagination .ErrorContext .UsageStats .ClientStreams}}
+	"io"
+{{- end}}
+	"net"
+{{- if .PprofLabels}}
+	"runtime/pprof"
+{{- end}}
+{{- if or .OpenMetrics .StreamStats}}
+	"sort"
+{{- end}}
+{{- if or .ErrorContext .RequestErrors .OpenMetrics}}
+	"strings"
+{{- end}}
+{{- if or .SerializationHooks .FaultInjection .Throttling .CallDraining .StreamBuffer .CallbackDispatcher .UsageStats .StreamStats .ClientStreams .Tasks .StreamHeartbeats .StreamBackpressure}}
+	"sync"
+{{- end}}
+{{- if or .FaultInjection .Throttling .PaymentTracking .CallDraining .Tasks .StreamHeartbeats .StreamStats}}
+	"time"
+{{- end}}
+{{- if .RequestErrors}}
+	"unicode/utf8"
+{{- end}}
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+{{- if or .PaymentTracking .CallDraining .StreamBuffer .Tasks .StreamHeartbeats}}
+	"google.golang.org/grpc/codes"
+{{- end}}
+{{- if or .PaymentTracking .CallDraining .StreamBuffer .Tasks .StreamHeartbeats .StreamBackpressure}}
+	"google.golang.org/grpc/status"
+{{- end}}
+{{- if .JSONEncoding}}
+	"google.golang.org/protobuf/encoding/protojson"
+{{- end}}
+{{- if .RequestErrors}}
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/reflect/protoreflect"
+{{- end}}
+)
+{{- define "callbackInterfaces"}}
+
+// Callback is an interface that is passed in by callers of the library, and
+// specifies where the responses should be delivered.
+type Callback interface {
+	// OnResponse is called by the library when a response from the daemon
+	// for the associated RPC call is received. The reponse is a serialized
+	// protobuf for the expected response, and must be deserialized by the
+	// caller.
+	OnResponse([]byte)
+
+	// OnError is called by the library if any error is encountered during
+	// the execution of the RPC call.
+	OnError(error)
+}
+
+// RecvStream is an interface that is passed in by callers of the library, and
+// specifies where the streaming responses should be delivered.
+type RecvStream interface {
+	// OnResponse is called by the library when a new stream response from
+	// the daemon for the associated RPC call is available. The reponse is
+	// a serialized protobuf for the expected response, and must be
+	// deserialized by the caller.
+	OnResponse([]byte)
+
+	// OnError is called by the library if any error is encountered during
+	// the execution of the RPC call, or if the response stream ends. No
+	// more stream responses will be received after this.
+	OnError(error)
+}
+
+// SendStream is an interface that the caller of the library can use to send
+// requests to the server during the execution of a bidirectional streaming RPC
+// call, or stop the stream.
+type SendStream interface {
+	// Send sends the serialized protobuf request to the server.
+	Send([]byte) error
+
+	// Stop closes the bidirecrional connection.
+	Stop() error
+}
+{{- end}}
+{{- if not .GenCallbacks}}
+{{- template "callbackInterfaces"}}
+{{- end}}
+
+// sendStream is an internal struct that satisifies the SendStream interface.
+// We use it to wrap customizable send and stop methods, that can be tuned to
+// the specific RPC call in question.
+type sendStream struct {
+	send func([]byte) error
+	stop func() error
+}
+
+// Send sends the serialized protobuf request to the server.
+//
+// Part of the SendStream interface.
+func (s *sendStream) Send(req []byte) error {
+	return s.send(req)
+}
+
+// Stop closes the bidirectional connection.
+//
+// Part of the SendStream interface.
+func (r *sendStream) Stop() error {
+	return r.stop()
+}
+{{- if .ErrorContext}}
+
+// errorContextCallback wraps a Callback or RecvStream, prefixing the errors
+// delivered to it with the method they originate from.
+type errorContextCallback struct {
+	Callback
+
+	method string
+}
+
+// OnError is called if any error is encountered during the execution of the
+// RPC call.
+func (c *errorContextCallback) OnError(err error) {
+	c.Callback.OnError(methodError(c.method, err))
+}
+
+// methodError prefixes err with the service and method it originates from,
+// e.g. lnrpc.Lightning/SendCoins. The io.EOF marking the end of a stream is
+// passed on unchanged.
+func methodError(method string, err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+
+	return fmt.Errorf("%s: %w", strings.TrimPrefix(method, "/"), err)
+}
+{{- end}}
+{{- if .CallbackDispatcher}}
+
+// CallbackTask is an invocation of a Callback or RecvStream, handed to the
+// CallbackDispatcher to be run.
+type CallbackTask interface {
+	// Run invokes the callback.
+	Run()
+}
+
+// CallbackDispatcher is an interface that can be passed in by callers of the
+// library to choose the thread or queue callbacks are invoked on.
+type CallbackDispatcher interface {
+	// Dispatch is called for every invocation of a Callback or RecvStream,
+	// and must run the task on the desired thread or queue, e.g. the main
+	// thread. The tasks must be run in the order they are dispatched in to
+	// preserve the order of the responses.
+	Dispatch(task CallbackTask)
+}
+
+var (
+	// callbackDispatcher is the dispatcher all callbacks are invoked
+	// through, if set.
+	callbackDispatcher CallbackDispatcher
+
+	// callbackDispatcherMtx guards access to callbackDispatcher.
+	callbackDispatcherMtx sync.RWMutex
+)
+
+// SetCallbackDispatcher sets the dispatcher all invocations of a Callback or
+// RecvStream are routed through, instead of invoking them on arbitrary
+// goroutines. Passing nil invokes them directly again. Only calls started after
+// the dispatcher is set are affected.
+func SetCallbackDispatcher(dispatcher CallbackDispatcher) {
+	callbackDispatcherMtx.Lock()
+	defer callbackDispatcherMtx.Unlock()
+
+	callbackDispatcher = dispatcher
+}
+
+// callbackTask is a CallbackTask running a function.
+type callbackTask func()
+
+// Run invokes the callback.
+//
+// Part of the CallbackTask interface.
+func (t callbackTask) Run() {
+	t()
+}
+
+// dispatchedCallback wraps a Callback or RecvStream, invoking it through a
+// callback dispatcher.
+type dispatchedCallback struct {
+	Callback
+
+	dispatcher CallbackDispatcher
+}
+
+// OnResponse is called when a response for the RPC call is received.
+func (c *dispatchedCallback) OnResponse(b []byte) {
+	c.dispatcher.Dispatch(callbackTask(func() {
+		c.Callback.OnResponse(b)
+	}))
+}
+
+// OnError is called if any error is encountered during the execution of the
+// RPC call.
+func (c *dispatchedCallback) OnError(err error) {
+	c.dispatcher.Dispatch(callbackTask(func() {
+		c.Callback.OnError(err)
+	}))
+}
+
+// dispatchCallback wraps the Callback or RecvStream of a call that is started,
+// such that it is invoked through the current callback dispatcher. If none is
+// set, the callback is returned unchanged.
+func dispatchCallback(callback Callback) Callback {
+	callbackDispatcherMtx.RLock()
+	defer callbackDispatcherMtx.RUnlock()
+
+	if callbackDispatcher == nil {
+		return callback
+	}
+
+	return &dispatchedCallback{
+		Callback:   callback,
+		dispatcher: callbackDispatcher,
+	}
+}
+{{- end}}
+{{- if eq .StreamDelivery "ordered"}}
+
+// orderedStream delivers the responses and the error of a stream one at a time,
+// strictly in the order they are received. They are queued, so receiving isn't
+// blocked while the caller processes them, and delivered from a single
+// goroutine of the stream{{if .CallbackDispatcher}}, or a single task of the callback dispatcher{{end}}
+// at a time.
+type orderedStream struct {
+	RecvStream
+{{- if .CallbackDispatcher}}
+
+	dispatcher CallbackDispatcher
+{{- end}}
+
+	mu       sync.Mutex
+	queue    []func()
+	draining bool
+}
+
+// orderStream wraps the RecvStream of a stream that is started, such that its
+// responses are delivered in order.
+func orderStream(rStream RecvStream) RecvStream {
+	s := &orderedStream{
+		RecvStream: rStream,
+	}
+{{- if .CallbackDispatcher}}
+
+	callbackDispatcherMtx.RLock()
+	s.dispatcher = callbackDispatcher
+	callbackDispatcherMtx.RUnlock()
+{{- end}}
+
+	return s
+}
+
+// OnResponse queues the response for delivery.
+func (s *orderedStream) OnResponse(b []byte) {
+	s.enqueue(func() {
+		s.RecvStream.OnResponse(b)
+	})
+}
+
+// OnError queues the error for delivery after all responses received before.
+func (s *orderedStream) OnError(err error) {
+	s.enqueue(func() {
+		s.RecvStream.OnError(err)
+	})
+}
+
+// enqueue queues the delivery, and starts draining the queue unless it is
+// already being drained.
+func (s *orderedStream) enqueue(deliver func()) {
+	s.mu.Lock()
+	s.queue = append(s.queue, deliver)
+	if s.draining {
+		s.mu.Unlock()
+		return
+	}
+	s.draining = true
+	s.mu.Unlock()
+{{- if .CallbackDispatcher}}
+
+	if s.dispatcher != nil {
+		s.dispatcher.Dispatch(callbackTask(s.drain))
+		return
+	}
+{{- end}}
+
+	go s.drain()
+}
+
+// drain delivers the queued responses until the queue is empty.
+func (s *orderedStream) drain() {
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.draining = false
+			s.mu.Unlock()
+
+			return
+		}
+		deliver := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		deliver()
+	}
+}
+{{- end}}
+{{- if eq .StreamDelivery "concurrent"}}
+
+// concurrentCallback delivers each response of a stream from a goroutine of its
+// own, without waiting for the previous one to be processed. They may
+// therefore be processed out of order. The error ending the stream is only
+// delivered once all responses were processed.
+type concurrentCallback struct {
+	RecvStream
+
+	// pending tracks the responses that are still being delivered.
+	pending sync.WaitGroup
+}
+
+// concurrentStream wraps the RecvStream of a stream that is started, such that
+// its responses are delivered concurrently.
+func concurrentStream(rStream RecvStream) RecvStream {
+{{- if .CallbackDispatcher}}
+	// If a dispatcher is set, it decides how the responses are run.
+	if dispatched := dispatchCallback(rStream); dispatched != rStream {
+		return dispatched
+	}
+
+{{end}}
+	return &concurrentCallback{
+		RecvStream: rStream,
+	}
+}
+
+// OnResponse delivers the response from a new goroutine.
+func (c *concurrentCallback) OnResponse(b []byte) {
+	c.pending.Add(1)
+	go func() {
+		defer c.pending.Done()
+
+		c.RecvStream.OnResponse(b)
+	}()
+}
+
+// OnError delivers the error from a new goroutine, once all responses were
+// delivered, such that no response follows it.
+func (c *concurrentCallback) OnError(err error) {
+	go func() {
+		c.pending.Wait()
+
+		c.RecvStream.OnError(err)
+	}()
+}
+{{- end}}
+{{- if .UsageStats}}
+
+// methodUsage is the usage of a single method since startup.
+type methodUsage struct {
+	// Calls is the number of calls started.
+	Calls int64 ` + "`" + `json:"calls"` + "`" + `
+
+	// Errors is the number of calls that failed.
+	Errors int64 ` + "`" + `json:"errors"` + "`" + `
+
+	// OpenStreams is the number of streams currently open.
+	OpenStreams int64 ` + "`" + `json:"open_streams"` + "`" + `
+}
+
+var (
+	// usageStats maps the full name of each method called to its usage.
+	usageStats = make(map[string]*methodUsage)
+
+	// usageStatsMtx guards access to usageStats.
+	usageStatsMtx sync.Mutex
+)
+
+// UsageSnapshot returns the usage of every method called since startup as a
+// JSON object keyed by the full method name, holding the number of calls
+// started, the number of calls that failed and the number of streams currently
+// open, e.g.
+// {"/lnrpc.Lightning/GetInfo": {"calls": 2, "errors": 0, "open_streams": 0}}.
+func UsageSnapshot() string {
+	usageStatsMtx.Lock()
+	defer usageStatsMtx.Unlock()
+
+	b, err := json.Marshal(usageStats)
+	if err != nil {
+		return "{}"
+	}
+
+	return string(b)
+}
+{{- if .OpenMetrics}}
+
+// UsageMetrics returns the usage of every method called since startup in the
+// OpenMetrics text format, such that it can be attached to support requests
+// or forwarded to the telemetry of the app without running an HTTP server.
+// The metrics are labeled with the full method name, e.g.
+// falafel_calls_total{method="/lnrpc.Lightning/GetInfo"} 2.
+func UsageMetrics() string {
+	usageStatsMtx.Lock()
+	defer usageStatsMtx.Unlock()
+
+	methods := make([]string, 0, len(usageStats))
+	for method := range usageStats {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	// Label values must have backslashes, quotes and newlines escaped.
+	escape := strings.NewReplacer("\\", "\\\\", "\"", "\\\"",
+		"\n", "\\n")
+
+	var b strings.Builder
+	family := func(name, typ, help, sample string,
+		value func(*methodUsage) int64) {
+
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, typ)
+		fmt.Fprintf(&b, "# HELP %s %s\n", name, help)
+		for _, method := range methods {
+			fmt.Fprintf(&b, "%s{method=\"%s\"} %d\n", sample,
+				escape.Replace(method), value(usageStats[method]))
+		}
+	}
+
+	family("falafel_calls", "counter", "Number of calls started.",
+		"falafel_calls_total", func(u *methodUsage) int64 {
+			return u.Calls
+		})
+	family("falafel_errors", "counter", "Number of calls that failed.",
+		"falafel_errors_total", func(u *methodUsage) int64 {
+			return u.Errors
+		})
+	family("falafel_open_streams", "gauge",
+		"Number of streams currently open.", "falafel_open_streams",
+		func(u *methodUsage) int64 {
+			return u.OpenStreams
+		})
+	b.WriteString("# EOF\n")
+
+	return b.String()
+}
+{{- end}}
+
+// usageCallback wraps a Callback or RecvStream, recording the outcome of the
+// call.
+type usageCallback struct {
+	Callback
+
+	usage  *methodUsage
+	stream bool
+	ended  bool
+}
+
+// OnError is called if any error is encountered during the execution of the
+// RPC call, or once a stream ends.
+func (c *usageCallback) OnError(err error) {
+	c.end(err)
+	c.Callback.OnError(err)
+}
+
+// end records the outcome of the call. Only the first outcome of a call is
+// recorded.
+func (c *usageCallback) end(err error) {
+	usageStatsMtx.Lock()
+	defer usageStatsMtx.Unlock()
+
+	if c.ended {
+		return
+	}
+	c.ended = true
+
+	if err != nil && err != io.EOF {
+		c.usage.Errors++
+	}
+	if c.stream {
+		c.usage.OpenStreams--
+	}
+}
+
+// trackUsage records that a call of the method is started, and wraps its
+// Callback or RecvStream to record the outcome.
+func trackUsage(method string, callback Callback,
+	stream bool) *usageCallback {
+
+	usageStatsMtx.Lock()
+	defer usageStatsMtx.Unlock()
+
+	usage, ok := usageStats[method]
+	if !ok {
+		usage = &methodUsage{}
+		usageStats[method] = usage
+	}
+
+	usage.Calls++
+	if stream {
+		usage.OpenStreams++
+	}
+
+	return &usageCallback{
+		Callback: callback,
+		usage:    usage,
+		stream:   stream,
+	}
+}
+{{- end}}
+{{- if .StreamStats}}
+
+// streamStats is the activity of a single open stream.
+type streamStats struct {
+	// ID is the number of streams opened before this one.
+	ID int64 ` + "`" + `json:"id"` + "`" + `
+
+	// Method is the full name of the method of the stream.
+	Method string ` + "`" + `json:"method"` + "`" + `
+
+	// OpenMs is the time since the stream was opened in milliseconds.
+	OpenMs int64 ` + "`" + `json:"open_ms"` + "`" + `
+
+	// Received is the number of responses delivered to the caller.
+	Received int64 ` + "`" + `json:"received"` + "`" + `
+
+	// Sent is the number of requests sent by the caller.
+	Sent int64 ` + "`" + `json:"sent"` + "`" + `
+
+	// IdleMs is the time since the last response was delivered or request
+	// was sent, or since the stream was opened if there was none, in
+	// milliseconds.
+	IdleMs int64 ` + "`" + `json:"idle_ms"` + "`" + `
+
+	opened       time.Time
+	lastActivity time.Time
+}
+
+var (
+	// openStreams maps the ID of each open stream to its activity.
+	openStreams = make(map[int64]*streamStats)
+
+	// nextStreamID is the ID of the next stream opened.
+	nextStreamID int64
+
+	// openStreamsMtx guards access to openStreams and nextStreamID.
+	openStreamsMtx sync.Mutex
+)
+
+// ListOpenStreams returns the streams currently open as a JSON array ordered by
+// the time they were opened, holding the method, the time since the stream was
+// opened, the number of responses delivered and requests sent, and the time
+// since the last of them in milliseconds, e.g.
+// [{"id": 0, "method": "/lnrpc.Lightning/SubscribeInvoices", "open_ms": 5230,
+// "received": 3, "sent": 0, "idle_ms": 1200}].
+func ListOpenStreams() string {
+	openStreamsMtx.Lock()
+	defer openStreamsMtx.Unlock()
+
+	now := time.Now()
+	streams := make([]streamStats, 0, len(openStreams))
+	for _, stats := range openStreams {
+		s := *stats
+		s.OpenMs = now.Sub(s.opened).Milliseconds()
+		s.IdleMs = now.Sub(s.lastActivity).Milliseconds()
+		streams = append(streams, s)
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].ID < streams[j].ID
+	})
+
+	b, err := json.Marshal(streams)
+	if err != nil {
+		return "[]"
+	}
+
+	return string(b)
+}
+
+// statsStream wraps the RecvStream of a stream, keeping it listed as open
+// until it ends.
+type statsStream struct {
+	RecvStream
+
+	stats *streamStats
+}
+
+// OnResponse records the delivery of the response before delivering it.
+func (s *statsStream) OnResponse(b []byte) {
+	s.record(&s.stats.Received)
+	s.RecvStream.OnResponse(b)
+}
+
+// OnError is called if any error is encountered during the execution of the
+// RPC call, or once the stream ends.
+func (s *statsStream) OnError(err error) {
+	s.end()
+	s.RecvStream.OnError(err)
+}
+
+// sent records that a request was sent to the stream.
+func (s *statsStream) sent() {
+	s.record(&s.stats.Sent)
+}
+
+// record increments the counter of the stream's activity.
+func (s *statsStream) record(counter *int64) {
+	openStreamsMtx.Lock()
+	defer openStreamsMtx.Unlock()
+
+	*counter++
+	s.stats.lastActivity = time.Now()
+}
+
+// end removes the stream from the open streams. It is safe to call it more
+// than once.
+func (s *statsStream) end() {
+	openStreamsMtx.Lock()
+	defer openStreamsMtx.Unlock()
+
+	delete(openStreams, s.stats.ID)
+}
+
+// trackStreamStats lists a newly opened stream of the method as open, and wraps
+// its RecvStream to record its activity and remove it once it ends.
+func trackStreamStats(method string, rStream RecvStream) *statsStream {
+	openStreamsMtx.Lock()
+	defer openStreamsMtx.Unlock()
+
+	now := time.Now()
+	stats := &streamStats{
+		ID:           nextStreamID,
+		Method:       method,
+		opened:       now,
+		lastActivity: now,
+	}
+	nextStreamID++
+	openStreams[stats.ID] = stats
+
+	return &statsStream{
+		RecvStream: rStream,
+		stats:      stats,
+	}
+}
+{{- end}}
+
+// dialListener dials the given in-memory listener using the passed extra dial
+// options, and returns the grpc client connection.
+func dialListener(lis interface{ Dial() (net.Conn, error) },
+	extraOpts ...grpc.DialOption) (*grpc.ClientConn, func(), error) {
+
+	conn, err := lis.Dial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Set up a custom dialer using the listener conn.
+	dialer := func(context.Context, string) (net.Conn, error) {
+		return conn, nil
+	}
+
+	// Create a dial options array.
+	opts := []grpc.DialOption{
+		grpc.WithContextDialer(dialer),
+	}
+	opts = append(opts, extraOpts...)
+
+{{- if eq .GRPCCompat "latest"}}
+
+	// As target we use "localhost" to mimic a local connection, which is
+	// passed through to the dialer.
+	clientConn, err := grpc.NewClient("passthrough:///localhost", opts...)
+{{- else}}
+
+	// As address we use "localhost" to mimic a local connection.
+	address := "localhost"
+	clientConn, err := grpc.Dial(address, opts...)
+{{- end}}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	closeConn := func() {
+		conn.Close()
+	}
+
+	return clientConn, closeConn, nil
+}
+
+// recvStream is the receiving half of a gRPC stream, delivering responses of
+// type Resp. All generated server-streaming and bidirectional clients satisfy
+// this interface.
+type recvStream[Resp proto.Message] interface {
+	// Recv returns the next response from the stream.
+	Recv() (Resp, error)
+}
+
+// biStream is a bidirectional gRPC stream sending requests of type Req and
+// receiving responses of type Resp.
+type biStream[Req, Resp proto.Message] interface {
+	recvStream[Resp]
+
+	// Send sends the given request to the stream.
+	Send(Req) error
+
+	// CloseSend closes the request stream.
+	CloseSend() error
+}
+{{- if .ClientStreams}}
+
+// clientStream is a client-streaming gRPC stream sending requests of type Req,
+// and receiving a single response of type Resp once the request stream is
+// closed.
+type clientStream[Req, Resp proto.Message] interface {
+	// Send sends the given request to the stream.
+	Send(Req) error
+
+	// CloseAndRecv closes the request stream and returns the response.
+	CloseAndRecv() (Resp, error)
+
+	// Context returns the context of the stream.
+	Context() context.Context
+}
+
+// clientStreamAdapter adapts a client-streaming gRPC stream to a bidirectional
+// one, such that it can be started with startBiStream. Its only response is
+// received once the request stream is closed.
+type clientStreamAdapter[Req, Resp proto.Message] struct {
+	stream clientStream[Req, Resp]
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	received  bool
+}
+
+// newClientStreamAdapter creates a clientStreamAdapter for the stream.
+func newClientStreamAdapter[Req, Resp proto.Message](
+	stream clientStream[Req, Resp]) *clientStreamAdapter[Req, Resp] {
+
+	return &clientStreamAdapter[Req, Resp]{
+		stream: stream,
+		closed: make(chan struct{}),
+	}
+}
+
+// Send sends the given request to the stream.
+func (a *clientStreamAdapter[Req, Resp]) Send(req Req) error {
+	return a.stream.Send(req)
+}
+
+// CloseSend closes the request stream, after which the response is received.
+func (a *clientStreamAdapter[Req, Resp]) CloseSend() error {
+	a.closeOnce.Do(func() {
+		close(a.closed)
+	})
+
+	return nil
+}
+
+// Recv blocks until the request stream is closed and returns the response.
+// Any further call returns io.EOF.
+func (a *clientStreamAdapter[Req, Resp]) Recv() (Resp, error) {
+	var zero Resp
+	if a.received {
+		return zero, io.EOF
+	}
+
+	select {
+	case <-a.closed:
+	case <-a.stream.Context().Done():
+		return zero, a.stream.Context().Err()
+	}
+
+	a.received = true
+	return a.stream.CloseAndRecv()
+}
+
+// clientStreamCallback wraps the Callback of a client-streaming call, which
+// is started as a bidirectional stream, dropping the io.EOF that ends the
+// stream after the response was delivered.
+type clientStreamCallback struct {
+	Callback
+}
+
+// OnError is called if any error is encountered during the execution of the
+// RPC call.
+func (c *clientStreamCallback) OnError(err error) {
+	if err == io.EOF {
+		return
+	}
+
+	c.Callback.OnError(err)
+}
+{{- end}}
+
+// syncHandler is a struct used to call the daemon's RPC interface on methods
+// where only one request and one response is expected.
+type syncHandler struct {
+	// method is the full gRPC method name of the RPC call.
+	method string
+
+	// newProto returns an empty struct for the desired grpc request.
+	newProto func() proto.Message
+
+	// getSync calls the desired method on the given client in a
+	// blocking matter.
+	getSync func(context.Context, proto.Message) (proto.Message, error)
+}
+
+// start executes the RPC call specified by this syncHandler using the
+// specified serialized msg request.
+func (s *syncHandler) start(msg []byte, callback Callback) {
+{{- if .UsageStats}}
+	// Record the call, and its outcome once it is done.
+	callback = trackUsage(s.method, callback, false)
+
+{{end}}{{- if .ErrorContext}}
+	// Prefix all errors delivered to the caller with the method.
+	callback = &errorContextCallback{Callback: callback, method: s.method}
+
+{{end}}{{- if .CallbackDispatcher}}
+	// Invoke the callback through the callback dispatcher.
+	callback = dispatchCallback(callback)
+
+{{end}}
+	// We must make a copy of the passed byte slice, as there is no
+	// guarantee the contents won't be changed while the go routine is
+	// executing.
+	data := make([]byte, len(msg))
+	copy(data[:], msg[:])
+
+	go func() {
+{{- if .PprofLabels}}
+		labelGoroutine(s.method)
+{{ end}}
+		// Get an empty proto of the desired type, and deserialize msg
+		// as this proto type.
+		req := s.newProto()
+		err := unmarshalRequest(s.method, data, req)
+		if err != nil {
+			callback.OnError(err)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+{{- if .CallDraining}}
+
+		// Now execute the RPC call, keeping track of it such that it
+		// can be drained.
+		resp, err := trackedCall(ctx, func(ctx context.Context) (
+			proto.Message, error) {
+
+			return s.getSync(ctx, req)
+		})
+{{- else}}
+
+		// Now execute the RPC call.
+		resp, err := s.getSync(ctx, req)
+{{- end}}
+		if err != nil {
+			callback.OnError(err)
+			return
+		}
+
+		// We serialize the response before returning it to the caller.
+		b, err := marshalResponse(s.method, resp)
+		if err != nil {
+			callback.OnError(err)
+			return
+		}
+{{- if .FaultInjection}}
+
+		// Give the fault injector a chance to delay, drop or fail the
+		// response.
+		drop, err := injectFault(s.method)
+		if err != nil {
+			callback.OnError(err)
+			return
+		}
+		if drop {
+			return
+		}
+{{- end}}
+
+		callback.OnResponse(b)
+	}()
+}
+
+{{- if .JSONEncoding}}
+
+var (
+	// jsonMarshaler encodes the responses delivered to the caller. Like
+	// the REST proxy of lnd, it names the fields as in the proto files
+	// and emits unpopulated ones. 64-bit integers are encoded as strings,
+	// since JavaScript numbers can't represent all of them exactly.
+	jsonMarshaler = protojson.MarshalOptions{
+		UseProtoNames:   true,
+		EmitUnpopulated: true,
+	}
+
+	// jsonUnmarshaler decodes the requests received from the caller,
+	// whose 64-bit integers may be given as strings or numbers.
+	jsonUnmarshaler = protojson.UnmarshalOptions{
+{{- if .DiscardUnknown}}
+		DiscardUnknown: true,
+{{- end}}
+	}
+)
+{{- end}}
+
+// unmarshalRequest deserializes the request received for the given method into
+// req.
+func unmarshalRequest(method string, data []byte, req proto.Message) error {
+{{- if .Throttling}}
+	// Simulate the configured bandwidth before dispatching the request.
+	throttle(len(data))
+{{end}}
+{{- if .SerializationHooks}}
+	// Give the serialization hook a chance to transform the request
+	// before it is deserialized.
+	if hook := getSerializationHook(); hook != nil {
+		var err error
+		data, err = hook.OnRequest(method, data)
+		if err != nil {
+			return err
+		}
+	}
+{{end}}
+{{- if .JSONEncoding}}
+	// Like an empty serialized request, an empty JSON-encoded one is an
+	// empty message.
+	if len(data) == 0 {
+		req.Reset()
+		return nil
+	}
+
+	return jsonUnmarshaler.Unmarshal(data, proto.MessageV2(req))
+{{- else if .RequestErrors}}
+	if err := proto.Unmarshal(data, req); err != nil {
+		return requestError(data, req, err)
+	}
+
+	return nil
+{{- else}}
+	return proto.Unmarshal(data, req)
+{{- end}}
+}
+{{- if .RequestErrors}}
+
+// requestError enriches the error of deserializing the request data into req
+// with the type of the request and, if the malformed data can be located, its
+// byte offset and the number and name of the field it belongs to.
+func requestError(data []byte, req proto.Message, err error) error {
+	desc := proto.MessageReflect(req).Descriptor()
+
+	offset, numbers, names, ok := locateWireError(desc, data)
+	if !ok {
+		return fmt.Errorf("unable to unmarshal %s: %w", desc.FullName(),
+			err)
+	}
+
+	if len(numbers) == 0 {
+		return fmt.Errorf("unable to unmarshal %s at byte %d: %w",
+			desc.FullName(), offset, err)
+	}
+
+	return fmt.Errorf("unable to unmarshal %s at byte %d, field %s (%s): "+
+		"%w", desc.FullName(), offset, strings.Join(numbers, "."),
+		strings.Join(names, "."), err)
+}
+
+// locateWireError walks the wire encoding of a message of the given type, and
+// returns the byte offset of the first malformed field, as well as the path of
+// numbers and names of the fields leading to it. Fields unknown to the type
+// are named by their number. The offset is reported without a field if the
+// tag of the field itself is malformed.
+func locateWireError(desc protoreflect.MessageDescriptor, b []byte) (int,
+	[]string, []string, bool) {
+
+	for offset := 0; offset < len(b); {
+		num, typ, n := protowire.ConsumeTag(b[offset:])
+		if n < 0 {
+			return offset, nil, nil, true
+		}
+
+		number := fmt.Sprint(int32(num))
+		name := number
+		field := desc.Fields().ByNumber(num)
+		if field != nil {
+			name = string(field.Name())
+		}
+
+		m := protowire.ConsumeFieldValue(num, typ, b[offset+n:])
+		if m < 0 {
+			return offset, []string{number}, []string{name}, true
+		}
+
+		// The values of length-delimited fields can be malformed even
+		// though their wire encoding is valid, so we check strings and
+		// descend into nested messages.
+		if field != nil && typ == protowire.BytesType {
+			value, _ := protowire.ConsumeBytes(b[offset+n:])
+			start := offset + n + m - len(value)
+
+			switch {
+			case field.Kind() == protoreflect.StringKind &&
+				!utf8.Valid(value):
+
+				return offset, []string{number}, []string{name},
+					true
+
+			case field.Kind() == protoreflect.MessageKind:
+				o, nums, nms, ok := locateWireError(
+					field.Message(), value,
+				)
+				if ok {
+					return start + o,
+						append([]string{number}, nums...),
+						append([]string{name}, nms...), true
+				}
+			}
+		}
+
+		offset += n + m
+	}
+
+	return 0, nil, nil, false
+}
+{{- end}}
+
+// marshalResponse serializes the response produced by the given method before
+// it is delivered to the caller.
+func marshalResponse(method string, resp proto.Message) ([]byte, error) {
+{{- if .JSONEncoding}}
+	b, err := jsonMarshaler.Marshal(proto.MessageV2(resp))
+{{- else}}
+	b, err := proto.Marshal(resp)
+{{- end}}
+	if err != nil {
+		return nil, err
+	}
+{{- if .SerializationHooks}}
+
+	// Give the serialization hook a chance to transform the response
+	// before it is delivered.
+	if hook := getSerializationHook(); hook != nil {
+		b, err = hook.OnResponse(method, b)
+		if err != nil {
+			return nil, err
+		}
+	}
+{{- end}}
+{{- if .Throttling}}
+
+	// Simulate the configured bandwidth before delivering the response.
+	throttle(len(b))
+{{- end}}
+
+	return b, nil
+}
+{{- if .SerializationHooks}}
+
+// SerializationHook is an interface that can be implemented by callers of the
+// library to transform the serialized payloads crossing the library boundary,
+// for instance to inject fields, compress or encrypt them.
+type SerializationHook interface {
+	// OnRequest is called with the full method name and the serialized
+	// request before it is deserialized. The returned payload is
+	// deserialized in its place.
+	OnRequest(method string, payload []byte) ([]byte, error)
+
+	// OnResponse is called with the full method name and the serialized
+	// response before it is delivered to the caller. The returned payload
+	// is delivered in its place.
+	OnResponse(method string, payload []byte) ([]byte, error)
+}
+
+var (
+	// serializationHook is the currently set serialization hook, or nil
+	// if none is set.
+	serializationHook SerializationHook
+
+	// serializationHookMtx guards access to serializationHook.
+	serializationHookMtx sync.RWMutex
+)
+
+// SetSerializationHook sets the hook that is invoked with every serialized
+// request and response crossing the library boundary. Passing nil removes a
+// previously set hook.
+func SetSerializationHook(hook SerializationHook) {
+	serializationHookMtx.Lock()
+	defer serializationHookMtx.Unlock()
+
+	serializationHook = hook
+}
+
+// getSerializationHook returns the currently set serialization hook.
+func getSerializationHook() SerializationHook {
+	serializationHookMtx.RLock()
+	defer serializationHookMtx.RUnlock()
+
+	return serializationHook
+}
+{{- end}}
+
+// startReadStream executes a server-streaming RPC call using the specified
+// serialized msg request. The client is retrieved using getClient and the
+// stream is opened by call, after which all responses are delivered to
+// rStream. Generated methods are thin instantiations of this function, with T
+// being the request message type and Req the pointer to it.
+func startReadStream[C any, T any, Req interface {
+	*T
+	proto.Message
+}, Resp proto.Message](method string, msg []byte, rStream RecvStream,
+	getClient func(context.Context) (C, func(), error),
+	call func(context.Context, C, Req) (recvStream[Resp], error)) {
+
+{{- if .UsageStats}}
+	// Record the stream, and its outcome once it ends.
+	rStream = trackUsage(method, rStream, true)
+
+{{end}}{{- if .StreamStats}}
+	// List the stream as open until it ends.
+	rStream = trackStreamStats(method, rStream)
+
+{{end}}{{- if .ErrorContext}}
+	// Prefix all errors delivered to the caller with the method.
+	rStream = &errorContextCallback{Callback: rStream, method: method}
+
+{{end}}{{- if eq .StreamDelivery "ordered"}}
+	// Deliver the responses one at a time, in the order they are
+	// received.
+	rStream = orderStream(rStream)
+
+{{else if eq .StreamDelivery "concurrent"}}
+	// Deliver each response without waiting for the previous one.
+	rStream = concurrentStream(rStream)
+
+{{else if .CallbackDispatcher}}
+	// Invoke the stream through the callback dispatcher.
+	rStream = dispatchCallback(rStream)
+
+{{end}}
+	// We must make a copy of the passed byte slice, as there is no
+	// guarantee the contents won't be changed while the go routine is
+	// executing.
+	data := make([]byte, len(msg))
+	copy(data[:], msg[:])
+
+	go func() {
+{{- if .PprofLabels}}
+		labelGoroutine(method)
+{{ end}}
+		// Get a new proto of the desired type and deserialize the
+		// passed msg as this type.
+		req := Req(new(T))
+		err := unmarshalRequest(method, data, req)
+		if err != nil {
+			rStream.OnError(err)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+{{- if .CallDraining}}
+
+		// Keep track of the stream, such that it can be drained.
+		ctx, rStream, err = trackStream(ctx, rStream)
+		if err != nil {
+			rStream.OnError(err)
+			return
+		}
+{{- end}}
+
+{{- if .StreamHeartbeats}}
+
+		// End the stream once it stays silent for longer than its
+		// heartbeat timeout.
+		ctx, watchdog := watchStream(ctx, method)
+{{- end}}
+
+		// Get the gRPC client.
+		client, closeClient, err := getClient(ctx)
+		if err != nil {
+			rStream.OnError(err)
+			return
+		}
+		defer closeClient()
+
+		// Call the desired method on the client using the decoded gRPC
+		// request, and get the receive stream back.
+		stream, err := call(ctx, client, req)
+		if err != nil {
+			rStream.OnError(err)
+			return
+		}
+{{- if .StreamHeartbeats}}
+		stream = newWatchedStream[Resp](stream, watchdog)
+{{- end}}
+
+		forwardResponses[Resp](method, stream, rStream)
+	}()
+}
+
+// startBiStream executes a bidirectional streaming RPC call, sending messages
+// coming from the returned SendStream. The client is retrieved using getClient
+// and the stream is opened by call, after which all responses are delivered to
+// rStream. Generated methods are thin instantiations of this function, with T
+// being the request message type and Req the pointer to it.
+func startBiStream[C any, T any, Req interface {
+	*T
+	proto.Message
+}, Resp proto.Message](method string, rStream RecvStream,
+	getClient func(context.Context) (C, func(), error),
+	call func(context.Context, C) (biStream[Req, Resp], error)) (
+	SendStream, error) {
+{{- if .UsageStats}}
+
+	// Record the stream, and its outcome once it ends.
+	usage := trackUsage(method, rStream, true)
+	rStream = usage
+{{- end}}{{- if .StreamStats}}
+
+	// List the stream as open until it ends.
+	stats := trackStreamStats(method, rStream)
+	rStream = stats
+{{- end}}{{- if .ErrorContext}}
+
+	// Prefix all errors delivered to the caller with the method.
+	rStream = &errorContextCallback{Callback: rStream, method: method}
+{{- end}}
+{{- if eq .StreamDelivery "ordered"}}
+
+	// Deliver the responses one at a time, in the order they are
+	// received.
+	rStream = orderStream(rStream)
+{{- else if eq .StreamDelivery "concurrent"}}
+
+	// Deliver each response without waiting for the previous one.
+	rStream = concurrentStream(rStream)
+{{- else if .CallbackDispatcher}}
+
+	// Invoke the stream through the callback dispatcher.
+	rStream = dispatchCallback(rStream)
+{{- end}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Get the gRPC client.
+	client, closeClient, err := getClient(ctx)
+	if err != nil {
+		cancel()
+{{- if .UsageStats}}
+		usage.end(err)
+{{- end}}
+{{- if .StreamStats}}
+		stats.end()
+{{- end}}
+		return nil, {{template "methodError" .}}
+	}
+{{- if .CallDraining}}
+
+	// Keep track of the stream, such that it can be drained.
+	ctx, rStream, err = trackStream(ctx, rStream)
+	if err != nil {
+		cancel()
+		closeClient()
+{{- if .UsageStats}}
+		usage.end(err)
+{{- end}}
+{{- if .StreamStats}}
+		stats.end()
+{{- end}}
+		return nil, {{template "methodError" .}}
+	}
+{{- end}}
+{{- if .StreamHeartbeats}}
+
+	// End the stream once it stays silent for longer than its heartbeat
+	// timeout.
+	ctx, watchdog := watchStream(ctx, method)
+{{- end}}
+
+	// Start a bidirectional stream for the desired RPC method.
+	stream, err := call(ctx, client)
+	if err != nil {
+		cancel()
+		closeClient()
+{{- if .UsageStats}}
+		usage.end(err)
+{{- end}}
+{{- if .StreamStats}}
+		stats.end()
+{{- end}}
+		return nil, {{template "methodError" .}}
+	}
+
+	// We create a sendStream which is a wrapper for the methods we
+	// will expose to the caller via the SendStream interface.
+	ss := &sendStream{
+		send: func(msg []byte) error {
+			// Get an empty proto and deserialize the message
+			// coming from the caller.
+			req := Req(new(T))
+			err := unmarshalRequest(method, msg, req)
+			if err != nil {
+				return err
+			}
+
+			// Send the request to the server.
+{{- if .StreamStats}}
+			if err := stream.Send(req); err != nil {
+				return err
+			}
+			stats.sent()
+
+			return nil
+{{- else}}
+			return stream.Send(req)
+{{- end}}
+		},
+		stop: stream.CloseSend,
+	}
+{{- if .ErrorContext}}
+
+	// Prefix the errors of the send stream with the method as well.
+	send, stop := ss.send, ss.stop
+	ss.send = func(msg []byte) error {
+		return methodError(method, send(msg))
+	}
+	ss.stop = func() error {
+		return methodError(method, stop())
+	}
+{{- end}}
+
+	// Now launch a goroutine that will handle the asynchronous stream of
+	// responses.
+	go func() {
+{{- if .PprofLabels}}
+		labelGoroutine(method)
+{{ end}}
+		defer cancel()
+		defer closeClient()
+{{- if .StreamHeartbeats}}
+
+		forwardResponses[Resp](
+			method, newWatchedStream[Resp](stream, watchdog), rStream,
+		)
+{{- else}}
+
+		forwardResponses[Resp](method, stream, rStream)
+{{- end}}
+	}()
+
+	// Return the send stream to the caller, which then can be used to pass
+	// messages to the server.
+	return ss, nil
+}
+
+// forwardResponses reads responses from the stream of the given method until
+// an error is encountered, delivering each serialized response to rStream.
+func forwardResponses[Resp proto.Message](method string,
+	stream recvStream[Resp], rStream RecvStream) {
+{{- if .StreamBuffer}}
+
+	// Deliver the responses through a bounded buffer if configured, such
+	// that a slow consumer doesn't hold up reading the stream.
+	buf := newStreamBuffer(rStream)
+	if buf != nil {
+		rStream = buf
+	}
+{{- end}}
+
+	for {
+		// Read a response from the stream.
+		resp, err := stream.Recv()
+		if err != nil {
+			rStream.OnError(err)
+			return
+		}
+
+		// Serialize the response before returning it to the caller.
+		b, err := marshalResponse(method, resp)
+		if err != nil {
+			rStream.OnError(err)
+			return
+		}
+{{- if .FaultInjection}}
+
+		// Give the fault injector a chance to delay, drop or fail the
+		// response.
+		drop, err := injectFault(method)
+		if err != nil {
+			rStream.OnError(err)
+			return
+		}
+		if drop {
+			continue
+		}
+{{- end}}
+
+		rStream.OnResponse(b)
+{{- if .StreamBuffer}}
+
+		// Stop reading the stream once the buffer overflowed.
+		if buf != nil && buf.overflowed() {
+			return
+		}
+{{- end}}
+	}
+}
+{{- if .FaultInjection}}
+
+// FaultInjector is an interface that can be implemented to inject faults into
+// the generated APIs, allowing to test how an application handles slow,
+// lost or failing calls and streams. It is consulted every time a response is
+// about to be delivered to the caller.
+//
+// NOTE: This is only meant to be used for testing.
+type FaultInjector interface {
+	// Delay returns the number of milliseconds the delivery of the next
+	// response of the given method should be delayed by.
+	Delay(method string) int64
+
+	// Drop returns true if the next response of the given method should
+	// be dropped instead of being delivered.
+	Drop(method string) bool
+
+	// Fail returns a non-nil error if the call or stream of the given
+	// method should fail with it, instead of delivering the next response.
+	Fail(method string) error
+}
+
+var (
+	// faultInjector is the currently set fault injector, or nil if none
+	// is set.
+	faultInjector FaultInjector
+
+	// faultInjectorMtx guards access to faultInjector.
+	faultInjectorMtx sync.RWMutex
+)
+
+// SetFaultInjector sets the fault injector that is consulted every time a
+// response is about to be delivered. Passing nil removes a previously set
+// injector.
+//
+// NOTE: This is only meant to be used for testing.
+func SetFaultInjector(injector FaultInjector) {
+	faultInjectorMtx.Lock()
+	defer faultInjectorMtx.Unlock()
+
+	faultInjector = injector
+}
+
+// injectFault consults the fault injector, if set, before a response of the
+// given method is delivered. It blocks for the requested delay, and returns
+// true if the response should be dropped, or an error if the call should fail.
+func injectFault(method string) (bool, error) {
+	faultInjectorMtx.RLock()
+	injector := faultInjector
+	faultInjectorMtx.RUnlock()
+
+	if injector == nil {
+		return false, nil
+	}
+
+	if delay := injector.Delay(method); delay > 0 {
+		time.Sleep(time.Duration(delay) * time.Millisecond)
+	}
+
+	if err := injector.Fail(method); err != nil {
+		return false, err
+	}
+
+	return injector.Drop(method), nil
+}
+{{- end}}
+{{- if .Throttling}}
+
+var (
+	// throttleRate is the simulated bandwidth in bytes per second, or
+	// zero if throttling is disabled.
+	throttleRate int64
+
+	// throttleNext is the time at which the simulated link becomes
+	// available for the next transfer.
+	throttleNext time.Time
+
+	// throttleMtx guards access to the above throttle variables.
+	throttleMtx sync.Mutex
+)
+
+// SetThrottle limits the bandwidth used by requests dispatched to and responses
+// delivered from the server to the given number of bytes per second, to
+// simulate poor network conditions. A rate of zero disables throttling.
+func SetThrottle(bytesPerSec int64) {
+	throttleMtx.Lock()
+	defer throttleMtx.Unlock()
+
+	throttleRate = bytesPerSec
+	throttleNext = time.Time{}
+}
+
+// throttle blocks until a transfer of n bytes is completed on the simulated
+// link. All transfers share the same link, so concurrent transfers are queued
+// after each other.
+func throttle(n int) {
+	throttleMtx.Lock()
+	if throttleRate <= 0 {
+		throttleMtx.Unlock()
+		return
+	}
+
+	// The transfer starts as soon as the link is free, and takes as long
+	// as the configured rate allows.
+	start := time.Now()
+	if throttleNext.After(start) {
+		start = throttleNext
+	}
+	duration := time.Duration(n) * time.Second / time.Duration(throttleRate)
+	throttleNext = start.Add(duration)
+	done := throttleNext
+	throttleMtx.Unlock()
+
+	time.Sleep(time.Until(done))
+}
+{{- end}}
+{{- if .Pagination}}
+
+// startPagination executes a list-style RPC call repeatedly, starting with the
+// specified serialized msg request. Each page of results is delivered to
+// rStream, after which nextPage is used to move the request to the next page.
+// Once it returns false, all pages have been retrieved and io.EOF is
+// delivered.
+func startPagination[C any, T any, Req interface {
+	*T
+	proto.Message
+}, Resp proto.Message](method string, msg []byte, rStream RecvStream,
+	getClient func(context.Context) (C, func(), error),
+	call func(context.Context, C, Req) (Resp, error),
+	nextPage func(Req, Resp) bool) {
+
+{{- if .UsageStats}}
+	// Record the stream, and its outcome once it ends.
+	rStream = trackUsage(method, rStream, true)
+
+{{end}}{{- if .StreamStats}}
+	// List the stream as open until it ends.
+	rStream = trackStreamStats(method, rStream)
+
+{{end}}{{- if .ErrorContext}}
+	// Prefix all errors delivered to the caller with the method.
+	rStream = &errorContextCallback{Callback: rStream, method: method}
+
+{{end}}{{- if eq .StreamDelivery "ordered"}}
+	// Deliver the responses one at a time, in the order they are
+	// received.
+	rStream = orderStream(rStream)
+
+{{else if eq .StreamDelivery "concurrent"}}
+	// Deliver each response without waiting for the previous one.
+	rStream = concurrentStream(rStream)
+
+{{else if .CallbackDispatcher}}
+	// Invoke the stream through the callback dispatcher.
+	rStream = dispatchCallback(rStream)
+
+{{end}}
+	// We must make a copy of the passed byte slice, as there is no
+	// guarantee the contents won't be changed while the go routine is
+	// executing.
+	data := make([]byte, len(msg))
+	copy(data[:], msg[:])
+
+	go func() {
+{{- if .PprofLabels}}
+		labelGoroutine(method)
+{{ end}}
+		// Get a new proto of the desired type and deserialize the
+		// passed msg as this type.
+		req := Req(new(T))
+		err := unmarshalRequest(method, data, req)
+		if err != nil {
+			rStream.OnError(err)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+{{- if .CallDraining}}
+
+		// Keep track of the stream, such that it can be drained.
+		ctx, rStream, err = trackStream(ctx, rStream)
+		if err != nil {
+			rStream.OnError(err)
+			return
+		}
+{{- end}}
+
+		// Get the gRPC client.
+		client, closeClient, err := getClient(ctx)
+		if err != nil {
+			rStream.OnError(err)
+			return
+		}
+		defer closeClient()
+
+		for {
+			// Fetch the current page.
+			resp, err := call(ctx, client, req)
+			if err != nil {
+				rStream.OnError(err)
+				return
+			}
+
+			// Serialize the page before returning it to the
+			// caller.
+			b, err := marshalResponse(method, resp)
+			if err != nil {
+				rStream.OnError(err)
+				return
+			}
+			rStream.OnResponse(b)
+
+			// Move on to the next page, if there is any.
+			if !nextPage(req, resp) {
+				rStream.OnError(io.EOF)
+				return
+			}
+		}
+	}()
+}
+{{- end}}
+{{- if .PaymentTracking}}
+
+// maxPaymentStreamRetries is the maximum number of consecutive attempts to
+// re-track a payment after its stream dropped.
+const maxPaymentStreamRetries = 5
+
+// startPaymentStream executes a payment streaming RPC call with the specified
+// serialized msg request, delivering the payment updates to rStream. If the
+// stream drops before it is done, the payment is re-tracked using track.
+// Updates equal to the last delivered one are skipped, as the re-tracked
+// stream starts with the current state of the payment.
+func startPaymentStream[C any, T any, Req interface {
+	*T
+	proto.Message
+}, Resp proto.Message](method string, msg []byte, rStream RecvStream,
+	getClient func(context.Context) (C, func(), error),
+	call func(context.Context, C, Req) (recvStream[Resp], error),
+	track func(context.Context, C, Resp) (recvStream[Resp], error)) {
+
+{{- if .UsageStats}}
+	// Record the stream, and its outcome once it ends.
+	rStream = trackUsage(method, rStream, true)
+
+{{end}}{{- if .StreamStats}}
+	// List the stream as open until it ends.
+	rStream = trackStreamStats(method, rStream)
+
+{{end}}{{- if .ErrorContext}}
+	// Prefix all errors delivered to the caller with the method.
+	rStream = &errorContextCallback{Callback: rStream, method: method}
+
+{{end}}{{- if eq .StreamDelivery "ordered"}}
+	// Deliver the responses one at a time, in the order they are
+	// received.
+	rStream = orderStream(rStream)
+
+{{else if eq .StreamDelivery "concurrent"}}
+	// Deliver each response without waiting for the previous one.
+	rStream = concurrentStream(rStream)
+
+{{else if .CallbackDispatcher}}
+	// Invoke the stream through the callback dispatcher.
+	rStream = dispatchCallback(rStream)
+
+{{end}}
+	// We must make a copy of the passed byte slice, as there is no
+	// guarantee the contents won't be changed while the go routine is
+	// executing.
+	data := make([]byte, len(msg))
+	copy(data[:], msg[:])
+
+	go func() {
+{{- if .PprofLabels}}
+		labelGoroutine(method)
+{{ end}}
+		// Get a new proto of the desired type and deserialize the
+		// passed msg as this type.
+		req := Req(new(T))
+		err := unmarshalRequest(method, data, req)
+		if err != nil {
+			rStream.OnError(err)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+{{- if .CallDraining}}
+
+		// Keep track of the stream, such that it can be drained.
+		ctx, rStream, err = trackStream(ctx, rStream)
+		if err != nil {
+			rStream.OnError(err)
+			return
+		}
+{{- end}}
+
+		// Get the gRPC client.
+		client, closeClient, err := getClient(ctx)
+		if err != nil {
+			rStream.OnError(err)
+			return
+		}
+		defer closeClient()
+
+		stream, err := call(ctx, client, req)
+		if err != nil {
+			rStream.OnError(err)
+			return
+		}
+
+		var (
+			last    Resp
+			tracked bool
+			retries int
+		)
+		for {
+			resp, err := stream.Recv()
+			if err == nil {
+				retries = 0
+
+				// Skip the update if it was already delivered.
+				if tracked && proto.Equal(last, resp) {
+					continue
+				}
+				last, tracked = resp, true
+
+				// Serialize the update before returning it to
+				// the caller.
+				b, err := marshalResponse(method, resp)
+				if err != nil {
+					rStream.OnError(err)
+					return
+				}
+				rStream.OnResponse(b)
+
+				continue
+			}
+
+			// The stream dropped, so we re-track the payment.
+			// This is only possible once we know the payment from
+			// a first update.
+			for err != nil {
+				retries++
+				if !tracked || status.Code(err) != codes.Unavailable ||
+					retries > maxPaymentStreamRetries {
+
+					rStream.OnError(err)
+					return
+				}
+
+				time.Sleep(time.Duration(retries) * time.Second)
+				stream, err = track(ctx, client, last)
+			}
+		}
+	}()
+}
+{{- end}}
+{{- if .InitialResponse}}
+
+// initialStream is a RecvStream that delivers the first response of a stream
+// to a separate callback.
+type initialStream struct {
+	initial  Callback
+	rStream  RecvStream
+	received bool
+}
+
+// newInitialStream creates a new initialStream delivering the first response
+// to initial and all following responses to rStream.
+func newInitialStream(initial Callback, rStream RecvStream) *initialStream {
+	return &initialStream{
+		initial: initial,
+		rStream: rStream,
+	}
+}
+
+// OnResponse is called for every response received on the stream.
+func (s *initialStream) OnResponse(b []byte) {
+	if !s.received {
+		s.received = true
+		s.initial.OnResponse(b)
+		return
+	}
+
+	s.rStream.OnResponse(b)
+}
+
+// OnError is called once the stream has ended.
+func (s *initialStream) OnError(err error) {
+	if !s.received {
+		s.initial.OnError(err)
+		return
+	}
+
+	s.rStream.OnError(err)
+}
+{{- end}}
+{{- if .StreamTransforms}}
+
+// StreamTransform is an interface that can be passed in when subscribing to a
+// stream, to filter, down-sample or rewrite its responses before they are
+// delivered to the caller.
+type StreamTransform interface {
+	// Transform is called with every serialized response of the stream.
+	// It returns the serialized response of the same type that is
+	// delivered instead, or nil to drop the response. If an error is
+	// returned, the stream is ended with it.
+	Transform([]byte) ([]byte, error)
+}
+
+// transformedStream is a stream passing all responses received through a
+// StreamTransform.
+type transformedStream[Resp proto.Message] struct {
+	recvStream[Resp]
+
+	transform StreamTransform
+}
+
+// newTransformedStream creates a new transformedStream passing the responses
+// of stream through transform.
+func newTransformedStream[Resp proto.Message](stream recvStream[Resp],
+	transform StreamTransform) *transformedStream[Resp] {
+
+	return &transformedStream[Resp]{
+		recvStream: stream,
+		transform:  transform,
+	}
+}
+
+// Recv returns the next response of the stream that isn't dropped by the
+// transform.
+func (s *transformedStream[Resp]) Recv() (Resp, error) {
+	for {
+		resp, err := s.recvStream.Recv()
+		if err != nil {
+			return resp, err
+		}
+{{if .JSONEncoding}}
+		b, err := jsonMarshaler.Marshal(proto.MessageV2(resp))
+{{- else}}
+		b, err := proto.Marshal(resp)
+{{- end}}
+		if err != nil {
+			return resp, err
+		}
+
+		b, err = s.transform.Transform(b)
+		if err != nil {
+			return resp, err
+		}
+		if b == nil {
+			continue
+		}
+
+		// Unmarshal resets the response before decoding the
+		// transformed one into it.
+{{- if .JSONEncoding}}
+		err = jsonUnmarshaler.Unmarshal(b, proto.MessageV2(resp))
+		if err != nil {
+{{- else}}
+		if err := proto.Unmarshal(b, resp); err != nil {
+{{- end}}
+			return resp, err
+		}
+
+		return resp, nil
+	}
+}
+{{- end}}
+{{- if .StreamBackpressure}}
+
+// StreamDemand is an opaque handle passed to the XxxWithDemand APIs, applying
+// backpressure to a stream. The stream reads ahead up to the buffer size of
+// responses, but only delivers as many of them as were requested.
+type StreamDemand struct {
+	// bufferSize is the number of responses read ahead of the demand.
+	bufferSize int
+
+	// credits is the number of requested responses that weren't delivered
+	// yet.
+	credits int64
+
+	// requested is signalled whenever more responses are requested.
+	requested chan struct{}
+
+	// mtx guards access to credits.
+	mtx sync.Mutex
+}
+
+// NewStreamDemand creates a new demand for a single stream, which reads ahead
+// up to bufferSize responses. Once the buffer is full, the stream isn't read
+// until more responses are requested, so the server is slowed down by gRPC's
+// flow control. No responses are delivered before they are requested.
+func NewStreamDemand(bufferSize int) *StreamDemand {
+	if bufferSize < 0 {
+		bufferSize = 0
+	}
+
+	return &StreamDemand{
+		bufferSize: bufferSize,
+		requested:  make(chan struct{}, 1),
+	}
+}
+
+// Request requests n more responses, which are delivered as soon as they are
+// received.
+func (d *StreamDemand) Request(n int64) {
+	if n <= 0 {
+		return
+	}
+
+	d.mtx.Lock()
+	d.credits += n
+	d.mtx.Unlock()
+
+	select {
+	case d.requested <- struct{}{}:
+	default:
+	}
+}
+
+// acquire blocks until a response is requested and takes it from the demand.
+// It returns false if the context is done first.
+func (d *StreamDemand) acquire(ctx context.Context) bool {
+	for {
+		d.mtx.Lock()
+		if d.credits > 0 {
+			d.credits--
+			d.mtx.Unlock()
+
+			return true
+		}
+		d.mtx.Unlock()
+
+		select {
+		case <-d.requested:
+
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// demandResult is a result of a stream read ahead by a demandStream.
+type demandResult[Resp proto.Message] struct {
+	resp Resp
+	err  error
+}
+
+// demandStream is a stream only returning the responses requested from its
+// StreamDemand. The responses are read ahead into a buffer of the demand's
+// size.
+type demandStream[Resp proto.Message] struct {
+	recvStream[Resp]
+
+	ctx     context.Context
+	demand  *StreamDemand
+	results chan demandResult[Resp]
+}
+
+// newDemandStream creates a new demandStream reading ahead the responses of
+// stream until ctx is done. If demand is nil, stream is returned unchanged.
+func newDemandStream[Resp proto.Message](ctx context.Context,
+	stream recvStream[Resp], demand *StreamDemand) recvStream[Resp] {
+
+	if demand == nil {
+		return stream
+	}
+
+	s := &demandStream[Resp]{
+		recvStream: stream,
+		ctx:        ctx,
+		demand:     demand,
+		results: make(
+			chan demandResult[Resp], demand.bufferSize,
+		),
+	}
+
+	go func() {
+		for {
+			resp, err := stream.Recv()
+
+			select {
+			case s.results <- demandResult[Resp]{resp, err}:
+
+			case <-ctx.Done():
+				return
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return s
+}
+
+// Recv returns the next response once it is requested. The error ending the
+// stream is returned without being requested, after all responses before it.
+func (s *demandStream[Resp]) Recv() (Resp, error) {
+	var result demandResult[Resp]
+	select {
+	case result = <-s.results:
+
+	case <-s.ctx.Done():
+		return result.resp, status.FromContextError(s.ctx.Err()).Err()
+	}
+
+	if result.err != nil {
+		return result.resp, result.err
+	}
+	if !s.demand.acquire(s.ctx) {
+		return result.resp, status.FromContextError(s.ctx.Err()).Err()
+	}
+
+	return result.resp, nil
+}
+{{- end}}
+
+{{- if .Tasks}}
+
+// ErrTaskTimeout is returned by Task.Await if the task isn't completed within
+// the timeout. The call isn't affected by this and can be awaited again.
+var ErrTaskTimeout = status.Error(codes.DeadlineExceeded,
+	"task not completed within timeout")
+
+// Task is the pending result of a call started with one of the XxxTask
+// methods. Instead of passing in a callback when starting the call, the
+// result can be awaited, or delivered to callbacks registered later on.
+type Task struct {
+	// done is closed once the result is set.
+	done chan struct{}
+
+	mu        sync.Mutex
+	resp      []byte
+	err       error
+	callbacks []Callback
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+// newTask creates a new pending Task.
+func newTask() *Task {
+	return &Task{
+		done: make(chan struct{}),
+	}
+}
+
+// Await blocks until the task is completed, and returns the serialized
+// response or the error of the call. If the task isn't completed within
+// timeoutMs milliseconds, ErrTaskTimeout is returned. A timeout of zero or
+// less waits until the task is completed.
+func (t *Task) Await(timeoutMs int64) ([]byte, error) {
+	var timeout <-chan time.Time
+	if timeoutMs > 0 {
+		timer := time.NewTimer(time.Duration(timeoutMs) * time.Millisecond)
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	select {
+	case <-t.done:
+		return t.resp, t.err
+
+	case <-timeout:
+		return nil, ErrTaskTimeout
+	}
+}
+
+// OnResult delivers the result of the task to the callback once it is
+// completed, or right away if it already is. Several callbacks can be
+// registered, each of them is called once.
+func (t *Task) OnResult(callback Callback) {
+	t.mu.Lock()
+	select {
+	case <-t.done:
+		t.mu.Unlock()
+
+		go t.deliver(callback)
+		return
+
+	default:
+	}
+
+	t.callbacks = append(t.callbacks, callback)
+	t.mu.Unlock()
+}
+
+// Cancel cancels the call of the task. The task is completed with the
+// cancellation error, unless it already is completed.
+func (t *Task) Cancel() {
+	t.mu.Lock()
+	t.cancelled = true
+	cancel := t.cancel
+	t.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// bind derives the context of the call from ctx, such that it is cancelled
+// by Cancel.
+func (t *Task) bind(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.cancelled {
+		cancel()
+	}
+	t.cancel = cancel
+
+	return ctx, cancel
+}
+
+// complete sets the result of the task and delivers it to the registered
+// callbacks.
+func (t *Task) complete(resp []byte, err error) {
+	t.mu.Lock()
+	t.resp, t.err = resp, err
+	close(t.done)
+
+	callbacks := t.callbacks
+	t.callbacks = nil
+	t.mu.Unlock()
+
+	for _, callback := range callbacks {
+		t.deliver(callback)
+	}
+}
+
+// deliver delivers the result of the completed task to the callback.
+func (t *Task) deliver(callback Callback) {
+	if t.err != nil {
+		callback.OnError(t.err)
+		return
+	}
+
+	callback.OnResponse(t.resp)
+}
+
+// taskCallback is the Callback completing a Task with the result of its call.
+type taskCallback struct {
+	task *Task
+}
+
+// OnResponse completes the task with the response of the call.
+func (c *taskCallback) OnResponse(resp []byte) {
+	c.task.complete(resp, nil)
+}
+
+// OnError completes the task with the error of the call.
+func (c *taskCallback) OnError(err error) {
+	c.task.complete(nil, err)
+}
+{{- end}}
+{{- if .PprofLabels}}
+
+// labelGoroutine labels the current goroutine with the RPC method it serves,
+// such that goroutine dumps, e.g. from crash reports, attribute leaked or
+// blocked goroutines to the RPC.
+func labelGoroutine(method string) {
+	labels := pprof.Labels("falafel.method", method)
+	pprof.SetGoroutineLabels(
+		pprof.WithLabels(context.Background(), labels),
+	)
+}
+{{- end}}
+{{- if .CallDraining}}
+
+// ErrServerRestarting is returned for calls and streams that were cancelled
+// because the listeners were drained to restart the server.
+var ErrServerRestarting = status.Error(codes.Aborted, "server restarting")
+
+// inFlightCall is a call or stream currently executed.
+type inFlightCall struct {
+	cancel  context.CancelFunc
+	drained bool
+	once    sync.Once
+}
+
+// inFlight keeps track of all calls and streams currently executed, such that
+// they can be drained before the listeners are re-created.
+var inFlight = struct {
+	sync.Mutex
+
+	// calls is the set of in-flight calls.
+	calls map[*inFlightCall]struct{}
+
+	// idle is non-nil while the listeners are drained and there are
+	// in-flight calls left, and is closed once all of them are done.
+	idle chan struct{}
+
+	// restarted is non-nil while the listeners are drained, and is closed
+	// once they have been re-created.
+	restarted chan struct{}
+
+	// retry indicates whether drained unary calls are retried once the
+	// listeners have been re-created.
+	retry bool
+}{
+	calls: make(map[*inFlightCall]struct{}),
+}
+
+// SetDrainRetry enables or disables retrying unary calls that were cancelled
+// by DrainListeners. If enabled, they are executed again once the listeners
+// have been re-created, instead of failing with ErrServerRestarting.
+func SetDrainRetry(enabled bool) {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+
+	inFlight.retry = enabled
+}
+
+// DrainListeners prepares swapping the listeners, e.g. when the server is
+// restarted after unlocking. New calls fail with ErrServerRestarting, while
+// the in-flight calls are given up to timeoutMs milliseconds to complete,
+// after which they are cancelled with ErrServerRestarting. RecreateListeners
+// must be called once the new listeners are needed.
+func DrainListeners(timeoutMs int64) {
+	inFlight.Lock()
+	if inFlight.restarted == nil {
+		inFlight.restarted = make(chan struct{})
+	}
+	if len(inFlight.calls) == 0 {
+		inFlight.Unlock()
+		return
+	}
+	if inFlight.idle == nil {
+		inFlight.idle = make(chan struct{})
+	}
+	idle := inFlight.idle
+	inFlight.Unlock()
+
+	// Wait for the in-flight calls to complete, up to the timeout. No new
+	// calls are added from now on.
+	select {
+	case <-idle:
+		return
+
+	case <-time.After(time.Duration(timeoutMs) * time.Millisecond):
+	}
+
+	// Cancel all calls that haven't completed in time.
+	inFlight.Lock()
+	defer inFlight.Unlock()
+
+	for call := range inFlight.calls {
+		call.drained = true
+		call.cancel()
+	}
+}
+
+// listenersRecreated is called once the listeners have been re-created, and
+// resumes the calls waiting for them.
+func listenersRecreated() {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+
+	if inFlight.restarted != nil {
+		close(inFlight.restarted)
+		inFlight.restarted = nil
+	}
+}
+
+// trackCall registers a new in-flight call, returning the context the call must
+// use and a function to call with its final error once it is done. The
+// function returns ErrServerRestarting instead if the call was drained. If the
+// listeners are currently drained, ErrServerRestarting is returned.
+func trackCall(ctx context.Context) (context.Context, func(error) error,
+	error) {
+
+	inFlight.Lock()
+	defer inFlight.Unlock()
+
+	if inFlight.restarted != nil {
+		return nil, nil, ErrServerRestarting
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	call := &inFlightCall{
+		cancel: cancel,
+	}
+	inFlight.calls[call] = struct{}{}
+
+	done := func(err error) error {
+		call.once.Do(func() {
+			cancel()
+
+			inFlight.Lock()
+			defer inFlight.Unlock()
+
+			// Signal a waiting drain once the last call is done.
+			delete(inFlight.calls, call)
+			if inFlight.idle != nil && len(inFlight.calls) == 0 {
+				close(inFlight.idle)
+				inFlight.idle = nil
+			}
+		})
+
+		inFlight.Lock()
+		defer inFlight.Unlock()
+
+		if err != nil && call.drained {
+			return ErrServerRestarting
+		}
+
+		return err
+	}
+
+	return ctx, done, nil
+}
+
+// trackedCall executes the unary call f as an in-flight call. If the call is
+// drained and retrying is enabled, it is executed again once the listeners
+// have been re-created.
+func trackedCall(ctx context.Context,
+	f func(context.Context) (proto.Message, error)) (proto.Message, error) {
+
+	for {
+		callCtx, done, err := trackCall(ctx)
+		if err == nil {
+			var resp proto.Message
+			resp, err = f(callCtx)
+			if err = done(err); err == nil {
+				return resp, nil
+			}
+		}
+
+		if err != ErrServerRestarting {
+			return nil, err
+		}
+
+		// Wait for the listeners to be re-created if we should retry
+		// the call.
+		inFlight.Lock()
+		restarted, retry := inFlight.restarted, inFlight.retry
+		inFlight.Unlock()
+
+		if !retry {
+			return nil, err
+		}
+		if restarted != nil {
+			<-restarted
+		}
+	}
+}
+
+// drainStream is a RecvStream of a stream tracked as in-flight call, releasing
+// it once the stream has ended.
+type drainStream struct {
+	RecvStream
+
+	done func(error) error
+}
+
+// OnError is called once the stream has ended.
+func (s *drainStream) OnError(err error) {
+	s.RecvStream.OnError(s.done(err))
+}
+
+// trackStream registers a stream as in-flight call, returning the context the
+// stream must use and the receive stream its responses must be delivered to.
+// If the listeners are currently drained, ErrServerRestarting is returned.
+func trackStream(ctx context.Context, rStream RecvStream) (context.Context,
+	RecvStream, error) {
+
+	ctx, done, err := trackCall(ctx)
+	if err != nil {
+		return ctx, rStream, err
+	}
+
+	return ctx, &drainStream{
+		RecvStream: rStream,
+		done:       done,
+	}, nil
+}
+{{- end}}
+{{- if .StreamBuffer}}
+
+const (
+	// OverflowBlock makes a stream wait for the consumer once its buffer
+	// is full.
+	OverflowBlock = 0
+
+	// OverflowDropOldest drops the oldest buffered response once the
+	// buffer of a stream is full.
+	OverflowDropOldest = 1
+
+	// OverflowError fails a stream with ErrStreamOverflow once its buffer
+	// is full.
+	OverflowError = 2
+)
+
+// ErrStreamOverflow is returned for streams that were failed because their
+// buffer was full, using the OverflowError policy.
+var ErrStreamOverflow = status.Error(
+	codes.ResourceExhausted, "stream buffer overflow",
+)
+
+var (
+	// streamBufferSize is the number of responses buffered per stream.
+	// Zero disables buffering, delivering the responses directly.
+	streamBufferSize int
+
+	// streamOverflowPolicy is the policy applied once a stream buffer is
+	// full.
+	streamOverflowPolicy int
+
+	// streamBufferMtx guards access to the stream buffer settings.
+	streamBufferMtx sync.Mutex
+)
+
+// SetStreamBuffer sets the number of responses buffered for each new stream,
+// and the policy applied once the buffer is full, which is one of
+// OverflowBlock, OverflowDropOldest and OverflowError. A size of zero disables
+// buffering, which is the default.
+func SetStreamBuffer(size int, policy int) error {
+	if size < 0 {
+		return fmt.Errorf("invalid stream buffer size %d", size)
+	}
+
+	switch policy {
+	case OverflowBlock, OverflowDropOldest, OverflowError:
+	default:
+		return fmt.Errorf("unknown overflow policy %d", policy)
+	}
+
+	streamBufferMtx.Lock()
+	defer streamBufferMtx.Unlock()
+
+	streamBufferSize = size
+	streamOverflowPolicy = policy
+
+	return nil
+}
+
+// streamBuffer is a RecvStream buffering the responses of a stream, which are
+// delivered to the consumer by a separate goroutine.
+type streamBuffer struct {
+	rStream RecvStream
+	size    int
+	policy  int
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	queue [][]byte
+	ended bool
+	err   error
+}
+
+// newStreamBuffer creates a new streamBuffer delivering to rStream using the
+// current settings, or returns nil if buffering is disabled.
+func newStreamBuffer(rStream RecvStream) *streamBuffer {
+	streamBufferMtx.Lock()
+	size, policy := streamBufferSize, streamOverflowPolicy
+	streamBufferMtx.Unlock()
+
+	if size == 0 {
+		return nil
+	}
+
+	b := &streamBuffer{
+		rStream: rStream,
+		size:    size,
+		policy:  policy,
+	}
+	b.cond = sync.NewCond(&b.mu)
+
+	go b.deliver()
+
+	return b
+}
+
+// OnResponse buffers a response of the stream, applying the overflow policy
+// if the buffer is full.
+func (b *streamBuffer) OnResponse(resp []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.policy == OverflowBlock && len(b.queue) >= b.size && !b.ended {
+		b.cond.Wait()
+	}
+	if b.ended {
+		return
+	}
+
+	if len(b.queue) >= b.size {
+		switch b.policy {
+		case OverflowDropOldest:
+			b.queue = b.queue[1:]
+
+		case OverflowError:
+			b.ended = true
+			b.err = ErrStreamOverflow
+			b.cond.Broadcast()
+
+			return
+		}
+	}
+
+	b.queue = append(b.queue, resp)
+	b.cond.Broadcast()
+}
+
+// OnError ends the stream, after all buffered responses have been delivered.
+func (b *streamBuffer) OnError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.ended {
+		b.ended = true
+		b.err = err
+	}
+	b.cond.Broadcast()
+}
+
+// overflowed returns true if the stream was failed because the buffer was
+// full.
+func (b *streamBuffer) overflowed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.ended && b.err == ErrStreamOverflow
+}
+
+// deliver delivers the buffered responses to the consumer until the stream has
+// ended.
+func (b *streamBuffer) deliver() {
+	for {
+		b.mu.Lock()
+		for len(b.queue) == 0 && !b.ended {
+			b.cond.Wait()
+		}
+
+		if len(b.queue) == 0 {
+			err := b.err
+			b.mu.Unlock()
+
+			b.rStream.OnError(err)
+			return
+		}
+
+		resp := b.queue[0]
+		b.queue = b.queue[1:]
+		b.cond.Broadcast()
+		b.mu.Unlock()
+
+		b.rStream.OnResponse(resp)
+	}
+}
+{{- end}}
+{{- if .StreamHeartbeats}}
+
+// ErrStreamStale is returned for streams that were ended because no response
+// arrived within their heartbeat timeout.
+var ErrStreamStale = status.Error(
+	codes.Unavailable, "no stream response within heartbeat timeout",
+)
+
+var (
+	// heartbeatTimeouts maps the full gRPC method names to the heartbeat
+	// timeouts of their streams. The empty method applies to all streams
+	// without a timeout of their own.
+	heartbeatTimeouts = make(map[string]time.Duration)
+
+	// heartbeatMtx guards access to heartbeatTimeouts.
+	heartbeatMtx sync.Mutex
+)
+
+// SetStreamHeartbeat sets the time in milliseconds within which each response
+// must arrive on new streams of the given method, e.g.
+// /lnrpc.Lightning/SubscribeInvoices, or of all streams if the method is empty.
+// If the stream stays silent for longer, for example because the connection
+// was silently dropped during a network transition of the OS, it is cancelled
+// and ended with ErrStreamStale, such that the app can subscribe again. A
+// timeout of zero or less disables the heartbeat, which is the default.
+func SetStreamHeartbeat(method string, timeoutMs int64) {
+	heartbeatMtx.Lock()
+	defer heartbeatMtx.Unlock()
+
+	if timeoutMs <= 0 {
+		delete(heartbeatTimeouts, method)
+		return
+	}
+
+	heartbeatTimeouts[method] = time.Duration(timeoutMs) * time.Millisecond
+}
+
+// streamWatchdog cancels a stream once it stays silent for longer than its
+// heartbeat timeout.
+type streamWatchdog struct {
+	timeout time.Duration
+	timer   *time.Timer
+
+	mu    sync.Mutex
+	stale bool
+}
+
+// watchStream derives the context of a stream of the given method from ctx,
+// which is cancelled by the returned watchdog once the stream is stale. If no
+// heartbeat timeout is set for the method, ctx is returned unchanged together
+// with a nil watchdog.
+func watchStream(ctx context.Context, method string) (context.Context,
+	*streamWatchdog) {
+
+	heartbeatMtx.Lock()
+	timeout, ok := heartbeatTimeouts[method]
+	if !ok {
+		timeout, ok = heartbeatTimeouts[""]
+	}
+	heartbeatMtx.Unlock()
+
+	if !ok {
+		return ctx, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	w := &streamWatchdog{
+		timeout: timeout,
+	}
+	w.timer = time.AfterFunc(timeout, func() {
+		w.mu.Lock()
+		w.stale = true
+		w.mu.Unlock()
+
+		cancel()
+	})
+
+	return ctx, w
+}
+
+// watchedStream is a stream resetting the timer of its watchdog with every
+// response received.
+type watchedStream[Resp proto.Message] struct {
+	recvStream[Resp]
+
+	watchdog *streamWatchdog
+}
+
+// newWatchedStream returns the stream watched by the watchdog, or the stream
+// itself if the watchdog is nil.
+func newWatchedStream[Resp proto.Message](stream recvStream[Resp],
+	watchdog *streamWatchdog) recvStream[Resp] {
+
+	if watchdog == nil {
+		return stream
+	}
+
+	return &watchedStream[Resp]{
+		recvStream: stream,
+		watchdog:   watchdog,
 	}
-	s.start(msg, rStream)
 }
-`))
 
-	biStreamTemplate = template.Must(template.New("biStream").Parse(`
-{{.Comment}}
-//
-// NOTE: This method produces a stream of responses, and the receive stream can
-// be called zero or more times. After EOF error is returned, no more responses
-// will be produced. The send stream can accept zero or more requests before it
-// is closed.
-func {{.ApiPrefix}}{{.MethodName}}(rStream RecvStream) (SendStream, error) {
-	b := &biStreamHandler{
-		newProto: func() proto.Message {
-			return &{{.RequestType}}{}
-		},
-		biStream: func(ctx context.Context) (*receiver, *sender, func(), error) {
+// Recv returns the next response of the stream, or ErrStreamStale if the
+// stream was cancelled by the watchdog.
+func (s *watchedStream[Resp]) Recv() (Resp, error) {
+	resp, err := s.recvStream.Recv()
+	if err != nil {
+		s.watchdog.timer.Stop()
 
-			// Get the gRPC client.
-			client, closeClient, err := get{{.ServiceName}}Client()
-			if err != nil {
-				return nil, nil, nil, err
-			}
+		s.watchdog.mu.Lock()
+		defer s.watchdog.mu.Unlock()
 
-			stream, err := client.{{.MethodName}}(ctx)
-			if err != nil {
-				closeClient()
-				return nil, nil, nil, err
-			}
-			return &receiver{
-					recv: func() (proto.Message, error) {
-						return stream.Recv()
-					},
-				},
-				&sender{
-					send: func(req proto.Message) error {
-						r := req.(*{{.RequestType}})
-						return stream.Send(r)
-					},
-					closeStream: stream.CloseSend,
-				}, closeClient, nil
-		},
+		if s.watchdog.stale {
+			err = ErrStreamStale
+		}
+		return resp, err
 	}
-	return b.start(rStream)
+
+	s.watchdog.timer.Reset(s.watchdog.timeout)
+
+	return resp, nil
 }
+{{- end}}
+{{- define "methodError"}}
+{{- if .ErrorContext}}methodError(method, err){{else}}err{{end}}
+{{- end}}
 `))
-)
 
-type memRpcParams struct {
+// callbacksParams is a struct that holds all data passed in to the callbacks
+// template.
+type callbacksParams struct {
 	ToolName string
 	Package  string
+	BuildTag string
 }
 
-var memRpcTemplate = template.Must(template.New("mem").Parse(`// Code generated by {{.ToolName}} DO NOT EDIT.
+// callbacksTemplate creates the Callback, RecvStream and SendStream interfaces
+// implemented by the callers of the mobile APIs. It is cloned from the
+// memRpcTemplate, which defines them unless they are created separately.
+var callbacksTemplate = template.Must(template.Must(
+	memRpcTemplate.Clone()).New("callbacks").Parse(`// Code generated by {{.ToolName}}. DO NOT EDIT.
+{{if .BuildTag}}
+{{.BuildTag}}
+{{end}}
+package {{.Package}}
+{{- template "callbackInterfaces"}}
+`))
+
+// memRpcRuntimeTemplate is used instead of memRpcTemplate when the generated
+// code should import the shared falafel runtime package, rather than carrying
+// its own copy of the plumbing.
+var memRpcRuntimeTemplate = template.Must(template.New("memRuntime").Parse(`// Code generated by {{.ToolName}} DO NOT EDIT.
+{{if .BuildTag}}
+{{.BuildTag}}
+{{end}}
 package {{.Package}}
 
 import (
 	"context"
+	"net"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/lightninglabs/falafel/runtime"
+	"google.golang.org/grpc"
 )
 
 // Callback is an interface that is passed in by callers of the library, and
 // specifies where the responses should be delivered.
-type Callback interface {
-	// OnResponse is called by the library when a response from the daemon
-	// for the associated RPC call is received. The reponse is a serialized
-	// protobuf for the expected response, and must be deserialized by the
-	// caller.
-	OnResponse([]byte)
-
-	// OnError is called by the library if any error is encountered during
-	// the execution of the RPC call.
-	OnError(error)
-}
+type Callback = runtime.Callback
 
 // RecvStream is an interface that is passed in by callers of the library, and
 // specifies where the streaming responses should be delivered.
-type RecvStream interface {
-	// OnResponse is called by the library when a new stream response from
-	// the daemon for the associated RPC call is available. The reponse is
-	// a serialized protobuf for the expected response, and must be
-	// deserialized by the caller.
-	OnResponse([]byte)
-
-	// OnError is called by the library if any error is encountered during
-	// the execution of the RPC call, or if the response stream ends. No
-	// more stream responses will be received after this.
-	OnError(error)
-}
+type RecvStream = runtime.RecvStream
 
 // SendStream is an interface that the caller of the library can use to send
 // requests to the server during the execution of a bidirectional streaming RPC
 // call, or stop the stream.
-type SendStream interface {
-	// Send sends the serialized protobuf request to the server.
-	Send([]byte) error
+type SendStream = runtime.SendStream
 
-	// Stop closes the bidirecrional connection.
-	Stop() error
-}
+// dialListener dials the given in-memory listener using the passed extra dial
+// options, and returns the grpc client connection.
+func dialListener(lis interface{ Dial() (net.Conn, error) },
+	extraOpts ...grpc.DialOption) (*grpc.ClientConn, func(), error) {
 
-// sendStream is an internal struct that satisifies the SendStream interface.
-// We use it to wrap customizable send and stop methods, that can be tuned to
-// the specific RPC call in question.
-type sendStream struct {
-	send func([]byte) error
-	stop func() error
+	return runtime.DialListener(lis, extraOpts...)
 }
 
-// Send sends the serialized protobuf request to the server.
-//
-// Part of the SendStream interface.
-func (s *sendStream) Send(req []byte) error {
-	return s.send(req)
+// recvStream is the receiving half of a gRPC stream, delivering responses of
+// type Resp.
+type recvStream[Resp proto.Message] interface {
+	runtime.Receiver[Resp]
 }
 
-// Stop closes the bidirectional connection.
-//
-// Part of the SendStream interface.
-func (r *sendStream) Stop() error {
-	return r.stop()
+// biStream is a bidirectional gRPC stream sending requests of type Req and
+// receiving responses of type Resp.
+type biStream[Req, Resp proto.Message] interface {
+	runtime.BiStream[Req, Resp]
 }
+{{- if .ClientStreams}}
 
-// receiver is a struct used to hold a generic recv closure, that can be set to
-// return messages from the desired stream of responses.
-type receiver struct {
-	// recv returns a message from the stream of responses.
-	recv func() (proto.Message, error)
+// clientStream is a client-streaming gRPC stream sending requests of type Req,
+// and receiving a single response of type Resp once the request stream is
+// closed.
+type clientStream[Req, Resp proto.Message] interface {
+	runtime.ClientStream[Req, Resp]
 }
 
-// sender is a struct used to hold a generic send closure, that can be set to
-// send messages to the desired stream of requests.
-type sender struct {
-	// send sends the given message to the request stream.
-	send func(proto.Message) error
+// newClientStreamAdapter adapts the client-streaming gRPC stream to a
+// bidirectional one, such that it can be started with startBiStream.
+func newClientStreamAdapter[Req, Resp proto.Message](
+	stream clientStream[Req, Resp]) biStream[Req, Resp] {
 
-	// closeStream closes the request stream.
-	closeStream func() error
+	return runtime.NewClientStreamAdapter[Req, Resp](stream)
 }
 
+// clientStreamCallback wraps the Callback of a client-streaming call, which
+// is started as a bidirectional stream, dropping the io.EOF that ends the
+// stream after the response was delivered.
+type clientStreamCallback = runtime.ClientStreamCallback
+{{- end}}
+
 // syncHandler is a struct used to call the daemon's RPC interface on methods
 // where only one request and one response is expected.
 type syncHandler struct {
+	// method is the full gRPC method name of the RPC call.
+	method string
+
 	// newProto returns an empty struct for the desired grpc request.
 	newProto func() proto.Message
 
@@ -557,180 +11424,274 @@ type syncHandler struct {
 // start executes the RPC call specified by this syncHandler using the
 // specified serialized msg request.
 func (s *syncHandler) start(msg []byte, callback Callback) {
-	// We must make a copy of the passed byte slice, as there is no
-	// guarantee the contents won't be changed while the go routine is
-	// executing.
-	data := make([]byte, len(msg))
-	copy(data[:], msg[:])
+{{- if .ErrorContext}}
+	// Prefix all errors delivered to the caller with the method.
+	callback = &runtime.ErrorContextCallback{
+		Callback: callback,
+		Method:   s.method,
+	}
 
-	go func() {
-		// Get an empty proto of the desired type, and deserialize msg
-		// as this proto type.
-		req := s.newProto()
-		err := proto.Unmarshal(data, req)
-		if err != nil {
-			callback.OnError(err)
-			return
-		}
+{{end}}
+	runtime.StartSync(msg, callback, s.newProto, s.getSync)
+}
 
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
+// startReadStream executes a server-streaming RPC call using the shared
+// runtime.
+func startReadStream[C any, T any, Req interface {
+	*T
+	proto.Message
+}, Resp proto.Message]({{if .ErrorContext}}method{{else}}_{{end}} string, msg []byte, rStream RecvStream,
+	getClient func(context.Context) (C, func(), error),
+	call func(context.Context, C, Req) (recvStream[Resp], error)) {
+{{- if .ErrorContext}}
 
-		// Now execute the RPC call.
-		resp, err := s.getSync(ctx, req)
-		if err != nil {
-			callback.OnError(err)
-			return
-		}
+	// Prefix all errors delivered to the caller with the method.
+	rStream = &runtime.ErrorContextCallback{
+		Callback: rStream,
+		Method:   method,
+	}
+{{- end}}
 
-		// We serialize the response before returning it to the caller.
-		b, err := proto.Marshal(resp)
-		if err != nil {
-			callback.OnError(err)
-			return
-		}
+	runtime.StartReadStream[C, T, Req, Resp](msg, rStream, getClient,
+		func(ctx context.Context, client C, req Req) (
+			runtime.Receiver[Resp], error) {
 
-		callback.OnResponse(b)
-	}()
+			return call(ctx, client, req)
+		},
+	)
 }
 
-// readStreamHandler is a struct used to call the daemon's RPC interface on
-// methods where a stream of responses is expected, as in subscription type
-// requests.
-type readStreamHandler struct {
-	// newProto returns an empty struct for the desired grpc request.
-	newProto func() proto.Message
+// startBiStream executes a bidirectional streaming RPC call using the shared
+// runtime.
+func startBiStream[C any, T any, Req interface {
+	*T
+	proto.Message
+}, Resp proto.Message]({{if .ErrorContext}}method{{else}}_{{end}} string, rStream RecvStream,
+	getClient func(context.Context) (C, func(), error),
+	call func(context.Context, C) (biStream[Req, Resp], error)) (
+	SendStream, error) {
+{{- if .ErrorContext}}
+
+	// Prefix all errors delivered to the caller with the method.
+	rStream = &runtime.ErrorContextCallback{
+		Callback: rStream,
+		Method:   method,
+	}
+
+	sStream, err := runtime.StartBiStream[C, T, Req, Resp](rStream, getClient,
+		func(ctx context.Context, client C) (
+			runtime.BiStream[Req, Resp], error) {
+
+			return call(ctx, client)
+		},
+	)
+	if err != nil {
+		return nil, runtime.MethodError(method, err)
+	}
+
+	// Prefix the errors of the send stream with the method as well.
+	return &runtime.ErrorContextSendStream{
+		SendStream: sStream,
+		Method:     method,
+	}, nil
+{{- else}}
+
+	return runtime.StartBiStream[C, T, Req, Resp](rStream, getClient,
+		func(ctx context.Context, client C) (
+			runtime.BiStream[Req, Resp], error) {
 
-	// recvStream calls the given client with the request and returns a
-	// receiver that reads the stream of responses.
-	recvStream func(context.Context, proto.Message) (*receiver, func(), error)
+			return call(ctx, client)
+		},
+	)
+{{- end}}
 }
+{{- if .Pagination}}
 
-// start executes the RPC call specified by this readStreamHandler using the
-// specified serialized msg request.
-func (s *readStreamHandler) start(msg []byte, rStream RecvStream) {
-	// We must make a copy of the passed byte slice, as there is no
-	// guarantee the contents won't be changed while the go routine is
-	// executing.
-	data := make([]byte, len(msg))
-	copy(data[:], msg[:])
+// startPagination executes a list-style RPC call repeatedly using the shared
+// runtime, delivering each page of results to rStream.
+func startPagination[C any, T any, Req interface {
+	*T
+	proto.Message
+}, Resp proto.Message]({{if .ErrorContext}}method{{else}}_{{end}} string, msg []byte, rStream RecvStream,
+	getClient func(context.Context) (C, func(), error),
+	call func(context.Context, C, Req) (Resp, error),
+	nextPage func(Req, Resp) bool) {
+{{- if .ErrorContext}}
 
-	go func() {
-		// Get a new proto of the desired type and deserialize the
-		// passed msg as this type.
-		req := s.newProto()
-		err := proto.Unmarshal(data, req)
-		if err != nil {
-			rStream.OnError(err)
-			return
-		}
+	// Prefix all errors delivered to the caller with the method.
+	rStream = &runtime.ErrorContextCallback{
+		Callback: rStream,
+		Method:   method,
+	}
+{{- end}}
 
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
+	runtime.StartPagination[C, T, Req, Resp](
+		msg, rStream, getClient, call, nextPage,
+	)
+}
+{{- end}}
+{{- if .PaymentTracking}}
 
-		// Call the desired method on the client using the decoded gRPC
-		// request, and get the receive stream back.
-		stream, closeStream, err := s.recvStream(ctx, req)
-		if err != nil {
-			rStream.OnError(err)
-			return
-		}
-		defer closeStream()
+// startPaymentStream executes a payment streaming RPC call using the shared
+// runtime, re-tracking the payment if the stream drops before it is done.
+func startPaymentStream[C any, T any, Req interface {
+	*T
+	proto.Message
+}, Resp proto.Message]({{if .ErrorContext}}method{{else}}_{{end}} string, msg []byte, rStream RecvStream,
+	getClient func(context.Context) (C, func(), error),
+	call func(context.Context, C, Req) (recvStream[Resp], error),
+	track func(context.Context, C, Resp) (recvStream[Resp], error)) {
+{{- if .ErrorContext}}
 
-		// We will read responses from the stream until we encounter an
-		// error.
-		for {
-			// Read a response from the stream.
-			resp, err := stream.recv()
-			if err != nil {
-				rStream.OnError(err)
-				return
-			}
+	// Prefix all errors delivered to the caller with the method.
+	rStream = &runtime.ErrorContextCallback{
+		Callback: rStream,
+		Method:   method,
+	}
+{{- end}}
 
-			// Serielize the response before returning it to the
-			// caller.
-			b, err := proto.Marshal(resp)
-			if err != nil {
-				rStream.OnError(err)
-				return
-			}
-			rStream.OnResponse(b)
-		}
-	}()
+	runtime.StartPaymentStream[C, T, Req, Resp](msg, rStream, getClient,
+		func(ctx context.Context, client C, req Req) (
+			runtime.Receiver[Resp], error) {
+
+			return call(ctx, client, req)
+		},
+		func(ctx context.Context, client C, payment Resp) (
+			runtime.Receiver[Resp], error) {
 
+			return track(ctx, client, payment)
+		},
+	)
 }
+{{- end}}
+{{- if .InitialResponse}}
 
-// biStreamHandler is a struct used to call the daemon's RPC interface on
-// methods where a bidirectional stream of request and responses is expected.
-type biStreamHandler struct {
-	// newProto returns an empty struct for the desired grpc request.
-	newProto func() proto.Message
+// newInitialStream creates a RecvStream delivering the first response of a
+// stream to initial and all following responses to rStream.
+func newInitialStream(initial Callback, rStream RecvStream) RecvStream {
+	return runtime.NewInitialStream(initial, rStream)
+}
+{{- end}}
+{{- if .StreamTransforms}}
+
+// StreamTransform is an interface that can be passed in when subscribing to a
+// stream, to filter, down-sample or rewrite its responses before they are
+// delivered to the caller.
+type StreamTransform = runtime.StreamTransform
 
-	// biStream calls the desired method on the given client and returns a
-	// receiver that reads the stream of responses, and a sender that can
-	// be used to send a stream of requests.
-	biStream func(context.Context) (*receiver, *sender, func(), error)
+// newTransformedStream creates a stream passing the responses of stream
+// through transform.
+func newTransformedStream[Resp proto.Message](stream recvStream[Resp],
+	transform StreamTransform) recvStream[Resp] {
+
+	return runtime.NewTransformedStream[Resp](stream, transform)
 }
+{{- end}}
+{{- if .StreamBackpressure}}
 
-// start executes the RPC call specified by this biStreamHandler, sending
-// messages coming from the returned SendStream.
-func (b *biStreamHandler) start(rStream RecvStream) (SendStream, error) {
-	ctx, cancel := context.WithCancel(context.Background())
+// StreamDemand is an opaque handle passed to the XxxWithDemand APIs, applying
+// backpressure to a stream. The stream reads ahead up to the buffer size of
+// responses, but only delivers as many of them as were requested.
+type StreamDemand struct {
+	demand *runtime.StreamDemand
+}
 
-	// Start a bidirectional stream for the desired RPC method.
-	r, s, closeStream, err := b.biStream(ctx)
-	if err != nil {
-		cancel()
-		return nil, err
+// NewStreamDemand creates a new demand for a single stream, which reads ahead
+// up to bufferSize responses. Once the buffer is full, the stream isn't read
+// until more responses are requested, so the server is slowed down by gRPC's
+// flow control. No responses are delivered before they are requested.
+func NewStreamDemand(bufferSize int) *StreamDemand {
+	return &StreamDemand{
+		demand: runtime.NewStreamDemand(bufferSize),
 	}
+}
 
-	// We create a sendStream which is a wrapper for the methods we
-	// will expose to the caller via the SendStream interface.
-	ss := &sendStream{
-		send: func(msg []byte) error {
-			// Get an empty proto and deserialize the message
-			// coming from the caller.
-			req := b.newProto()
-			err := proto.Unmarshal(msg, req)
-			if err != nil {
-				return err
-			}
+// Request requests n more responses, which are delivered as soon as they are
+// received.
+func (d *StreamDemand) Request(n int64) {
+	d.demand.Request(n)
+}
 
-			// Send the request to the server.
-			return s.send(req)
-		},
-		stop: s.closeStream,
+// newDemandStream creates a stream only returning the responses of stream
+// requested from demand, reading them ahead until ctx is done. If demand is
+// nil, stream is returned unchanged.
+func newDemandStream[Resp proto.Message](ctx context.Context,
+	stream recvStream[Resp], demand *StreamDemand) recvStream[Resp] {
+
+	if demand == nil {
+		return stream
 	}
 
-	// Now launch a goroutine that will handle the asynchronous stream of
-	// responses.
-	go func() {
-		defer cancel()
-		defer closeStream()
+	return runtime.NewDemandStream[Resp](ctx, stream, demand.demand)
+}
+{{- end}}
 
-		// We will read responses from the recv stream until we
-		// encounter an error.
-		for {
-			// Wait for a new response from the server.
-			resp, err := r.recv()
-			if err != nil {
-				rStream.OnError(err)
-				return
-			}
+{{- if .Tasks}}
 
-			// Serialize the response before returning it to the
-			// caller.
-			b, err := proto.Marshal(resp)
-			if err != nil {
-				rStream.OnError(err)
-				return
-			}
-			rStream.OnResponse(b)
-		}
-	}()
+// ErrTaskTimeout is returned by Task.Await if the task isn't completed within
+// the timeout. The call isn't affected by this and can be awaited again.
+var ErrTaskTimeout = runtime.ErrTaskTimeout
 
-	// Return the send stream to the caller, which then can be used to pass
-	// messages to the server.
-	return ss, nil
+// Task is the pending result of a call started with one of the XxxTask
+// methods. Instead of passing in a callback when starting the call, the
+// result can be awaited, or delivered to callbacks registered later on.
+type Task struct {
+	task *runtime.Task
+}
+
+// newTask creates a new pending Task.
+func newTask() *Task {
+	return &Task{
+		task: runtime.NewTask(),
+	}
+}
+
+// Await blocks until the task is completed, and returns the serialized
+// response or the error of the call. If the task isn't completed within
+// timeoutMs milliseconds, ErrTaskTimeout is returned. A timeout of zero or
+// less waits until the task is completed.
+func (t *Task) Await(timeoutMs int64) ([]byte, error) {
+	return t.task.Await(timeoutMs)
+}
+
+// OnResult delivers the result of the task to the callback once it is
+// completed, or right away if it already is. Several callbacks can be
+// registered, each of them is called once.
+func (t *Task) OnResult(callback Callback) {
+	t.task.OnResult(callback)
+}
+
+// Cancel cancels the call of the task. The task is completed with the
+// cancellation error, unless it already is completed.
+func (t *Task) Cancel() {
+	t.task.Cancel()
+}
+
+// bind derives the context of the call from ctx, such that it is cancelled
+// by Cancel.
+func (t *Task) bind(ctx context.Context) (context.Context, context.CancelFunc) {
+	return t.task.Bind(ctx)
+}
+
+// complete sets the result of the task and delivers it to the registered
+// callbacks.
+func (t *Task) complete(resp []byte, err error) {
+	t.task.Complete(resp, err)
+}
+
+// taskCallback is the Callback completing a Task with the result of its call.
+type taskCallback struct {
+	task *Task
+}
+
+// OnResponse completes the task with the response of the call.
+func (c *taskCallback) OnResponse(resp []byte) {
+	c.task.complete(resp, nil)
+}
+
+// OnError completes the task with the error of the call.
+func (c *taskCallback) OnError(err error) {
+	c.task.complete(nil, err)
 }
+{{- end}}
 `))
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"google.golang.org/protobuf/compiler/protogen"
+)
+
+// overridableTemplates maps the names of the template files that can be
+// supplied with templates_dir=<path> to the built-in templates they replace.
+var overridableTemplates = map[string]**template.Template{
+	"header":     &headerTemplate,
+	"service":    &serviceTemplate,
+	"sync":       &syncTemplate,
+	"readstream": &readStreamTemplate,
+	"bistream":   &biStreamTemplate,
+	"js":         &jsTemplate,
+}
+
+// applyTemplatesDir replaces the built-in templates with those found in the
+// directory selected with templates_dir=<path>. A template is overridden by a
+// file named after it with a .tmpl extension, e.g. sync.tmpl, and is given the
+// same data as the built-in one. The override is parsed into a copy of the
+// built-in template, so the templates it defines, such as syncCall, can be
+// used or redefined as well.
+func applyTemplatesDir(param map[string]string) {
+	dir, ok := param["templates_dir"]
+	if !ok {
+		return
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		log.Fatalf("unable to read templates_dir: %v", err)
+	}
+	if !info.IsDir() {
+		log.Fatalf("templates_dir %s is not a directory", dir)
+	}
+
+	for name, tmpl := range overridableTemplates {
+		path := filepath.Join(dir, name+".tmpl")
+		b, err := os.ReadFile(path)
+		switch {
+		// Templates without an override keep the built-in one.
+		case errors.Is(err, fs.ErrNotExist):
+			continue
+
+		case err != nil:
+			log.Fatalf("unable to read template: %v", err)
+		}
+
+		override, err := template.Must((*tmpl).Clone()).
+			Funcs(funcMap).Parse(string(b))
+		if err != nil {
+			log.Fatalf("invalid template %s: %v", path, err)
+		}
+
+		*tmpl = override
+	}
+}
+
+var (
+	// templateErrors is how a failing template is handled, either fail or
+	// skip. It is selected with template_errors=<mode>.
+	templateErrors = "fail"
+
+	// skippedFiles is the set of files left out because one of their
+	// templates failed. The remaining templates of a skipped file aren't
+	// executed anymore.
+	skippedFiles = make(map[*protogen.GeneratedFile]bool)
+)
+
+// applyTemplateErrors selects how a failing template is handled. As the
+// templates given with templates_dir are executed the same way as the built-in
+// ones, this applies to both.
+func applyTemplateErrors(param map[string]string) {
+	switch mode := param["template_errors"]; mode {
+	case "", "fail":
+		templateErrors = "fail"
+
+	case "skip":
+		templateErrors = mode
+
+	default:
+		log.Fatalf("invalid template_errors %s", mode)
+	}
+}
+
+// executeTemplate renders the template with the data into the generated file.
+// The output is buffered, such that the file only ever receives fully rendered
+// content. If the template fails, generation fails with an error naming the
+// template and the method, service or package it was executed for, unless
+// template_errors=skip is set, in which case the whole file is left out with
+// a warning.
+func executeTemplate(g *protogen.GeneratedFile, tmpl *template.Template,
+	data interface{}) {
+
+	if skippedFiles[g] {
+		return
+	}
+
+	var b bytes.Buffer
+	err := tmpl.Execute(&b, data)
+	if err == nil {
+		if _, err := g.Write(b.Bytes()); err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	err = fmt.Errorf("template %s failed for %s: %w", tmpl.Name(),
+		templateContext(data), err)
+	if templateErrors != "skip" {
+		log.Fatal(err)
+	}
+
+	log.Printf("skipping file: %v", err)
+	skippedFiles[g] = true
+	g.Skip()
+}
+
+// templateContext describes the data a template is executed with by the
+// method, service or package it is generated for, followed by its type.
+func templateContext(data interface{}) string {
+	context := fmt.Sprintf("%T", data)
+
+	v := reflect.Indirect(reflect.ValueOf(data))
+	if v.Kind() != reflect.Struct {
+		return context
+	}
+
+	fields := []struct {
+		name, kind string
+	}{
+		{"FullMethod", "method"},
+		{"ServiceName", "service"},
+		{"Package", "package"},
+	}
+	for _, field := range fields {
+		f := v.FieldByName(field.name)
+		if f.Kind() == reflect.String && f.String() != "" {
+			return fmt.Sprintf("%s %s (%s)", field.kind,
+				strings.TrimSpace(f.String()), context)
+		}
+	}
+
+	return context
+}
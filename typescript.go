@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// tsWellKnownTypes maps the well-known types to the TypeScript types of their
+// special JSON encoding.
+var tsWellKnownTypes = map[protoreflect.FullName]string{
+	"google.protobuf.Any":         "{ \"@type\": string; [key: string]: unknown }",
+	"google.protobuf.Duration":    "string",
+	"google.protobuf.Empty":       "Record<string, never>",
+	"google.protobuf.FieldMask":   "string",
+	"google.protobuf.ListValue":   "unknown[]",
+	"google.protobuf.Struct":      "{ [key: string]: unknown }",
+	"google.protobuf.Timestamp":   "string",
+	"google.protobuf.Value":       "unknown",
+	"google.protobuf.BoolValue":   "boolean",
+	"google.protobuf.BytesValue":  "string",
+	"google.protobuf.DoubleValue": "number",
+	"google.protobuf.FloatValue":  "number",
+	"google.protobuf.Int32Value":  "number",
+	"google.protobuf.Int64Value":  "string",
+	"google.protobuf.StringValue": "string",
+	"google.protobuf.UInt32Value": "number",
+	"google.protobuf.UInt64Value": "string",
+}
+
+// tsDefinitions collects the TypeScript declarations of the messages and enums
+// referenced by the methods of a service.
+type tsDefinitions struct {
+	// decls are the declarations in the order they were added.
+	decls []string
+
+	// added is the set of messages and enums already declared.
+	added map[protoreflect.FullName]bool
+}
+
+// tsName returns the TypeScript name of the message or enum, which is its full
+// proto name with the dots replaced by underscores.
+func tsName(name protoreflect.FullName) string {
+	return strings.ReplaceAll(string(name), ".", "_")
+}
+
+// addMessage declares the message, and all messages and enums it references,
+// and returns the TypeScript type of its JSON encoding.
+func (d *tsDefinitions) addMessage(msg protoreflect.MessageDescriptor) string {
+	if t, ok := tsWellKnownTypes[msg.FullName()]; ok {
+		return t
+	}
+
+	name := tsName(msg.FullName())
+	if d.added[msg.FullName()] {
+		return name
+	}
+	d.added[msg.FullName()] = true
+
+	// The declaration is reserved before the fields are resolved, such
+	// that it precedes those of the messages it references.
+	index := len(d.decls)
+	d.decls = append(d.decls, "")
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "/** The JSON encoding of %s. */\n", msg.FullName())
+	fmt.Fprintf(&b, "export interface %s {", name)
+
+	fields := msg.Fields()
+	if fields.Len() > 0 {
+		b.WriteString("\n")
+	}
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+
+		var t string
+		switch {
+		case field.IsMap():
+			t = fmt.Sprintf("{ [key: string]: %s }",
+				d.valueType(field.MapValue()))
+
+		case field.IsList():
+			t = d.valueType(field) + "[]"
+
+		default:
+			t = d.valueType(field)
+		}
+
+		// Unset fields may be left out of requests, and unset
+		// messages and oneofs are left out of responses as well.
+		fmt.Fprintf(&b, "    %s?: %s;\n", field.Name(), t)
+	}
+	b.WriteString("}\n")
+
+	d.decls[index] = b.String()
+
+	return name
+}
+
+// addEnum declares the enum, and returns its TypeScript type.
+func (d *tsDefinitions) addEnum(enum protoreflect.EnumDescriptor) string {
+	name := tsName(enum.FullName())
+	if d.added[enum.FullName()] {
+		return name
+	}
+	d.added[enum.FullName()] = true
+
+	values := enum.Values()
+	names := make([]string, 0, values.Len())
+	for i := 0; i < values.Len(); i++ {
+		names = append(names, fmt.Sprintf("%q", values.Get(i).Name()))
+	}
+
+	d.decls = append(d.decls, fmt.Sprintf(
+		"/** The JSON encoding of %s. */\nexport type %s = %s;\n",
+		enum.FullName(), name, strings.Join(names, " | "),
+	))
+
+	return name
+}
+
+// valueType returns the TypeScript type of a single value of the field in the
+// JSON encoding of the stubs.
+func (d *tsDefinitions) valueType(field protoreflect.FieldDescriptor) string {
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		return "boolean"
+
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind,
+		protoreflect.Sfixed32Kind, protoreflect.Uint32Kind,
+		protoreflect.Fixed32Kind, protoreflect.FloatKind,
+		protoreflect.DoubleKind:
+
+		return "number"
+
+	// 64-bit integers are encoded as strings, and bytes as base64
+	// strings.
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind,
+		protoreflect.Sfixed64Kind, protoreflect.Uint64Kind,
+		protoreflect.Fixed64Kind, protoreflect.StringKind,
+		protoreflect.BytesKind:
+
+		return "string"
+
+	case protoreflect.EnumKind:
+		return d.addEnum(field.Enum())
+
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return d.addMessage(field.Message())
+	}
+
+	return "unknown"
+}
+
+// genTSDefinitions creates a TypeScript declaration file for the JSON stubs of
+// the service. It declares the JSON requests and responses of its methods, a
+// map from the names the methods are registered under to their requests and
+// responses, and the type of the callbacks.
+func genTSDefinitions(gen *protogen.Plugin, file *protogen.File,
+	service *protogen.Service, pkg string, param map[string]string) {
+
+	defs := &tsDefinitions{
+		added: make(map[protoreflect.FullName]bool),
+	}
+	clientStreams := param["js_client_streams"] == "1"
+
+	var methods strings.Builder
+	for _, method := range includedMethods(service, param) {
+		clientStream := method.Desc.IsStreamingClient()
+		serverStream := method.Desc.IsStreamingServer()
+
+		// Client-streaming methods are only exposed by the JSON stubs
+		// if requested.
+		if clientStream && !clientStreams {
+			continue
+		}
+
+		entry := fmt.Sprintf("{\n"+
+			"        request: %s;\n"+
+			"        response: %s;\n"+
+			"        clientStreaming: %t;\n"+
+			"        serverStreaming: %t;\n"+
+			"    };\n",
+			defs.addMessage(method.Input.Desc),
+			defs.addMessage(method.Output.Desc),
+			clientStream, serverStream,
+		)
+
+		// The comment must not end the doc comment early.
+		comment := strings.TrimSpace(string(method.Comments.Leading))
+		comment = strings.ReplaceAll(comment, "*/", "*\\/")
+		if comment != "" {
+			methods.WriteString("    /**\n")
+			for _, line := range strings.Split(comment, "\n") {
+				line = strings.TrimRight(" * "+line, " ")
+				methods.WriteString("    " + line + "\n")
+			}
+			methods.WriteString("     */\n")
+		}
+
+		name := pkg + "." + service.GoName + "." + method.GoName
+		fmt.Fprintf(&methods, "    %q: %s", name, entry)
+
+		if param["js_camel_case"] == "1" {
+			name = pkg + "." + service.GoName + "." +
+				lowerCase(method.GoName)
+			fmt.Fprintf(&methods, "    %q: %s", name, entry)
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "// Code generated by %s. DO NOT EDIT.\n", versionString)
+	fmt.Fprintf(&b, "// source: %s\n\n", file.Proto.GetName())
+
+	fmt.Fprintf(&b, "/**\n"+
+		" * %[1]sMethods maps the names the methods of the %[1]s\n"+
+		" * service are registered under to their JSON requests and responses.\n"+
+		" */\n"+
+		"export interface %[1]sMethods {\n%[2]s}\n\n",
+		service.GoName, methods.String())
+
+	fmt.Fprintf(&b, "/**\n"+
+		" * %[1]sCallback is called with each parsed JSON response of the\n"+
+		" * method M of the %[1]s service, or with the error ending the call.\n"+
+		" */\n"+
+		"export type %[1]sCallback<M extends keyof %[1]sMethods> = (\n"+
+		"    response: %[1]sMethods[M][\"response\"] | null,\n"+
+		"    error: Error | null,\n"+
+		") => void;\n",
+		service.GoName)
+
+	for _, decl := range defs.decls {
+		b.WriteString("\n" + decl)
+	}
+
+	filename := outDir(param, service, "./") +
+		strings.ToLower(service.GoName) + ".d.ts"
+	g := gen.NewGeneratedFile(filename, file.GoImportPath)
+	if _, err := g.Write([]byte(b.String())); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"log"
+
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// unlockParams holds the methods and types used by the generated
+// UnlockAndWait helper.
+type unlockParams struct {
+	ToolName string
+	Package  string
+	BuildTag string
+	Imports  []goImport
+
+	// UnlockService and UnlockMethod are the names of the unary method
+	// unlocking the wallet.
+	UnlockService string
+	UnlockMethod  string
+
+	// UnlockRequest is the request type of the unlock method, and
+	// PasswordField its field holding the wallet password.
+	UnlockRequest string
+	PasswordField string
+
+	// StateService and SubscribeMethod are the names of the method
+	// streaming the state of the node.
+	StateService    string
+	SubscribeMethod string
+
+	// SubscribeRequest is the request type of the subscribe method, and
+	// StateField the field of its responses holding the state.
+	SubscribeRequest string
+	StateField       string
+
+	// ActiveStates are the states in which the RPC server is active.
+	ActiveStates []string
+}
+
+// activeStates are the names of the wallet states in which the RPC server is
+// active, as defined by lnd.
+var activeStates = []string{"RPC_ACTIVE", "SERVER_ACTIVE"}
+
+// detectUnlockHelper looks up the methods used by the UnlockAndWait helper in
+// the generated files. They follow lnd, requiring an UnlockWallet method
+// taking the wallet_password, and a SubscribeState method streaming the state
+// of the node, which reaches RPC_ACTIVE once the wallet has been unlocked.
+func detectUnlockHelper(gen *protogen.Plugin,
+	imports *goImports) *unlockParams {
+
+	p := detectLndMethods(gen, imports)
+	if p.UnlockMethod == "" || p.SubscribeMethod == "" {
+		return nil
+	}
+
+	return p
+}
+
+// detectLndMethods looks up lnd's UnlockWallet and SubscribeState methods in
+// the generated files. The fields of the methods that aren't found are left
+// empty.
+func detectLndMethods(gen *protogen.Plugin, imports *goImports) *unlockParams {
+	p := &unlockParams{}
+	for _, f := range gen.Files {
+		if !f.Generate {
+			continue
+		}
+
+		for _, service := range f.Services {
+			for _, method := range service.Methods {
+				switch method.GoName {
+				case "UnlockWallet":
+					detectUnlockMethod(p, service, method, imports)
+
+				case "SubscribeState":
+					detectStateMethod(p, service, method, imports)
+				}
+			}
+		}
+	}
+
+	return p
+}
+
+// detectUnlockMethod sets the unlock method of the helper if the given method
+// is a unary method taking the wallet password.
+func detectUnlockMethod(p *unlockParams, service *protogen.Service,
+	method *protogen.Method, imports *goImports) {
+
+	if method.Desc.IsStreamingClient() || method.Desc.IsStreamingServer() {
+		return
+	}
+
+	password := findField(method.Input, "wallet_password")
+	if password == nil || password.Desc.Kind() != protoreflect.BytesKind {
+		return
+	}
+
+	p.UnlockService = service.GoName
+	p.UnlockMethod = method.GoName
+	p.UnlockRequest = imports.typeName(method.Input.GoIdent)
+	p.PasswordField = password.GoName
+}
+
+// detectStateMethod sets the state method of the helper if the given method
+// streams responses holding an enum state with active values.
+func detectStateMethod(p *unlockParams, service *protogen.Service,
+	method *protogen.Method, imports *goImports) {
+
+	if method.Desc.IsStreamingClient() || !method.Desc.IsStreamingServer() {
+		return
+	}
+
+	state := findField(method.Output, "state")
+	if state == nil || state.Enum == nil {
+		return
+	}
+
+	var active []string
+	for _, value := range state.Enum.Values {
+		for _, name := range activeStates {
+			if string(value.Desc.Name()) == name {
+				active = append(
+					active, imports.typeName(value.GoIdent),
+				)
+			}
+		}
+	}
+	if len(active) == 0 {
+		return
+	}
+
+	p.StateService = service.GoName
+	p.SubscribeMethod = method.GoName
+	p.SubscribeRequest = imports.typeName(method.Input.GoIdent)
+	p.StateField = state.GoName
+	p.ActiveStates = active
+}
+
+// genUnlockHelper creates the UnlockAndWait helper, which unlocks the wallet
+// and waits until the RPC server is active.
+func genUnlockHelper(gen *protogen.Plugin, file *protogen.File, pkg,
+	buildTag string, importAliases, importRewrites map[string]string) {
+
+	imports := newGoImports(pkg, importAliases, importRewrites)
+	p := detectUnlockHelper(gen, imports)
+	if p == nil {
+		log.Fatal("unlock_helper requires an UnlockWallet and a " +
+			"SubscribeState method")
+	}
+
+	p.ToolName = versionString
+	p.Package = pkg
+	p.BuildTag = buildTag
+	p.Imports = imports.imports()
+
+	filename := "./unlock_generated.go"
+	g := gen.NewGeneratedFile(filename, file.GoImportPath)
+	executeTemplate(g, unlockTemplate, p)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// uploadParams holds what is needed to send a large payload to a
+// client-streaming RPC in chunks.
+type uploadParams struct {
+	// Field is the request field holding a chunk of the payload.
+	Field string
+
+	// Number is the field number of the chunk field, which is used to
+	// append each chunk to the encoded request.
+	Number int32
+
+	// FmtPkg is the name the fmt package is imported as.
+	FmtPkg string
+
+	// WirePkg is the name the protowire package is imported as.
+	WirePkg string
+}
+
+// detectUpload checks whether the given method is a client-streaming RPC
+// uploading a payload in chunks, as for example the PSBT or backup uploads of
+// lnd. Its request must have a single bytes field, which holds the chunks. Nil
+// is returned if the method doesn't follow this pattern.
+func detectUpload(method *protogen.Method, imports *goImports) *uploadParams {
+	if !method.Desc.IsStreamingClient() || method.Desc.IsStreamingServer() {
+		return nil
+	}
+
+	var chunk *protogen.Field
+	for _, field := range method.Input.Fields {
+		if field.Desc.Kind() != protoreflect.BytesKind {
+			continue
+		}
+
+		// The chunks can't be spread over several fields.
+		if chunk != nil {
+			return nil
+		}
+		chunk = field
+	}
+	if chunk == nil || chunk.Desc.IsList() {
+		return nil
+	}
+
+	// Fields of a oneof are set through a wrapper type.
+	if chunk.Oneof != nil && !chunk.Oneof.Desc.IsSynthetic() {
+		return nil
+	}
+
+	wirePkg := imports.add("google.golang.org/protobuf/encoding/protowire")
+
+	return &uploadParams{
+		Field:   chunk.GoName,
+		Number:  int32(chunk.Desc.Number()),
+		FmtPkg:  imports.add("fmt"),
+		WirePkg: wirePkg,
+	}
+}